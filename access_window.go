@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AccessWindow restricts when tenant labels may be used. It applies to the given labels, or to all
+// labels if none are given, of the users and groups in Identities, or of everybody if none are given.
+// Access is allowed on the given days between From and To in the time zone, and only until Expires.
+type AccessWindow struct {
+	Identities []string `mapstructure:"identities"`
+	Labels     []string `mapstructure:"labels"`
+	Days       []string `mapstructure:"days"`
+	From       string   `mapstructure:"from"`
+	To         string   `mapstructure:"to"`
+	Timezone   string   `mapstructure:"timezone"`
+	Expires    string   `mapstructure:"expires"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// validate returns the first problem found in the window definition.
+func (w AccessWindow) validate() error {
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", w.Timezone)
+	}
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("invalid day %q, must be one of mon, tue, wed, thu, fri, sat, sun", day)
+		}
+	}
+	if (w.From == "") != (w.To == "") {
+		return fmt.Errorf("from and to have to be set together")
+	}
+	for _, clock := range []string{w.From, w.To} {
+		if _, err := time.Parse("15:04", clock); clock != "" && err != nil {
+			return fmt.Errorf("invalid time %q, must be HH:MM", clock)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, w.Expires); w.Expires != "" && err != nil {
+		return fmt.Errorf("invalid expiry %q, must be RFC 3339", w.Expires)
+	}
+	return nil
+}
+
+// appliesTo reports whether the window restricts the labels of the token.
+func (w AccessWindow) appliesTo(token OAuthToken) bool {
+	if len(w.Identities) == 0 {
+		return true
+	}
+	for _, id := range w.Identities {
+		if id == token.PreferredUsername || ContainsIgnoreCase(token.Groups, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// denies returns why access is not allowed at the given time, or an empty string if it is.
+// Invalid windows deny access.
+func (w AccessWindow) denies(now time.Time) string {
+	if err := w.validate(); err != nil {
+		return fmt.Sprintf("invalid access window: %v", err)
+	}
+	if w.Expires != "" {
+		expires, _ := time.Parse(time.RFC3339, w.Expires)
+		if !now.Before(expires) {
+			return fmt.Sprintf("access expired at %s", expires.Format(time.RFC3339))
+		}
+	}
+	loc, _ := time.LoadLocation(w.Timezone)
+	local := now.In(loc)
+	if len(w.Days) > 0 {
+		allowed := false
+		for _, day := range w.Days {
+			allowed = allowed || weekdays[strings.ToLower(day)] == local.Weekday()
+		}
+		if !allowed {
+			return fmt.Sprintf("access is only allowed on %s (%s)", strings.Join(w.Days, ", "), loc)
+		}
+	}
+	if w.From != "" {
+		clock := local.Format("15:04")
+		inside := clock >= w.From && clock < w.To
+		if w.To < w.From {
+			// the window spans midnight
+			inside = clock >= w.From || clock < w.To
+		}
+		if !inside {
+			return fmt.Sprintf("access is only allowed between %s and %s (%s)", w.From, w.To, loc)
+		}
+	}
+	return ""
+}
+
+// applyAccessWindows removes the tenant labels of the token that are outside of their access windows at
+// the given time. Every removal is audited. It returns the remaining labels and the reasons for the removals.
+func applyAccessWindows(token OAuthToken, tenantLabels map[string]bool, windows []AccessWindow, now time.Time) (map[string]bool, []string) {
+	var reasons []string
+	for _, w := range windows {
+		if !w.appliesTo(token) {
+			continue
+		}
+		reason := w.denies(now)
+		if reason == "" {
+			continue
+		}
+		labels := w.Labels
+		if len(labels) == 0 {
+			labels = MapKeysToArray(tenantLabels)
+		}
+		var removed []string
+		for _, label := range labels {
+			if tenantLabels[label] {
+				removed = append(removed, label)
+			}
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		sort.Strings(removed)
+		remaining := make(map[string]bool, len(tenantLabels))
+		for label := range tenantLabels {
+			remaining[label] = true
+		}
+		for _, label := range removed {
+			delete(remaining, label)
+		}
+		tenantLabels = remaining
+		reasons = append(reasons, fmt.Sprintf("%s: %s", strings.Join(removed, ", "), reason))
+		log.Info().
+			Str("audit", "access_window").
+			Str("user", token.PreferredUsername).
+			Strs("labels", removed).
+			Str("reason", reason).
+			Msg("Tenant labels outside of their access window")
+	}
+	return tenantLabels, reasons
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessWindowDenies(t *testing.T) {
+	// a Wednesday, 10:30 in Vienna
+	now := time.Date(2026, 10, 14, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		window AccessWindow
+		denied string
+	}{
+		{name: "no restriction", window: AccessWindow{}},
+		{name: "business hours", window: AccessWindow{Days: []string{"mon", "wed"}, From: "08:00", To: "18:00", Timezone: "Europe/Vienna"}},
+		{name: "wrong day", window: AccessWindow{Days: []string{"Sat", "Sun"}}, denied: "access is only allowed on Sat, Sun (UTC)"},
+		{name: "outside hours", window: AccessWindow{From: "12:00", To: "18:00", Timezone: "Europe/Vienna"}, denied: "access is only allowed between 12:00 and 18:00 (Europe/Vienna)"},
+		{name: "overnight", window: AccessWindow{From: "22:00", To: "09:00"}},
+		{name: "overnight outside", window: AccessWindow{From: "22:00", To: "06:00"}, denied: "access is only allowed between 22:00 and 06:00 (UTC)"},
+		{name: "not expired", window: AccessWindow{Expires: "2026-10-15T00:00:00Z"}},
+		{name: "expired", window: AccessWindow{Expires: "2026-10-14T08:00:00Z"}, denied: "access expired at 2026-10-14T08:00:00Z"},
+		{name: "invalid", window: AccessWindow{From: "8am", To: "6pm"}, denied: `invalid access window: invalid time "8am", must be HH:MM`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.denied, tt.window.denies(now))
+		})
+	}
+}
+
+func TestApplyAccessWindows(t *testing.T) {
+	now := time.Date(2026, 10, 14, 20, 0, 0, 0, time.UTC)
+	windows := []AccessWindow{
+		{Identities: []string{"Contractors"}, Labels: []string{"payment"}, From: "08:00", To: "18:00"},
+		{Identities: []string{"jane"}, Expires: "2026-10-01T00:00:00Z"},
+	}
+	labels := map[string]bool{"payment": true, "shop": true}
+
+	remaining, reasons := applyAccessWindows(OAuthToken{PreferredUsername: "bob", Groups: []string{"contractors"}}, labels, windows, now)
+	assert.Equal(t, map[string]bool{"shop": true}, remaining)
+	assert.Equal(t, []string{"payment: access is only allowed between 08:00 and 18:00 (UTC)"}, reasons)
+	assert.Len(t, labels, 2, "the resolved labels must not be modified")
+
+	remaining, reasons = applyAccessWindows(OAuthToken{PreferredUsername: "jane"}, labels, windows, now)
+	assert.Empty(t, remaining)
+	assert.Equal(t, []string{"payment, shop: access expired at 2026-10-01T00:00:00Z"}, reasons)
+
+	remaining, reasons = applyAccessWindows(OAuthToken{PreferredUsername: "alice"}, labels, windows, now)
+	assert.Equal(t, labels, remaining)
+	assert.Empty(t, reasons)
+}
+
+func TestValidateLabelsAccessWindowExpired(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg().AccessWindows = []AccessWindow{{Expires: "2020-01-01T00:00:00Z"}}
+	oauthToken, _, _ := parseJwtToken(tokens["groupTenant"], app.Cfg(), app)
+
+	_, _, err := validateLabels(oauthToken, app.Cfg(), app)
+
+	assert.EqualError(t, err, "no tenant labels within their access window: allowed_group1, also_allowed_group1: access expired at 2020-01-01T00:00:00Z")
+}
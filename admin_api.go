@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// statusRecorder is a http.ResponseWriter that remembers the status code written to it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap allows hijacking the underlying connection, e.g. for WebSocket streams.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// inAnyGroup reports whether the token is a member of one of the groups.
+func inAnyGroup(token OAuthToken, groups []string) bool {
+	for _, group := range groups {
+		if group != "" && ContainsIgnoreCase(token.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// tsdbAdminGroups returns the groups allowed to use the TSDB admin APIs.
+// If none are configured, the admin group is used.
+func (a *App) tsdbAdminGroups() []string {
+	if len(a.Cfg().Admin.TSDBGroups) > 0 {
+		return a.Cfg().Admin.TSDBGroups
+	}
+	return []string{a.Cfg().Admin.Group}
+}
+
+// tsdbAdmin forwards calls to the Prometheus TSDB admin APIs (delete_series, snapshot and
+// clean_tombstones) for members of the TSDB admin groups and rejects everybody else with 403.
+// Every call is audited, whether it was allowed or not.
+func (a *App) tsdbAdmin(upstreamURL *url.URL) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// parse a copy, the body still has to be forwarded
+		form := r.Clone(r.Context())
+		form.Body = io.NopCloser(bytes.NewReader(readBody(r)))
+		_ = form.ParseForm()
+		event := requestLogger(r).Info().
+			Str("audit", "tsdb_admin").
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Strs("match[]", form.Form["match[]"]).
+			Str("remote", r.RemoteAddr)
+
+		oauthToken, err := getToken(r, a.Cfg(), a)
+		if err != nil {
+			event.Err(err).Bool("allowed", false).Msg("TSDB admin API call rejected")
+			writeTokenError(w, err)
+			return
+		}
+		event = event.Str("user", oauthToken.PreferredUsername).Strs("groups", oauthToken.Groups)
+
+		if !inAnyGroup(oauthToken, a.tsdbAdminGroups()) {
+			event.Bool("allowed", false).Msg("TSDB admin API call rejected")
+			logAndWriteError(w, http.StatusForbidden, nil, "user is not allowed to use the TSDB admin APIs")
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		streamUp(rec, r, upstreamURL, a.Cfg().Thanos.UseMutualTLS, a.Cfg().Thanos.Headers, a)
+		event.Bool("allowed", true).Int("status", rec.status).Msg("TSDB admin API call forwarded")
+	}
+}
+
+// operatorGroups returns the groups allowed to read the operational APIs.
+// If none are configured, the admin group is used.
+func (a *App) operatorGroups() []string {
+	if len(a.Cfg().Admin.OperatorGroups) > 0 {
+		return a.Cfg().Admin.OperatorGroups
+	}
+	return []string{a.Cfg().Admin.Group}
+}
+
+// operatorAPI forwards GET requests to the operational APIs of Thanos and Prometheus, e.g. stores, targets,
+// rules and the status pages, for members of the operator groups. Their responses span all tenants and can not
+// be enforced, so everybody else is rejected with 403. Every call is audited, whether it was allowed or not.
+func (a *App) operatorAPI(upstreamURL *url.URL) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := requestLogger(r).Info().
+			Str("audit", "operator_api").
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("remote", r.RemoteAddr)
+
+		oauthToken, err := getToken(r, a.Cfg(), a)
+		if err != nil {
+			event.Err(err).Bool("allowed", false).Msg("Operator API call rejected")
+			writeTokenError(w, err)
+			return
+		}
+		event = event.Str("user", oauthToken.PreferredUsername).Strs("groups", oauthToken.Groups)
+
+		if !inAnyGroup(oauthToken, a.operatorGroups()) {
+			event.Bool("allowed", false).Msg("Operator API call rejected")
+			logAndWriteError(w, http.StatusForbidden, nil, "user is not allowed to read the operational APIs")
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		streamUp(rec, r, upstreamURL, a.Cfg().Thanos.UseMutualTLS, a.Cfg().Thanos.Headers, a)
+		event.Bool("allowed", true).Int("status", rec.status).Msg("Operator API call forwarded")
+	}
+}
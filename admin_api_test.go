@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTSDBAdmin(t *testing.T) {
+	env := newE2EEnv(t)
+
+	rr := env.do(http.MethodPost, "/api/v1/admin/tsdb/delete_series", "adminUserToken", "match[]=up")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, ok := env.Thanos.LastRequest()
+	assert.True(t, ok)
+	assert.Equal(t, "/api/v1/admin/tsdb/delete_series", req.Path)
+	assert.Equal(t, []string{"up"}, req.Params["match[]"])
+
+	env.Thanos.Reset()
+	for _, path := range []string{"delete_series", "snapshot", "clean_tombstones"} {
+		rr = env.do(http.MethodPost, "/api/v1/admin/tsdb/"+path, "userTenant", "")
+		assert.Equal(t, http.StatusForbidden, rr.Code, path)
+	}
+	rr = env.do(http.MethodPost, "/api/v1/admin/tsdb/snapshot", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Empty(t, env.Thanos.Requests())
+}
+
+func TestTSDBAdminGroups(t *testing.T) {
+	app := newApp(&Config{Admin: AdminConfig{Group: "admins"}})
+	assert.Equal(t, []string{"admins"}, app.tsdbAdminGroups())
+
+	app.Cfg().Admin.TSDBGroups = []string{"storage-team"}
+	assert.Equal(t, []string{"storage-team"}, app.tsdbAdminGroups())
+}
+
+func TestOperatorAPI(t *testing.T) {
+	env := newE2EEnv(t)
+
+	for _, path := range []string{"/api/v1/stores", "/api/v1/targets", "/api/v1/rules", "/api/v1/status/flags"} {
+		rr := env.do(http.MethodGet, path, "adminUserToken", "")
+		assert.Equal(t, http.StatusOK, rr.Code, path)
+		req, _ := env.Thanos.LastRequest()
+		assert.Equal(t, path, req.Path)
+	}
+
+	env.Thanos.Reset()
+	rr := env.do(http.MethodGet, "/api/v1/targets", "userTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = env.do(http.MethodGet, "/api/v1/rules", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr = env.do(http.MethodPost, "/api/v1/stores", "adminUserToken", "")
+	assert.NotEqual(t, http.StatusOK, rr.Code)
+	assert.Empty(t, env.Thanos.Requests())
+
+	env.App.Cfg().Admin.OperatorGroups = []string{"group1"}
+	rr = env.do(http.MethodGet, "/api/v1/status/config", "groupTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = env.do(http.MethodGet, "/api/v1/status/config", "adminUserToken", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
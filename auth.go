@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"golang.org/x/exp/maps"
@@ -23,11 +24,66 @@ type OAuthToken struct {
 
 // getToken retrieves the OAuth token from the incoming HTTP request.
 // It extracts, parses, and validates the token from the Authorization header.
-func getToken(r *http.Request, a *App) (OAuthToken, error) {
+// With the lockout enabled, requests of locked out users and client addresses are rejected with a
+// lockedOutError and invalid tokens count as failures, see lockout.
+// The identity of a valid token is added to the logger of the request and, with identity headers enabled,
+// set on the request for the upstreams, see setIdentityHeaders.
+// With security events enabled, failed authentications are exported, see securityEvents.
+func getToken(r *http.Request, cfg *Config, a *App) (OAuthToken, error) {
+	oauthToken, err := authenticate(r, cfg, a)
+	if err != nil {
+		a.securityEvents.emit(r, securityAuthFailure, OAuthToken{}, err)
+	}
+	return oauthToken, err
+}
+
+// authenticate is getToken without exporting failures.
+func authenticate(r *http.Request, cfg *Config, a *App) (OAuthToken, error) {
+	if a.lockout == nil {
+		oauthToken, err := readToken(r, cfg, a)
+		if err == nil {
+			logIdentity(r, oauthToken)
+			setIdentityHeaders(r, cfg.IdentityHeaders, oauthToken)
+		}
+		return oauthToken, err
+	}
+	if err := a.lockout.check(r, ""); err != nil {
+		return OAuthToken{}, err
+	}
+	oauthToken, err := readToken(r, cfg, a)
+	if err != nil {
+		if r.Header.Get("Authorization") != "" || (cfg.Alert.Enabled && r.Header.Get(cfg.Alert.TokenHeader) != "") ||
+			(a.forwardAuth != nil && r.Header.Get(a.forwardAuth.cfg.UserHeader) != "") {
+			a.lockout.fail(r, "")
+		}
+		return OAuthToken{}, err
+	}
+	if err := a.lockout.check(r, oauthToken.PreferredUsername); err != nil {
+		return OAuthToken{}, err
+	}
+	logIdentity(r, oauthToken)
+	setIdentityHeaders(r, cfg.IdentityHeaders, oauthToken)
+	return oauthToken, nil
+}
+
+// readToken extracts, parses, and validates the token from the Authorization header.
+// With forward-auth enabled, the identity headers of trusted requests are used instead, see forwardAuth.
+// With the OIDC login enabled, requests without a token are authenticated by their session cookie, see oidcLogin.
+func readToken(r *http.Request, cfg *Config, a *App) (OAuthToken, error) {
+	if a.forwardAuth != nil {
+		if oauthToken, ok, err := a.forwardAuth.token(r); ok {
+			return oauthToken, err
+		}
+	}
 	authToken := r.Header.Get("Authorization")
 	if authToken == "" {
-		if a.Cfg.Alert.Enabled && r.Header.Get(a.Cfg.Alert.TokenHeader) != "" {
-			authToken = r.Header.Get(a.Cfg.Alert.TokenHeader)
+		if cfg.Alert.Enabled && r.Header.Get(cfg.Alert.TokenHeader) != "" {
+			authToken = r.Header.Get(cfg.Alert.TokenHeader)
+		} else if a.oidc != nil {
+			if oauthToken, ok, err := a.oidc.session(r); ok {
+				return oauthToken, err
+			}
+			return OAuthToken{}, errors.New("no Authorization header or session cookie found, log in at /oauth/login")
 		} else {
 			return OAuthToken{}, errors.New("no Authorization header found")
 		}
@@ -38,8 +94,11 @@ func getToken(r *http.Request, a *App) (OAuthToken, error) {
 	if len(splitToken) != 2 {
 		return OAuthToken{}, errors.New("invalid Authorization header")
 	}
+	if a.Jwks == nil {
+		return OAuthToken{}, errors.New("JWT authentication is not configured")
+	}
 
-	oauthToken, token, err := parseJwtToken(strings.TrimSpace(splitToken[1]), a)
+	oauthToken, token, err := parseJwtToken(strings.TrimSpace(splitToken[1]), cfg, a)
 	if err != nil {
 		return OAuthToken{}, fmt.Errorf("error parsing token")
 	}
@@ -51,7 +110,7 @@ func getToken(r *http.Request, a *App) (OAuthToken, error) {
 
 // parseJwtToken parses the JWT token string and constructs an OAuthToken from the parsed claims.
 // It returns the constructed OAuthToken, the parsed jwt.Token, and any error that occurred during parsing.
-func parseJwtToken(tokenString string, a *App) (OAuthToken, *jwt.Token, error) {
+func parseJwtToken(tokenString string, cfg *Config, a *App) (OAuthToken, *jwt.Token, error) {
 	var oAuthToken OAuthToken
 	var claimsMap jwt.MapClaims
 
@@ -78,7 +137,7 @@ func parseJwtToken(tokenString string, a *App) (OAuthToken, *jwt.Token, error) {
 		oAuthToken.Email = v
 	}
 
-	if v, ok := claimsMap[a.Cfg.Web.OAuthGroupName].([]interface{}); ok {
+	if v, ok := claimsMap[cfg.Web.OAuthGroupName].([]interface{}); ok {
 		for _, item := range v {
 			if s, ok := item.(string); ok {
 				log.Trace().Str("group", s).Msg("Group")
@@ -92,10 +151,12 @@ func parseJwtToken(tokenString string, a *App) (OAuthToken, *jwt.Token, error) {
 
 // validateLabels validates the labels in the OAuth token.
 // It checks if the user is an admin and skips label enforcement if true.
+// The labels returned by the label store are transformed as configured in label_transform and
+// labels outside of their access windows or suspended are removed.
 // Returns a map representing valid labels, a boolean indicating whether label enforcement should be skipped,
 // and any error that occurred during validation.
-func validateLabels(token OAuthToken, a *App) (map[string]bool, bool, error) {
-	if isAdmin(token, a) {
+func validateLabels(token OAuthToken, cfg *Config, a *App) (map[string]bool, bool, error) {
+	if isAdmin(token, cfg) {
 		log.Debug().Str("user", token.PreferredUsername).Bool("Admin", true).Msg("Skipping label enforcement")
 		return nil, true, nil
 	}
@@ -105,14 +166,24 @@ func validateLabels(token OAuthToken, a *App) (map[string]bool, bool, error) {
 		log.Debug().Str("user", token.PreferredUsername).Bool("Admin", false).Msg("Skipping label enforcement")
 		return nil, true, nil
 	}
+	tenantLabels = cfg.LabelTransform.ApplyAll(tenantLabels)
+	tenantLabels, denied := applyAccessWindows(token, tenantLabels, cfg.AccessWindows, time.Now())
+	tenantLabels, suspended := a.suspensions.remove(token, tenantLabels, cfg.Suspensions, suspendBlock)
 	log.Debug().Str("user", token.PreferredUsername).Strs("labels", maps.Keys(tenantLabels)).Msg("")
 
+	if len(tenantLabels) < 1 && len(suspended) > 0 {
+		suspendedRequests.WithLabelValues(suspendBlock).Inc()
+		return nil, false, errors.New(strings.Join(suspended, "; "))
+	}
+	if len(tenantLabels) < 1 && len(denied) > 0 {
+		return nil, false, fmt.Errorf("no tenant labels within their access window: %s", strings.Join(denied, "; "))
+	}
 	if len(tenantLabels) < 1 {
 		return nil, false, fmt.Errorf("no tenant labels found")
 	}
 	return tenantLabels, false, nil
 }
 
-func isAdmin(token OAuthToken, a *App) bool {
-	return ContainsIgnoreCase(token.Groups, a.Cfg.Admin.Group) && a.Cfg.Admin.Bypass
+func isAdmin(token OAuthToken, cfg *Config) bool {
+	return ContainsIgnoreCase(token.Groups, cfg.Admin.Group) && cfg.Admin.Bypass
 }
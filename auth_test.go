@@ -13,7 +13,7 @@ func TestGetToken_ValidToken(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
 
-	token, err := getToken(req, &app)
+	token, err := getToken(req, app.Cfg(), app)
 
 	assert.NoError(t, err)
 	assert.Equal(t, "user", token.PreferredUsername)
@@ -24,7 +24,7 @@ func TestGetToken_MissingAuthorizationHeader(t *testing.T) {
 	app, _ := setupTestMain()
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 
-	token, err := getToken(req, &app)
+	token, err := getToken(req, app.Cfg(), app)
 
 	assert.Error(t, err)
 	assert.Equal(t, OAuthToken{}, token)
@@ -35,7 +35,7 @@ func TestGetToken_InvalidAuthorizationFormat(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.Header.Set("Authorization", "InvalidToken")
 
-	token, err := getToken(req, &app)
+	token, err := getToken(req, app.Cfg(), app)
 
 	assert.Error(t, err)
 	assert.Equal(t, OAuthToken{}, token)
@@ -45,7 +45,7 @@ func TestParseJwtToken_ValidToken(t *testing.T) {
 	app, tokens := setupTestMain()
 	tokenString := tokens["groupTenant"]
 
-	oauthToken, _, err := parseJwtToken(tokenString, &app)
+	oauthToken, _, err := parseJwtToken(tokenString, app.Cfg(), app)
 
 	assert.NoError(t, err)
 	assert.Equal(t, "not-a-user", oauthToken.PreferredUsername)
@@ -56,7 +56,7 @@ func TestParseJwtToken_InvalidToken(t *testing.T) {
 	app, _ := setupTestMain()
 	tokenString := "invalidToken"
 
-	oauthToken, _, err := parseJwtToken(tokenString, &app)
+	oauthToken, _, err := parseJwtToken(tokenString, app.Cfg(), app)
 
 	assert.Error(t, err)
 	assert.Equal(t, OAuthToken{}, oauthToken)
@@ -66,12 +66,12 @@ func TestValidateLabels_AdminUser(t *testing.T) {
 	app, tokens := setupTestMain()
 	tokenString := tokens["adminUserToken"]
 
-	oauthToken, _, _ := parseJwtToken(tokenString, &app)
+	oauthToken, _, _ := parseJwtToken(tokenString, app.Cfg(), app)
 
-	app.Cfg.Admin.Group = "admins"
-	app.Cfg.Admin.Bypass = true
+	app.Cfg().Admin.Group = "admins"
+	app.Cfg().Admin.Bypass = true
 
-	tenantLabels, skip, err := validateLabels(oauthToken, &app)
+	tenantLabels, skip, err := validateLabels(oauthToken, app.Cfg(), app)
 
 	assert.NoError(t, err)
 	assert.True(t, skip)
@@ -82,9 +82,9 @@ func TestValidateLabels_NonAdminUserWithValidLabels(t *testing.T) {
 	app, tokens := setupTestMain()
 	tokenString := tokens["userTenant"]
 
-	oauthToken, _, _ := parseJwtToken(tokenString, &app)
+	oauthToken, _, _ := parseJwtToken(tokenString, app.Cfg(), app)
 
-	tenantLabels, skip, err := validateLabels(oauthToken, &app)
+	tenantLabels, skip, err := validateLabels(oauthToken, app.Cfg(), app)
 
 	assert.NoError(t, err)
 	assert.False(t, skip)
@@ -96,9 +96,9 @@ func TestValidateLabels_NonAdminUserWithoutLabels(t *testing.T) {
 	app, tokens := setupTestMain()
 	tokenString := tokens["noTenant"]
 
-	oauthToken, _, _ := parseJwtToken(tokenString, &app)
+	oauthToken, _, _ := parseJwtToken(tokenString, app.Cfg(), app)
 
-	tenantLabels, skip, err := validateLabels(oauthToken, &app)
+	tenantLabels, skip, err := validateLabels(oauthToken, app.Cfg(), app)
 
 	assert.Error(t, err)
 	assert.False(t, skip)
@@ -109,12 +109,12 @@ func TestIsAdmin_ValidAdminUser(t *testing.T) {
 	app, tokens := setupTestMain()
 	tokenString := tokens["adminUserToken"]
 
-	oauthToken, _, _ := parseJwtToken(tokenString, &app)
+	oauthToken, _, _ := parseJwtToken(tokenString, app.Cfg(), app)
 
-	app.Cfg.Admin.Group = "admins"
-	app.Cfg.Admin.Bypass = true
+	app.Cfg().Admin.Group = "admins"
+	app.Cfg().Admin.Bypass = true
 
-	isAdmin := isAdmin(oauthToken, &app)
+	isAdmin := isAdmin(oauthToken, app.Cfg())
 
 	assert.True(t, isAdmin)
 }
@@ -123,12 +123,12 @@ func TestIsAdmin_NonAdminUser(t *testing.T) {
 	app, tokens := setupTestMain()
 	tokenString := tokens["userTenant"]
 
-	oauthToken, _, _ := parseJwtToken(tokenString, &app)
+	oauthToken, _, _ := parseJwtToken(tokenString, app.Cfg(), app)
 
-	app.Cfg.Admin.Group = "admins"
-	app.Cfg.Admin.Bypass = true
+	app.Cfg().Admin.Group = "admins"
+	app.Cfg().Admin.Bypass = true
 
-	isAdmin := isAdmin(oauthToken, &app)
+	isAdmin := isAdmin(oauthToken, app.Cfg())
 
 	assert.False(t, isAdmin)
 }
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/common/model"
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// benchKID is the key id of the tokens signed by the dev issuer of the bench subcommand.
+const benchKID = "multena-bench"
+
+// BenchMix is the query mix replayed by the bench subcommand, read from a YAML file.
+type BenchMix struct {
+	// Users are the identities of the synthetic tokens, requests are spread across them round-robin.
+	Users   []BenchUser  `yaml:"users"`
+	Queries []BenchQuery `yaml:"queries"`
+}
+
+// BenchUser is the identity of a synthetic token.
+type BenchUser struct {
+	Name   string   `yaml:"name"`
+	Email  string   `yaml:"email"`
+	Groups []string `yaml:"groups"`
+}
+
+// BenchQuery is a request of the mix. Parameter values of the form now or now-<duration>, e.g. now-1h, are
+// replaced by the unix time at which the request is sent.
+type BenchQuery struct {
+	Name   string            `yaml:"name"`
+	Method string            `yaml:"method"`
+	Path   string            `yaml:"path"`
+	Params map[string]string `yaml:"params"`
+	// Weight is the share of the requests of the mix sent for the query, defaults to 1.
+	Weight int `yaml:"weight"`
+}
+
+// defaultBenchMix is the mix without --mix, the requests of a Grafana dashboard and its label browser.
+var defaultBenchMix = BenchMix{
+	Queries: []BenchQuery{
+		{Name: "instant", Path: "/api/v1/query", Params: map[string]string{"query": "up", "time": "now"}, Weight: 4},
+		{Name: "range", Path: "/api/v1/query_range", Params: map[string]string{
+			"query": `sum by (job) (rate(http_requests_total[5m]))`, "start": "now-1h", "end": "now", "step": "30s",
+		}, Weight: 4},
+		{Name: "labels", Path: "/api/v1/labels", Params: map[string]string{"start": "now-1h", "end": "now"}, Weight: 1},
+		{Name: "values", Path: "/api/v1/label/__name__/values", Params: map[string]string{"start": "now-1h", "end": "now"}, Weight: 1},
+	},
+}
+
+// loadBenchMix reads the mix from the file, or returns the default mix for an empty path.
+func loadBenchMix(path string) (BenchMix, error) {
+	mix := defaultBenchMix
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return BenchMix{}, err
+		}
+		mix = BenchMix{}
+		if err := yaml.Unmarshal(data, &mix); err != nil {
+			return BenchMix{}, err
+		}
+	}
+	if len(mix.Queries) == 0 {
+		return BenchMix{}, errors.New("the mix has no queries")
+	}
+	for i, q := range mix.Queries {
+		if q.Path == "" {
+			return BenchMix{}, fmt.Errorf("query %d has no path", i)
+		}
+		if q.Name == "" {
+			mix.Queries[i].Name = q.Path
+		}
+		if q.Method == "" {
+			mix.Queries[i].Method = http.MethodGet
+		}
+		mix.Queries[i].Method = strings.ToUpper(mix.Queries[i].Method)
+		if m := mix.Queries[i].Method; m != http.MethodGet && m != http.MethodPost {
+			return BenchMix{}, fmt.Errorf("query %s: method %q is not GET or POST", mix.Queries[i].Name, q.Method)
+		}
+		if q.Weight < 0 {
+			return BenchMix{}, fmt.Errorf("query %s: weight must not be negative", mix.Queries[i].Name)
+		}
+		if q.Weight == 0 {
+			mix.Queries[i].Weight = 1
+		}
+		for name, value := range q.Params {
+			if _, err := resolveBenchParam(value, time.Now()); err != nil {
+				return BenchMix{}, fmt.Errorf("query %s: parameter %s: %w", mix.Queries[i].Name, name, err)
+			}
+		}
+	}
+	return mix, nil
+}
+
+// resolveBenchParam replaces now and now-<duration> with the unix time relative to now.
+func resolveBenchParam(value string, now time.Time) (string, error) {
+	if !strings.HasPrefix(value, "now") {
+		return value, nil
+	}
+	rest := strings.TrimPrefix(value, "now")
+	if rest == "" {
+		return strconv.FormatInt(now.Unix(), 10), nil
+	}
+	if !strings.HasPrefix(rest, "-") {
+		return "", fmt.Errorf("invalid relative time %q, must be now or now-<duration>", value)
+	}
+	d, err := model.ParseDuration(strings.TrimPrefix(rest, "-"))
+	if err != nil {
+		return "", fmt.Errorf("invalid relative time %q: %w", value, err)
+	}
+	return strconv.FormatInt(now.Add(-time.Duration(d)).Unix(), 10), nil
+}
+
+// benchIssuer is the dev issuer of the bench subcommand. It signs synthetic tokens with an ES256 key and serves
+// the public key as JWKS, so that a proxy with jwks_cert_url pointing to it accepts them.
+type benchIssuer struct {
+	key  *ecdsa.PrivateKey
+	jwks []byte
+}
+
+// newBenchIssuer loads the signing key from the PEM file, creating the file with a new key if it does not exist.
+// The key is kept across runs so that the JWKS a proxy fetched once stays valid. Without a path the key is
+// generated for the run only.
+func newBenchIssuer(path string) (*benchIssuer, error) {
+	var key *ecdsa.PrivateKey
+	data, err := os.ReadFile(path)
+	switch {
+	case path != "" && err == nil:
+		key, err = jwt.ParseECPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("error reading signing key %s: %w", path, err)
+		}
+	case path != "" && !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	default:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if path != "" {
+			der, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	jwk, err := jwkset.NewJWKFromKey(key.Public(), jwkset.JWKOptions{
+		Metadata: jwkset.JWKMetadataOptions{KID: benchKID, ALG: jwkset.AlgES256, USE: jwkset.UseSig},
+	})
+	if err != nil {
+		return nil, err
+	}
+	storage := jwkset.NewMemoryStorage()
+	if err := storage.KeyWrite(context.Background(), jwk); err != nil {
+		return nil, err
+	}
+	jwks, err := storage.JSONPublic(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &benchIssuer{key: key, jwks: jwks}, nil
+}
+
+// sign returns a token of the user, with its groups in the group claim, valid for the ttl.
+func (b *benchIssuer) sign(user BenchUser, groupClaim string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":                "multena-bench",
+		"sub":                user.Name,
+		"preferred_username": user.Name,
+		"email":              user.Email,
+		groupClaim:           user.Groups,
+		"iat":                now.Unix(),
+		"exp":                now.Add(ttl).Unix(),
+	})
+	token.Header["kid"] = benchKID
+	return token.SignedString(b.key)
+}
+
+func (b *benchIssuer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b.jwks)
+}
+
+// benchResult is the outcome of one request, its latency through the proxy and, with a baseline upstream,
+// the latency of the same request sent to the upstream directly.
+type benchResult struct {
+	query    string
+	latency  time.Duration
+	baseline time.Duration
+	status   int
+	err      error
+}
+
+// benchStats collects the results of a query or of the whole run.
+type benchStats struct {
+	latencies []time.Duration
+	overheads []time.Duration
+	errors    int
+	rejected  int
+}
+
+func (s *benchStats) add(res benchResult) {
+	s.latencies = append(s.latencies, res.latency)
+	if res.baseline > 0 {
+		s.overheads = append(s.overheads, res.latency-res.baseline)
+	}
+	switch {
+	case res.err != nil || res.status >= http.StatusInternalServerError:
+		s.errors++
+	case res.status >= http.StatusBadRequest:
+		s.rejected++
+	}
+}
+
+// percentile returns the nearest-rank percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+// benchTarget sends the requests of a run to the proxy and the optional baseline upstream.
+type benchTarget struct {
+	client        *http.Client
+	proxyURL      string
+	baselineURL   string
+	baselineToken string
+	tokens        []string
+	queries       []BenchQuery
+	// order holds the index of every query as often as its weight, requests are sent in this order.
+	order []int
+	next  atomic.Uint64
+}
+
+// send sends the next request of the mix through the proxy and then to the baseline upstream.
+func (b *benchTarget) send(ctx context.Context) benchResult {
+	n := b.next.Add(1) - 1
+	q := b.queries[b.order[n%uint64(len(b.order))]]
+	params := url.Values{}
+	now := time.Now()
+	for name, value := range q.Params {
+		resolved, _ := resolveBenchParam(value, now)
+		params.Set(name, resolved)
+	}
+	res := benchResult{query: q.Name}
+	token := ""
+	if len(b.tokens) > 0 {
+		token = b.tokens[n%uint64(len(b.tokens))]
+	}
+	res.latency, res.status, res.err = b.do(ctx, b.proxyURL, q, params, token)
+	if b.baselineURL != "" && res.err == nil && res.status < http.StatusBadRequest {
+		if latency, status, err := b.do(ctx, b.baselineURL, q, params, b.baselineToken); err == nil && status < http.StatusBadRequest {
+			res.baseline = latency
+		}
+	}
+	return res
+}
+
+// do sends the request and reads the whole response, the latency includes the transfer of the body.
+func (b *benchTarget) do(ctx context.Context, base string, q BenchQuery, params url.Values, token string) (time.Duration, int, error) {
+	target := strings.TrimSuffix(base, "/") + q.Path
+	var body io.Reader
+	if q.Method == http.MethodPost {
+		body = strings.NewReader(params.Encode())
+	} else {
+		target += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, q.Method, target, body)
+	if err != nil {
+		return 0, 0, err
+	}
+	if q.Method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	start := time.Now()
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return time.Since(start), 0, err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return time.Since(start), resp.StatusCode, err
+}
+
+// runBenchLoad sends requests with the workers until the context is done or the number of requests is reached.
+// limiter caps the rate of all workers, nil is unlimited.
+func runBenchLoad(ctx context.Context, target *benchTarget, workers int, requests int, limiter *rate.Limiter) []benchResult {
+	var (
+		mu      sync.Mutex
+		results []benchResult
+		sent    atomic.Int64
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if requests > 0 && sent.Add(1) > int64(requests) {
+					return
+				}
+				if limiter != nil && limiter.Wait(ctx) != nil {
+					return
+				}
+				res := target.send(ctx)
+				if ctx.Err() != nil && res.err != nil {
+					// requests cancelled at the end of the run do not count
+					return
+				}
+				mu.Lock()
+				results = append(results, res)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// scrapeUpstreamRequests returns the number of upstream requests and of those answered with 5xx from the
+// multena_upstream_requests_total counters of the metrics endpoint.
+func scrapeUpstreamRequests(client *http.Client, metricsURL string) (total float64, failed float64, err error) {
+	resp, err := client.Get(metricsURL)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("metrics endpoint answered %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "multena_upstream_requests_total{") {
+			continue
+		}
+		end := strings.LastIndex(line, "}")
+		if end < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(line[end+1:]), 64)
+		if err != nil {
+			continue
+		}
+		total += value
+		if strings.Contains(line[:end], `code="5`) {
+			failed += value
+		}
+	}
+	return total, failed, nil
+}
+
+// runBench implements the bench subcommand. It signs synthetic tokens with the dev issuer, replays the query
+// mix against a running proxy and reports the latency percentiles per query, the enforcement overhead compared
+// to a baseline upstream and the error rates. It returns the process exit code: 0 if the run met the thresholds,
+// 1 if it did not and 2 on usage errors.
+func runBench(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	target := fs.String("target", "http://localhost:8080", "URL of the proxy under test")
+	mixFile := fs.String("mix", "", "YAML file with the users and queries to replay, defaults to a dashboard like mix")
+	duration := fs.Duration("duration", 30*time.Second, "length of the run")
+	requests := fs.Int("requests", 0, "stop after this many requests, 0 runs for the duration")
+	concurrency := fs.Int("concurrency", 10, "number of concurrent workers")
+	qps := fs.Float64("rate", 0, "requests per second of all workers, 0 is unlimited")
+	user := fs.String("user", "bench", "user of the token if the mix has no users")
+	groups := fs.String("groups", "", "comma separated groups of the user if the mix has no users")
+	groupClaim := fs.String("group-claim", "groups", "claim holding the groups, oauth_group_name of the proxy")
+	keyFile := fs.String("key", "", "PEM file with the signing key of the dev issuer, created if missing, empty for a key of this run")
+	issuerListen := fs.String("issuer-listen", "127.0.0.1:8089", "address the dev issuer serves its JWKS on, empty to not serve it")
+	token := fs.String("token", "", "bearer token to use instead of synthetic tokens, e.g. from the real identity provider")
+	baseline := fs.String("baseline", "", "URL of the upstream to send the same requests to directly, to measure the enforcement overhead")
+	baselineToken := fs.String("baseline-token", "", "bearer token for the baseline upstream")
+	metricsURL := fs.String("metrics", "", "metrics endpoint of the proxy, e.g. http://localhost:8081/metrics, to report upstream errors")
+	insecure := fs.Bool("insecure", false, "skip verifying the TLS certificates of the proxy and the baseline upstream")
+	maxErrorRate := fs.Float64("max-error-rate", 0, "fail if more than this fraction of requests fail, 0 disables the check")
+	maxP99 := fs.Duration("max-p99", 0, "fail if the p99 latency of all requests exceeds this, 0 disables the check")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	if *concurrency < 1 || *duration <= 0 || *requests < 0 || *qps < 0 {
+		_, _ = fmt.Fprintln(stdout, "ERROR concurrency and duration must be positive, requests and rate must not be negative")
+		return 2
+	}
+
+	mix, err := loadBenchMix(*mixFile)
+	if err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR mix: %v\n", err)
+		return 2
+	}
+	if len(mix.Users) == 0 {
+		mix.Users = []BenchUser{{Name: *user}}
+		if *groups != "" {
+			mix.Users[0].Groups = strings.Split(*groups, ",")
+		}
+	}
+
+	var tokens []string
+	if *token != "" {
+		tokens = []string{*token}
+	} else {
+		issuer, err := newBenchIssuer(*keyFile)
+		if err != nil {
+			_, _ = fmt.Fprintf(stdout, "ERROR issuer: %v\n", err)
+			return 2
+		}
+		for _, u := range mix.Users {
+			if u.Email == "" {
+				u.Email = u.Name + "@bench.local"
+			}
+			signed, err := issuer.sign(u, *groupClaim, *duration+time.Hour)
+			if err != nil {
+				_, _ = fmt.Fprintf(stdout, "ERROR issuer: %v\n", err)
+				return 2
+			}
+			tokens = append(tokens, signed)
+		}
+		if *issuerListen != "" {
+			listener, err := net.Listen("tcp", *issuerListen)
+			if err != nil {
+				_, _ = fmt.Fprintf(stdout, "ERROR issuer: %v\n", err)
+				return 2
+			}
+			server := &http.Server{Handler: issuer, ReadHeaderTimeout: 5 * time.Second}
+			go func() { _ = server.Serve(listener) }()
+			defer server.Close()
+			_, _ = fmt.Fprintf(stdout, "Dev issuer JWKS at http://%s/jwks.json, set web.jwks_cert_url of the proxy to it\n", listener.Addr())
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *concurrency
+	if *insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{Transport: transport}
+	bt := &benchTarget{
+		client:        client,
+		proxyURL:      *target,
+		baselineURL:   *baseline,
+		baselineToken: *baselineToken,
+		tokens:        tokens,
+		queries:       mix.Queries,
+	}
+	for i, q := range mix.Queries {
+		for j := 0; j < q.Weight; j++ {
+			bt.order = append(bt.order, i)
+		}
+	}
+
+	var upstreamBefore, failedBefore float64
+	if *metricsURL != "" {
+		if upstreamBefore, failedBefore, err = scrapeUpstreamRequests(client, *metricsURL); err != nil {
+			_, _ = fmt.Fprintf(stdout, "ERROR metrics: %v\n", err)
+			return 2
+		}
+	}
+	var limiter *rate.Limiter
+	if *qps > 0 {
+		limiter = rate.NewLimiter(rate.Limit(*qps), 1)
+	}
+	_, _ = fmt.Fprintf(stdout, "Benchmarking %s with %d workers for %s\n", *target, *concurrency, *duration)
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	start := time.Now()
+	results := runBenchLoad(ctx, bt, *concurrency, *requests, limiter)
+	elapsed := time.Since(start)
+
+	total := printBenchReport(stdout, mix.Queries, results, elapsed)
+	if *metricsURL != "" {
+		upstreamAfter, failedAfter, err := scrapeUpstreamRequests(client, *metricsURL)
+		if err != nil {
+			_, _ = fmt.Fprintf(stdout, "ERROR metrics: %v\n", err)
+		} else {
+			upstream, failed := upstreamAfter-upstreamBefore, failedAfter-failedBefore
+			_, _ = fmt.Fprintf(stdout, "Upstream requests: %.0f, 5xx: %.0f (%s)\n", upstream, failed, ratio(failed, upstream))
+		}
+	}
+
+	code := 0
+	if len(results) == 0 {
+		_, _ = fmt.Fprintln(stdout, "FAIL no requests were sent")
+		return 1
+	}
+	if errorRate := float64(total.errors) / float64(len(results)); *maxErrorRate > 0 && errorRate > *maxErrorRate {
+		_, _ = fmt.Fprintf(stdout, "FAIL error rate %.2f%% exceeds %.2f%%\n", errorRate*100, *maxErrorRate*100)
+		code = 1
+	}
+	if p99 := percentile(total.latencies, 99); *maxP99 > 0 && p99 > *maxP99 {
+		_, _ = fmt.Fprintf(stdout, "FAIL p99 latency %s exceeds %s\n", p99.Round(time.Microsecond), *maxP99)
+		code = 1
+	}
+	return code
+}
+
+// printBenchReport prints the statistics of every query and of all requests, whose statistics it returns.
+// Errors are failed requests and 5xx responses, rejected are 4xx responses, e.g. of the enforcement.
+// The overhead is the latency through the proxy minus the latency of the same request to the baseline upstream.
+func printBenchReport(w io.Writer, queries []BenchQuery, results []benchResult, elapsed time.Duration) *benchStats {
+	byQuery := map[string]*benchStats{}
+	total := &benchStats{}
+	for _, res := range results {
+		if byQuery[res.query] == nil {
+			byQuery[res.query] = &benchStats{}
+		}
+		byQuery[res.query].add(res)
+		total.add(res)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "QUERY\tREQUESTS\tERRORS\tREJECTED\tP50\tP90\tP99\tMAX\tOVERHEAD P50\tOVERHEAD P99")
+	row := func(name string, s *benchStats) {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		sort.Slice(s.overheads, func(i, j int) bool { return s.overheads[i] < s.overheads[j] })
+		overhead50, overhead99 := "-", "-"
+		if len(s.overheads) > 0 {
+			overhead50 = percentile(s.overheads, 50).Round(time.Microsecond).String()
+			overhead99 = percentile(s.overheads, 99).Round(time.Microsecond).String()
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name, len(s.latencies),
+			ratio(float64(s.errors), float64(len(s.latencies))), ratio(float64(s.rejected), float64(len(s.latencies))),
+			percentile(s.latencies, 50).Round(time.Microsecond), percentile(s.latencies, 90).Round(time.Microsecond),
+			percentile(s.latencies, 99).Round(time.Microsecond), percentile(s.latencies, 100).Round(time.Microsecond),
+			overhead50, overhead99)
+	}
+	seen := map[string]bool{}
+	for _, q := range queries {
+		if s := byQuery[q.Name]; s != nil && !seen[q.Name] {
+			seen[q.Name] = true
+			row(q.Name, s)
+		}
+	}
+	row("total", total)
+	_ = tw.Flush()
+	_, _ = fmt.Fprintf(w, "Sent %d requests in %s, %.1f requests per second\n", len(results), elapsed.Round(time.Millisecond),
+		float64(len(results))/elapsed.Seconds())
+	return total
+}
+
+// ratio formats the fraction as percentage.
+func ratio(part, whole float64) string {
+	if whole == 0 {
+		return "0.00%"
+	}
+	return fmt.Sprintf("%.2f%%", part/whole*100)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBenchMix(t *testing.T) {
+	mix, err := loadBenchMix("")
+	assert.NoError(t, err)
+	assert.Len(t, mix.Queries, 4)
+
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "mix.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	mix, err = loadBenchMix(write(`
+users:
+  - name: jane
+    groups: [dev]
+queries:
+  - path: /loki/api/v1/query_range
+    method: post
+    params:
+      query: '{app="a"}'
+      start: now-15m
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []BenchUser{{Name: "jane", Groups: []string{"dev"}}}, mix.Users)
+	assert.Equal(t, BenchQuery{Name: "/loki/api/v1/query_range", Method: http.MethodPost, Path: "/loki/api/v1/query_range",
+		Params: map[string]string{"query": `{app="a"}`, "start": "now-15m"}, Weight: 1}, mix.Queries[0])
+
+	_, err = loadBenchMix(write(`queries: [{path: /api/v1/query, method: delete}]`))
+	assert.Error(t, err)
+	_, err = loadBenchMix(write(`queries: [{path: /api/v1/query, params: {time: now+1h}}]`))
+	assert.Error(t, err)
+	_, err = loadBenchMix(write(`users: [{name: jane}]`))
+	assert.Error(t, err)
+}
+
+func TestResolveBenchParam(t *testing.T) {
+	now := time.Unix(1780000000, 0)
+	for value, expected := range map[string]string{
+		"now":     "1780000000",
+		"now-1h":  "1779996400",
+		"now-30s": "1779999970",
+		"up":      "up",
+	} {
+		resolved, err := resolveBenchParam(value, now)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, resolved, value)
+	}
+	_, err := resolveBenchParam("now-1x", now)
+	assert.Error(t, err)
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	assert.Equal(t, 50*time.Millisecond, percentile(sorted, 50))
+	assert.Equal(t, 99*time.Millisecond, percentile(sorted, 99))
+	assert.Equal(t, 100*time.Millisecond, percentile(sorted, 100))
+	assert.Equal(t, time.Millisecond, percentile(sorted[:1], 99))
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+}
+
+func TestBenchIssuerKeyIsKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench.pem")
+	first, err := newBenchIssuer(path)
+	assert.NoError(t, err)
+	second, err := newBenchIssuer(path)
+	assert.NoError(t, err)
+	assert.Equal(t, first.jwks, second.jwks)
+	assert.Contains(t, string(first.jwks), `"kid":"multena-bench"`)
+	assert.NotContains(t, string(first.jwks), `"d":`, "the private key is not published")
+}
+
+func TestE2E_Bench(t *testing.T) {
+	env := newE2EEnv(t)
+	key := filepath.Join(t.TempDir(), "bench.pem")
+	issuer, err := newBenchIssuer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(issuer)
+	defer jwks.Close()
+	env.App.Cfg().Web.JwksCertURL = jwks.URL
+	env.App.WithJWKS()
+	proxy := httptest.NewServer(env.App.e)
+	defer proxy.Close()
+	metrics := httptest.NewServer(promhttp.Handler())
+	defer metrics.Close()
+
+	mix := filepath.Join(t.TempDir(), "mix.yaml")
+	assert.NoError(t, os.WriteFile(mix, []byte(`
+users:
+  - name: user
+queries:
+  - name: allowed
+    path: /api/v1/query
+    params: {query: up, time: now}
+    weight: 3
+  - name: forbidden
+    path: /api/v1/query
+    params: {query: 'up{tenant_id="forbidden_tenant"}'}
+`), 0o600))
+
+	var out bytes.Buffer
+	code := runBench([]string{
+		"--target", proxy.URL, "--mix", mix, "--key", key, "--issuer-listen", "",
+		"--requests", "20", "--concurrency", "4", "--duration", "10s",
+		"--baseline", env.Thanos.URL, "--metrics", metrics.URL, "--max-error-rate", "0.01",
+	}, &out)
+
+	assert.Equal(t, 0, code, out.String())
+	assert.Regexp(t, `allowed\s+15\s+0.00%\s+0.00%`, out.String())
+	assert.Regexp(t, `forbidden\s+5\s+0.00%\s+100.00%`, out.String())
+	assert.Regexp(t, `total\s+20\s`, out.String())
+	assert.Contains(t, out.String(), "Upstream requests: ")
+	assert.Contains(t, out.String(), "5xx: 0 (0.00%)")
+	assert.Len(t, env.Thanos.Requests(), 30, "allowed queries are sent through the proxy and to the baseline")
+
+	code = runBench([]string{"--target", proxy.URL, "--token", "invalid", "--requests", "3", "--max-p99", "1ns"}, &out)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, out.String(), "FAIL p99 latency")
+}
+
+func TestRunBenchLoadStopsAtDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	target := &benchTarget{
+		client:   server.Client(),
+		proxyURL: server.URL,
+		queries:  []BenchQuery{{Name: "q", Method: http.MethodGet, Path: "/api/v1/query", Params: map[string]string{"time": "now"}}},
+		order:    []int{0},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	results := runBenchLoad(ctx, target, 2, 0, nil)
+	assert.NotEmpty(t, results)
+	for _, res := range results {
+		assert.NoError(t, res.err)
+		assert.Equal(t, http.StatusOK, res.status)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// EnforceComparison is the response of the /debug/compare endpoint.
+type EnforceComparison struct {
+	User     string   `json:"user"`
+	Language string   `json:"language"`
+	Query    string   `json:"query"`
+	Labels   []string `json:"labels"`
+	Skip     bool     `json:"skip"`
+	Enforced string   `json:"enforced,omitempty"`
+	// Without and With summarise the results of the query and of the enforced query.
+	Without ComparedResult `json:"without_enforcement"`
+	With    ComparedResult `json:"with_enforcement"`
+	// Removed are the series or streams withheld by the enforcement. Added are only returned by the enforced
+	// query, which hints at an enforcement that changed more than the selected tenants.
+	Removed int `json:"removed"`
+	Added   int `json:"added"`
+	// Outside are the values of the tenant label in the enforced result that are not tenant labels of the user.
+	Outside []string `json:"outside,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// ComparedResult summarises the series or streams returned by the upstream for a query.
+type ComparedResult struct {
+	Series int `json:"series"`
+	// TenantValues are the distinct values of the tenant label in the result.
+	TenantValues []string `json:"tenant_values"`
+}
+
+// enforceComparison runs a query with and without the enforcement of a user against the upstream and answers
+// with the difference of the returned series or streams. It is meant to audit that the enforcement restricts
+// the data of a tenant as intended and is only available to admins.
+func (a *App) enforceComparison(w http.ResponseWriter, r *http.Request) {
+	cfg := a.Cfg()
+	oauthToken, err := getToken(r, cfg, a)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	if !ContainsIgnoreCase(oauthToken.Groups, cfg.Admin.Group) {
+		logAndWriteError(w, http.StatusForbidden, nil, "only admins may compare enforced and unenforced results")
+		return
+	}
+
+	query := r.FormValue("query")
+	language := r.FormValue("language")
+	enforcer, ok := a.enforcers[language]
+	if !ok {
+		logAndWriteError(w, http.StatusBadRequest, nil, fmt.Sprintf("unknown query language %q", language))
+		return
+	}
+	target, tl, tls, headers, rewrite := cfg.Thanos.URL, cfg.Thanos.TenantLabel, cfg.Thanos.UseMutualTLS, cfg.Thanos.Headers, cfg.Thanos.PathRewrite
+	path := "/api/v1/query"
+	if language == "logql" {
+		target, tl, tls, headers, rewrite = cfg.Loki.URL, cfg.Loki.TenantLabel, cfg.Loki.UseMutualTLS, cfg.Loki.Headers, cfg.Loki.PathRewrite
+		path = "/loki/api/v1/query_range"
+	}
+	upstreamURL, err := url.Parse(target)
+	if err != nil {
+		logAndWriteError(w, http.StatusInternalServerError, err, "")
+		return
+	}
+	rewriter, err := newPathRewriter(rewrite)
+	if err != nil {
+		logAndWriteError(w, http.StatusInternalServerError, err, "")
+		return
+	}
+	upstreamURL = upstreamURL.JoinPath(rewriter.rewrite(path))
+
+	username := r.FormValue("username")
+	if username == "" {
+		username = oauthToken.PreferredUsername
+	}
+	requestLogger(r).Info().Str("audit", "enforce_comparison").Str("compared_user", username).Str("query", query).
+		Msg("Comparing enforced and unenforced results")
+
+	comparison := EnforceComparison{User: username, Language: language, Query: query}
+	tenantLabels, skip, err := validateLabels(OAuthToken{PreferredUsername: username}, cfg, a)
+	switch {
+	case err != nil:
+		comparison.Error = err.Error()
+	case skip:
+		comparison.Skip = true
+	default:
+		comparison.Labels = MapKeysToArray(tenantLabels)
+		sort.Strings(comparison.Labels)
+		comparison.Enforced, err = enforcer.Enforce(query, tenantLabels, tl)
+		if err != nil {
+			comparison.Error = err.Error()
+		}
+	}
+	if comparison.Error != "" || comparison.Skip {
+		writeComparison(w, r, comparison)
+		return
+	}
+
+	params := comparisonParams(r, language)
+	client := a.upstreams.httpClient(upstreamURL)
+	without, err := querySeries(client, upstreamURL, params, query, tls, headers, a.ServiceAccountToken)
+	if err != nil {
+		logAndWriteError(w, http.StatusBadGateway, err, "")
+		return
+	}
+	with, err := querySeries(client, upstreamURL, params, comparison.Enforced, tls, headers, a.ServiceAccountToken)
+	if err != nil {
+		logAndWriteError(w, http.StatusBadGateway, err, "")
+		return
+	}
+	comparison.Without = summariseSeries(without, tl)
+	comparison.With = summariseSeries(with, tl)
+	for key := range without {
+		if _, ok := with[key]; !ok {
+			comparison.Removed++
+		}
+	}
+	for key := range with {
+		if _, ok := without[key]; !ok {
+			comparison.Added++
+		}
+	}
+	// grants restrict more labels than the tenant label, the values of the tenant label are not comparable
+	grants := hasGrant(comparison.Labels)
+	for _, value := range comparison.With.TenantValues {
+		if !grants && !tenantLabels[value] {
+			comparison.Outside = append(comparison.Outside, value)
+		}
+	}
+	writeComparison(w, r, comparison)
+}
+
+func writeComparison(w http.ResponseWriter, r *http.Request, comparison EnforceComparison) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(comparison); err != nil {
+		requestLogger(r).Error().Err(err).Msg("Error while writing enforcement comparison")
+	}
+}
+
+// hasGrant reports whether any of the tenant labels is a grant, see Grant.
+func hasGrant(tenantLabels []string) bool {
+	for _, label := range tenantLabels {
+		if strings.Contains(label, "=") {
+			return true
+		}
+	}
+	return false
+}
+
+// comparisonParams returns the query parameters of both queries. The time range is taken from the request,
+// log queries default to the last hour and 100 lines.
+func comparisonParams(r *http.Request, language string) url.Values {
+	params := url.Values{}
+	for _, name := range []string{"time", "start", "end", "step", "limit"} {
+		if value := r.FormValue(name); value != "" {
+			params.Set(name, value)
+		}
+	}
+	if language == "logql" {
+		now := time.Now()
+		if params.Get("start") == "" {
+			params.Set("start", fmt.Sprint(now.Add(-time.Hour).UnixNano()))
+		}
+		if params.Get("end") == "" {
+			params.Set("end", fmt.Sprint(now.UnixNano()))
+		}
+		if params.Get("limit") == "" {
+			params.Set("limit", "100")
+		}
+	}
+	return params
+}
+
+// querySeries runs the query against the upstream and returns the label sets of the returned series or
+// streams by their canonical form.
+func querySeries(client *http.Client, upstreamURL *url.URL, params url.Values, query string, tls bool, headers map[string]string, sat string) (map[string]labels.Labels, error) {
+	values := url.Values{}
+	for name, value := range params {
+		values[name] = value
+	}
+	values.Set("query", query)
+	u := *upstreamURL
+	u.RawQuery = values.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(req, tls, headers, sat)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := decodeAPIResponse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("upstream answered %d: %w", resp.StatusCode, err)
+	}
+	var result struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	if result.ResultType == "scalar" || result.ResultType == "string" {
+		return nil, fmt.Errorf("results of type %s have no series", result.ResultType)
+	}
+	var entries []struct {
+		Metric map[string]string `json:"metric"`
+		Stream map[string]string `json:"stream"`
+	}
+	if err := json.Unmarshal(result.Result, &entries); err != nil {
+		return nil, err
+	}
+	series := make(map[string]labels.Labels, len(entries))
+	for _, entry := range entries {
+		set := labels.FromMap(entry.Metric)
+		if entry.Stream != nil {
+			set = labels.FromMap(entry.Stream)
+		}
+		series[set.String()] = set
+	}
+	return series, nil
+}
+
+func summariseSeries(series map[string]labels.Labels, tl string) ComparedResult {
+	values := map[string]bool{}
+	for _, set := range series {
+		if value := set.Get(tl); value != "" {
+			values[value] = true
+		}
+	}
+	summary := ComparedResult{Series: len(series), TenantValues: MapKeysToArray(values)}
+	sort.Strings(summary.TenantValues)
+	return summary
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforceComparison(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg().Admin.Group = "admins"
+	ignoreTenants := false
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		received = append(received, r.URL.Path+" "+query)
+		tenants := []string{"allowed_user", "also_allowed_user", "other"}
+		if strings.Contains(query, "tenant_id=") && !ignoreTenants {
+			tenants = tenants[:2]
+		}
+		var series []string
+		for _, tenant := range tenants {
+			series = append(series, fmt.Sprintf(`{"metric":{"__name__":"up","tenant_id":%q},"value":[1,"1"]}`, tenant))
+		}
+		_, _ = fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[%s]}}`, strings.Join(series, ","))
+	}))
+	defer upstream.Close()
+	app.Cfg().Thanos.URL = upstream.URL
+	app.WithRoutes()
+
+	compare := func(token string) (*httptest.ResponseRecorder, EnforceComparison) {
+		params := url.Values{"query": {"up"}, "language": {"promql"}, "username": {"user"}}
+		req := httptest.NewRequest(http.MethodGet, "/debug/compare?"+params.Encode(), nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[token])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		var comparison EnforceComparison
+		_ = json.Unmarshal(rr.Body.Bytes(), &comparison)
+		return rr, comparison
+	}
+
+	rr, comparison := compare("adminUserToken")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `up{tenant_id=~"allowed_user|also_allowed_user"}`, comparison.Enforced)
+	assert.Equal(t, []string{"/api/v1/query up", `/api/v1/query up{tenant_id=~"allowed_user|also_allowed_user"}`}, received)
+	assert.Equal(t, ComparedResult{Series: 3, TenantValues: []string{"allowed_user", "also_allowed_user", "other"}}, comparison.Without)
+	assert.Equal(t, ComparedResult{Series: 2, TenantValues: []string{"allowed_user", "also_allowed_user"}}, comparison.With)
+	assert.Equal(t, 1, comparison.Removed)
+	assert.Zero(t, comparison.Added)
+	assert.Empty(t, comparison.Outside)
+
+	// an upstream that does not apply the tenant matcher leaks the data of other tenants
+	ignoreTenants = true
+	rr, comparison = compare("adminUserToken")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Zero(t, comparison.Removed)
+	assert.Equal(t, []string{"other"}, comparison.Outside)
+
+	rr, _ = compare("userTenant")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
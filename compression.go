@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// CompressionConfig controls the gzip compression of responses that were decompressed to be rewritten.
+type CompressionConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MinSize is the smallest body in bytes that is compressed, defaults to 1024.
+	MinSize int `mapstructure:"min_size"`
+	// ContentTypes are the media types that are compressed, defaults to application/json.
+	ContentTypes []string `mapstructure:"content_types"`
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows a gzip encoded response.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// compressResponse returns a response modifier that gzip encodes uncompressed responses of an allowed
+// content type and at least the minimum size, for clients accepting gzip. It runs after the modifiers
+// that rewrite the body, which leave it decompressed.
+func compressResponse(cfg CompressionConfig, acceptEncoding string) func(*http.Response) error {
+	minSize := cfg.MinSize
+	if minSize <= 0 {
+		minSize = 1024
+	}
+	contentTypes := cfg.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/json"}
+	}
+	return func(resp *http.Response) error {
+		if !acceptsGzip(acceptEncoding) || resp.Header.Get("Content-Encoding") != "" {
+			return nil
+		}
+		mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil || !containsFold(contentTypes, mediaType) {
+			return nil
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength < int64(minSize) {
+			return nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(body) < minSize {
+			setResponseBody(resp, body)
+			return nil
+		}
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		setResponseBody(resp, buf.Bytes())
+		resp.Header.Set("Content-Encoding", "gzip")
+		resp.Header.Add("Vary", "Accept-Encoding")
+		return nil
+	}
+}
+
+// containsFold reports whether values contains s, ignoring case.
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	assert.True(t, acceptsGzip("gzip"))
+	assert.True(t, acceptsGzip("deflate, gzip;q=0.8"))
+	assert.True(t, acceptsGzip("*"))
+	assert.False(t, acceptsGzip(""))
+	assert.False(t, acceptsGzip("br, deflate"))
+	assert.False(t, acceptsGzip("gzip;q=0"))
+}
+
+func TestCompressResponse(t *testing.T) {
+	large := `{"status":"success","data":"` + strings.Repeat("a", 2048) + `"}`
+	newResponse := func(contentType string, body string) *http.Response {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {contentType}}}
+		setResponseBody(resp, []byte(body))
+		return resp
+	}
+
+	resp := newResponse("application/json; charset=utf-8", large)
+	assert.NoError(t, compressResponse(CompressionConfig{Enabled: true}, "gzip")(resp))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Less(t, resp.ContentLength, int64(len(large)))
+	gz, err := gzip.NewReader(resp.Body)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(gz)
+	assert.Equal(t, large, string(body))
+
+	for name, resp := range map[string]*http.Response{
+		"small":        newResponse("application/json", `{"status":"success"}`),
+		"content type": newResponse("text/plain", large),
+	} {
+		assert.NoError(t, compressResponse(CompressionConfig{Enabled: true}, "gzip")(resp), name)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"), name)
+	}
+
+	resp = newResponse("application/json", large)
+	assert.NoError(t, compressResponse(CompressionConfig{Enabled: true}, "br")(resp))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"), "client does not accept gzip")
+}
+
+func TestE2E_RewrittenResponsesAreCompressed(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Thanos.RewriteWarnings = true
+	env.App.Cfg().Compression = CompressionConfig{Enabled: true, MinSize: 10}
+	env.App.WithRoutes()
+	env.Thanos.SetResponse("/api/v1/query", http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("Authorization", "Bearer "+env.Tokens["userTenant"])
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(bytes.NewReader(rr.Body.Bytes()))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(gz)
+	assert.Contains(t, string(body), "query restricted by multena")
+}
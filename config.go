@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type LogConfig struct {
@@ -21,20 +23,30 @@ type LogConfig struct {
 }
 
 type WebConfig struct {
-	ProxyPort           int    `mapstructure:"proxy_port"`
-	MetricsPort         int    `mapstructure:"metrics_port"`
-	Host                string `mapstructure:"host"`
-	TLSVerifySkip       bool   `mapstructure:"tls_verify_skip"`
-	TrustedRootCaPath   string `mapstructure:"trusted_root_ca_path"`
-	LabelStoreKind      string `mapstructure:"label_store_kind"`
-	JwksCertURL         string `mapstructure:"jwks_cert_url"`
-	OAuthGroupName      string `mapstructure:"oauth_group_name"`
-	ServiceAccountToken string `mapstructure:"service_account_token"`
+	ProxyPort           int              `mapstructure:"proxy_port"`
+	MetricsPort         int              `mapstructure:"metrics_port"`
+	Host                string           `mapstructure:"host"`
+	TLSVerifySkip       bool             `mapstructure:"tls_verify_skip"`
+	TrustedRootCaPath   string           `mapstructure:"trusted_root_ca_path"`
+	LabelStoreKind      string           `mapstructure:"label_store_kind"`
+	JwksCertURL         string           `mapstructure:"jwks_cert_url"`
+	OAuthGroupName      string           `mapstructure:"oauth_group_name"`
+	ServiceAccountToken string           `mapstructure:"service_account_token"`
+	DryRun              bool             `mapstructure:"dry_run"`
+	JwksCachePath       string           `mapstructure:"jwks_cache_path"`
+	ConditionalRequests bool             `mapstructure:"conditional_requests"`
+	Listeners           []ListenerConfig `mapstructure:"listeners"`
+	Lifecycle           LifecycleConfig  `mapstructure:"lifecycle"`
 }
 
 type AdminConfig struct {
-	Bypass bool   `mapstructure:"bypass"`
-	Group  string `mapstructure:"group"`
+	Bypass     bool     `mapstructure:"bypass"`
+	Group      string   `mapstructure:"group"`
+	TSDBGroups []string `mapstructure:"tsdb_groups"`
+	// TenantGroups may change the tenant mappings through the tenant admin API.
+	TenantGroups []string `mapstructure:"tenant_groups"`
+	// OperatorGroups may read the operational APIs, e.g. stores, targets and rules.
+	OperatorGroups []string `mapstructure:"operator_groups"`
 }
 
 type AlertConfig struct {
@@ -58,73 +70,170 @@ type DbConfig struct {
 	DbName       string `mapstructure:"dbName"`
 	Query        string `mapstructure:"query"`
 	TokenKey     string `mapstructure:"token_key"`
+	// InsertQuery and DeleteQuery add and remove a label of an identity, they enable the tenant admin API.
+	InsertQuery string `mapstructure:"insert_query"`
+	DeleteQuery string `mapstructure:"delete_query"`
+	// AuditQuery records every change made through the tenant admin API, optional.
+	AuditQuery string `mapstructure:"audit_query"`
+	// CacheTTL caches the labels of an identity, changes made through the tenant admin API invalidate the cache.
+	CacheTTL time.Duration `mapstructure:"cache_ttl"`
 }
 
 type ThanosConfig struct {
-	URL          string            `mapstructure:"url"`
-	TenantLabel  string            `mapstructure:"tenant_label"`
-	UseMutualTLS bool              `mapstructure:"use_mutual_tls"`
-	Cert         string            `mapstructure:"cert"`
-	Key          string            `mapstructure:"key"`
-	Headers      map[string]string `mapstructure:"headers"`
-	ActorHeader  string            `mapstructure:"actor_header"`
+	URL           string            `mapstructure:"url"`
+	TenantLabel   string            `mapstructure:"tenant_label"`
+	UseMutualTLS  bool              `mapstructure:"use_mutual_tls"`
+	Cert          string            `mapstructure:"cert"`
+	Key           string            `mapstructure:"key"`
+	Headers       map[string]string `mapstructure:"headers"`
+	ActorHeader   string            `mapstructure:"actor_header"`
+	Enforcer      string            `mapstructure:"enforcer"`
+	TenantHeaders map[string]string `mapstructure:"tenant_headers"`
+	// ShadowEnforcer runs an enforcer plugin, or the built-in enforcer, next to Enforcer, see ShadowEnforcer.
+	ShadowEnforcer string `mapstructure:"shadow_enforcer"`
+	// CrossTenantPolicy is one of allow, warn or deny, see checkCrossTenant.
+	CrossTenantPolicy string `mapstructure:"cross_tenant_policy"`
+	// ExemptRoutes are authenticated but not enforced, see defaultExemptRoutes.
+	ExemptRoutes []string `mapstructure:"exempt_routes"`
+	// RouteMethods are the allowed methods of routes, see defaultRouteMethods.
+	RouteMethods map[string][]string `mapstructure:"route_methods"`
+	// RewriteWarnings adds a warning to responses of queries that were rewritten by the enforcement.
+	RewriteWarnings bool                 `mapstructure:"rewrite_warnings"`
+	Proxy           EgressProxyConfig    `mapstructure:"proxy"`
+	Discovery       DiscoveryConfig      `mapstructure:"discovery"`
+	PathRewrite     PathRewriteConfig    `mapstructure:"path_rewrite"`
+	TimeRouting     TimeRoutingConfig    `mapstructure:"time_routing"`
+	FanOut          FanOutConfig         `mapstructure:"fan_out"`
+	Client          UpstreamClientConfig `mapstructure:"client"`
+	LabelIndex      LabelIndexConfig     `mapstructure:"label_index"`
 }
 
 type LokiConfig struct {
-	URL          string            `mapstructure:"url"`
-	TenantLabel  string            `mapstructure:"tenant_label"`
-	UseMutualTLS bool              `mapstructure:"use_mutual_tls"`
-	Cert         string            `mapstructure:"cert"`
-	Key          string            `mapstructure:"key"`
-	Headers      map[string]string `mapstructure:"headers"`
-	ActorHeader  string            `mapstructure:"actor_header"`
+	URL           string            `mapstructure:"url"`
+	TenantLabel   string            `mapstructure:"tenant_label"`
+	UseMutualTLS  bool              `mapstructure:"use_mutual_tls"`
+	Cert          string            `mapstructure:"cert"`
+	Key           string            `mapstructure:"key"`
+	Headers       map[string]string `mapstructure:"headers"`
+	ActorHeader   string            `mapstructure:"actor_header"`
+	Enforcer      string            `mapstructure:"enforcer"`
+	TenantHeaders map[string]string `mapstructure:"tenant_headers"`
+	// ShadowEnforcer runs an enforcer plugin, or the built-in enforcer, next to Enforcer, see ShadowEnforcer.
+	ShadowEnforcer string `mapstructure:"shadow_enforcer"`
+	// ExemptRoutes are authenticated but not enforced, see defaultExemptRoutes.
+	ExemptRoutes []string `mapstructure:"exempt_routes"`
+	// RouteMethods are the allowed methods of routes, see defaultRouteMethods.
+	RouteMethods map[string][]string `mapstructure:"route_methods"`
+	// StructuredMetadataKeys constrain the entries of log queries on structured metadata, see StructuredMetadataEnforcer.
+	StructuredMetadataKeys []string `mapstructure:"structured_metadata_keys"`
+	// RewriteWarnings adds a warning to responses of queries that were rewritten by the enforcement.
+	RewriteWarnings bool                 `mapstructure:"rewrite_warnings"`
+	Tail            TailConfig           `mapstructure:"tail"`
+	Proxy           EgressProxyConfig    `mapstructure:"proxy"`
+	Discovery       DiscoveryConfig      `mapstructure:"discovery"`
+	PathRewrite     PathRewriteConfig    `mapstructure:"path_rewrite"`
+	TimeRouting     TimeRoutingConfig    `mapstructure:"time_routing"`
+	FanOut          FanOutConfig         `mapstructure:"fan_out"`
+	Client          UpstreamClientConfig `mapstructure:"client"`
+}
+
+type PluginConfig struct {
+	Dir      string                       `mapstructure:"dir"`
+	Settings map[string]map[string]string `mapstructure:"settings"`
 }
 
 type Config struct {
-	Log    LogConfig    `mapstructure:"log"`
-	Web    WebConfig    `mapstructure:"web"`
-	Admin  AdminConfig  `mapstructure:"admin"`
-	Alert  AlertConfig  `mapstructure:"alert"`
-	Dev    DevConfig    `mapstructure:"dev"`
-	Db     DbConfig     `mapstructure:"db"`
-	Thanos ThanosConfig `mapstructure:"thanos"`
-	Loki   LokiConfig   `mapstructure:"loki"`
+	Log            LogConfig            `mapstructure:"log"`
+	Web            WebConfig            `mapstructure:"web"`
+	Admin          AdminConfig          `mapstructure:"admin"`
+	Alert          AlertConfig          `mapstructure:"alert"`
+	Dev            DevConfig            `mapstructure:"dev"`
+	Db             DbConfig             `mapstructure:"db"`
+	Git            GitConfig            `mapstructure:"git"`
+	Namespaces     NamespacesConfig     `mapstructure:"namespaces"`
+	Thanos         ThanosConfig         `mapstructure:"thanos"`
+	Loki           LokiConfig           `mapstructure:"loki"`
+	Plugins        PluginConfig         `mapstructure:"plugins"`
+	LabelTransform LabelTransformConfig `mapstructure:"label_transform"`
+	AccessWindows  []AccessWindow       `mapstructure:"access_windows"`
+	Quotas         QuotasConfig         `mapstructure:"quotas"`
+	Preflight      PreflightConfig      `mapstructure:"preflight"`
+	LoadShedding   LoadSheddingConfig   `mapstructure:"load_shedding"`
+	Compression    CompressionConfig    `mapstructure:"compression"`
+	Violations     ViolationsConfig     `mapstructure:"violations"`
+	Lockout        LockoutConfig        `mapstructure:"lockout"`
+	ForwardAuth    ForwardAuthConfig    `mapstructure:"forward_auth"`
+	OIDC           OIDCConfig           `mapstructure:"oidc"`
+	// ResponseHeaders are applied to the responses of enforced routes in order, see ResponseHeaderPolicy.
+	ResponseHeaders []ResponseHeaderPolicy `mapstructure:"response_headers"`
+	IdentityHeaders IdentityHeadersConfig  `mapstructure:"identity_headers"`
+	// Suspensions restrict tenant labels by their value, see TenantSuspension.
+	Suspensions map[string]TenantSuspension `mapstructure:"suspensions"`
+	// SecurityEvents exports authentication and enforcement decisions, see SecurityEventsConfig.
+	SecurityEvents SecurityEventsConfig `mapstructure:"security_events"`
 }
 
-func (a *App) WithConfig() *App {
+// configPaths are the directories searched for config.yaml.
+var configPaths = []string{"/etc/config/config/", "./configs"}
+
+// newViper returns a viper instance that reads the named yaml file from the given directories.
+func newViper(name string, paths []string) *viper.Viper {
 	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
-	v.SetConfigName("config")
+	v.SetConfigName(name)
 	v.SetConfigType("yaml")
-	v.AddConfigPath("/etc/config/config/")
-	v.AddConfigPath("./configs")
+	for _, path := range paths {
+		v.AddConfigPath(path)
+	}
+	return v
+}
+
+// readConfig reads and unmarshals config.yaml from the given directories without watching it.
+func readConfig(paths []string) (*Config, error) {
+	v := newViper("config", paths)
+	if err := v.MergeInConfig(); err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := v.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// WithConfig reads config.yaml, exits if it fails checkConfig and watches it for changes, see reloadConfig.
+func (a *App) WithConfig() *App {
+	v := newViper("config", configPaths)
 	err := v.MergeInConfig()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error no config found")
 		return nil
 	}
-	a.Cfg = &Config{}
-	err = v.Unmarshal(a.Cfg)
+	cfg := &Config{}
+	err = v.Unmarshal(cfg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error while unmarshalling config file")
 	}
+	// the same checks as for reloads and the validate command, so boot and reload accept the same configs
+	if problems := checkConfig(cfg); len(problems) > 0 {
+		log.Fatal().Err(errors.Join(problems...)).Msg("Error invalid config")
+	}
+	a.setConfig(cfg)
 	v.OnConfigChange(func(e fsnotify.Event) {
 		log.Info().Str("file", e.Name).Msg("Config file changed")
-		err := v.Unmarshal(a.Cfg)
-		if err != nil {
-			log.Error().Err(err).Msg("Error while unmarshalling config file")
-			a.healthy = false
+		// reloaded like /-/reload, requests keep reading the active config until a valid one is swapped in
+		if err := a.reloadConfig(configPaths); err != nil {
+			log.Error().Err(err).Msg("Config reload failed, keeping the current config")
 		}
-		zerolog.SetGlobalLevel(zerolog.Level(a.Cfg.Log.Level))
 	})
 	v.WatchConfig()
-	zerolog.SetGlobalLevel(zerolog.Level(a.Cfg.Log.Level))
-	log.Debug().Any("config", a.Cfg).Msg("")
+	zerolog.SetGlobalLevel(zerolog.Level(a.Cfg().Log.Level))
+	log.Debug().Any("config", a.Cfg()).Msg("")
 	return a
 }
 
 func (a *App) WithSAT() *App {
-	if a.Cfg.Dev.Enabled {
-		a.ServiceAccountToken = a.Cfg.Web.ServiceAccountToken
+	if a.Cfg().Dev.Enabled {
+		a.ServiceAccountToken = a.Cfg().Web.ServiceAccountToken
 		return a
 	}
 	sa, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
@@ -135,6 +244,7 @@ func (a *App) WithSAT() *App {
 	return a
 }
 
+// WithTLSConfig loads the trusted CAs. The client certificates of the upstreams are loaded by WithUpstreamClients.
 func (a *App) WithTLSConfig() *App {
 	caCert, err := os.ReadFile("/etc/ssl/ca/ca-certificates.crt")
 	if err != nil {
@@ -148,8 +258,8 @@ func (a *App) WithTLSConfig() *App {
 	}
 	log.Debug().Any("rootCAs", rootCAs).Msg("")
 
-	if a.Cfg.Web.TrustedRootCaPath != "" {
-		err := filepath.Walk(a.Cfg.Web.TrustedRootCaPath, func(path string, info os.FileInfo, err error) error {
+	if a.Cfg().Web.TrustedRootCaPath != "" {
+		err := filepath.Walk(a.Cfg().Web.TrustedRootCaPath, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
@@ -173,50 +283,37 @@ func (a *App) WithTLSConfig() *App {
 		}
 	}
 
-	var certificates []tls.Certificate
-
-	lokiCert, err := tls.LoadX509KeyPair(a.Cfg.Loki.Cert, a.Cfg.Loki.Key)
-	if err != nil {
-		log.Error().Err(err).Msg("Error while loading loki certificate")
-	} else {
-		log.Debug().Str("path", a.Cfg.Loki.Cert).Msg("Adding Loki certificate")
-		certificates = append(certificates, lokiCert)
-	}
-
-	thanosCert, err := tls.LoadX509KeyPair(a.Cfg.Thanos.Cert, a.Cfg.Thanos.Key)
-	if err != nil {
-		log.Error().Err(err).Msg("Error while loading thanos certificate")
-	} else {
-		log.Debug().Str("path", a.Cfg.Thanos.Cert).Msg("Adding Thanos certificate")
-		certificates = append(certificates, thanosCert)
-	}
-
-	config := &tls.Config{
-		InsecureSkipVerify: a.Cfg.Web.TLSVerifySkip,
+	a.TlS = &tls.Config{
+		InsecureSkipVerify: a.Cfg().Web.TLSVerifySkip,
 		RootCAs:            rootCAs,
-		Certificates:       certificates,
 	}
-
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = config
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = a.TlS
+	a.client = &http.Client{Transport: transport}
 	return a
 }
 
+// WithJWKS loads the keys tokens are validated with. Without a JWKS URL, forward-auth is the only authentication.
 func (a *App) WithJWKS() *App {
+	if a.Cfg().Web.JwksCertURL == "" && a.Cfg().ForwardAuth.Enabled {
+		log.Info().Msg("No JWKS URL configured, only forward-auth requests are authenticated")
+		return a
+	}
 	log.Info().Msg("Init JWKS config")
-	urls := []string{a.Cfg.Web.JwksCertURL}
-	if a.Cfg.Alert.Enabled {
-		urls = []string{a.Cfg.Web.JwksCertURL, a.Cfg.Alert.CertURL}
+	urls := []string{a.Cfg().Web.JwksCertURL}
+	if a.Cfg().Alert.Enabled {
+		urls = []string{a.Cfg().Web.JwksCertURL, a.Cfg().Alert.CertURL}
 	}
 	var cert json.RawMessage
 	cert = nil
-	if a.Cfg.Alert.Cert != "" {
-		cert = json.RawMessage(a.Cfg.Alert.Cert)
+	if a.Cfg().Alert.Cert != "" {
+		cert = json.RawMessage(a.Cfg().Alert.Cert)
 	}
-	jwks, err := NewCombinedJwks(context.Background(), urls, cert)
+	jwks, err := NewCombinedJwks(context.Background(), urls, cert, JwksCache{Path: a.Cfg().Web.JwksCachePath}, a.httpClient())
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create a keyfunc from the server's URL")
 	}
-	log.Info().Str("url", a.Cfg.Web.JwksCertURL).Msg("JWKS URL")
+	log.Info().Str("url", a.Cfg().Web.JwksCertURL).Msg("JWKS URL")
 	a.Jwks = jwks
 	return a
 }
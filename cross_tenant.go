@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/log"
+)
+
+// Cross-tenant policies for binary expressions between vectors, configured as thanos.cross_tenant_policy.
+const (
+	crossTenantAllow = "allow"
+	crossTenantWarn  = "warn"
+	crossTenantDeny  = "deny"
+)
+
+var crossTenantQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_cross_tenant_queries_total",
+	Help: "Number of enforced queries with binary expressions whose operands span several tenants, by policy applied.",
+}, []string{"policy"})
+
+// checkCrossTenant applies the cross-tenant policy to an enforced expression. A binary expression
+// between two vectors, including group_left and group_right joins, is cross-tenant if its
+// operands together select more than one value of the tenant label. With the deny policy such
+// queries are rejected, with the warn policy they are logged and counted.
+func checkCrossTenant(expr parser.Expr, labelMatch string, policy string) error {
+	if policy == "" || policy == crossTenantAllow {
+		return nil
+	}
+	var spanning []string
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		binary, ok := node.(*parser.BinaryExpr)
+		if !ok || binary.LHS.Type() == parser.ValueTypeScalar || binary.RHS.Type() == parser.ValueTypeScalar {
+			return nil
+		}
+		tenants := selectedTenants(binary.LHS, labelMatch)
+		for tenant := range selectedTenants(binary.RHS, labelMatch) {
+			tenants[tenant] = true
+		}
+		if len(tenants) > 1 {
+			values := MapKeysToArray(tenants)
+			sort.Strings(values)
+			spanning = values
+		}
+		return nil
+	})
+	if spanning == nil {
+		return nil
+	}
+
+	crossTenantQueries.WithLabelValues(policy).Inc()
+	if policy == crossTenantDeny {
+		return fmt.Errorf("binary expressions across tenants are not allowed, operands span %s", strings.Join(spanning, ", "))
+	}
+	log.Warn().Str("query", expr.String()).Strs("tenants", spanning).Msg("Query combines several tenants in a binary expression")
+	return nil
+}
+
+// selectedTenants returns the values of the tenant label selected by the vector selectors of the expression.
+func selectedTenants(expr parser.Expr, labelMatch string) map[string]bool {
+	tenants := map[string]bool{}
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		for _, m := range vector.LabelMatchers {
+			if m.Name == labelMatch && (m.Type == labels.MatchEqual || m.Type == labels.MatchRegexp) {
+				for _, v := range strings.Split(m.Value, "|") {
+					tenants[v] = true
+				}
+			}
+		}
+		return nil
+	})
+	return tenants
+}
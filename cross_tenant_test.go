@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrossTenantPolicy(t *testing.T) {
+	tenants := map[string]bool{"a": true, "b": true}
+	tests := []struct {
+		name    string
+		policy  string
+		query   string
+		labels  map[string]bool
+		wantErr bool
+	}{
+		{name: "allow", policy: crossTenantAllow, query: `sum(rate(x{namespace="a"}[5m])) / sum(rate(y[5m]))`, labels: tenants},
+		{name: "deny ratio", policy: crossTenantDeny, query: `sum(rate(x[5m])) / sum(rate(y[5m]))`, labels: tenants, wantErr: true},
+		{name: "deny ratio restricted by query", policy: crossTenantDeny, query: `sum(rate(x{namespace="a"}[5m])) / sum(rate(y[5m]))`, labels: tenants},
+		{name: "deny group_left", policy: crossTenantDeny, query: `x * on(pod) group_left(node) kube_pod_info`, labels: tenants, wantErr: true},
+		{name: "deny tenant subset", policy: crossTenantDeny, query: `x{namespace=~"a|b"} / y`, labels: map[string]bool{"a": true, "b": true, "c": true}, wantErr: true},
+		{name: "deny same tenant", policy: crossTenantDeny, query: `x{namespace="a"} / y{namespace="a"}`, labels: tenants},
+		{name: "deny single tenant user", policy: crossTenantDeny, query: `sum(x) / sum(y)`, labels: map[string]bool{"a": true}},
+		{name: "deny scalar operand", policy: crossTenantDeny, query: `sum(x) / 2`, labels: tenants},
+		{name: "deny no binary expression", policy: crossTenantDeny, query: `sum(rate(x[5m]))`, labels: tenants},
+		{name: "warn", policy: crossTenantWarn, query: `x / y`, labels: tenants},
+		{name: "deny grants", policy: crossTenantDeny, query: `x{cluster="c"} / y{cluster="d"}`, labels: map[string]bool{`cluster="c",namespace="a"`: true, `cluster="d",namespace="b"`: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := PromQLEnforcer{CrossTenantPolicy: tt.policy}.Enforce(tt.query, tt.labels, "namespace")
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "binary expressions across tenants are not allowed")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// EnforcePreview is the response of the /debug/enforce endpoint.
+type EnforcePreview struct {
+	User     string   `json:"user"`
+	Language string   `json:"language"`
+	Query    string   `json:"query"`
+	Labels   []string `json:"labels"`
+	// ProviderLabels are the labels as returned by the label store, before label_transform was applied.
+	ProviderLabels []string `json:"provider_labels,omitempty"`
+	Skip           bool     `json:"skip"`
+	Enforced       string   `json:"enforced,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// enforcePreview answers with the enforced version of the given query and the tenant labels it was
+// enforced with, without forwarding anything upstream. The caller has to be authenticated.
+// Admins may pass a username and groups to preview the enforcement for another user.
+func (a *App) enforcePreview(w http.ResponseWriter, r *http.Request) {
+	cfg := a.Cfg()
+	oauthToken, err := getToken(r, cfg, a)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+
+	query := r.FormValue("query")
+	language := r.FormValue("language")
+	username := r.FormValue("username")
+	var groups []string
+	for _, value := range r.Form["groups"] {
+		for _, group := range strings.Split(value, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	enforcer, ok := a.enforcers[language]
+	if !ok {
+		logAndWriteError(w, http.StatusBadRequest, nil, fmt.Sprintf("unknown query language %q", language))
+		return
+	}
+	tl := cfg.Thanos.TenantLabel
+	if language == "logql" {
+		tl = cfg.Loki.TenantLabel
+	}
+
+	if (username != "" && username != oauthToken.PreferredUsername) || len(groups) > 0 {
+		if !inAnyGroup(oauthToken, []string{cfg.Admin.Group}) {
+			logAndWriteError(w, http.StatusForbidden, nil, "only admins may preview the enforcement of other users")
+			return
+		}
+		if username == "" {
+			username = oauthToken.PreferredUsername
+		}
+		requestLogger(r).Info().Str("user", oauthToken.PreferredUsername).Str("impersonated", username).
+			Strs("groups", groups).Msg("Enforcement preview for other user")
+		oauthToken = OAuthToken{PreferredUsername: username, Groups: groups}
+	}
+
+	preview := EnforcePreview{
+		User:     oauthToken.PreferredUsername,
+		Language: language,
+		Query:    query,
+	}
+	labels, skip, err := validateLabels(oauthToken, cfg, a)
+	if err != nil {
+		preview.Error = err.Error()
+	} else {
+		preview.Skip = skip
+		preview.Labels = MapKeysToArray(labels)
+		sort.Strings(preview.Labels)
+		if cfg.LabelTransform.enabled() {
+			for _, l := range preview.Labels {
+				preview.ProviderLabels = append(preview.ProviderLabels, cfg.LabelTransform.Invert(l))
+			}
+		}
+		if skip {
+			preview.Enforced = query
+		} else if preview.Enforced, err = cfg.LabelTransform.enforcer(enforcer, language).Enforce(query, labels, tl); err != nil {
+			preview.Error = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(preview); err != nil {
+		requestLogger(r).Error().Err(err).Msg("Error while writing enforcement preview")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforcePreview(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg().Admin.Group = "admins"
+	app.WithRoutes()
+
+	cases := []struct {
+		name           string
+		token          string
+		params         url.Values
+		expectedStatus int
+		expected       EnforcePreview
+	}{
+		{
+			name:           "PromQL_query_of_own_user",
+			token:          tokens["userTenant"],
+			params:         url.Values{"query": {"rate(http_requests_total{tenant_id=\"allowed_user\"}[5m])"}, "language": {"promql"}},
+			expectedStatus: http.StatusOK,
+			expected: EnforcePreview{
+				User:     "user",
+				Language: "promql",
+				Query:    "rate(http_requests_total{tenant_id=\"allowed_user\"}[5m])",
+				Labels:   []string{"allowed_user", "also_allowed_user"},
+				Enforced: "rate(http_requests_total{tenant_id=\"allowed_user\"}[5m])",
+			},
+		},
+		{
+			name:           "LogQL_query_with_forbidden_tenant",
+			token:          tokens["groupTenant"],
+			params:         url.Values{"query": {"{tenant_id=\"forbidden\"}"}, "language": {"logql"}},
+			expectedStatus: http.StatusOK,
+			expected: EnforcePreview{
+				User:     "not-a-user",
+				Language: "logql",
+				Query:    "{tenant_id=\"forbidden\"}",
+				Labels:   []string{"allowed_group1", "also_allowed_group1"},
+				Error:    "unauthorized label forbidden",
+			},
+		},
+		{
+			name:           "Admin_previews_other_user",
+			token:          tokens["adminUserToken"],
+			params:         url.Values{"query": {"up{tenant_id=\"allowed_user\"}"}, "language": {"promql"}, "username": {"user"}},
+			expectedStatus: http.StatusOK,
+			expected: EnforcePreview{
+				User:     "user",
+				Language: "promql",
+				Query:    "up{tenant_id=\"allowed_user\"}",
+				Labels:   []string{"allowed_user", "also_allowed_user"},
+				Enforced: "up{tenant_id=\"allowed_user\"}",
+			},
+		},
+		{
+			name:           "Admin_previews_other_user_with_groups",
+			token:          tokens["adminUserToken"],
+			params:         url.Values{"query": {"{tenant_id=\"allowed_group1\"}"}, "language": {"logql"}, "username": {"not-a-user"}, "groups": {"group1"}},
+			expectedStatus: http.StatusOK,
+			expected: EnforcePreview{
+				User:     "not-a-user",
+				Language: "logql",
+				Query:    "{tenant_id=\"allowed_group1\"}",
+				Labels:   []string{"allowed_group1", "also_allowed_group1"},
+				Enforced: "{tenant_id=\"allowed_group1\"}",
+			},
+		},
+		{
+			name:           "Non_admin_previews_other_groups",
+			token:          tokens["userTenant"],
+			params:         url.Values{"query": {"up"}, "language": {"promql"}, "groups": {"group1"}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Non_admin_previews_other_user",
+			token:          tokens["groupTenant"],
+			params:         url.Values{"query": {"up"}, "language": {"promql"}, "username": {"user"}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Unknown_language",
+			token:          tokens["userTenant"],
+			params:         url.Values{"query": {"up"}, "language": {"sql"}},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/debug/enforce?"+tc.params.Encode(), nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			var preview EnforcePreview
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &preview))
+			assert.Equal(t, tc.expected, preview)
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DiscoveryConfig resolves the endpoints of an upstream from DNS instead of connecting to its URL's host.
+type DiscoveryConfig struct {
+	// Mode is dns to use all addresses of the URL's host, e.g. a headless Kubernetes service, or srv to use
+	// the targets of the SRV record named by the URL's host. Empty disables discovery.
+	Mode string `mapstructure:"mode"`
+	// Interval is how often the endpoints are resolved again, defaults to 30s.
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+const (
+	discoveryDNS = "dns"
+	discoverySRV = "srv"
+)
+
+// dnsResolver looks up the endpoints of upstreams with discovery, it is implemented by net.Resolver.
+type dnsResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error)
+}
+
+// endpointResolver holds the discovered endpoints of an upstream and hands them out round-robin.
+// The endpoints are looked up with dns, nil uses net.DefaultResolver.
+type endpointResolver struct {
+	name string
+	mode string
+	host string
+	port string
+	dns  dnsResolver
+
+	mu        sync.RWMutex
+	endpoints []string
+	next      atomic.Uint64
+}
+
+// resolve looks up the endpoints and reports whether they changed.
+func (r *endpointResolver) resolve(ctx context.Context) (bool, error) {
+	var endpoints []string
+	var dns dnsResolver = net.DefaultResolver
+	if r.dns != nil {
+		dns = r.dns
+	}
+	switch r.mode {
+	case discoveryDNS:
+		addrs, err := dns.LookupHost(ctx, r.host)
+		if err != nil {
+			return false, err
+		}
+		for _, addr := range addrs {
+			endpoints = append(endpoints, net.JoinHostPort(addr, r.port))
+		}
+	case discoverySRV:
+		_, records, err := dns.LookupSRV(ctx, "", "", r.host)
+		if err != nil {
+			return false, err
+		}
+		for _, srv := range records {
+			endpoints = append(endpoints, net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port))))
+		}
+	default:
+		return false, fmt.Errorf("unknown discovery mode %q", r.mode)
+	}
+	if len(endpoints) == 0 {
+		return false, fmt.Errorf("no endpoints found for %s", r.host)
+	}
+	slices.Sort(endpoints)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := !slices.Equal(r.endpoints, endpoints)
+	r.endpoints = endpoints
+	return changed, nil
+}
+
+// pick returns the next endpoint, or an empty string if none were discovered yet.
+func (r *endpointResolver) pick() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.endpoints) == 0 {
+		return ""
+	}
+	return r.endpoints[(r.next.Add(1)-1)%uint64(len(r.endpoints))]
+}
+
+// discoveryDialer dials one of the discovered endpoints for connections to an upstream with discovery.
+// Requests keep the URL's host for the Host header and TLS verification.
+type discoveryDialer struct {
+	resolvers map[string]*endpointResolver
+	dial      func(ctx context.Context, network string, addr string) (net.Conn, error)
+}
+
+func (d *discoveryDialer) dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d.dial(ctx, network, addr)
+	}
+	if r, ok := d.resolvers[host]; ok {
+		if endpoint := r.pick(); endpoint != "" {
+			log.Trace().Str("upstream", r.name).Str("endpoint", endpoint).Msg("Dialing discovered endpoint")
+			return d.dial(ctx, network, endpoint)
+		}
+	}
+	return d.dial(ctx, network, addr)
+}
+
+// WithDiscovery resolves the endpoints of upstreams with discovery and distributes new connections across them.
+// The endpoints are resolved again on the interval, idle connections of the upstream are closed when they change
+// so that new endpoints receive requests. The endpoints are looked up with the resolver of the App, nil uses
+// net.DefaultResolver.
+func (a *App) WithDiscovery() *App {
+	for name, upstream := range map[string]struct {
+		url       string
+		discovery DiscoveryConfig
+	}{
+		"thanos": {a.Cfg().Thanos.URL, a.Cfg().Thanos.Discovery},
+		"loki":   {a.Cfg().Loki.URL, a.Cfg().Loki.Discovery},
+	} {
+		client := a.upstreams.byName[name]
+		if upstream.url == "" || upstream.discovery.Mode == "" || client == nil {
+			continue
+		}
+		upstreamURL, err := url.Parse(upstream.url)
+		if err != nil {
+			log.Fatal().Err(err).Str("url", upstream.url).Msg("Error parsing URL")
+		}
+		r := &endpointResolver{name: name, mode: upstream.discovery.Mode, host: upstreamURL.Hostname(), port: upstreamURL.Port(), dns: a.dns}
+		if r.port == "" {
+			r.port = "80"
+			if upstreamURL.Scheme == "https" {
+				r.port = "443"
+			}
+		}
+		if _, err := r.resolve(context.Background()); err != nil {
+			log.Error().Err(err).Str("upstream", name).Msg("Error discovering upstream endpoints")
+		}
+		log.Info().Str("upstream", name).Strs("endpoints", r.endpoints).Msg("Discovered upstream endpoints")
+		transport := client.transport
+		d := &discoveryDialer{resolvers: map[string]*endpointResolver{r.host: r}, dial: transport.DialContext}
+		transport.DialContext = d.dialContext
+
+		interval := upstream.discovery.Interval
+		if interval <= 0 {
+			interval = 30 * time.Second
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				changed, err := r.resolve(context.Background())
+				if err != nil {
+					log.Error().Err(err).Str("upstream", r.name).Msg("Error discovering upstream endpoints, keeping the previous ones")
+					continue
+				}
+				if changed {
+					log.Info().Str("upstream", r.name).Strs("endpoints", r.endpoints).Msg("Upstream endpoints changed")
+					transport.CloseIdleConnections()
+				}
+			}
+		}()
+	}
+	return a
+}
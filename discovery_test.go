@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDNS answers lookups from its records, keyed by the host or the SRV record name.
+type fakeDNS struct {
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (f *fakeDNS) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, ok := f.hosts[host]
+	if !ok {
+		return nil, errors.New("unknown host")
+	}
+	return addrs, nil
+}
+
+func (f *fakeDNS) LookupSRV(_ context.Context, _ string, _ string, name string) (string, []*net.SRV, error) {
+	records, ok := f.srv[name]
+	if !ok {
+		return "", nil, errors.New("unknown record")
+	}
+	return name, records, nil
+}
+
+func TestEndpointResolver(t *testing.T) {
+	dns := &fakeDNS{hosts: map[string][]string{"loki-querier-headless": {"10.0.0.2", "10.0.0.1"}}}
+	r := &endpointResolver{mode: discoveryDNS, host: "loki-querier-headless", port: "3100", dns: dns}
+	assert.Equal(t, "", r.pick())
+	changed, err := r.resolve(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{"10.0.0.1:3100", "10.0.0.2:3100", "10.0.0.1:3100"}, []string{r.pick(), r.pick(), r.pick()})
+
+	changed, err = r.resolve(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	dns.hosts["loki-querier-headless"] = nil
+	_, err = r.resolve(context.Background())
+	assert.ErrorContains(t, err, "no endpoints found")
+	assert.Equal(t, "10.0.0.2:3100", r.pick(), "the previous endpoints are kept")
+}
+
+func TestDiscoveryDialer(t *testing.T) {
+	hits := map[string]int{}
+	var hosts []string
+	var servers []*httptest.Server
+	var records []*net.SRV
+	for _, name := range []string{"a", "b"} {
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts = append(hosts, r.Host)
+			hits[name]++
+		}))
+		t.Cleanup(srv.Close)
+		servers = append(servers, srv)
+		u, _ := url.Parse(srv.URL)
+		port, _ := strconv.Atoi(u.Port())
+		records = append(records, &net.SRV{Target: "127.0.0.1", Port: uint16(port)})
+	}
+	dns := &fakeDNS{srv: map[string][]*net.SRV{"_http._tcp.loki.example": records}}
+
+	r := &endpointResolver{mode: discoverySRV, host: "_http._tcp.loki.example", port: "80", dns: dns}
+	_, err := r.resolve(context.Background())
+	assert.NoError(t, err)
+	d := &discoveryDialer{resolvers: map[string]*endpointResolver{r.host: r}, dial: (&net.Dialer{}).DialContext}
+	client := &http.Client{Transport: &http.Transport{DialContext: d.dialContext, DisableKeepAlives: true}}
+
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get("http://_http._tcp.loki.example/ready")
+		assert.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, hits)
+	for _, host := range hosts {
+		assert.Equal(t, "_http._tcp.loki.example", host, "the host of the upstream URL is kept")
+	}
+
+	resp, err := client.Get(servers[0].URL)
+	assert.NoError(t, err, "hosts without discovery are dialed directly")
+	_ = resp.Body.Close()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/maps"
+)
+
+var dryRunDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_dry_run_decisions_total",
+	Help: "Number of requests evaluated in dry-run mode, partitioned by the decision that would have been taken.",
+}, []string{"decision", "reason"})
+
+// dryRunEvaluate runs label resolution and enforcement on a copy of the request of an authenticated
+// user and logs and counts the decision. The original request is left untouched so that it can be
+// forwarded to the upstream unmodified. Authentication is not part of the dry run, requests without
+// a valid token are rejected before.
+func dryRunEvaluate(r *http.Request, oauthToken OAuthToken, matchWord string, enforcer EnforceQL, tl string, cfg *Config, a *App) {
+	shadow := r.Clone(r.Context())
+	shadow.Body = io.NopCloser(bytes.NewReader(readBody(r)))
+	if shadow.Method == http.MethodPost {
+		_ = shadow.ParseForm()
+	}
+
+	event := requestLogger(r).Info().Bool("dry_run", true).Str("path", r.URL.Path).Str("original", queryParam(shadow, matchWord)).
+		Str("user", oauthToken.PreferredUsername)
+
+	labels, skip, err := validateLabels(oauthToken, cfg, a)
+	if err != nil {
+		dryRunDecisions.WithLabelValues("deny", "labels").Inc()
+		event.Err(err).Str("decision", "deny").Str("reason", "labels").Msg("Request would be denied")
+		return
+	}
+	if skip {
+		dryRunDecisions.WithLabelValues("skip", "").Inc()
+		event.Str("decision", "skip").Msg("Request would skip enforcement")
+		return
+	}
+	event = event.Strs("labels", maps.Keys(labels))
+
+	err = enforceRequest(shadow, enforcer, labels, tl, matchWord)
+	if err != nil {
+		dryRunDecisions.WithLabelValues("deny", "enforcement").Inc()
+		event.Err(err).Str("decision", "deny").Str("reason", "enforcement").Msg("Request would be denied")
+		return
+	}
+	dryRunDecisions.WithLabelValues("allow", "").Inc()
+	event.Str("decision", "allow").Str("enforced", queryParam(shadow, matchWord)).Msg("Request would be rewritten")
+}
+
+// queryParam returns the value of the given parameter from the URL query or, for POST requests, from the form body.
+func queryParam(r *http.Request, name string) string {
+	if r.Method == http.MethodPost && r.PostForm != nil {
+		return r.PostForm.Get(name)
+	}
+	return r.URL.Query().Get(name)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg().Web.DryRun = true
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, r.URL.Query().Get("query"))
+	}))
+	defer upstream.Close()
+	app.Cfg().Thanos.URL = upstream.URL
+	app.WithRoutes()
+
+	cases := []struct {
+		name          string
+		authorization string
+		query         string
+		status        int
+	}{
+		{
+			name:   "Missing_token",
+			query:  "up",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:          "Forbidden_tenant",
+			authorization: "Bearer " + tokens["groupTenant"],
+			query:         "up{tenant_id=\"forbidden_tenant\"}",
+			status:        http.StatusOK,
+		},
+		{
+			name:          "Allowed_query_is_not_rewritten",
+			authorization: "Bearer " + tokens["groupTenant"],
+			query:         "up",
+			status:        http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(tc.query), nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.status, rr.Code)
+			if tc.status == http.StatusOK {
+				assert.Equal(t, tc.query, rr.Body.String())
+			}
+		})
+	}
+}
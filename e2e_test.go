@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gepaplexx/multena-proxy/internal/mockupstream"
+)
+
+// e2eEnv is a fully wired App in front of mock Thanos and Loki upstreams.
+type e2eEnv struct {
+	App    *App
+	Thanos *mockupstream.Server
+	Loki   *mockupstream.Server
+	Tokens map[string]string
+}
+
+func newE2EEnv(t *testing.T) *e2eEnv {
+	t.Helper()
+	app, tokens := setupTestMain()
+	thanos := mockupstream.NewThanos()
+	loki := mockupstream.NewLoki()
+	t.Cleanup(thanos.Close)
+	t.Cleanup(loki.Close)
+
+	app.Cfg().Thanos.URL = thanos.URL
+	app.Cfg().Loki.URL = loki.URL
+	app.Cfg().Admin.Group = "admins"
+	app.ServiceAccountToken = "service-account-token"
+	app.WithRoutes()
+	return &e2eEnv{App: app, Thanos: thanos, Loki: loki, Tokens: tokens}
+}
+
+// do sends a request through the proxy router. A non-empty body is sent form encoded.
+func (e *e2eEnv) do(method string, target string, token string, body string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body != "" {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.Tokens[token])
+	}
+	rr := httptest.NewRecorder()
+	e.App.e.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestE2E_ThanosQueryIsEnforced(t *testing.T) {
+	env := newE2EEnv(t)
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(`sum(rate(http_requests_total[5m]))`), "groupTenant", "")
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"success","data":{"resultType":"vector","result":[]}}`, rr.Body.String())
+	req, ok := env.Thanos.LastRequest()
+	assert.True(t, ok)
+	assert.Equal(t, "/api/v1/query", req.Path)
+	assert.Contains(t, req.Params.Get("query"), `tenant_id=~"`)
+	assert.Contains(t, req.Params.Get("query"), "allowed_group1")
+	assert.Equal(t, "Bearer service-account-token", req.Header.Get("Authorization"))
+}
+
+func TestE2E_LokiPostQueryIsEnforced(t *testing.T) {
+	env := newE2EEnv(t)
+
+	form := url.Values{"query": {`{app="grafana"} |= "error"`}, "limit": {"100"}}
+	rr := env.do(http.MethodPost, "/loki/api/v1/query_range", "userTenant", form.Encode())
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, ok := env.Loki.LastRequest()
+	assert.True(t, ok)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "/loki/api/v1/query_range", req.Path)
+	assert.Contains(t, req.Params.Get("query"), `app="grafana"`)
+	assert.Contains(t, req.Params.Get("query"), `tenant_id=~"`)
+	assert.Equal(t, "100", req.Params.Get("limit"))
+	assert.Equal(t, "application", req.Header.Get("X-Scope-OrgID"))
+}
+
+func TestE2E_ForbiddenTenantNeverReachesUpstream(t *testing.T) {
+	env := newE2EEnv(t)
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(`up{tenant_id="forbidden_tenant"}`), "groupTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = env.do(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{tenant_id="forbidden_tenant"}`), "groupTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	assert.Empty(t, env.Thanos.Requests())
+	assert.Empty(t, env.Loki.Requests())
+}
+
+func TestE2E_RepeatedMatchersAreAllEnforced(t *testing.T) {
+	env := newE2EEnv(t)
+	target := "/api/v1/series?" + url.Values{"match[]": {"up", `node_load1{tenant_id="forbidden_tenant"}`}}.Encode()
+
+	rr := env.do(http.MethodGet, target, "userTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code, "every occurrence is enforced")
+	assert.Empty(t, env.Thanos.Requests())
+
+	rr = env.do(http.MethodGet, "/api/v1/series?"+url.Values{"match[]": {"up", "node_load1"}}.Encode(), "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ := env.Thanos.LastRequest()
+	matchers := req.Params["match[]"]
+	assert.Len(t, matchers, 2)
+	for _, m := range matchers {
+		assert.Contains(t, m, "tenant_id")
+	}
+
+	rr = env.do(http.MethodPost, "/api/v1/labels", "userTenant", url.Values{"match[]": {"up", "node_load1"}}.Encode())
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ = env.Thanos.LastRequest()
+	assert.Len(t, req.Params["match[]"], 2)
+
+	rr = env.do(http.MethodGet, "/api/v1/labels", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ = env.Thanos.LastRequest()
+	assert.Len(t, req.Params["match[]"], 1)
+	assert.Regexp(t, `^\{tenant_id=~"(allowed_user\|also_allowed_user|also_allowed_user\|allowed_user)"\}$`, req.Params.Get("match[]"), "requests without matchers are restricted to the tenants")
+}
+
+func TestE2E_AdminBypassesEnforcement(t *testing.T) {
+	env := newE2EEnv(t)
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "adminUserToken", "")
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, ok := env.Thanos.LastRequest()
+	assert.True(t, ok)
+	assert.Equal(t, "up", req.Params.Get("query"))
+}
+
+func TestE2E_UpstreamErrorsArePassedThrough(t *testing.T) {
+	env := newE2EEnv(t)
+	env.Thanos.SetResponse("/api/v1/query", http.StatusUnprocessableEntity, `{"status":"error","errorType":"execution","error":"query timed out"}`)
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.JSONEq(t, `{"status":"error","errorType":"execution","error":"query timed out"}`, rr.Body.String())
+}
+
+func TestE2E_ErrorsUsePrometheusEnvelope(t *testing.T) {
+	env := newE2EEnv(t)
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status":"error","errorType":"unauthorized","error":"no Authorization header found"}`, rr.Body.String())
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "noTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.JSONEq(t, `{"status":"error","errorType":"forbidden","error":"no tenant labels found"}`, rr.Body.String())
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query="+url.QueryEscape("sum(up"), "userTenant", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"errorType":"bad_data"`)
+	assert.Empty(t, env.Thanos.Requests())
+}
+
+func TestE2E_ExemptRoutesAreOnlyAuthenticated(t *testing.T) {
+	env := newE2EEnv(t)
+
+	for _, target := range []string{"/api/v1/status/buildinfo", "/api/v1/status/runtimeinfo", "/loki/api/v1/status/buildinfo", "/ready"} {
+		rr := env.do(http.MethodGet, target, "noTenant", "")
+		assert.Equal(t, http.StatusOK, rr.Code, target)
+	}
+	req, ok := env.Thanos.LastRequest()
+	assert.True(t, ok)
+	assert.Empty(t, req.Params.Get("query"))
+
+	rr := env.do(http.MethodGet, "/api/v1/status/buildinfo", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "noTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestE2E_RouteMethods(t *testing.T) {
+	env := newE2EEnv(t)
+
+	rr := env.do(http.MethodHead, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, ok := env.Thanos.LastRequest()
+	assert.True(t, ok)
+	assert.Equal(t, http.MethodGet, req.Method)
+	assert.Contains(t, req.Params.Get("query"), `tenant_id=~"`)
+
+	for _, method := range []string{http.MethodPut, http.MethodOptions, http.MethodDelete} {
+		rr = env.do(method, "/api/v1/query?query=up", "userTenant", "")
+		assert.Equal(t, http.StatusMethodNotAllowed, rr.Code, method)
+		assert.Equal(t, "GET, HEAD, POST", rr.Header().Get("Allow"), method)
+		assert.Contains(t, rr.Body.String(), `"status":"error"`, method)
+	}
+	assert.Len(t, env.Thanos.Requests(), 1)
+	rr = env.do(http.MethodPut, "/api/v1/unknown", "userTenant", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	env.App.Cfg().Loki.RouteMethods = map[string][]string{"/api/v1/query_range": {"get"}}
+	env.App.WithRoutes()
+	rr = env.do(http.MethodPost, "/loki/api/v1/query_range", "userTenant", "query="+url.QueryEscape(`{app="a"}`))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET", rr.Header().Get("Allow"))
+	rr = env.do(http.MethodGet, "/loki/api/v1/query_range?query="+url.QueryEscape(`{app="a"}`), "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
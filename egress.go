@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// EgressProxyConfig is the forward proxy requests to an upstream are sent through.
+type EgressProxyConfig struct {
+	// URL of the proxy, e.g. http://proxy.corp:3128. Empty uses the proxy of the process environment.
+	URL string `mapstructure:"url"`
+	// NoProxy are hosts, domains and CIDRs reached directly, in the format of the NO_PROXY variable.
+	NoProxy []string `mapstructure:"no_proxy"`
+	// User and the password read from PasswordPath authenticate at the proxy.
+	User         string `mapstructure:"user"`
+	PasswordPath string `mapstructure:"password_path"`
+}
+
+// proxyFunc returns the function selecting the proxy for a request, or nil if no proxy is configured.
+func (c EgressProxyConfig) proxyFunc() (func(*url.URL) (*url.URL, error), error) {
+	if c.URL == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	if c.User != "" {
+		password, err := os.ReadFile(c.PasswordPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read proxy password: %w", err)
+		}
+		proxyURL.User = url.UserPassword(c.User, strings.TrimSpace(string(password)))
+	}
+	cfg := httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    strings.Join(c.NoProxy, ","),
+	}
+	return cfg.ProxyFunc(), nil
+}
+
+// WithEgressProxies routes the requests to each upstream through its configured egress proxy. Upstreams
+// without a configured proxy use the proxy of the process environment, as before.
+func (a *App) WithEgressProxies() *App {
+	for name, proxyConfig := range map[string]EgressProxyConfig{
+		"thanos": a.Cfg().Thanos.Proxy,
+		"loki":   a.Cfg().Loki.Proxy,
+	} {
+		client := a.upstreams.byName[name]
+		if client == nil || proxyConfig.URL == "" {
+			continue
+		}
+		proxy, err := proxyConfig.proxyFunc()
+		if err != nil {
+			log.Fatal().Err(err).Str("upstream", name).Msg("Error configuring egress proxy")
+		}
+		log.Info().Str("upstream", name).Str("proxy", redactedURL(proxyConfig.URL)).Msg("Using egress proxy")
+		client.transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			return proxy(r.URL)
+		}
+	}
+	return a
+}
+
+// redactedURL returns the URL with its password removed, for logging.
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
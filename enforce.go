@@ -4,9 +4,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
-
-	"github.com/rs/zerolog/log"
 )
 
 // EnforceQL represents an interface that any query language enforcement should implement.
@@ -31,17 +30,15 @@ func enforceRequest(r *http.Request, enforce EnforceQL, tenantLabels map[string]
 // enforceGet enforces the query parameters of the incoming GET HTTP request.
 // It modifies the request URL's query parameters to ensure they adhere to tenant labels and label match.
 func enforceGet(r *http.Request, enforce EnforceQL, tenantLabels map[string]bool, labelMatch string, queryMatch string) error {
-	log.Trace().Str("kind", "urlmatch").Str("queryMatch", queryMatch).Str("query", r.URL.Query().Get("query")).Str("match[]", r.URL.Query().Get("match[]")).Msg("")
+	requestLogger(r).Trace().Str("kind", "urlmatch").Str("queryMatch", queryMatch).Str("query", r.URL.Query().Get("query")).Str("match[]", r.URL.Query().Get("match[]")).Msg("")
 
-	query, err := enforce.Enforce(r.URL.Query().Get(queryMatch), tenantLabels, labelMatch)
-	if err != nil {
+	requestLogger(r).Trace().Any("url", r.URL).Msg("pre enforced url")
+	values := r.URL.Query()
+	if err := enforceValues(values, enforce, tenantLabels, labelMatch, queryMatch); err != nil {
 		return err
 	}
-	log.Trace().Any("url", r.URL).Msg("pre enforced url")
-	values := r.URL.Query()
-	values.Set(queryMatch, query)
 	r.URL.RawQuery = values.Encode()
-	log.Trace().Any("url", r.URL).Msg("post enforced url")
+	requestLogger(r).Trace().Any("url", r.URL).Msg("post enforced url")
 
 	r.Body = io.NopCloser(strings.NewReader(""))
 	r.ContentLength = 0
@@ -52,21 +49,56 @@ func enforceGet(r *http.Request, enforce EnforceQL, tenantLabels map[string]bool
 // It modifies the request's form values to ensure they adhere to tenant labels and label match.
 func enforcePost(r *http.Request, enforce EnforceQL, tenantLabels map[string]bool, labelMatch string, queryMatch string) error {
 	if err := r.ParseForm(); err != nil {
-		return err
+		return badQueryError{err}
 	}
-	log.Trace().Str("kind", "bodymatch").Str("queryMatch", queryMatch).Str("query", r.PostForm.Get("query")).Str("match[]", r.PostForm.Get("match[]")).Msg("")
+	requestLogger(r).Trace().Str("kind", "bodymatch").Str("queryMatch", queryMatch).Str("query", r.PostForm.Get("query")).Str("match[]", r.PostForm.Get("match[]")).Msg("")
 
-	query := r.PostForm.Get(queryMatch)
-	query, err := enforce.Enforce(query, tenantLabels, labelMatch)
-	if err != nil {
+	if err := enforceValues(r.PostForm, enforce, tenantLabels, labelMatch, queryMatch); err != nil {
 		return err
 	}
 
 	_ = r.Body.Close()
-	r.PostForm.Set(queryMatch, query)
 	newBody := r.PostForm.Encode()
 	r.Body = io.NopCloser(strings.NewReader(newBody))
 	r.ContentLength = int64(len(newBody))
 	r.URL.RawQuery = ""
 	return nil
 }
+
+// enforceValues enforces every occurrence of the match word, e.g. the repeated match[] of the series API.
+// Without any occurrence the empty query is enforced, which selects all series of the tenants, so that the
+// upstream never answers for everything. An enforcer returning an empty query is rejected for the same reason.
+func enforceValues(values url.Values, enforce EnforceQL, tenantLabels map[string]bool, labelMatch string, queryMatch string) error {
+	queries := values[queryMatch]
+	if len(queries) == 0 {
+		queries = []string{""}
+	}
+	enforced := make([]string, 0, len(queries))
+	for _, query := range queries {
+		query, err := enforce.Enforce(query, tenantLabels, labelMatch)
+		if err != nil {
+			return err
+		}
+		if query == "" {
+			return fmt.Errorf("enforcement of %s resulted in an empty query", queryMatch)
+		}
+		enforced = append(enforced, query)
+	}
+	values[queryMatch] = enforced
+	return nil
+}
+
+// rewriteRequestParams applies rewrite to the parameters of an enforced request, the form body of POST
+// requests or the URL query otherwise, and encodes the result back into the request.
+func rewriteRequestParams(r *http.Request, rewrite func(url.Values)) {
+	if r.Method == http.MethodPost && r.PostForm != nil {
+		rewrite(r.PostForm)
+		body := r.PostForm.Encode()
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+		return
+	}
+	values := r.URL.Query()
+	rewrite(values)
+	r.URL.RawQuery = values.Encode()
+}
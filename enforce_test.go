@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// enforceFunc adapts a function to EnforceQL.
+type enforceFunc func(query string, tenantLabels map[string]bool, labelMatch string) (string, error)
+
+func (f enforceFunc) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
+	return f(query, tenantLabels, labelMatch)
+}
+
+func TestEnforceValues(t *testing.T) {
+	tenants := map[string]bool{"a": true}
+
+	values := url.Values{"match[]": {"up", `up{job="x"}`}, "start": {"1"}}
+	assert.NoError(t, enforceValues(values, PromQLEnforcer{}, tenants, "namespace", "match[]"))
+	assert.Equal(t, []string{`up{namespace="a"}`, `up{job="x",namespace="a"}`}, values["match[]"])
+	assert.Equal(t, "1", values.Get("start"))
+
+	values = url.Values{}
+	assert.NoError(t, enforceValues(values, PromQLEnforcer{}, tenants, "namespace", "match[]"))
+	assert.Equal(t, []string{`{namespace="a"}`}, values["match[]"])
+
+	empty := enforceFunc(func(string, map[string]bool, string) (string, error) { return "", nil })
+	err := enforceValues(url.Values{}, empty, tenants, "namespace", "query")
+	assert.ErrorContains(t, err, "empty query")
+}
@@ -11,28 +11,46 @@ import (
 )
 
 // LogQLEnforcer manipulates and enforces tenant isolation on LogQL queries.
-type LogQLEnforcer struct{}
+// TenantSets caches the compiled tenant sets, without it they are compiled for every query.
+type LogQLEnforcer struct {
+	TenantSets *tenantSetCache
+}
 
 // Enforce modifies a LogQL query string to enforce tenant isolation based on provided tenant labels and a label match string.
 // If the input query is empty, a new query is constructed to match provided tenant labels.
 // If the input query is non-empty, it is parsed and modified to ensure tenant isolation.
+// If the tenant labels contain grants on several labels, every stream selector is restricted to the grants instead.
 // Returns the modified query or an error if parsing or modification fails.
-func (LogQLEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
+func (e LogQLEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
 	log.Trace().Str("function", "enforcer").Str("query", query).Msg("input")
-	if query == "" {
-		operator := "="
-		if len(tenantLabels) > 1 {
-			operator = "=~"
+	all, err := e.TenantSets.get(tenantLabels, labelMatch)
+	if err != nil {
+		return "", err
+	}
+	var grants []Grant
+	if all.grants {
+		if grants, err = parseGrants(tenantLabels, labelMatch); err != nil {
+			return "", err
 		}
-		query = fmt.Sprintf("{%s%s\"%s\"}", labelMatch, operator, strings.Join(MapKeysToArray(tenantLabels), "|"))
-		log.Trace().Str("function", "enforcer").Str("query", query).Msg("enforcing")
-		return query, nil
+	}
+	if query == "" && grants != nil {
+		matchers, err := enforceGrantMatchers(nil, grants)
+		if err != nil {
+			return "", err
+		}
+		stream := &logqlv2.StreamMatcherExpr{}
+		stream.SetMatchers(matchers)
+		return stream.String(), nil
+	}
+	if query == "" {
+		log.Trace().Str("function", "enforcer").Str("query", all.selector).Msg("enforcing")
+		return all.selector, nil
 	}
 	log.Trace().Str("function", "enforcer").Str("query", query).Msg("enforcing")
 
 	expr, err := logqlv2.ParseExpr(query)
 	if err != nil {
-		return "", err
+		return "", badQueryError{err}
 	}
 
 	errMsg := error(nil)
@@ -40,7 +58,16 @@ func (LogQLEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMa
 	expr.Walk(func(expr interface{}) {
 		switch labelExpression := expr.(type) {
 		case *logqlv2.StreamMatcherExpr:
-			matchers, err := MatchTenantLabelMatchers(labelExpression.Matchers(), tenantLabels, labelMatch)
+			var matchers []*labels.Matcher
+			var err error
+			if grants != nil {
+				matchers, err = enforceGrantMatchers(labelExpression.Matchers(), grants)
+			} else {
+				matchers, err = resolveNegativeTenantMatchers(labelExpression.Matchers(), tenantLabels, labelMatch)
+				if err == nil {
+					matchers, err = matchTenantLabelMatchers(matchers, tenantLabels, all)
+				}
+			}
 			if err != nil {
 				errMsg = err
 				return
@@ -53,15 +80,40 @@ func (LogQLEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMa
 	if errMsg != nil {
 		return "", errMsg
 	}
-	log.Trace().Str("function", "enforcer").Str("query", expr.String()).Msg("enforcing")
-	return expr.String(), nil
+	if grants != nil {
+		enforced := expr.String()
+		log.Trace().Str("function", "enforcer").Str("query", enforced).Msg("enforcing")
+		return enforced, nil
+	}
+	// print the tenant matcher as its placeholder, see tenantSet.print
+	expr.Walk(func(expr interface{}) {
+		if stream, ok := expr.(*logqlv2.StreamMatcherExpr); ok {
+			matchers := stream.Matchers()
+			all.usePlaceholder(matchers)
+			stream.SetMatchers(matchers)
+		}
+	})
+	enforced := all.unquote(expr.String())
+	log.Trace().Str("function", "enforcer").Str("query", enforced).Msg("enforcing")
+	return enforced, nil
 }
 
 // MatchTenantLabelMatchers ensures tenant label matchers in a LogQL query adhere to provided tenant labels.
 // It verifies that the tenant label exists in the query matchers, validating or modifying its values based on tenantLabels.
-// If the tenant label is absent in the matchers, it's added along with all values from tenantLabels.
+// If the tenant label is absent in the matchers, it's added along with all values from tenantLabels, see tenantSet.
 // Returns an error for an unauthorized namespace and nil on success.
-func MatchTenantLabelMatchers(queryMatches []*labels.Matcher, tenantLabels map[string]bool, labelMatch string) ([]*labels.Matcher, error) {
+func (e LogQLEnforcer) MatchTenantLabelMatchers(queryMatches []*labels.Matcher, tenantLabels map[string]bool, labelMatch string) ([]*labels.Matcher, error) {
+	all, err := e.TenantSets.get(tenantLabels, labelMatch)
+	if err != nil {
+		return nil, err
+	}
+	return matchTenantLabelMatchers(queryMatches, tenantLabels, all)
+}
+
+// matchTenantLabelMatchers is MatchTenantLabelMatchers with the tenant set of all tenant labels, which
+// the enforcer looks up once per query instead of once per stream selector.
+func matchTenantLabelMatchers(queryMatches []*labels.Matcher, tenantLabels map[string]bool, all *tenantSet) ([]*labels.Matcher, error) {
+	labelMatch := all.labelMatch
 	foundTenantLabel := false
 	for _, match := range queryMatches {
 		if match.Name == labelMatch {
@@ -76,16 +128,7 @@ func MatchTenantLabelMatchers(queryMatches []*labels.Matcher, tenantLabels map[s
 		}
 	}
 	if !foundTenantLabel {
-		matchType := labels.MatchEqual
-		if len(tenantLabels) > 1 {
-			matchType = labels.MatchRegexp
-		}
-
-		queryMatches = append(queryMatches, &labels.Matcher{
-			Type:  matchType,
-			Name:  labelMatch,
-			Value: strings.Join(MapKeysToArray(tenantLabels), "|"),
-		})
+		queryMatches = append(queryMatches, all.matcher)
 	}
 	return queryMatches, nil
 }
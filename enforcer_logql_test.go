@@ -3,6 +3,7 @@ package main
 import (
 	"testing"
 
+	logqlv2 "github.com/observatorium/api/logql/v2"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/assert"
 )
@@ -87,7 +88,7 @@ func TestMatchNamespaceMatchers(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := MatchTenantLabelMatchers(tt.matchers, tt.tenantLabels, "kubernetes_namespace_name")
+			_, err := LogQLEnforcer{}.MatchTenantLabelMatchers(tt.matchers, tt.tenantLabels, "kubernetes_namespace_name")
 			if tt.expectErr {
 				assert.Error(t, err)
 			} else {
@@ -96,3 +97,48 @@ func TestMatchNamespaceMatchers(t *testing.T) {
 		})
 	}
 }
+
+func FuzzLogQLEnforcer(f *testing.F) {
+	f.Add(`{app="grafana"}`, "ns1")
+	f.Add(`{kubernetes_namespace_name="ns1"} |= "error"`, "ns1,ns2")
+	f.Add(`sum by (level) (count_over_time({app="api"} | json | line_format "{{.message}}" [1m]))`, "a,b")
+	f.Add(`{kubernetes_namespace_name=~"a|b"} | logfmt | duration > 10s`, "a")
+	f.Add(`rate({app="a"} |~ "timeout" [5m]) / on () group_left rate({app="b"}[5m])`, "team-a")
+	f.Add(`topk(5, sum by (pod) (bytes_over_time({job="x"} | unwrap bytes [1h])))`, "ns")
+
+	f.Fuzz(func(t *testing.T, query string, labelList string) {
+		tenantLabels, ok := fuzzTenantLabels(labelList)
+		if !ok {
+			t.Skip()
+		}
+		enforced, err := LogQLEnforcer{}.Enforce(query, tenantLabels, "kubernetes_namespace_name")
+		if err != nil {
+			return
+		}
+		expr, err := logqlv2.ParseExpr(enforced)
+		if err != nil {
+			return
+		}
+		expr.Walk(func(e interface{}) {
+			if stream, ok := e.(*logqlv2.StreamMatcherExpr); ok {
+				checkTenantMatchers(t, stream.Matchers(), tenantLabels, "kubernetes_namespace_name", enforced)
+			}
+		})
+	})
+}
+
+func BenchmarkLogQLEnforcerLargeTenantSet(b *testing.B) {
+	quietLogs(b)
+	tenantLabels := largeTenantLabels(5000)
+	for _, query := range []string{"", `sum(count_over_time({app="api"} |= "error" [5m]))`, `{namespace="team-namespace-00042"}`} {
+		b.Run(query, func(b *testing.B) {
+			enforcer := LogQLEnforcer{TenantSets: newTenantSetCache()}
+			b.ReportAllocs()
+			for range b.N {
+				if _, err := enforcer.Enforce(query, tenantLabels, "namespace"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
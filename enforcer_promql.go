@@ -6,33 +6,39 @@ import (
 
 	"github.com/rs/zerolog/log"
 
-	enforcer "github.com/prometheus-community/prom-label-proxy/injectproxy"
-	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 )
 
 // PromQLEnforcer is a struct with methods to enforce specific rules on Prometheus Query Language (PromQL) queries.
-type PromQLEnforcer struct{}
+// CrossTenantPolicy decides how binary expressions spanning several tenants are handled, see checkCrossTenant.
+// TenantSets caches the compiled tenant sets, without it they are compiled for every query.
+type PromQLEnforcer struct {
+	CrossTenantPolicy string
+	TenantSets        *tenantSetCache
+}
 
 // Enforce enhances a given PromQL query string with additional label matchers,
 // ensuring that the query complies with the allowed tenant labels and specified label match.
+// If the tenant labels contain grants on several labels, the query is enforced with enforcePromQLGrants.
 // It returns the enhanced query or an error if the query cannot be parsed or is not compliant.
-func (PromQLEnforcer) Enforce(query string, allowedTenantLabels map[string]bool, labelMatch string) (string, error) {
+func (p PromQLEnforcer) Enforce(query string, allowedTenantLabels map[string]bool, labelMatch string) (string, error) {
 	log.Trace().Str("function", "enforcer").Str("query", query).Msg("input")
+	all, err := p.TenantSets.get(allowedTenantLabels, labelMatch)
+	if err != nil {
+		return "", err
+	}
+	if all.grants {
+		return enforcePromQLGrants(query, allowedTenantLabels, labelMatch, p.CrossTenantPolicy)
+	}
 	if query == "" {
-		operator := "="
-		if len(allowedTenantLabels) > 1 {
-			operator = "=~"
-		}
-		query = fmt.Sprintf("{%s%s\"%s\"}",
-			labelMatch,
-			operator,
-			strings.Join(MapKeysToArray(allowedTenantLabels),
-				"|"))
+		return all.selector, nil
 	}
 	log.Trace().Str("function", "enforcer").Str("query", query).Msg("enforcing")
 	expr, err := parser.ParseExpr(query)
 	if err != nil {
+		return "", badQueryError{err}
+	}
+	if err := resolveNegativeMatchersPromQL(expr, allowedTenantLabels, labelMatch); err != nil {
 		return "", err
 	}
 
@@ -41,18 +47,81 @@ func (PromQLEnforcer) Enforce(query string, allowedTenantLabels map[string]bool,
 		return "", err
 	}
 
-	tenantLabels, err := enforceLabels(queryLabels, allowedTenantLabels, labelMatch)
+	set, err := enforceLabels(all, queryLabels, allowedTenantLabels, labelMatch)
 	if err != nil {
 		return "", err
 	}
 
-	labelEnforcer := createEnforcer(tenantLabels, labelMatch)
-	err = labelEnforcer.EnforceNode(expr)
+	dropEnforcedMatchers(expr, set.matcher)
+	err = set.enforcer.EnforceNode(expr)
+	if err != nil {
+		return "", err
+	}
+	if err := checkCrossTenant(expr, labelMatch, p.CrossTenantPolicy); err != nil {
+		return "", err
+	}
+	enforced := set.print(expr)
+	log.Trace().Str("function", "enforcer").Str("query", enforced).Msg("enforcing")
+	return enforced, nil
+}
+
+// enforcePromQLGrants restricts every vector selector of the query to the grants of the tenant labels.
+// Unlike the single label enforcement, each selector may be restricted differently, depending on the
+// grants it is compatible with.
+func enforcePromQLGrants(query string, tenantLabels map[string]bool, labelMatch string, crossTenantPolicy string) (string, error) {
+	grants, err := parseGrants(tenantLabels, labelMatch)
+	if err != nil {
+		return "", err
+	}
+	if query == "" {
+		matchers, err := enforceGrantMatchers(nil, grants)
+		if err != nil {
+			return "", err
+		}
+		return (&parser.VectorSelector{LabelMatchers: matchers}).String(), nil
+	}
+	expr, err := parser.ParseExpr(query)
 	if err != nil {
+		return "", badQueryError{err}
+	}
+	errMsg := error(nil)
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		if vector, ok := node.(*parser.VectorSelector); ok {
+			matchers, err := enforceGrantMatchers(vector.LabelMatchers, grants)
+			if err != nil {
+				errMsg = err
+				return err
+			}
+			vector.LabelMatchers = matchers
+		}
+		return nil
+	})
+	if errMsg != nil {
+		return "", errMsg
+	}
+	if err := checkCrossTenant(expr, labelMatch, crossTenantPolicy); err != nil {
 		return "", err
 	}
-	log.Trace().Str("function", "enforcer").Str("query", expr.String()).Msg("enforcing")
-	return expr.String(), nil
+	enforced := expr.String()
+	log.Trace().Str("function", "enforcer").Str("query", enforced).Msg("enforcing")
+	return enforced, nil
+}
+
+// resolveNegativeMatchersPromQL resolves the negative tenant label matchers of every vector selector, see resolveNegativeTenantMatchers.
+func resolveNegativeMatchersPromQL(expr parser.Expr, tenantLabels map[string]bool, labelMatch string) error {
+	var errMsg error
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		if vector, ok := node.(*parser.VectorSelector); ok {
+			matchers, err := resolveNegativeTenantMatchers(vector.LabelMatchers, tenantLabels, labelMatch)
+			if err != nil {
+				errMsg = err
+				return err
+			}
+			vector.LabelMatchers = matchers
+		}
+		return nil
+	})
+	return errMsg
 }
 
 // extractLabelsAndValues parses a PromQL expression and extracts labels and their values.
@@ -72,18 +141,18 @@ func extractLabelsAndValues(expr parser.Expr) (map[string]string, error) {
 }
 
 // enforceLabels checks if provided query labels comply with allowed tenant labels and a specified label match.
-// If the labels comply, it returns them (or all allowed tenant labels if not specified in the query) and nil.
-// If not, it returns an error indicating the non-compliant label.
-func enforceLabels(queryLabels map[string]string, allowedTenantLabels map[string]bool, labelMatch string) ([]string, error) {
+// If the labels comply, it returns the tenant set of them (or all, the set of all allowed tenant labels, if
+// not specified in the query) and nil. If not, it returns an error indicating the non-compliant label.
+func enforceLabels(all *tenantSet, queryLabels map[string]string, allowedTenantLabels map[string]bool, labelMatch string) (*tenantSet, error) {
 	if _, ok := queryLabels[labelMatch]; ok {
 		ok, tenantLabels := checkLabels(queryLabels, allowedTenantLabels, labelMatch)
 		if !ok {
 			return nil, fmt.Errorf("user not allowed with tenant label %s", tenantLabels[0])
 		}
-		return tenantLabels, nil
+		return newTenantSet(tenantLabels, labelMatch)
 	}
 
-	return MapKeysToArray(allowedTenantLabels), nil
+	return all, nil
 }
 
 // checkLabels validates if query labels are present in the allowed tenant labels and returns them.
@@ -98,18 +167,3 @@ func checkLabels(queryLabels map[string]string, allowedTenantLabels map[string]b
 	}
 	return true, splitQueryLabels
 }
-
-func createEnforcer(tenantLabels []string, labelMatch string) *enforcer.PromQLEnforcer {
-	var matchType labels.MatchType
-	if len(tenantLabels) > 1 {
-		matchType = labels.MatchRegexp
-	} else {
-		matchType = labels.MatchEqual
-	}
-
-	return enforcer.NewPromQLEnforcer(true, &labels.Matcher{
-		Name:  labelMatch,
-		Type:  matchType,
-		Value: strings.Join(tenantLabels, "|"),
-	})
-}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog"
 )
 
 func Test_promqlEnforcer(t *testing.T) {
@@ -66,3 +72,102 @@ func Test_promqlEnforcer(t *testing.T) {
 		})
 	}
 }
+
+var fuzzLabelValue = regexp.MustCompile(`^[a-z0-9]([a-z0-9_-]*[a-z0-9])?$`)
+
+// fuzzTenantLabels turns a comma separated list into a tenant label set.
+// It returns false if the list contains values that can not be namespace names.
+func fuzzTenantLabels(list string) (map[string]bool, bool) {
+	tenantLabels := map[string]bool{}
+	for _, v := range strings.Split(list, ",") {
+		if !fuzzLabelValue.MatchString(v) {
+			return nil, false
+		}
+		tenantLabels[v] = true
+	}
+	return tenantLabels, true
+}
+
+// checkTenantMatchers verifies that the matchers restrict the tenant label to allowed values only.
+func checkTenantMatchers(t *testing.T, matchers []*labels.Matcher, tenantLabels map[string]bool, labelMatch string, query string) {
+	restricted := false
+	for _, m := range matchers {
+		if m.Name != labelMatch || (m.Type != labels.MatchEqual && m.Type != labels.MatchRegexp) {
+			continue
+		}
+		allowed := true
+		for _, v := range strings.Split(m.Value, "|") {
+			if !tenantLabels[v] {
+				allowed = false
+			}
+		}
+		restricted = restricted || allowed
+	}
+	if !restricted {
+		t.Fatalf("enforced query %q has selector %v that is not restricted to %v", query, matchers, MapKeysToArray(tenantLabels))
+	}
+}
+
+func FuzzPromQLEnforcer(f *testing.F) {
+	f.Add("up", "namespace1")
+	f.Add(`up{namespace="namespace1"}`, "namespace1,namespace2")
+	f.Add(`sum(rate(http_requests_total{job="api"}[5m])) by (namespace) / sum(rate(http_requests_total[5m]))`, "a,b")
+	f.Add(`{__name__=~"up|down",namespace=~"a|b"}`, "a")
+	f.Add(`label_replace(up, "namespace", "other", "", "")`, "team-a")
+	f.Add(`count by (pod) (kube_pod_info{namespace!="kube-system"}) and on (pod) up offset 5m @ 1690000000`, "team-a")
+	f.Add(`histogram_quantile(0.99, sum by (le) (rate(http_request_duration_seconds_bucket[$__rate_interval])))`, "ns")
+	f.Add(`vector(1) + scalar(max_over_time(up[1h:5m]))`, "ns")
+
+	f.Fuzz(func(t *testing.T, query string, labelList string) {
+		tenantLabels, ok := fuzzTenantLabels(labelList)
+		if !ok {
+			t.Skip()
+		}
+		enforced, err := PromQLEnforcer{}.Enforce(query, tenantLabels, "namespace")
+		if err != nil {
+			return
+		}
+		expr, err := parser.ParseExpr(enforced)
+		if err != nil {
+			return
+		}
+		parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+			if vector, ok := node.(*parser.VectorSelector); ok {
+				checkTenantMatchers(t, vector.LabelMatchers, tenantLabels, "namespace", enforced)
+			}
+			return nil
+		})
+	})
+}
+
+// largeTenantLabels returns n tenant labels, like the namespaces of a platform team.
+func largeTenantLabels(n int) map[string]bool {
+	tenantLabels := make(map[string]bool, n)
+	for i := range n {
+		tenantLabels[fmt.Sprintf("team-namespace-%05d", i)] = true
+	}
+	return tenantLabels
+}
+
+// quietLogs disables logging for the benchmark, the enforcers trace every query.
+func quietLogs(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	b.Cleanup(func() { zerolog.SetGlobalLevel(level) })
+}
+
+func BenchmarkPromQLEnforcerLargeTenantSet(b *testing.B) {
+	quietLogs(b)
+	tenantLabels := largeTenantLabels(5000)
+	for _, query := range []string{"", `sum(rate(http_requests_total{job="api"}[5m])) by (namespace)`, `up{namespace="team-namespace-00042"}`} {
+		b.Run(query, func(b *testing.B) {
+			enforcer := PromQLEnforcer{TenantSets: newTenantSetCache()}
+			b.ReportAllocs()
+			for range b.N {
+				if _, err := enforcer.Enforce(query, tenantLabels, "namespace"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
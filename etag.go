@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// isConditionalEndpoint reports whether the path is a label or metadata lookup, which Grafana repeats
+// for every dashboard variable and query editor and which rarely changes between requests.
+func isConditionalEndpoint(path string) bool {
+	return isSeriesEndpoint(path) || strings.HasSuffix(path, "/api/v1/metadata")
+}
+
+// etagMatches reports whether the If-None-Match header matches the entity tag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionalResponse returns a response modifier that sets a strong ETag computed from the body of
+// successful responses and replaces them with 304 Not Modified if the client already has that body.
+// It has to run last, so that the tag covers the body as it is sent to the client.
+func conditionalResponse(ifNoneMatch string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(append([]byte(resp.Header.Get("Content-Encoding")+"\n"), body...))
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		resp.Header.Set("ETag", etag)
+		if ifNoneMatch == "" || !etagMatches(ifNoneMatch, etag) {
+			setResponseBody(resp, body)
+			return nil
+		}
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = http.StatusText(http.StatusNotModified)
+		resp.Body = io.NopCloser(bytes.NewReader(nil))
+		resp.ContentLength = 0
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Content-Type")
+		return nil
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtagMatches(t *testing.T) {
+	assert.True(t, etagMatches(`"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`"x", W/"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`*`, `"abc"`))
+	assert.False(t, etagMatches(`"x"`, `"abc"`))
+}
+
+func TestIsConditionalEndpoint(t *testing.T) {
+	assert.True(t, isConditionalEndpoint("/api/v1/labels"))
+	assert.True(t, isConditionalEndpoint("/loki/api/v1/label/app/values"))
+	assert.True(t, isConditionalEndpoint("/api/v1/metadata"))
+	assert.False(t, isConditionalEndpoint("/api/v1/query"))
+}
+
+func TestE2E_ConditionalLabelRequests(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Web.ConditionalRequests = true
+	env.App.WithRoutes()
+	env.Thanos.SetResponse("/api/v1/labels", http.StatusOK, `{"status":"success","data":["__name__","tenant_id"]}`)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/labels", nil)
+		req.Header.Set("Authorization", "Bearer "+env.Tokens["userTenant"])
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		env.App.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+	assert.Contains(t, rr.Body.String(), "tenant_id")
+
+	rr = get(etag)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Empty(t, rr.Body.String())
+	assert.Equal(t, etag, rr.Header().Get("ETag"))
+
+	env.Thanos.SetResponse("/api/v1/labels", http.StatusOK, `{"status":"success","data":["__name__","job","tenant_id"]}`)
+	rr = get(etag)
+	assert.Equal(t, http.StatusOK, rr.Code, "changed responses are sent in full")
+	assert.NotEqual(t, etag, rr.Header().Get("ETag"))
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Empty(t, rr.Header().Get("ETag"), "queries get no ETag")
+}
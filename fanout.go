@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// FanOutConfig sends enforced queries to further upstreams besides the URL of the datasource, e.g. the
+// Thanos queriers of other regions, and merges their results.
+type FanOutConfig struct {
+	URLs []string `mapstructure:"urls"`
+	// Timeout is the deadline of each upstream, upstreams missing it are left out of the result.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+var fanOutRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_fanout_upstream_requests_total",
+	Help: "Number of fan-out requests to each upstream, by query language, upstream host and result.",
+}, []string{"language", "upstream", "result"})
+
+// fanOut forwards requests to all upstreams concurrently and merges the results.
+type fanOut struct {
+	language  string
+	upstreams []*url.URL
+	timeout   time.Duration
+}
+
+// newFanOut returns the fan-out of the config, or nil if it has no further upstreams.
+func newFanOut(language string, cfg FanOutConfig) *fanOut {
+	if len(cfg.URLs) == 0 {
+		return nil
+	}
+	f := &fanOut{language: language, timeout: cfg.Timeout}
+	if f.timeout <= 0 {
+		f.timeout = 30 * time.Second
+	}
+	for _, raw := range cfg.URLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			log.Fatal().Err(err).Str("url", raw).Msg("Error parsing fan-out URL")
+		}
+		f.upstreams = append(f.upstreams, u)
+	}
+	return f
+}
+
+// handles reports whether the request is sent to all upstreams. Only the APIs whose results can be merged
+// are, all others and live tails are forwarded to the datasource's URL alone.
+func (f *fanOut) handles(r *http.Request) bool {
+	if f == nil {
+		return false
+	}
+	path := r.URL.Path
+	return strings.HasSuffix(path, "/api/v1/query") ||
+		strings.HasSuffix(path, "/api/v1/query_range") ||
+		strings.HasSuffix(path, "/index/stats") ||
+		isSeriesEndpoint(path)
+}
+
+// fanOutResult is the response of one upstream.
+type fanOutResult struct {
+	upstream *url.URL
+	status   int
+	body     []byte
+	err      error
+}
+
+// serve has the signature of streamUp, the primary upstream is queried along with the fan-out upstreams.
+// As long as one upstream answers, the merged result is served with a warning for every failed upstream.
+// If all fail, the response of the primary upstream is relayed, or 502 if it had none.
+func (f *fanOut) serve(w http.ResponseWriter, r *http.Request, primary *url.URL, tls bool, headers map[string]string, a *App, modifiers ...func(*http.Response) error) {
+	setHeaders(r, tls, headers, a.ServiceAccountToken)
+	opts := mergeOptionsOf(r)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logAndWriteError(w, http.StatusBadRequest, err, "could not read request body")
+		return
+	}
+	if len(body) == 0 && r.Method == http.MethodPost && r.PostForm != nil {
+		// the form was parsed, e.g. for the enforcement, without rewriting the body
+		body = []byte(r.PostForm.Encode())
+	}
+
+	upstreams := append([]*url.URL{primary}, f.upstreams...)
+	results := make([]fanOutResult, len(upstreams))
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = f.fetch(r, body, upstream, a.upstreams.roundTripper(upstream))
+		}()
+	}
+	wg.Wait()
+
+	var bodies [][]byte
+	var warnings []string
+	for _, result := range results {
+		if result.err == nil {
+			bodies = append(bodies, result.body)
+			continue
+		}
+		requestLogger(r).Warn().Err(result.err).Str("upstream", result.upstream.Host).Str("path", r.URL.Path).Msg("Fan-out upstream failed")
+		warnings = append(warnings, fmt.Sprintf("partial result, upstream %s failed: %v", result.upstream.Host, result.err))
+	}
+	if len(bodies) == 0 {
+		if results[0].status != 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(results[0].status)
+			_, _ = w.Write(results[0].body)
+			return
+		}
+		logAndWriteError(w, http.StatusBadGateway, results[0].err, "")
+		return
+	}
+
+	merged, err := mergeAPIResponses(bodies, warnings, opts)
+	if err != nil {
+		logAndWriteError(w, http.StatusBadGateway, err, "could not merge the upstream results")
+		return
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(merged)),
+		Request:    r,
+	}
+	if len(modifiers) > 0 && a.Cfg().Compression.Enabled {
+		modifiers = append(modifiers, compressResponse(a.Cfg().Compression, r.Header.Get("Accept-Encoding")))
+	}
+	for _, modify := range modifiers {
+		if err := modify(resp); err != nil {
+			logAndWriteError(w, http.StatusBadGateway, err, "")
+			return
+		}
+	}
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// fetch sends the request to the upstream within the fan-out timeout.
+func (f *fanOut) fetch(r *http.Request, body []byte, upstream *url.URL, transport http.RoundTripper) fanOutResult {
+	result := fanOutResult{upstream: upstream}
+	ctx, cancel := context.WithTimeout(r.Context(), f.timeout)
+	defer cancel()
+	req := r.Clone(ctx)
+	req.URL = &url.URL{
+		Scheme:   upstream.Scheme,
+		Host:     upstream.Host,
+		Path:     strings.TrimSuffix(upstream.Path, "/") + r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	req.Host = ""
+	req.RequestURI = ""
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	// the transport decompresses responses itself if the request does not ask for an encoding
+	req.Header.Del("Accept-Encoding")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		result.err = err
+		if errors.Is(err, context.DeadlineExceeded) {
+			fanOutRequests.WithLabelValues(f.language, upstream.Host, "timeout").Inc()
+		} else {
+			fanOutRequests.WithLabelValues(f.language, upstream.Host, "error").Inc()
+		}
+		return result
+	}
+	defer resp.Body.Close()
+	result.status = resp.StatusCode
+	result.body, result.err = io.ReadAll(resp.Body)
+	if result.err == nil && resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		if json.Unmarshal(result.body, &apiErr) == nil && apiErr.Error != "" {
+			result.err = fmt.Errorf("status %d: %s", resp.StatusCode, apiErr.Error)
+		} else {
+			result.err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	if result.err != nil {
+		fanOutRequests.WithLabelValues(f.language, upstream.Host, "error").Inc()
+		return result
+	}
+	fanOutRequests.WithLabelValues(f.language, upstream.Host, "success").Inc()
+	return result
+}
+
+// mergeOptions are the request parameters that shape merged Loki streams.
+type mergeOptions struct {
+	forward bool
+	limit   int
+}
+
+func mergeOptionsOf(r *http.Request) mergeOptions {
+	limit, _ := strconv.Atoi(requestParam(r, "limit"))
+	return mergeOptions{forward: requestParam(r, "direction") == "forward", limit: limit}
+}
+
+// mergeAPIResponses merges the data of Prometheus or Loki API responses and appends the warnings to theirs.
+// Responses without an envelope, like the index stats of Loki, are merged as a whole and carry no warnings.
+func mergeAPIResponses(bodies [][]byte, warnings []string, opts mergeOptions) ([]byte, error) {
+	var merged map[string]json.RawMessage
+	var data []json.RawMessage
+	for i, body := range bodies {
+		var envelope map[string]json.RawMessage
+		if err := json.Unmarshal(body, &envelope); err != nil {
+			return nil, err
+		}
+		if envelope["status"] == nil {
+			data = append(data, body)
+			continue
+		}
+		if i == 0 {
+			merged = envelope
+		} else {
+			var w []string
+			_ = json.Unmarshal(envelope["warnings"], &w)
+			for _, warning := range w {
+				if !slices.Contains(warnings, warning) {
+					warnings = append(warnings, warning)
+				}
+			}
+		}
+		data = append(data, envelope["data"])
+	}
+	mergedData, err := mergeData(data, opts)
+	if err != nil || merged == nil {
+		return mergedData, err
+	}
+	merged["data"] = mergedData
+	for _, warning := range warnings {
+		appendWarning(merged, warning)
+	}
+	return json.Marshal(merged)
+}
+
+// mergeData merges the data of the responses by their shape: label names and values are joined, series,
+// samples and log lines are deduplicated by their labels and timestamps and index stats are summed.
+func mergeData(data []json.RawMessage, opts mergeOptions) (json.RawMessage, error) {
+	if len(data) == 1 {
+		return data[0], nil
+	}
+	trimmed := bytes.TrimSpace(data[0])
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var names []string
+		if err := json.Unmarshal(data[0], &names); err == nil {
+			return mergeStrings(data)
+		}
+		return mergeSeries(data)
+	}
+	var first map[string]json.RawMessage
+	if err := json.Unmarshal(data[0], &first); err != nil {
+		return nil, err
+	}
+	if _, ok := first["resultType"]; !ok {
+		return mergeStats(data)
+	}
+	var resultType string
+	_ = json.Unmarshal(first["resultType"], &resultType)
+	var results [][]json.RawMessage
+	for _, d := range data {
+		var part struct {
+			Result []json.RawMessage `json:"result"`
+		}
+		if err := json.Unmarshal(d, &part); err != nil {
+			return nil, err
+		}
+		results = append(results, part.Result)
+	}
+	var result []json.RawMessage
+	var err error
+	switch resultType {
+	case "vector":
+		result, err = mergeByLabels(results, "metric", "", nil)
+	case "matrix":
+		result, err = mergeByLabels(results, "metric", "values", sampleOrder(true))
+	case "streams":
+		result, err = mergeByLabels(results, "stream", "values", sampleOrder(opts.forward))
+		if err == nil {
+			result, err = limitEntries(result, opts)
+		}
+	default:
+		// scalars and strings can not be merged, the first upstream wins
+		return data[0], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if first["result"], err = json.Marshal(result); err != nil {
+		return nil, err
+	}
+	// the query statistics of Loki are those of a single upstream
+	delete(first, "stats")
+	return json.Marshal(first)
+}
+
+func mergeStrings(data []json.RawMessage) (json.RawMessage, error) {
+	seen := map[string]bool{}
+	var merged []string
+	for _, d := range data {
+		var values []string
+		if err := json.Unmarshal(d, &values); err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			if !seen[v] {
+				seen[v] = true
+				merged = append(merged, v)
+			}
+		}
+	}
+	sort.Strings(merged)
+	return json.Marshal(merged)
+}
+
+func mergeSeries(data []json.RawMessage) (json.RawMessage, error) {
+	seen := map[string]bool{}
+	merged := []map[string]string{}
+	for _, d := range data {
+		var series []map[string]string
+		if err := json.Unmarshal(d, &series); err != nil {
+			return nil, err
+		}
+		for _, s := range series {
+			if key := labelsKey(s); !seen[key] {
+				seen[key] = true
+				merged = append(merged, s)
+			}
+		}
+	}
+	return json.Marshal(merged)
+}
+
+func mergeStats(data []json.RawMessage) (json.RawMessage, error) {
+	sums := map[string]float64{}
+	for _, d := range data {
+		var stats map[string]float64
+		if err := json.Unmarshal(d, &stats); err != nil {
+			return nil, err
+		}
+		for k, v := range stats {
+			sums[k] += v
+		}
+	}
+	return json.Marshal(sums)
+}
+
+// mergeByLabels merges the results with the same labels in the labels field. The entries of the values field
+// are joined, deduplicated and sorted with less, without a values field the first result wins.
+func mergeByLabels(results [][]json.RawMessage, labelsField string, valuesField string, less func(a, b []json.RawMessage) int) ([]json.RawMessage, error) {
+	type merged struct {
+		fields map[string]json.RawMessage
+		values [][]json.RawMessage
+		seen   map[string]bool
+	}
+	var order []string
+	byLabels := map[string]*merged{}
+	for _, result := range results {
+		for _, raw := range result {
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &fields); err != nil {
+				return nil, err
+			}
+			var lbls map[string]string
+			_ = json.Unmarshal(fields[labelsField], &lbls)
+			key := labelsKey(lbls)
+			m, ok := byLabels[key]
+			if !ok {
+				m = &merged{fields: fields, seen: map[string]bool{}}
+				byLabels[key] = m
+				order = append(order, key)
+			}
+			if valuesField == "" {
+				continue
+			}
+			var values [][]json.RawMessage
+			if err := json.Unmarshal(fields[valuesField], &values); err != nil {
+				return nil, err
+			}
+			for _, v := range values {
+				var id string
+				for _, part := range v {
+					id += string(part) + "\x00"
+				}
+				if !m.seen[id] {
+					m.seen[id] = true
+					m.values = append(m.values, v)
+				}
+			}
+		}
+	}
+	out := make([]json.RawMessage, 0, len(order))
+	for _, key := range order {
+		m := byLabels[key]
+		if valuesField != "" {
+			slices.SortStableFunc(m.values, less)
+			m.fields[valuesField], _ = json.Marshal(m.values)
+		}
+		raw, err := json.Marshal(m.fields)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, raw)
+	}
+	return out, nil
+}
+
+// sampleOrder sorts samples and log entries by their timestamp, the first element, which is a number for
+// Prometheus and a string of nanoseconds for Loki.
+func sampleOrder(ascending bool) func(a, b []json.RawMessage) int {
+	timestamp := func(v []json.RawMessage) float64 {
+		if len(v) == 0 {
+			return 0
+		}
+		f, _ := strconv.ParseFloat(strings.Trim(string(v[0]), `"`), 64)
+		return f
+	}
+	return func(a, b []json.RawMessage) int {
+		c := 0
+		if ta, tb := timestamp(a), timestamp(b); ta < tb {
+			c = -1
+		} else if ta > tb {
+			c = 1
+		}
+		if !ascending {
+			c = -c
+		}
+		return c
+	}
+}
+
+// limitEntries cuts the merged streams down to the requested number of log lines, which every upstream
+// returned on its own. The lines closest to the start of the direction are kept.
+func limitEntries(streams []json.RawMessage, opts mergeOptions) ([]json.RawMessage, error) {
+	if opts.limit <= 0 {
+		return streams, nil
+	}
+	type entry struct {
+		stream int
+		value  []json.RawMessage
+	}
+	var entries []entry
+	parsed := make([]map[string]json.RawMessage, len(streams))
+	for i, raw := range streams {
+		if err := json.Unmarshal(raw, &parsed[i]); err != nil {
+			return nil, err
+		}
+		var values [][]json.RawMessage
+		if err := json.Unmarshal(parsed[i]["values"], &values); err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			entries = append(entries, entry{stream: i, value: v})
+		}
+	}
+	if len(entries) <= opts.limit {
+		return streams, nil
+	}
+	order := sampleOrder(opts.forward)
+	slices.SortStableFunc(entries, func(a, b entry) int { return order(a.value, b.value) })
+	kept := make([][][]json.RawMessage, len(streams))
+	for _, e := range entries[:opts.limit] {
+		kept[e.stream] = append(kept[e.stream], e.value)
+	}
+	var out []json.RawMessage
+	for i, values := range kept {
+		if len(values) == 0 {
+			continue
+		}
+		parsed[i]["values"], _ = json.Marshal(values)
+		raw, err := json.Marshal(parsed[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, raw)
+	}
+	return out, nil
+}
+
+// labelsKey identifies a label set independent of the order of its labels.
+func labelsKey(lbls map[string]string) string {
+	keys := MapKeysToArray(lbls)
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(lbls[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gepaplexx/multena-proxy/internal/mockupstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeAPIResponses(t *testing.T) {
+	cases := []struct {
+		name   string
+		bodies []string
+		opts   mergeOptions
+		want   string
+	}{
+		{
+			name: "vector",
+			bodies: []string{
+				`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"a":"1"},"value":[1,"1"]}]}}`,
+				`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"a":"1"},"value":[1,"1"]},{"metric":{"a":"2"},"value":[1,"2"]}]}}`,
+			},
+			want: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"a":"1"},"value":[1,"1"]},{"metric":{"a":"2"},"value":[1,"2"]}]}}`,
+		},
+		{
+			name: "matrix",
+			bodies: []string{
+				`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"a":"1"},"values":[[1,"1"],[3,"3"]]}]}}`,
+				`{"status":"success","warnings":["slow"],"data":{"resultType":"matrix","result":[{"metric":{"a":"1"},"values":[[2,"2"],[3,"3"]]}]}}`,
+			},
+			want: `{"status":"success","warnings":["slow"],"data":{"resultType":"matrix","result":[{"metric":{"a":"1"},"values":[[1,"1"],[2,"2"],[3,"3"]]}]}}`,
+		},
+		{
+			name: "streams with limit",
+			bodies: []string{
+				`{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"a"},"values":[["30","c"],["10","a"]]}],"stats":{}}}`,
+				`{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"b"},"values":[["20","b"]]}],"stats":{}}}`,
+			},
+			opts: mergeOptions{limit: 2},
+			want: `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"a"},"values":[["30","c"]]},{"stream":{"app":"b"},"values":[["20","b"]]}]}}`,
+		},
+		{
+			name:   "labels",
+			bodies: []string{`{"status":"success","data":["job","namespace"]}`, `{"status":"success","data":["instance","job"]}`},
+			want:   `{"status":"success","data":["instance","job","namespace"]}`,
+		},
+		{
+			name:   "series",
+			bodies: []string{`{"status":"success","data":[{"a":"1","b":"2"}]}`, `{"status":"success","data":[{"b":"2","a":"1"},{"a":"3"}]}`},
+			want:   `{"status":"success","data":[{"a":"1","b":"2"},{"a":"3"}]}`,
+		},
+		{
+			name:   "loki index stats",
+			bodies: []string{`{"streams":1,"chunks":2,"entries":3,"bytes":4}`, `{"streams":1,"chunks":1,"entries":1,"bytes":1}`},
+			want:   `{"streams":2,"chunks":3,"entries":4,"bytes":5}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var bodies [][]byte
+			for _, b := range tc.bodies {
+				bodies = append(bodies, []byte(b))
+			}
+			merged, err := mergeAPIResponses(bodies, nil, tc.opts)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.want, string(merged))
+		})
+	}
+}
+
+func TestE2E_FanOut(t *testing.T) {
+	env := newE2EEnv(t)
+	env.Thanos.SetResponse("/api/v1/labels", http.StatusOK, `{"status":"success","data":["job","namespace"]}`)
+	region := mockupstream.NewThanos()
+	t.Cleanup(region.Close)
+	region.SetResponse("/api/v1/labels", http.StatusOK, `{"status":"success","data":["instance","namespace"]}`)
+	broken := mockupstream.NewThanos()
+	t.Cleanup(broken.Close)
+	broken.SetResponse("/api/v1/labels", http.StatusServiceUnavailable, `{"status":"error","errorType":"unavailable","error":"store down"}`)
+	env.App.Cfg().Thanos.FanOut = FanOutConfig{URLs: []string{region.URL, broken.URL}}
+	env.App.WithRoutes()
+
+	rr := env.do(http.MethodGet, "/api/v1/labels", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp struct {
+		Data     []string `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"instance", "job", "namespace"}, resp.Data)
+	assert.Len(t, resp.Warnings, 1)
+	assert.Contains(t, resp.Warnings[0], "store down")
+
+	// every upstream gets the enforced request
+	req, _ := region.LastRequest()
+	assert.Contains(t, req.Params.Get("match[]"), "allowed_user")
+	assert.Equal(t, "Bearer service-account-token", req.Header.Get("Authorization"))
+
+	// routes that can not be merged only go to the datasource's URL
+	before := len(region.Requests())
+	rr = env.do(http.MethodGet, "/api/v1/status/buildinfo", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, region.Requests(), before)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ForwardAuthConfig enables trusting the identity headers of a forward-auth layer in front of the proxy,
+// e.g. oauth2-proxy or an ingress with external authentication, instead of validating a JWT.
+// The headers are only trusted if the request carries the shared secret or comes from a trusted network,
+// if both are configured both must match.
+type ForwardAuthConfig struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	UserHeader   string `mapstructure:"user_header"`
+	GroupsHeader string `mapstructure:"groups_header"`
+	EmailHeader  string `mapstructure:"email_header"`
+	// SecretHeader carries the shared secret read from SecretPath.
+	SecretHeader    string   `mapstructure:"secret_header"`
+	SecretPath      string   `mapstructure:"secret_path"`
+	TrustedNetworks []string `mapstructure:"trusted_networks"`
+}
+
+var forwardAuthRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_forward_auth_requests_total",
+	Help: "Number of requests with forward-auth identity headers, by whether their source was trusted.",
+}, []string{"result"})
+
+// forwardAuth reads the identity of trusted forward-auth requests.
+type forwardAuth struct {
+	cfg      ForwardAuthConfig
+	secret   []byte
+	networks []*net.IPNet
+}
+
+func newForwardAuth(cfg ForwardAuthConfig) (*forwardAuth, error) {
+	if cfg.UserHeader == "" {
+		cfg.UserHeader = "X-Forwarded-User"
+	}
+	if cfg.GroupsHeader == "" {
+		cfg.GroupsHeader = "X-Forwarded-Groups"
+	}
+	if cfg.EmailHeader == "" {
+		cfg.EmailHeader = "X-Forwarded-Email"
+	}
+	if cfg.SecretHeader == "" {
+		cfg.SecretHeader = "X-Forward-Auth-Secret"
+	}
+	f := &forwardAuth{cfg: cfg}
+	if cfg.SecretPath != "" {
+		secret, err := os.ReadFile(cfg.SecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read forward-auth secret: %w", err)
+		}
+		f.secret = []byte(strings.TrimSpace(string(secret)))
+		if len(f.secret) == 0 {
+			return nil, fmt.Errorf("forward-auth secret %s is empty", cfg.SecretPath)
+		}
+	}
+	for _, cidr := range cfg.TrustedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		f.networks = append(f.networks, network)
+	}
+	if f.secret == nil && len(f.networks) == 0 {
+		return nil, errors.New("forward-auth needs a secret or trusted networks")
+	}
+	return f, nil
+}
+
+// token returns the identity of the forward-auth headers and whether the request has them.
+// Requests with identity headers from an untrusted source are rejected instead of falling back to the JWT,
+// as a client trying to spoof an identity should not get any further.
+// The secret header is removed, so it is not forwarded upstream.
+func (f *forwardAuth) token(r *http.Request) (OAuthToken, bool, error) {
+	user := strings.TrimSpace(r.Header.Get(f.cfg.UserHeader))
+	secret := r.Header.Get(f.cfg.SecretHeader)
+	r.Header.Del(f.cfg.SecretHeader)
+	if user == "" {
+		return OAuthToken{}, false, nil
+	}
+	if !f.trusted(r, secret) {
+		forwardAuthRequests.WithLabelValues("untrusted").Inc()
+		return OAuthToken{}, true, errors.New("forward-auth headers from an untrusted source")
+	}
+	forwardAuthRequests.WithLabelValues("trusted").Inc()
+
+	token := OAuthToken{PreferredUsername: user, Email: strings.TrimSpace(r.Header.Get(f.cfg.EmailHeader))}
+	for _, values := range r.Header.Values(f.cfg.GroupsHeader) {
+		for _, group := range strings.Split(values, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				token.Groups = append(token.Groups, group)
+			}
+		}
+	}
+	return token, true, nil
+}
+
+// trusted reports whether the request carries the shared secret and comes from a trusted network, as far as configured.
+func (f *forwardAuth) trusted(r *http.Request, secret string) bool {
+	if f.secret != nil && subtle.ConstantTimeCompare([]byte(secret), f.secret) != 1 {
+		return false
+	}
+	if len(f.networks) > 0 {
+		ip := net.ParseIP(clientIP(r))
+		if ip == nil || !slices.ContainsFunc(f.networks, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardAuthToken(t *testing.T) {
+	secretPath := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretPath, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := newForwardAuth(ForwardAuthConfig{SecretPath: secretPath, TrustedNetworks: []string{"192.0.2.0/24"}})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name    string
+		remote  string
+		secret  string
+		user    string
+		found   bool
+		wantErr bool
+	}{
+		{name: "trusted", remote: "192.0.2.1:1234", secret: "s3cret", user: "jane", found: true},
+		{name: "wrong secret", remote: "192.0.2.1:1234", secret: "guess", user: "jane", found: true, wantErr: true},
+		{name: "untrusted network", remote: "198.51.100.7:1234", secret: "s3cret", user: "jane", found: true, wantErr: true},
+		{name: "no user header", remote: "192.0.2.1:1234", secret: "s3cret"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.RemoteAddr = tc.remote
+			r.Header.Set("X-Forward-Auth-Secret", tc.secret)
+			if tc.user != "" {
+				r.Header.Set("X-Forwarded-User", tc.user)
+			}
+			r.Header.Add("X-Forwarded-Groups", "team-a, team-b")
+			r.Header.Add("X-Forwarded-Groups", "team-c")
+			r.Header.Set("X-Forwarded-Email", "jane@example.com")
+
+			token, found, err := f.token(r)
+			assert.Equal(t, tc.found, found)
+			assert.Equal(t, tc.wantErr, err != nil)
+			assert.Empty(t, r.Header.Get("X-Forward-Auth-Secret"))
+			if found && !tc.wantErr {
+				assert.Equal(t, OAuthToken{PreferredUsername: "jane", Email: "jane@example.com", Groups: []string{"team-a", "team-b", "team-c"}}, token)
+			}
+		})
+	}
+
+	_, err = newForwardAuth(ForwardAuthConfig{})
+	assert.Error(t, err)
+}
+
+func TestE2E_ForwardAuth(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().ForwardAuth = ForwardAuthConfig{Enabled: true, TrustedNetworks: []string{"192.0.2.0/24"}}
+	env.App.WithRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("X-Forwarded-User", "not-a-user")
+	req.Header.Set("X-Forwarded-Groups", "group1")
+	rr := httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	last, _ := env.Thanos.LastRequest()
+	assert.Contains(t, last.Params.Get("query"), "allowed_group1")
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	req.Header.Set("X-Forwarded-User", "admin")
+	req.Header.Set("X-Forwarded-Groups", "admins")
+	rr = httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// requests without identity headers still authenticate with their JWT
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
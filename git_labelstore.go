@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// GitConfig configures the git label store, which reads labels.yaml from a Git repository.
+type GitConfig struct {
+	URL    string `mapstructure:"url"`
+	Branch string `mapstructure:"branch"`
+	// Path is the directory in the repository that contains labels.yaml.
+	Path     string        `mapstructure:"path"`
+	Interval time.Duration `mapstructure:"interval"`
+	// Dir is the local checkout, it is created if it does not exist.
+	Dir string `mapstructure:"dir"`
+	// SSHKeyPath and KnownHostsPath authenticate SSH URLs.
+	SSHKeyPath     string `mapstructure:"ssh_key_path"`
+	KnownHostsPath string `mapstructure:"known_hosts_path"`
+	// User and TokenPath authenticate HTTPS URLs with basic auth.
+	User      string `mapstructure:"user"`
+	TokenPath string `mapstructure:"token_path"`
+}
+
+var (
+	gitSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_git_label_syncs_total",
+		Help: "Number of syncs of the git label store, by result.",
+	}, []string{"result"})
+	gitLastSync = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "multena_git_label_last_sync_timestamp_seconds",
+		Help: "Time of the last sync of the git label store that changed or confirmed the active labels.",
+	})
+)
+
+// GitHandler serves the labels of labels.yaml in a Git repository. The repository is pulled on an interval
+// and a new revision only replaces the active labels if it is valid, so a broken change keeps the last good labels.
+type GitHandler struct {
+	cfg GitConfig
+
+	mu       sync.RWMutex
+	labels   map[string]map[string]bool
+	revision string
+}
+
+func (g *GitHandler) Connect(a *App) error {
+	g.cfg = a.Cfg().Git
+	if g.cfg.Branch == "" {
+		g.cfg.Branch = "main"
+	}
+	if g.cfg.Interval <= 0 {
+		g.cfg.Interval = time.Minute
+	}
+	if g.cfg.Dir == "" {
+		g.cfg.Dir = filepath.Join(os.TempDir(), "multena-labels")
+	}
+	if err := g.sync(context.Background()); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(g.cfg.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), g.cfg.Interval)
+			if err := g.sync(ctx); err != nil {
+				log.Error().Err(err).Str("url", redactedURL(g.cfg.URL)).Msg("Could not sync labels from git, keeping the last good labels")
+			}
+			cancel()
+		}
+	}()
+	return nil
+}
+
+func (g *GitHandler) GetLabels(token OAuthToken) (map[string]bool, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return mergeLabels(g.labels, token)
+}
+
+// sync pulls the branch and swaps in its labels if they are valid.
+func (g *GitHandler) sync(ctx context.Context) error {
+	revision, err := g.pull(ctx)
+	if err != nil {
+		gitSyncs.WithLabelValues("pull_failed").Inc()
+		return err
+	}
+	g.mu.RLock()
+	unchanged := revision == g.revision
+	g.mu.RUnlock()
+	if unchanged {
+		gitSyncs.WithLabelValues("unchanged").Inc()
+		gitLastSync.SetToCurrentTime()
+		return nil
+	}
+
+	labels, problems := checkLabelsFile([]string{filepath.Join(g.cfg.Dir, g.cfg.Path)})
+	if len(problems) > 0 {
+		gitSyncs.WithLabelValues("invalid").Inc()
+		return fmt.Errorf("labels of revision %s are invalid: %w", revision, errors.Join(problems...))
+	}
+	g.mu.Lock()
+	g.labels, g.revision = labels, revision
+	g.mu.Unlock()
+	gitSyncs.WithLabelValues("updated").Inc()
+	gitLastSync.SetToCurrentTime()
+	log.Info().Str("revision", revision).Int("identities", len(labels)).Msg("Loaded labels from git")
+	return nil
+}
+
+// pull clones the branch into the checkout or fetches and resets it to the remote branch, and returns the revision.
+func (g *GitHandler) pull(ctx context.Context) (string, error) {
+	if _, err := os.Stat(filepath.Join(g.cfg.Dir, ".git")); err != nil {
+		if err := os.RemoveAll(g.cfg.Dir); err != nil {
+			return "", err
+		}
+		if _, err := g.git(ctx, "", "clone", "--quiet", "--depth", "1", "--single-branch", "--branch", g.cfg.Branch, g.cfg.URL, g.cfg.Dir); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := g.git(ctx, g.cfg.Dir, "fetch", "--quiet", "--depth", "1", "origin", g.cfg.Branch); err != nil {
+			return "", err
+		}
+		if _, err := g.git(ctx, g.cfg.Dir, "reset", "--quiet", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+	}
+	revision, err := g.git(ctx, g.cfg.Dir, "rev-parse", "HEAD")
+	return strings.TrimSpace(revision), err
+}
+
+// git runs a git command with the credentials of the config. The token is passed in the environment,
+// so it does not show up in the process list or the checkout's config.
+func (g *GitHandler) git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if g.cfg.SSHKeyPath != "" {
+		hostKeys := "-o StrictHostKeyChecking=accept-new"
+		if g.cfg.KnownHostsPath != "" {
+			hostKeys = fmt.Sprintf("-o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s", g.cfg.KnownHostsPath)
+		}
+		env = append(env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes %s", g.cfg.SSHKeyPath, hostKeys))
+	}
+	if g.cfg.TokenPath != "" {
+		token, err := os.ReadFile(g.cfg.TokenPath)
+		if err != nil {
+			return "", fmt.Errorf("could not read git token: %w", err)
+		}
+		user := g.cfg.User
+		if user == "" {
+			user = "git"
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(user + ":" + strings.TrimSpace(string(token))))
+		env = append(env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0=Authorization: Basic "+credentials)
+	}
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
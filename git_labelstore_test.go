@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// commitLabels writes labels.yaml into the directory of the repository and commits it.
+func commitLabels(t *testing.T, repo string, dir string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(repo, dir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, dir, "labels.yaml"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"add", "-A"}, {"commit", "--quiet", "-m", "update labels"}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+}
+
+func TestGitHandler(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo := t.TempDir()
+	if out, err := exec.Command("git", "init", "--quiet", "--initial-branch", "main", repo).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	commitLabels(t, repo, "prod", "jane:\n  team-a: true\nplatform:\n  '#cluster-wide': true\n")
+
+	g := &GitHandler{}
+	app := newApp(&Config{Git: GitConfig{URL: repo, Path: "prod", Dir: filepath.Join(t.TempDir(), "checkout"), Interval: time.Hour}})
+	if err := g.Connect(app); err != nil {
+		t.Fatal(err)
+	}
+
+	labels, skip := g.GetLabels(OAuthToken{PreferredUsername: "jane"})
+	assert.False(t, skip)
+	assert.Equal(t, map[string]bool{"team-a": true}, labels)
+	_, skip = g.GetLabels(OAuthToken{PreferredUsername: "john", Groups: []string{"platform"}})
+	assert.True(t, skip)
+
+	// an invalid revision keeps the last good labels
+	commitLabels(t, repo, "prod", "jane:\n  team-a: false\n")
+	assert.ErrorContains(t, g.sync(context.Background()), "invalid")
+	labels, _ = g.GetLabels(OAuthToken{PreferredUsername: "jane"})
+	assert.Equal(t, map[string]bool{"team-a": true}, labels)
+
+	commitLabels(t, repo, "prod", "jane:\n  team-a: true\n  team-b: true\n")
+	assert.NoError(t, g.sync(context.Background()))
+	labels, _ = g.GetLabels(OAuthToken{PreferredUsername: "jane"})
+	assert.Equal(t, map[string]bool{"team-a": true, "team-b": true}, labels)
+	assert.NoError(t, g.sync(context.Background()), "unchanged revision")
+
+	failing := &GitHandler{}
+	app.Cfg().Git.URL = filepath.Join(t.TempDir(), "missing")
+	app.Cfg().Git.Dir = filepath.Join(t.TempDir(), "checkout")
+	assert.ErrorContains(t, failing.Connect(app), "git clone")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Grant is a set of allowed values per label. A series is covered by a grant if it matches one of the
+// allowed values of every label of the grant, the labels of a grant are combined with AND.
+//
+// In the label store a grant is written as a label selector without braces, e.g.
+// `cluster="a",namespace=~"ns1|ns2"`. Plain values are grants on the tenant label only.
+// A user with several grants may access everything covered by any of them, grants are combined with OR.
+type Grant map[string]map[string]bool
+
+// parseGrant parses a tenant label value into a grant. Only equality and regex alternation
+// matchers are allowed, as the values of a grant have to be enumerable.
+func parseGrant(value string, labelMatch string) (Grant, error) {
+	if !strings.Contains(value, "=") {
+		return Grant{labelMatch: {value: true}}, nil
+	}
+	matchers, err := parser.ParseMetricSelector("{" + value + "}")
+	if err != nil {
+		return nil, fmt.Errorf("invalid grant %s: %w", value, err)
+	}
+	grant := Grant{}
+	for _, m := range matchers {
+		if m.Type != labels.MatchEqual && m.Type != labels.MatchRegexp {
+			return nil, fmt.Errorf("invalid grant %s: only = and =~ matchers are allowed", value)
+		}
+		if _, ok := grant[m.Name]; ok {
+			return nil, fmt.Errorf("invalid grant %s: label %s is used more than once", value, m.Name)
+		}
+		grant[m.Name] = map[string]bool{}
+		for _, v := range strings.Split(m.Value, "|") {
+			grant[m.Name][v] = true
+		}
+	}
+	return grant, nil
+}
+
+// parseGrants parses all tenant labels into grants.
+func parseGrants(tenantLabels map[string]bool, labelMatch string) ([]Grant, error) {
+	grants := make([]Grant, 0, len(tenantLabels))
+	for value := range tenantLabels {
+		grant, err := parseGrant(value, labelMatch)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// enforceGrantMatchers restricts the matchers of a single selector to the given grants.
+// Values the selector already selects on a granted label must all be covered by one grant, the
+// grants compatible with the selector are then injected as matchers for the labels the selector
+// does not restrict itself. If the compatible grants can not be expressed as one selector, for
+// example (a, ns1) OR (b, ns3) for an unrestricted query, the query is rejected and has to
+// select the grant explicitly.
+func enforceGrantMatchers(queryMatches []*labels.Matcher, grants []Grant) ([]*labels.Matcher, error) {
+	selected := map[string][]string{}
+	for _, m := range queryMatches {
+		if m.Type == labels.MatchEqual || m.Type == labels.MatchRegexp {
+			selected[m.Name] = append(selected[m.Name], strings.Split(m.Value, "|")...)
+		}
+	}
+
+	var compatible []Grant
+	for _, grant := range grants {
+		if grantCovers(grant, selected) {
+			compatible = append(compatible, grant)
+		}
+	}
+	if len(compatible) == 0 {
+		return nil, fmt.Errorf("unauthorized labels %s", formatSelected(selected, grants))
+	}
+
+	merged := mergeGrants(compatible)
+	if len(merged) > 1 {
+		return nil, fmt.Errorf("query matches several grants, select one of them explicitly with the labels %s", strings.Join(grantLabels(merged), ", "))
+	}
+	for _, name := range grantLabels(merged) {
+		if _, ok := selected[name]; ok {
+			continue
+		}
+		values := MapKeysToArray(merged[0][name])
+		sort.Strings(values)
+		matchType := labels.MatchEqual
+		if len(values) > 1 {
+			matchType = labels.MatchRegexp
+		}
+		queryMatches = append(queryMatches, &labels.Matcher{
+			Type:  matchType,
+			Name:  name,
+			Value: strings.Join(values, "|"),
+		})
+	}
+	return queryMatches, nil
+}
+
+// grantCovers reports whether every value the selector selects on a label of the grant is allowed by the grant.
+func grantCovers(grant Grant, selected map[string][]string) bool {
+	for name, allowed := range grant {
+		for _, v := range selected[name] {
+			if !allowed[v] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// mergeGrants combines grants that differ in the values of at most one label, as their union
+// can be expressed as a single selector. It merges until no more grants can be combined.
+func mergeGrants(grants []Grant) []Grant {
+	merged := make([]Grant, 0, len(grants))
+	for _, g := range grants {
+		merged = append(merged, copyGrant(g))
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(merged) && !changed; i++ {
+			for j := i + 1; j < len(merged) && !changed; j++ {
+				if name, ok := mergeableOn(merged[i], merged[j]); ok {
+					for v := range merged[j][name] {
+						merged[i][name][v] = true
+					}
+					merged = append(merged[:j], merged[j+1:]...)
+					changed = true
+				}
+			}
+		}
+	}
+	return merged
+}
+
+// mergeableOn returns the label two grants differ in, if they have the same labels and differ in at most one of them.
+func mergeableOn(a Grant, b Grant) (string, bool) {
+	if len(a) != len(b) {
+		return "", false
+	}
+	differs := ""
+	for name, values := range a {
+		other, ok := b[name]
+		if !ok {
+			return "", false
+		}
+		if len(values) == len(other) && grantCovers(Grant{name: values}, map[string][]string{name: MapKeysToArray(other)}) {
+			continue
+		}
+		if differs != "" {
+			return "", false
+		}
+		differs = name
+	}
+	if differs == "" {
+		// identical grants, merge on any label
+		for name := range a {
+			return name, true
+		}
+	}
+	return differs, true
+}
+
+func copyGrant(g Grant) Grant {
+	c := make(Grant, len(g))
+	for name, values := range g {
+		c[name] = make(map[string]bool, len(values))
+		for v := range values {
+			c[name][v] = true
+		}
+	}
+	return c
+}
+
+// grantLabels returns the sorted names of all labels used in the grants.
+func grantLabels(grants []Grant) []string {
+	names := map[string]bool{}
+	for _, g := range grants {
+		for name := range g {
+			names[name] = true
+		}
+	}
+	keys := MapKeysToArray(names)
+	sort.Strings(keys)
+	return keys
+}
+
+// formatSelected renders the values the selector selects on granted labels for error messages.
+func formatSelected(selected map[string][]string, grants []Grant) string {
+	var parts []string
+	for _, name := range grantLabels(grants) {
+		if values, ok := selected[name]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", name, strings.Join(values, "|")))
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGrant(t *testing.T) {
+	grant, err := parseGrant(`cluster="a",namespace=~"ns1|ns2"`, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, Grant{"cluster": {"a": true}, "namespace": {"ns1": true, "ns2": true}}, grant)
+
+	grant, err = parseGrant("ns1", "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, Grant{"namespace": {"ns1": true}}, grant)
+
+	_, err = parseGrant(`cluster!="a"`, "namespace")
+	assert.Error(t, err)
+	_, err = parseGrant(`cluster="a",cluster="b"`, "namespace")
+	assert.Error(t, err)
+	_, err = parseGrant(`cluster="a`, "namespace")
+	assert.Error(t, err)
+}
+
+func TestGrantEnforcement(t *testing.T) {
+	and := map[string]bool{`cluster="a",namespace=~"ns1|ns2"`: true}
+	pairs := map[string]bool{`cluster="a",namespace="ns1"`: true, `cluster="b",namespace="ns3"`: true}
+	sameCluster := map[string]bool{`cluster="a",namespace="ns1"`: true, `cluster="a",namespace="ns2"`: true}
+
+	tests := []struct {
+		name         string
+		enforcer     EnforceQL
+		query        string
+		tenantLabels map[string]bool
+		want         string
+		wantErr      bool
+	}{
+		{name: "and grant", enforcer: PromQLEnforcer{}, query: "up", tenantLabels: and, want: `up{cluster="a",namespace=~"ns1|ns2"}`},
+		{name: "and grant narrowed", enforcer: PromQLEnforcer{}, query: `up{namespace="ns2"}`, tenantLabels: and, want: `up{cluster="a",namespace="ns2"}`},
+		{name: "and grant other cluster", enforcer: PromQLEnforcer{}, query: `up{cluster="b"}`, tenantLabels: and, wantErr: true},
+		{name: "pair selected by cluster", enforcer: PromQLEnforcer{}, query: `up{cluster="b"}`, tenantLabels: pairs, want: `up{cluster="b",namespace="ns3"}`},
+		{name: "pair selected by namespace", enforcer: PromQLEnforcer{}, query: `up{namespace="ns1"}`, tenantLabels: pairs, want: `up{cluster="a",namespace="ns1"}`},
+		{name: "pair not granted", enforcer: PromQLEnforcer{}, query: `up{cluster="a",namespace="ns3"}`, tenantLabels: pairs, wantErr: true},
+		{name: "pairs unrestricted", enforcer: PromQLEnforcer{}, query: "up", tenantLabels: pairs, wantErr: true},
+		{name: "pairs merged", enforcer: PromQLEnforcer{}, query: "up", tenantLabels: sameCluster, want: `up{cluster="a",namespace=~"ns1|ns2"}`},
+		{name: "selectors enforced separately", enforcer: PromQLEnforcer{}, query: `up{cluster="a"} / on() up{cluster="b"}`, tenantLabels: pairs, want: `up{cluster="a",namespace="ns1"} / on () up{cluster="b",namespace="ns3"}`},
+		{name: "matrix selector", enforcer: PromQLEnforcer{}, query: `rate(http_requests_total{cluster="a"}[5m])`, tenantLabels: pairs, want: `rate(http_requests_total{cluster="a",namespace="ns1"}[5m])`},
+		{name: "empty query", enforcer: PromQLEnforcer{}, query: "", tenantLabels: and, want: `{cluster="a",namespace=~"ns1|ns2"}`},
+		{name: "plain value mixed with grant", enforcer: PromQLEnforcer{}, query: `up{cluster="c"}`, tenantLabels: map[string]bool{"ns4": true, `cluster="a",namespace="ns1"`: true}, want: `up{cluster="c",namespace="ns4"}`},
+		{name: "logql and grant", enforcer: LogQLEnforcer{}, query: `{app="api"}`, tenantLabels: and, want: `{app="api", cluster="a", namespace=~"ns1|ns2"}`},
+		{name: "logql pair", enforcer: LogQLEnforcer{}, query: `sum(rate({cluster="b"} |= "error" [5m]))`, tenantLabels: pairs, want: `sum(rate(({cluster="b", namespace="ns3"} |= "error") [5m]))`},
+		{name: "logql pairs unrestricted", enforcer: LogQLEnforcer{}, query: `{app="api"}`, tenantLabels: pairs, wantErr: true},
+		{name: "logql empty query", enforcer: LogQLEnforcer{}, query: "", tenantLabels: and, want: `{cluster="a", namespace=~"ns1|ns2"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.enforcer.Enforce(tt.query, tt.tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var hedgedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_hedged_requests_total",
+	Help: "Number of requests a hedged duplicate was sent for, by upstream and the attempt that answered first.",
+}, []string{"upstream", "winner"})
+
+// hedgedReadPaths are the POST APIs that only read, so that sending them twice is safe.
+var hedgedReadPaths = []string{
+	"/api/v1/query", "/api/v1/query_range", "/api/v1/series", "/api/v1/labels", "/api/v1/query_exemplars",
+	"/api/v1/format_query", "/api/v1/index/stats",
+}
+
+// isHedgeable reports whether a request may be sent twice: reads with GET or HEAD, and POST requests of the
+// query APIs. WebSocket upgrades of live tails are never duplicated.
+func isHedgeable(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		for _, path := range hedgedReadPaths {
+			if strings.HasSuffix(r.URL.Path, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hedgeResult is the outcome of one attempt of a hedged request.
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+}
+
+// hedgedRoundTrip sends the request and, if it was not answered after the delay, a duplicate of it. The first
+// response is returned and the other attempt is cancelled, so that a single slow replica, like a Thanos store
+// gateway, does not hold up the request. New connections of the duplicate are spread across the replicas by
+// the dialer, see discoveryDialer. If an attempt fails while the other is still running, its answer is awaited.
+func hedgedRoundTrip(next http.RoundTripper, r *http.Request, upstream string, delay time.Duration) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func() {
+		ctx, cancel := context.WithCancel(r.Context())
+		cancels = append(cancels, cancel)
+		req := r.Clone(ctx)
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+		}
+		attempt := len(cancels) - 1
+		go func() {
+			resp, err := next.RoundTrip(req)
+			results <- hedgeResult{attempt: attempt, resp: resp, err: err}
+		}()
+	}
+
+	send()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			send()
+			pending++
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				cancels[result.attempt]()
+				if pending > 0 {
+					continue
+				}
+				return nil, result.err
+			}
+			if len(cancels) > 1 {
+				winner := "original"
+				if result.attempt > 0 {
+					winner = "hedge"
+				}
+				hedgedRequests.WithLabelValues(upstream, winner).Inc()
+			}
+			for i, cancel := range cancels {
+				if i != result.attempt {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func() {
+					if loser := <-results; loser.resp != nil {
+						_ = loser.resp.Body.Close()
+					}
+				}()
+			}
+			// the winner is cancelled once its body was read
+			result.resp.Body = &cancelOnClose{ReadCloser: result.resp.Body, cancel: cancels[result.attempt]}
+			return result.resp, nil
+		}
+	}
+}
+
+// cancelOnClose releases the context of a request when its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsHedgeable(t *testing.T) {
+	for _, c := range []struct {
+		method, path string
+		hedgeable    bool
+	}{
+		{http.MethodGet, "/api/v1/query", true},
+		{http.MethodGet, "/loki/api/v1/delete", true},
+		{http.MethodPost, "/api/v1/query_range", true},
+		{http.MethodPost, "/prefix/api/v1/series", true},
+		{http.MethodPost, "/loki/api/v1/delete", false},
+		{http.MethodPut, "/api/v1/admin/tsdb/snapshot", false},
+	} {
+		assert.Equal(t, c.hedgeable, isHedgeable(httptest.NewRequest(c.method, c.path, nil)), c.method+" "+c.path)
+	}
+	tail := httptest.NewRequest(http.MethodGet, "/loki/api/v1/tail", nil)
+	tail.Header.Set("Upgrade", "websocket")
+	assert.False(t, isHedgeable(tail))
+}
+
+func TestE2E_HedgedRequests(t *testing.T) {
+	var calls atomic.Int32
+	cancelled := make(chan struct{})
+	thanos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		query := r.PostForm.Get("query")
+		if calls.Add(1) == 1 {
+			// a slow store gateway
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[]},"query":%q}`, query)
+	}))
+	t.Cleanup(thanos.Close)
+
+	env := newE2EEnv(t)
+	env.App.Cfg().Thanos.URL = thanos.URL
+	env.App.Cfg().Thanos.Client.HedgeDelay = 20 * time.Millisecond
+	env.App.WithUpstreamClients()
+	env.App.WithRoutes()
+
+	start := time.Now()
+	rr := env.do(http.MethodPost, "/api/v1/query", "userTenant", "query="+url.QueryEscape("up"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Contains(t, rr.Body.String(), `tenant_id=~`, "the duplicate is sent with the enforced body")
+	assert.Equal(t, int32(2), calls.Load())
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the slow attempt was not cancelled")
+	}
+
+	metrics := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, metrics.Body.String(), `multena_hedged_requests_total{upstream="thanos",winner="hedge"}`)
+}
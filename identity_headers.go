@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// IdentityHeadersConfig forwards the verified identity of requests to the upstreams, so that they and their logs
+// can attribute load to users. Empty header names use the defaults.
+type IdentityHeadersConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// UserHeader carries the username, defaults to X-Forwarded-User.
+	UserHeader string `mapstructure:"user_header"`
+	// GroupsHeader carries the comma separated groups, defaults to X-Forwarded-Groups.
+	GroupsHeader string `mapstructure:"groups_header"`
+	// ClientCertHeader carries a summary of the verified client certificate of listeners with a client_ca,
+	// defaults to X-Forwarded-Client-Cert.
+	ClientCertHeader string `mapstructure:"client_cert_header"`
+}
+
+// headers returns the names of the user, groups and client certificate headers.
+func (c IdentityHeadersConfig) headers() (string, string, string) {
+	user, groups, cert := c.UserHeader, c.GroupsHeader, c.ClientCertHeader
+	if user == "" {
+		user = "X-Forwarded-User"
+	}
+	if groups == "" {
+		groups = "X-Forwarded-Groups"
+	}
+	if cert == "" {
+		cert = "X-Forwarded-Client-Cert"
+	}
+	return user, groups, cert
+}
+
+// identityHeaderGuard removes the identity headers from incoming requests, so that clients cannot pass a spoofed
+// identity to the upstreams. The headers forward-auth reads the identity from are kept for it, they are only
+// trusted from its trusted sources and replaced by the verified identity after the authentication.
+func (a *App) identityHeaderGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.Cfg().IdentityHeaders
+		if cfg.Enabled {
+			user, groups, cert := cfg.headers()
+			for _, name := range []string{user, groups, cert} {
+				if a.forwardAuth != nil && (strings.EqualFold(name, a.forwardAuth.cfg.UserHeader) ||
+					strings.EqualFold(name, a.forwardAuth.cfg.GroupsHeader)) {
+					continue
+				}
+				r.Header.Del(name)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setIdentityHeaders sets the identity headers of an authenticated request to its verified identity.
+// Headers without a value for the identity are removed.
+func setIdentityHeaders(r *http.Request, cfg IdentityHeadersConfig, token OAuthToken) {
+	if !cfg.Enabled {
+		return
+	}
+	user, groups, cert := cfg.headers()
+	var names []string
+	for _, group := range token.Groups {
+		if group != "" {
+			names = append(names, group)
+		}
+	}
+	for name, value := range map[string]string{
+		user:   token.PreferredUsername,
+		groups: strings.Join(names, ","),
+		cert:   clientCertSummary(r),
+	} {
+		if value == "" {
+			r.Header.Del(name)
+		} else {
+			r.Header.Set(name, value)
+		}
+	}
+}
+
+// clientCertSummary describes the verified client certificate of the request in the format of Envoy's
+// X-Forwarded-Client-Cert, with the SHA-256 hash of the certificate, its subject and its first URI, e.g. a SPIFFE ID.
+// Requests without a verified certificate have no summary.
+func clientCertSummary(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	hash := sha256.Sum256(cert.Raw)
+	summary := fmt.Sprintf("Hash=%s;Subject=%q", hex.EncodeToString(hash[:]), cert.Subject.String())
+	if len(cert.URIs) > 0 {
+		summary += ";URI=" + cert.URIs[0].String()
+	}
+	return summary
+}
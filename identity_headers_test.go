@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestE2E_IdentityHeaders(t *testing.T) {
+	env := newE2EEnv(t)
+	send := func(token string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set("Authorization", "Bearer "+env.Tokens[token])
+		req.Header.Set("X-Forwarded-User", "admin")
+		req.Header.Set("X-Forwarded-Client-Cert", "Hash=spoofed")
+		rr := httptest.NewRecorder()
+		env.App.e.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		upstream, _ := env.Thanos.LastRequest()
+		return upstream.Header
+	}
+
+	header := send("groupsTenant")
+	assert.Equal(t, "admin", header.Get("X-Forwarded-User"), "disabled identity headers are passed through")
+
+	env.App.Cfg().IdentityHeaders = IdentityHeadersConfig{Enabled: true, GroupsHeader: "X-Auth-Groups"}
+	header = send("groupsTenant")
+	assert.Equal(t, "not-a-user", header.Get("X-Forwarded-User"))
+	assert.Equal(t, "group1,group2", header.Get("X-Auth-Groups"))
+	assert.Empty(t, header.Values("X-Forwarded-Client-Cert"))
+
+	header = send("userTenant")
+	assert.Equal(t, "user", header.Get("X-Forwarded-User"))
+	assert.Empty(t, header.Values("X-Auth-Groups"))
+
+	// requests that are not authenticated are not forwarded with the client's headers, also in dry-run mode
+	env.App.Cfg().Web.DryRun = true
+	env.Thanos.Reset()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("X-Forwarded-User", "admin")
+	rr := httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Empty(t, env.Thanos.Requests())
+}
+
+func TestClientCertSummary(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/grafana/sa/grafana")
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "grafana", Organization: []string{"monitoring"}}, URIs: []*url.URL{spiffe}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Empty(t, clientCertSummary(r))
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	assert.Empty(t, clientCertSummary(r), "unverified certificates are not summarized")
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	summary := clientCertSummary(r)
+	assert.True(t, strings.HasPrefix(summary, "Hash="), summary)
+	assert.True(t, strings.HasSuffix(summary, `;Subject="CN=grafana,O=monitoring";URI=spiffe://cluster.local/ns/grafana/sa/grafana`), summary)
+}
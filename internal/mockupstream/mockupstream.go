@@ -0,0 +1,143 @@
+// Package mockupstream provides fake Thanos and Loki HTTP servers with canned
+// responses. The servers record every request they receive so tests can assert
+// on what the proxy forwarded upstream.
+package mockupstream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Response is a canned response served for a path.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   string
+}
+
+// Request is a recorded request as received by the mock upstream.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	// Params contains the URL query and, for form encoded POST requests, the form body.
+	Params url.Values
+}
+
+// Server is a fake upstream that answers with canned responses per path.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]Response
+	fallback  Response
+	requests  []Request
+}
+
+// New starts a mock upstream that answers every request with the given fallback response
+// unless a more specific response is set for the path.
+func New(fallback Response) *Server {
+	s := &Server{
+		responses: map[string]Response{},
+		fallback:  fallback,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewThanos starts a mock upstream that answers like a Thanos querier.
+func NewThanos() *Server {
+	s := New(Response{Status: http.StatusOK, Body: `{"status":"success","data":{"resultType":"vector","result":[]}}`})
+	s.SetResponse("/api/v1/query_range", http.StatusOK, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+	s.SetResponse("/api/v1/series", http.StatusOK, `{"status":"success","data":[]}`)
+	s.SetResponse("/api/v1/labels", http.StatusOK, `{"status":"success","data":["__name__","namespace"]}`)
+	s.SetResponse("/api/v1/status/buildinfo", http.StatusOK, `{"status":"success","data":{"version":"2.53.0"}}`)
+	return s
+}
+
+// NewLoki starts a mock upstream that answers like a Loki querier.
+func NewLoki() *Server {
+	s := New(Response{Status: http.StatusOK, Body: `{"status":"success","data":{"resultType":"streams","result":[]}}`})
+	s.SetResponse("/loki/api/v1/series", http.StatusOK, `{"status":"success","data":[]}`)
+	s.SetResponse("/loki/api/v1/labels", http.StatusOK, `{"status":"success","data":["kubernetes_namespace_name"]}`)
+	s.SetResponse("/loki/api/v1/index/stats", http.StatusOK, `{"streams":0,"chunks":0,"entries":0,"bytes":0}`)
+	s.SetResponse("/loki/api/v1/status/buildinfo", http.StatusOK, `{"version":"3.1.0"}`)
+	return s
+}
+
+// SetResponse sets the canned JSON response for the given path.
+func (s *Server) SetResponse(path string, status int, body string) {
+	s.SetRawResponse(path, Response{
+		Status: status,
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   body,
+	})
+}
+
+// SetRawResponse sets the canned response for the given path.
+func (s *Server) SetRawResponse(path string, resp Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[path] = resp
+}
+
+// Requests returns all requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// LastRequest returns the most recently received request and whether there was one.
+func (s *Server) LastRequest() (Request, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		return Request{}, false
+	}
+	return s.requests[len(s.requests)-1], true
+}
+
+// Reset forgets all recorded requests.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		body, _ := io.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		for k, v := range form {
+			params[k] = append(params[k], v...)
+		}
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header.Clone(),
+		Params: params,
+	})
+	resp, ok := s.responses[r.URL.Path]
+	if !ok {
+		resp = s.fallback
+	}
+	s.mu.Unlock()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(resp.Status)
+	_, _ = io.WriteString(w, resp.Body)
+}
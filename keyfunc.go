@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/MicahParks/keyfunc/v3"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
 
 	"github.com/MicahParks/jwkset"
 )
@@ -15,32 +24,169 @@ var (
 	ErrKeyfunc = errors.New("failed keyfunc")
 )
 
-func NewCombinedJwks(ctx context.Context, urls []string, raw json.RawMessage) (keyfunc.Keyfunc, error) {
-	client, err := jwkset.NewDefaultHTTPClientCtx(ctx, urls)
+// jwksPersistInterval is how often the keys fetched from the JWKS URLs are written to the cache by default.
+const jwksPersistInterval = time.Minute
+
+// JwksCache is the file the keys fetched from the JWKS URLs are persisted to.
+type JwksCache struct {
+	Path string
+	// Interval is how often the fetched keys are written to Path, zero uses jwksPersistInterval.
+	Interval time.Duration
+}
+
+// NewCombinedJwks creates a keyfunc from the JWK Sets at the given URLs and the raw JWK Set.
+// If the cache path is set, the keys last fetched from the URLs are loaded from it and the fetched keys are
+// persisted to it in the background, so that tokens can be validated at startup while the URLs are unreachable.
+// The URLs are fetched with the client, nil uses http.DefaultClient.
+func NewCombinedJwks(ctx context.Context, urls []string, raw json.RawMessage, cache JwksCache, client *http.Client) (keyfunc.Keyfunc, error) {
+	cachePath := cache.Path
+	given := jwkset.NewMemoryStorage()
+	if raw != nil {
+		if err := writeJWKS(ctx, given, raw); err != nil {
+			return nil, err
+		}
+	}
+	if cachePath != "" {
+		cached, err := os.ReadFile(cachePath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			log.Info().Str("path", cachePath).Msg("No cached JWKS found")
+		case err != nil:
+			log.Warn().Err(err).Str("path", cachePath).Msg("Could not read cached JWKS")
+		default:
+			if err := writeJWKS(ctx, given, cached); err != nil {
+				log.Warn().Err(err).Str("path", cachePath).Msg("Could not load cached JWKS")
+			} else {
+				log.Info().Str("path", cachePath).Msg("Loaded cached JWKS")
+			}
+		}
+	}
+
+	remotes := make(map[string]jwkset.Storage, len(urls))
+	for _, u := range urls {
+		parsed, err := url.ParseRequestURI(u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse given URL %q: %w", u, errors.Join(err, ErrKeyfunc))
+		}
+		u = parsed.String()
+		remotes[u], err = jwkset.NewStorageFromHTTP(parsed, jwkset.HTTPClientStorageOptions{
+			Client:                    client,
+			Ctx:                       ctx,
+			NoErrorReturnFirstHTTPReq: true,
+			RefreshErrorHandler: func(ctx context.Context, err error) {
+				log.Error().Err(err).Str("url", u).Msg("Failed to refresh JWKS")
+			},
+			RefreshInterval: time.Hour,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP client storage for %q: %w", u, err)
+		}
+	}
+	storage, err := jwkset.NewHTTPClient(jwkset.HTTPClientOptions{
+		Given:             given,
+		HTTPURLs:          remotes,
+		RateLimitWaitMax:  time.Minute,
+		RefreshUnknownKID: rate.NewLimiter(rate.Every(5*time.Minute), 1),
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if raw != nil {
-		var jwks jwkset.JWKSMarshal
-		err := json.Unmarshal(raw, &jwks)
+	if cachePath != "" {
+		interval := cache.Interval
+		if interval <= 0 {
+			interval = jwksPersistInterval
+		}
+		go persistJWKS(ctx, remotes, cachePath, interval)
+	}
+
+	options := keyfunc.Options{
+		Storage: storage,
+	}
+	return keyfunc.New(options)
+}
+
+// writeJWKS writes all keys of the JWK Set JSON into the storage.
+func writeJWKS(ctx context.Context, storage jwkset.Storage, raw json.RawMessage) error {
+	var jwks jwkset.JWKSMarshal
+	err := json.Unmarshal(raw, &jwks)
+	if err != nil {
+		return fmt.Errorf("%w: could not unmarshal raw JWK Set JSON", errors.Join(err, ErrKeyfunc))
+	}
+	jwkss, err := jwks.JWKSlice()
+	if err != nil {
+		return fmt.Errorf("failed to create a slice of JWK from JWKSMarshal: %w", err)
+	}
+	for _, jwk := range jwkss {
+		err = storage.KeyWrite(ctx, jwk)
 		if err != nil {
-			return nil, fmt.Errorf("%w: could not unmarshal raw JWK Set JSON", errors.Join(err, ErrKeyfunc))
+			return fmt.Errorf("failed to write JWK to storage: %w", err)
 		}
-		jwkss, err := jwks.JWKSlice()
+	}
+	return nil
+}
+
+// persistJWKS writes the public keys fetched from the remotes to path every interval if they changed,
+// until ctx is done.
+func persistJWKS(ctx context.Context, remotes map[string]jwkset.Storage, path string, interval time.Duration) {
+	var last []byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		data, err := remoteJWKS(ctx, remotes)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create a slice of JWK from JWKSMarshal: %w", err)
+			log.Warn().Err(err).Msg("Could not collect JWKS for the cache")
+		} else if data != nil && !bytes.Equal(data, last) {
+			if err := writeFileAtomic(path, data); err != nil {
+				log.Warn().Err(err).Str("path", path).Msg("Could not persist JWKS")
+			} else {
+				log.Debug().Str("path", path).Msg("Persisted JWKS")
+				last = data
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		for _, jwk := range jwkss {
-			err = client.KeyWrite(context.Background(), jwk)
-			if err != nil {
-				return nil, fmt.Errorf("failed to write JWK to storage: %w", err)
+	}
+}
+
+// remoteJWKS returns the public keys of all remotes as JWK Set JSON, or nil if none were fetched yet.
+func remoteJWKS(ctx context.Context, remotes map[string]jwkset.Storage) ([]byte, error) {
+	combined := jwkset.NewMemoryStorage()
+	count := 0
+	for _, remote := range remotes {
+		keys, err := remote.KeyReadAll(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if err := combined.KeyWrite(ctx, key); err != nil {
+				return nil, err
 			}
+			count++
 		}
 	}
+	if count == 0 {
+		return nil, nil
+	}
+	return combined.JSONPublic(ctx)
+}
 
-	options := keyfunc.Options{
-		Storage: client,
+// writeFileAtomic writes data to a temporary file next to path and renames it, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
 	}
-	return keyfunc.New(options)
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCombinedJwks_PersistsAndLoadsCache(t *testing.T) {
+	app, tokens := setupTestMain()
+	jwks, err := app.Jwks.Storage().JSONPublic(context.Background())
+	assert.NoError(t, err)
+
+	cache := JwksCache{Path: filepath.Join(t.TempDir(), "jwks.json"), Interval: 10 * time.Millisecond}
+
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(jwks)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	_, err = NewCombinedJwks(ctx, []string{idp.URL}, nil, cache, nil)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		cached, err := os.ReadFile(cache.Path)
+		return err == nil && json.Valid(cached)
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	idp.Close()
+
+	// the identity provider is unreachable from now on
+	ctx, cancel = context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	kf, err := NewCombinedJwks(ctx, []string{idp.URL}, nil, cache, nil)
+	assert.NoError(t, err)
+	token, err := jwt.Parse(tokens["userTenant"], kf.Keyfunc)
+	assert.NoError(t, err)
+	assert.True(t, token.Valid)
+}
+
+func TestNewCombinedJwks_InvalidCacheIsIgnored(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(cachePath, []byte("not json"), 0o600))
+	idp := httptest.NewServer(http.NotFoundHandler())
+	idp.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	_, err := NewCombinedJwks(ctx, []string{idp.URL}, nil, JwksCache{Path: cachePath}, nil)
+
+	assert.NoError(t, err)
+}
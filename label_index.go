@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// LabelIndexConfig configures the per-tenant label index of Thanos, see labelIndex.
+type LabelIndexConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Interval is the time between two builds of the index of a tenant, defaults to 5m.
+	Interval time.Duration `mapstructure:"interval"`
+	// Lookback is the time range the index covers, defaults to 1h.
+	Lookback time.Duration `mapstructure:"lookback"`
+	// IdleTimeout drops the index of a tenant that was not browsed for so long, defaults to 1h.
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// MaxTenants is the number of tenants indexed at once, defaults to 1000.
+	MaxTenants int `mapstructure:"max_tenants"`
+	// Timeout is the time a build of the index of a tenant may take, defaults to 30s.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+func (c LabelIndexConfig) withDefaults() LabelIndexConfig {
+	if c.Interval <= 0 {
+		c.Interval = 5 * time.Minute
+	}
+	if c.Lookback <= 0 {
+		c.Lookback = time.Hour
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = time.Hour
+	}
+	if c.MaxTenants <= 0 {
+		c.MaxTenants = 1000
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30 * time.Second
+	}
+	return c
+}
+
+var (
+	labelIndexRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_label_index_requests_total",
+		Help: "Number of label and label values requests looked up in the label index, by result hit or miss.",
+	}, []string{"result"})
+	labelIndexBuilds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_label_index_builds_total",
+		Help: "Number of builds of the index of a tenant, by result success or error.",
+	}, []string{"result"})
+	labelIndexTenants = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "multena_label_index_tenants",
+		Help: "Number of tenants in the label index.",
+	})
+)
+
+// tenantLabelIndex is the index of a tenant, the sorted label names and the sorted values of every label name.
+type tenantLabelIndex struct {
+	built    time.Time
+	lastUsed time.Time
+	queued   bool
+	names    []string
+	values   map[string][]string
+}
+
+// labelIndex periodically precomputes the label names and values of the tenants whose labels are browsed,
+// so that the label browser of Grafana is answered by the proxy instead of the upstream. Tenants are added
+// to the index on their first lookup, which falls back to the upstream, and dropped once they are not browsed
+// for the idle timeout. Only lookups without matchers of users without grants are answered from the index,
+// see lookup.
+type labelIndex struct {
+	cfg         LabelIndexConfig
+	upstreamURL *url.URL
+	tenantLabel string
+	rewriter    *pathRewriter
+	tls         bool
+	headers     map[string]string
+	// tenantHeaders are rendered for the tenant label only, the index is shared by all users of the tenant.
+	tenantHeaders map[string]*template.Template
+	sat           string
+	client        *http.Client
+	now           func() time.Time
+
+	mu      sync.Mutex
+	tenants map[string]*tenantLabelIndex
+	pending chan string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newLabelIndex returns the label index of the Thanos upstream and starts building it in the background.
+func newLabelIndex(cfg ThanosConfig, tenantHeaders map[string]*template.Template, a *App) (*labelIndex, error) {
+	upstreamURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	rewriter, err := newPathRewriter(cfg.PathRewrite)
+	if err != nil {
+		return nil, err
+	}
+	x := &labelIndex{
+		cfg:           cfg.LabelIndex.withDefaults(),
+		upstreamURL:   upstreamURL,
+		tenantLabel:   cfg.TenantLabel,
+		rewriter:      rewriter,
+		tls:           cfg.UseMutualTLS,
+		headers:       cfg.Headers,
+		tenantHeaders: tenantHeaders,
+		sat:           a.ServiceAccountToken,
+		client:        a.upstreams.httpClient(upstreamURL),
+		now:           time.Now,
+		tenants:       map[string]*tenantLabelIndex{},
+		pending:       make(chan string, 100),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go x.run()
+	return x, nil
+}
+
+// close stops the background builds, it is safe to call on a nil index.
+func (x *labelIndex) close() {
+	if x == nil {
+		return
+	}
+	close(x.stop)
+	<-x.done
+	labelIndexTenants.Set(0)
+}
+
+// run builds the index of tenants on their first lookup and rebuilds all indexed tenants on the interval.
+func (x *labelIndex) run() {
+	defer close(x.done)
+	ticker := time.NewTicker(x.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-x.stop:
+			return
+		case tenant := <-x.pending:
+			x.build(tenant)
+		case <-ticker.C:
+			x.refresh()
+		}
+	}
+}
+
+// refresh drops the idle tenants and rebuilds the index of the others.
+func (x *labelIndex) refresh() {
+	now := x.now()
+	var tenants []string
+	x.mu.Lock()
+	for tenant, index := range x.tenants {
+		if now.Sub(index.lastUsed) > x.cfg.IdleTimeout {
+			delete(x.tenants, tenant)
+			continue
+		}
+		tenants = append(tenants, tenant)
+	}
+	labelIndexTenants.Set(float64(len(x.tenants)))
+	x.mu.Unlock()
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		select {
+		case <-x.stop:
+			return
+		default:
+		}
+		x.build(tenant)
+	}
+}
+
+// build fetches the label names of the tenant and the values of every name from the upstream.
+// A failed build keeps the previous index of the tenant until it is stale.
+func (x *labelIndex) build(tenant string) {
+	ctx, cancel := context.WithTimeout(context.Background(), x.cfg.Timeout)
+	defer cancel()
+	end := x.now()
+	params := url.Values{
+		"match[]": {fmt.Sprintf("{%s=%s}", x.tenantLabel, strconv.Quote(tenant))},
+		"start":   {strconv.FormatInt(end.Add(-x.cfg.Lookback).Unix(), 10)},
+		"end":     {strconv.FormatInt(end.Unix(), 10)},
+	}
+	names, err := x.fetch(ctx, "/api/v1/labels", params, tenant)
+	values := make(map[string][]string, len(names))
+	for _, name := range names {
+		if err != nil {
+			break
+		}
+		values[name], err = x.fetch(ctx, "/api/v1/label/"+name+"/values", params, tenant)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	index, ok := x.tenants[tenant]
+	if !ok {
+		return
+	}
+	index.queued = false
+	if err != nil {
+		labelIndexBuilds.WithLabelValues("error").Inc()
+		log.Error().Err(err).Str("tenant", tenant).Msg("Error building the label index of the tenant")
+		return
+	}
+	labelIndexBuilds.WithLabelValues("success").Inc()
+	index.built, index.names, index.values = end, names, values
+	log.Debug().Str("tenant", tenant).Int("labels", len(names)).Msg("Label index of the tenant built")
+}
+
+// fetch sends a label names or values request to the upstream and returns the sorted result.
+func (x *labelIndex) fetch(ctx context.Context, path string, params url.Values, tenant string) ([]string, error) {
+	u := *x.upstreamURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + x.rewriter.rewrite(path)
+	u.RawPath = ""
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(req, x.tls, x.headers, x.sat)
+	setTenantHeaders(req, x.tenantHeaders, OAuthToken{}, map[string]bool{tenant: true})
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := decodeAPIResponse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("upstream answered %d on %s: %w", resp.StatusCode, path, err)
+	}
+	var result []string
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// lookup returns the union of the indexed label names, or of the values of the label name if it is not empty,
+// of the tenant labels. It reports a miss if one of the tenants is not indexed or its index is stale, after
+// queueing the build of the missing tenants.
+func (x *labelIndex) lookup(tenantLabels map[string]bool, name string) ([]string, bool) {
+	now := x.now()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	hit := true
+	unique := map[string]bool{}
+	for tenant := range tenantLabels {
+		index, ok := x.tenants[tenant]
+		if !ok {
+			if len(x.tenants) >= x.cfg.MaxTenants {
+				hit = false
+				continue
+			}
+			index = &tenantLabelIndex{}
+			x.tenants[tenant] = index
+			labelIndexTenants.Set(float64(len(x.tenants)))
+		}
+		index.lastUsed = now
+		// an index that missed two builds is not trusted anymore
+		if index.built.IsZero() || now.Sub(index.built) > 2*x.cfg.Interval {
+			hit = false
+			if !index.queued {
+				select {
+				case x.pending <- tenant:
+					index.queued = true
+				default:
+				}
+			}
+			continue
+		}
+		result := index.names
+		if name != "" {
+			result = index.values[name]
+		}
+		for _, value := range result {
+			unique[value] = true
+		}
+	}
+	if !hit {
+		return nil, false
+	}
+	result := MapKeysToArray(unique)
+	sort.Strings(result)
+	return result, true
+}
+
+// serve answers a label names or values request of a user with the tenant labels from the index and reports
+// whether it did. Requests with matchers, with a start before the lookback or without start, of users with grants
+// and requests the index misses are left to the upstream. The limit of the request and the max_series of the quota
+// are applied to the result. Values of the tenant label are inverted as configured in label_transform, see
+// LabelTransformConfig.invertResponse.
+func (x *labelIndex) serve(w http.ResponseWriter, r *http.Request, tenantLabels map[string]bool, quota QuotaConfig, transform LabelTransformConfig) bool {
+	if x == nil || r.Method != http.MethodGet || len(tenantLabels) == 0 {
+		return false
+	}
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	var name string
+	switch route.GetName() {
+	case "/api/v1/labels":
+	case "/api/v1/label/{label}/values":
+		name = mux.Vars(r)["label"]
+	default:
+		return false
+	}
+	params := r.URL.Query()
+	if len(params["match[]"]) > 0 {
+		return false
+	}
+	start, ok := parseTimeParam(params.Get("start"))
+	if !ok || start.Before(x.now().Add(-x.cfg.Lookback)) {
+		return false
+	}
+	for label := range tenantLabels {
+		if strings.Contains(label, "=") {
+			return false
+		}
+	}
+
+	result, hit := x.lookup(tenantLabels, name)
+	if !hit {
+		labelIndexRequests.WithLabelValues("miss").Inc()
+		return false
+	}
+	labelIndexRequests.WithLabelValues("hit").Inc()
+	limit, _ := strconv.Atoi(params.Get("limit"))
+	if quota.MaxSeries > 0 && (limit <= 0 || limit > quota.MaxSeries) {
+		limit = quota.MaxSeries
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	if name == x.tenantLabel && transform.enabled() {
+		result = transform.InvertAll(result)
+	}
+	requestLogger(r).Debug().Str("label", name).Int("values", len(result)).Msg("Label lookup answered from the label index")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Status string   `json:"status"`
+		Data   []string `json:"data"`
+	}{Status: "success", Data: result})
+	return true
+}
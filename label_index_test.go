@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelIndexBuild(t *testing.T) {
+	failing := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"status":"error","error":"unavailable"}`))
+			return
+		}
+		tenant := strings.TrimSuffix(strings.TrimPrefix(r.URL.Query().Get("match[]"), `{namespace="`), `"}`)
+		switch r.URL.Path {
+		case "/prometheus/api/v1/labels":
+			_, _ = fmt.Fprint(w, `{"status":"success","data":["namespace","__name__"]}`)
+		case "/prometheus/api/v1/label/__name__/values":
+			_, _ = fmt.Fprintf(w, `{"status":"success","data":["up","%s_requests_total"]}`, tenant)
+		case "/prometheus/api/v1/label/namespace/values":
+			_, _ = fmt.Fprintf(w, `{"status":"success","data":["%s"]}`, tenant)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	upstreamURL, _ := url.Parse(upstream.URL)
+	rewriter, err := newPathRewriter(PathRewriteConfig{AddPrefix: "/prometheus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := &labelIndex{
+		cfg:         LabelIndexConfig{MaxTenants: 2}.withDefaults(),
+		upstreamURL: upstreamURL,
+		tenantLabel: "namespace",
+		rewriter:    rewriter,
+		client:      upstream.Client(),
+		now:         func() time.Time { return now },
+		tenants:     map[string]*tenantLabelIndex{},
+		pending:     make(chan string, 10),
+	}
+
+	_, hit := x.lookup(map[string]bool{"a": true, "b": true}, "")
+	assert.False(t, hit, "tenants are indexed on their first lookup")
+	x.lookup(map[string]bool{"c": true}, "")
+	assert.Len(t, x.tenants, 2, "no more than max_tenants are indexed")
+	for len(x.pending) > 0 {
+		x.build(<-x.pending)
+	}
+
+	names, hit := x.lookup(map[string]bool{"a": true, "b": true}, "")
+	assert.True(t, hit)
+	assert.Equal(t, []string{"__name__", "namespace"}, names)
+	values, _ := x.lookup(map[string]bool{"a": true, "b": true}, "__name__")
+	assert.Equal(t, []string{"a_requests_total", "b_requests_total", "up"}, values)
+	values, _ = x.lookup(map[string]bool{"a": true}, "pod")
+	assert.Empty(t, values)
+
+	failing = true
+	now = now.Add(6 * time.Minute)
+	x.refresh()
+	_, hit = x.lookup(map[string]bool{"a": true}, "")
+	assert.True(t, hit, "a failed build keeps the previous index")
+	now = now.Add(5 * time.Minute)
+	_, hit = x.lookup(map[string]bool{"a": true}, "")
+	assert.False(t, hit, "stale indexes are not used")
+
+	now = now.Add(2 * time.Hour)
+	x.refresh()
+	assert.Empty(t, x.tenants, "idle tenants are dropped")
+}
+
+func TestE2E_LabelIndex(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Thanos.LabelIndex = LabelIndexConfig{Enabled: true}
+	env.App.Cfg().Quotas = QuotasConfig{Default: QuotaConfig{MaxSeries: 2}}
+	env.App.WithRoutes()
+	t.Cleanup(env.App.labelIndex.close)
+	env.Thanos.SetResponse("/api/v1/label/__name__/values", http.StatusOK, `{"status":"success","data":["up"]}`)
+	env.Thanos.SetResponse("/api/v1/label/namespace/values", http.StatusOK, `{"status":"success","data":["ns1","ns2","ns3"]}`)
+	start := fmt.Sprint(time.Now().Add(-30 * time.Minute).Unix())
+
+	rr := env.do(http.MethodGet, "/api/v1/labels?start="+start, "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "namespace", "a miss is answered by the upstream")
+	assert.Eventually(t, func() bool {
+		_, hit := env.App.labelIndex.lookup(map[string]bool{"allowed_user": true, "also_allowed_user": true}, "")
+		return hit
+	}, 5*time.Second, 10*time.Millisecond)
+	var built []string
+	for _, req := range env.Thanos.Requests() {
+		if req.Header.Get(requestIDHeader) == "" {
+			built = append(built, req.Params.Get("match[]"))
+		}
+	}
+	assert.Contains(t, built, `{tenant_id="also_allowed_user"}`, "the index is built per tenant")
+
+	env.Thanos.Reset()
+	rr = env.do(http.MethodGet, "/api/v1/labels?start="+start, "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"success","data":["__name__","namespace"]}`, rr.Body.String())
+	rr = env.do(http.MethodGet, "/api/v1/label/namespace/values?start="+start, "userTenant", "")
+	assert.JSONEq(t, `{"status":"success","data":["ns1","ns2"]}`, rr.Body.String(), "the quota limits the values")
+	rr = env.do(http.MethodGet, "/api/v1/label/namespace/values?limit=1&start="+start, "userTenant", "")
+	assert.JSONEq(t, `{"status":"success","data":["ns1"]}`, rr.Body.String())
+	assert.Empty(t, env.Thanos.Requests())
+
+	env.do(http.MethodGet, "/api/v1/labels?start="+start+"&match[]=up", "userTenant", "")
+	env.do(http.MethodGet, "/api/v1/labels", "userTenant", "")
+	env.do(http.MethodGet, "/api/v1/labels?start="+fmt.Sprint(time.Now().Add(-2*time.Hour).Unix()), "userTenant", "")
+	assert.Len(t, env.Thanos.Requests(), 3, "lookups with matchers or outside the lookback are sent upstream")
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	logqlv2 "github.com/observatorium/api/logql/v2"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/log"
+)
+
+// LabelTransformConfig describes how tenant label values returned by the label store are
+// rewritten before enforcement, for environments where group names do not match namespaces.
+// Explicit mappings take precedence; all other values are lowercased (if enabled) and then
+// prefixed and suffixed.
+type LabelTransformConfig struct {
+	Lowercase bool              `mapstructure:"lowercase"`
+	Prefix    string            `mapstructure:"prefix"`
+	Suffix    string            `mapstructure:"suffix"`
+	Map       map[string]string `mapstructure:"map"`
+}
+
+func (t LabelTransformConfig) enabled() bool {
+	return t.Lowercase || t.Prefix != "" || t.Suffix != "" || len(t.Map) > 0
+}
+
+// Apply transforms a single label store value into the value used for enforcement.
+func (t LabelTransformConfig) Apply(value string) string {
+	if mapped, ok := t.Map[value]; ok {
+		return mapped
+	}
+	if t.Lowercase {
+		value = strings.ToLower(value)
+	}
+	return t.Prefix + value + t.Suffix
+}
+
+// validate rejects maps that rewrite several label store values to the same value, as the tenants of
+// these values could not be told apart after the transformation.
+func (t LabelTransformConfig) validate() error {
+	from := make(map[string]string, len(t.Map))
+	keys := make([]string, 0, len(t.Map))
+	for key := range t.Map {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if other, ok := from[t.Map[key]]; ok {
+			return fmt.Errorf("%q and %q are both mapped to %q", other, key, t.Map[key])
+		}
+		from[t.Map[key]] = key
+	}
+	return nil
+}
+
+// Invert transforms an enforced value back into the label store value. It is applied to the tenant label
+// values of responses, see invertResponse, and to the labels shown by /debug/enforce. Lowercasing can not be
+// undone, so the lowercased value is returned, and a value produced by both the map and the prefix and suffix
+// rules is inverted through the map.
+func (t LabelTransformConfig) Invert(value string) string {
+	for from, to := range t.Map {
+		if to == value {
+			return from
+		}
+	}
+	if strings.HasPrefix(value, t.Prefix) && strings.HasSuffix(value, t.Suffix) && len(value) >= len(t.Prefix)+len(t.Suffix) {
+		return value[len(t.Prefix) : len(value)-len(t.Suffix)]
+	}
+	return value
+}
+
+// ApplyAll transforms every tenant label of the set. The set is returned unchanged if no transformation is configured.
+// Grants on several labels are written out explicitly and passed through as they are.
+func (t LabelTransformConfig) ApplyAll(tenantLabels map[string]bool) map[string]bool {
+	if !t.enabled() || tenantLabels == nil {
+		return tenantLabels
+	}
+	transformed := make(map[string]bool, len(tenantLabels))
+	for value := range tenantLabels {
+		if strings.Contains(value, "=") {
+			transformed[value] = true
+			continue
+		}
+		transformed[t.Apply(value)] = true
+	}
+	return transformed
+}
+
+// InvertAll transforms every enforced value back into the label store value, see Invert.
+func (t LabelTransformConfig) InvertAll(values []string) []string {
+	inverted := make([]string, 0, len(values))
+	for _, value := range values {
+		inverted = append(inverted, t.Invert(value))
+	}
+	return inverted
+}
+
+// invertResponse returns the modifier inverting the transformation on the values of the tenant label in
+// label values and series responses, so that users are offered the values they know from the label store.
+// It returns nil for all other requests and if no transformation is configured.
+func (t LabelTransformConfig) invertResponse(r *http.Request, tl string) func(*http.Response) error {
+	route := mux.CurrentRoute(r)
+	if !t.enabled() || route == nil {
+		return nil
+	}
+	switch route.GetName() {
+	case "/api/v1/label/{label}/values":
+		if mux.Vars(r)["label"] != tl {
+			return nil
+		}
+		return rewriteResponseData(func(data json.RawMessage) (any, error) {
+			var values []string
+			if err := json.Unmarshal(data, &values); err != nil {
+				return nil, err
+			}
+			return t.InvertAll(values), nil
+		})
+	case "/api/v1/series":
+		return rewriteResponseData(func(data json.RawMessage) (any, error) {
+			var series []map[string]string
+			if err := json.Unmarshal(data, &series); err != nil {
+				return nil, err
+			}
+			for _, set := range series {
+				if value, ok := set[tl]; ok {
+					set[tl] = t.Invert(value)
+				}
+			}
+			return series, nil
+		})
+	default:
+		return nil
+	}
+}
+
+// rewriteResponseData returns the modifier replacing the data of a Prometheus or Loki API response with the
+// result of rewrite. Responses that are not such responses are left as they are.
+func rewriteResponseData(rewrite func(json.RawMessage) (any, error)) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+			return nil
+		}
+		body, err := readResponseBody(resp)
+		if err != nil {
+			return err
+		}
+		if rewritten, err := rewriteData(body, rewrite); err == nil {
+			body = rewritten
+		} else {
+			log.Debug().Err(err).Msg("Tenant label values not inverted, response is not a Prometheus or Loki API response")
+		}
+		setResponseBody(resp, body)
+		return nil
+	}
+}
+
+// rewriteData replaces the data of the API response body with the result of rewrite.
+func rewriteData(body []byte, rewrite func(json.RawMessage) (any, error)) ([]byte, error) {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	data, err := rewrite(envelope["data"])
+	if err != nil {
+		return nil, err
+	}
+	if envelope["data"], err = json.Marshal(data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+// labelTransformEnforcer rewrites the tenant label values of queries into enforced values before they are
+// enforced, see LabelTransformConfig.applyToQuery.
+type labelTransformEnforcer struct {
+	EnforceQL
+	transform LabelTransformConfig
+	language  string
+}
+
+func (e labelTransformEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
+	return e.EnforceQL.Enforce(e.transform.applyToQuery(query, e.language, tenantLabels, labelMatch), tenantLabels, labelMatch)
+}
+
+// enforcer returns the enforcer of the language that rewrites the values of inverted responses in queries
+// back, see applyToQuery, or the enforcer itself if no transformation is configured.
+func (t LabelTransformConfig) enforcer(enforcer EnforceQL, language string) EnforceQL {
+	if !t.enabled() {
+		return enforcer
+	}
+	return labelTransformEnforcer{EnforceQL: enforcer, transform: t, language: language}
+}
+
+// applyToQuery transforms the values of the tenant label matchers of the query that users took from
+// inverted responses, see invertResponse, into enforced values. A value is only transformed if it is not a
+// tenant label itself and its transformation is one, queries with enforced values are left as they are,
+// as are queries that can not be parsed, which the enforcer rejects.
+func (t LabelTransformConfig) applyToQuery(query string, language string, tenantLabels map[string]bool, tl string) string {
+	if query == "" {
+		return query
+	}
+	changed := false
+	transform := func(matchers []*labels.Matcher) {
+		for i, matcher := range matchers {
+			if matcher.Name != tl || (matcher.Type != labels.MatchEqual && matcher.Type != labels.MatchRegexp) {
+				continue
+			}
+			values := strings.Split(matcher.Value, "|")
+			transformed := false
+			for j, value := range values {
+				if !tenantLabels[value] && tenantLabels[t.Apply(value)] {
+					values[j] = t.Apply(value)
+					transformed = true
+				}
+			}
+			if !transformed {
+				continue
+			}
+			if m, err := labels.NewMatcher(matcher.Type, matcher.Name, strings.Join(values, "|")); err == nil {
+				matchers[i] = m
+				changed = true
+			}
+		}
+	}
+	if language == "logql" {
+		expr, err := logqlv2.ParseExpr(query)
+		if err != nil {
+			return query
+		}
+		expr.Walk(func(e interface{}) {
+			if stream, ok := e.(*logqlv2.StreamMatcherExpr); ok {
+				matchers := stream.Matchers()
+				transform(matchers)
+				stream.SetMatchers(matchers)
+			}
+		})
+		if !changed {
+			return query
+		}
+		return expr.String()
+	}
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return query
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if selector, ok := node.(*parser.VectorSelector); ok {
+			transform(selector.LabelMatchers)
+		}
+		return nil
+	})
+	if !changed {
+		return query
+	}
+	return expr.String()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelTransform(t *testing.T) {
+	transform := LabelTransformConfig{
+		Lowercase: true,
+		Prefix:    "ns-",
+		Suffix:    "-prod",
+		Map:       map[string]string{"platform": "openshift-monitoring"},
+	}
+
+	assert.Equal(t, "ns-team-a-prod", transform.Apply("Team-A"))
+	assert.Equal(t, "openshift-monitoring", transform.Apply("platform"))
+	assert.Equal(t, "team-a", transform.Invert("ns-team-a-prod"))
+	assert.Equal(t, "platform", transform.Invert("openshift-monitoring"))
+	assert.Equal(t, "other", transform.Invert("other"))
+
+	assert.Equal(t, map[string]bool{"ns-team-a-prod": true, "openshift-monitoring": true},
+		transform.ApplyAll(map[string]bool{"Team-A": true, "platform": true}))
+
+	none := LabelTransformConfig{}
+	labels := map[string]bool{"Team-A": true}
+	assert.Equal(t, labels, none.ApplyAll(labels))
+	assert.Nil(t, transform.ApplyAll(nil))
+}
+
+func TestLabelTransformMapCollision(t *testing.T) {
+	assert.NoError(t, LabelTransformConfig{Map: map[string]string{"platform": "openshift-monitoring", "infra": "openshift-infra"}}.validate())
+
+	collision := LabelTransformConfig{Map: map[string]string{"platform": "openshift-monitoring", "monitoring": "openshift-monitoring"}}
+	assert.EqualError(t, collision.validate(), `"monitoring" and "platform" are both mapped to "openshift-monitoring"`)
+
+	var messages []string
+	for _, p := range checkConfig(&Config{LabelTransform: collision}) {
+		messages = append(messages, p.Error())
+	}
+	assert.Contains(t, messages, `label_transform.map: "monitoring" and "platform" are both mapped to "openshift-monitoring"`)
+}
+
+func TestValidateLabelsAppliesTransform(t *testing.T) {
+	app, tokens := setupTestMain()
+	app.Cfg().LabelTransform = LabelTransformConfig{Prefix: "ns-"}
+	oauthToken, _, _ := parseJwtToken(tokens["groupTenant"], app.Cfg(), app)
+
+	tenantLabels, skip, err := validateLabels(oauthToken, app.Cfg(), app)
+
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.Equal(t, map[string]bool{"ns-allowed_group1": true, "ns-also_allowed_group1": true}, tenantLabels)
+}
+
+func TestLabelTransformApplyToQuery(t *testing.T) {
+	transform := LabelTransformConfig{Prefix: "ns-"}
+	tenantLabels := map[string]bool{"ns-team-a": true, "ns-team-b": true}
+
+	assert.Equal(t, `up{tenant_id="ns-team-a"}`, transform.applyToQuery(`up{tenant_id="team-a"}`, "promql", tenantLabels, "tenant_id"))
+	assert.Equal(t, `up{tenant_id=~"ns-team-a|ns-team-b"}`, transform.applyToQuery(`up{tenant_id=~"team-a|ns-team-b"}`, "promql", tenantLabels, "tenant_id"))
+	assert.Equal(t, `up{tenant_id="ns-team-a"}`, transform.applyToQuery(`up{tenant_id="ns-team-a"}`, "promql", tenantLabels, "tenant_id"))
+	assert.Equal(t, `up{tenant_id="team-c"}`, transform.applyToQuery(`up{tenant_id="team-c"}`, "promql", tenantLabels, "tenant_id"))
+	assert.Equal(t, `up{app="team-a"}`, transform.applyToQuery(`up{app="team-a"}`, "promql", tenantLabels, "tenant_id"))
+	assert.Equal(t, `{tenant_id="ns-team-a"} |= "error"`, transform.applyToQuery(`{tenant_id="team-a"} |= "error"`, "logql", tenantLabels, "tenant_id"))
+	assert.Equal(t, `{tenant_id="team-a"`, transform.applyToQuery(`{tenant_id="team-a"`, "logql", tenantLabels, "tenant_id"))
+}
+
+func TestE2E_LabelTransformInvertsResponses(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().LabelTransform = LabelTransformConfig{Prefix: "ns-"}
+	env.Thanos.SetResponse("/api/v1/label/tenant_id/values", http.StatusOK, `{"status":"success","data":["ns-allowed_user","ns-also_allowed_user"]}`)
+	env.Thanos.SetResponse("/api/v1/label/job/values", http.StatusOK, `{"status":"success","data":["ns-job"]}`)
+	env.Loki.SetResponse("/loki/api/v1/series", http.StatusOK, `{"status":"success","data":[{"tenant_id":"ns-allowed_user","app":"ns-app"}]}`)
+
+	rr := env.do(http.MethodGet, "/api/v1/label/tenant_id/values", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"success","data":["allowed_user","also_allowed_user"]}`, rr.Body.String())
+
+	rr = env.do(http.MethodGet, "/api/v1/label/job/values", "userTenant", "")
+	assert.JSONEq(t, `{"status":"success","data":["ns-job"]}`, rr.Body.String())
+
+	rr = env.do(http.MethodGet, "/loki/api/v1/series?match[]="+url.QueryEscape(`{app="ns-app"}`), "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"success","data":[{"tenant_id":"allowed_user","app":"ns-app"}]}`, rr.Body.String())
+
+	// the values of the responses can be used in queries
+	rr = env.do(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(`up{tenant_id="allowed_user"}`), "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ := env.Thanos.LastRequest()
+	assert.Equal(t, `up{tenant_id="ns-allowed_user"}`, req.Params.Get("query"))
+}
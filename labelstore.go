@@ -1,23 +1,26 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"maps"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-sql-driver/mysql"
-	"github.com/spf13/viper"
 )
 
 // Labelstore represents an interface defining methods for connecting to a
 // label store and retrieving labels associated with a given OAuth token.
 type Labelstore interface {
 	// Connect establishes a connection with the label store using App configuration.
-	Connect(App) error
+	Connect(*App) error
 	// GetLabels retrieves labels associated with the provided OAuth token.
 	// Returns a map containing the labels and a boolean indicating whether
 	// the label is cluster-wide or not.
@@ -26,18 +29,26 @@ type Labelstore interface {
 
 // WithLabelStore initializes and connects to a LabelStore specified in the
 // application configuration. It assigns the connected LabelStore to the App
-// instance and returns it. If the LabelStore type is unknown or an error
+// instance and returns it. Kinds other than the built-in ones are looked up
+// among the discovered labelstore plugins. If the LabelStore type is unknown or an error
 // occurs during the connection, it logs a fatal error.
 func (a *App) WithLabelStore() *App {
-	switch a.Cfg.Web.LabelStoreKind {
+	switch a.Cfg().Web.LabelStoreKind {
 	case "configmap":
 		a.LabelStore = &ConfigMapHandler{}
 	case "mysql":
 		a.LabelStore = &MySQLHandler{}
+	case "git":
+		a.LabelStore = &GitHandler{}
+	case "namespaces":
+		a.LabelStore = &NamespaceHandler{}
 	default:
-		log.Fatal().Str("type", a.Cfg.Web.LabelStoreKind).Msg("Unknown label store type")
+		if _, ok := a.plugins[labelstorePluginPrefix+a.Cfg().Web.LabelStoreKind]; !ok {
+			log.Fatal().Str("type", a.Cfg().Web.LabelStoreKind).Msg("Unknown label store type")
+		}
+		a.LabelStore = &PluginLabelstore{Name: a.Cfg().Web.LabelStoreKind}
 	}
-	err := a.LabelStore.Connect(*a)
+	err := a.LabelStore.Connect(a)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error connecting to labelstore")
 	}
@@ -48,12 +59,11 @@ type ConfigMapHandler struct {
 	labels map[string]map[string]bool
 }
 
-func (c *ConfigMapHandler) Connect(_ App) error {
-	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
-	v.SetConfigName("labels")
-	v.SetConfigType("yaml")
-	v.AddConfigPath("/etc/config/labels/")
-	v.AddConfigPath("./configs")
+// labelsPaths are the directories searched for labels.yaml.
+var labelsPaths = []string{"/etc/config/labels/", "./configs"}
+
+func (c *ConfigMapHandler) Connect(_ *App) error {
+	v := newViper("labels", labelsPaths)
 	err := v.MergeInConfig()
 	if err != nil {
 		return err
@@ -80,17 +90,23 @@ func (c *ConfigMapHandler) Connect(_ App) error {
 }
 
 func (c *ConfigMapHandler) GetLabels(token OAuthToken) (map[string]bool, bool) {
+	return mergeLabels(c.labels, token)
+}
+
+// mergeLabels returns the labels of the user and their groups in the labels of a labels.yaml,
+// or true if any of them is cluster-wide.
+func mergeLabels(labels map[string]map[string]bool, token OAuthToken) (map[string]bool, bool) {
 	username := token.PreferredUsername
 	groups := token.Groups
-	mergedNamespaces := make(map[string]bool, len(c.labels[username])*2)
-	for k := range c.labels[username] {
+	mergedNamespaces := make(map[string]bool, len(labels[username])*2)
+	for k := range labels[username] {
 		mergedNamespaces[k] = true
 		if k == "#cluster-wide" {
 			return nil, true
 		}
 	}
 	for _, group := range groups {
-		for k := range c.labels[group] {
+		for k := range labels[group] {
 			mergedNamespaces[k] = true
 			if k == "#cluster-wide" {
 				return nil, true
@@ -104,22 +120,33 @@ type MySQLHandler struct {
 	DB       *sql.DB
 	Query    string
 	TokenKey string
+	// InsertQuery, DeleteQuery and AuditQuery change the mappings for the tenant admin API.
+	InsertQuery string
+	DeleteQuery string
+	AuditQuery  string
+	cache       *labelCache
 }
 
-func (m *MySQLHandler) Connect(a App) error {
-	m.TokenKey = a.Cfg.Db.TokenKey
-	m.Query = a.Cfg.Db.Query
-	password, err := os.ReadFile(a.Cfg.Db.PasswordPath)
+func (m *MySQLHandler) Connect(a *App) error {
+	m.TokenKey = a.Cfg().Db.TokenKey
+	m.Query = a.Cfg().Db.Query
+	m.InsertQuery = a.Cfg().Db.InsertQuery
+	m.DeleteQuery = a.Cfg().Db.DeleteQuery
+	m.AuditQuery = a.Cfg().Db.AuditQuery
+	if a.Cfg().Db.CacheTTL > 0 {
+		m.cache = newLabelCache(a.Cfg().Db.CacheTTL)
+	}
+	password, err := os.ReadFile(a.Cfg().Db.PasswordPath)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not read db password")
 	}
 	cfg := mysql.Config{
-		User:                 a.Cfg.Db.User,
+		User:                 a.Cfg().Db.User,
 		Passwd:               string(password),
 		Net:                  "tcp",
 		AllowNativePasswords: true,
-		Addr:                 fmt.Sprintf("%s:%d", a.Cfg.Db.Host, a.Cfg.Db.Port),
-		DBName:               a.Cfg.Db.DbName,
+		Addr:                 fmt.Sprintf("%s:%d", a.Cfg().Db.Host, a.Cfg().Db.Port),
+		DBName:               a.Cfg().Db.DbName,
 	}
 	// Get a database handle.
 	m.DB, err = sql.Open("mysql", cfg.FormatDSN())
@@ -148,6 +175,14 @@ func (m *MySQLHandler) GetLabels(token OAuthToken) (map[string]bool, bool) {
 		log.Fatal().Str("property", m.TokenKey).Msg("Unsupported token property")
 		return nil, false
 	}
+	if m.cache != nil {
+		return m.cache.get(value, func() map[string]bool { return m.queryLabels(value) }), false
+	}
+	return m.queryLabels(value), false
+}
+
+// queryLabels runs the label query for the value of the token property.
+func (m *MySQLHandler) queryLabels(value string) map[string]bool {
 	n := strings.Count(m.Query, "?")
 
 	var params []any
@@ -174,5 +209,101 @@ func (m *MySQLHandler) GetLabels(token OAuthToken) (map[string]bool, bool) {
 			log.Fatal().Err(err).Msg("Error scanning DB result")
 		}
 	}
-	return labels, false
+	return labels
+}
+
+// Manageable reports whether the insert and delete queries for the tenant admin API are configured.
+func (m *MySQLHandler) Manageable() bool {
+	return m.InsertQuery != "" && m.DeleteQuery != ""
+}
+
+// AddLabels inserts the labels of the identity, see change.
+func (m *MySQLHandler) AddLabels(ctx context.Context, actor string, identity string, labels []string) error {
+	return m.change(ctx, "add", m.InsertQuery, actor, identity, labels)
+}
+
+// RemoveLabels deletes the labels of the identity, see change.
+func (m *MySQLHandler) RemoveLabels(ctx context.Context, actor string, identity string, labels []string) error {
+	return m.change(ctx, "remove", m.DeleteQuery, actor, identity, labels)
+}
+
+// change runs the query with the identity and each label in a single transaction, together with the audit query
+// if configured, which gets the actor, the action, the identity and the label. The label cache is cleared afterwards,
+// so the change applies to the next request of every user.
+func (m *MySQLHandler) change(ctx context.Context, action string, query string, actor string, identity string, labels []string) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, label := range labels {
+		if _, err := tx.ExecContext(ctx, query, identity, label); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("%s label %s: %w", action, label, err)
+		}
+		if m.AuditQuery == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, m.AuditQuery, actor, action, identity, label); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("audit %s label %s: %w", action, label, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if m.cache != nil {
+		m.cache.invalidate()
+	}
+	return nil
+}
+
+// labelCache caches the labels of identities of the MySQL label store for a TTL.
+type labelCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]labelCacheEntry
+	// generation is increased by invalidate, so labels loaded before a change are not cached after it.
+	generation int
+}
+
+type labelCacheEntry struct {
+	labels  map[string]bool
+	expires time.Time
+}
+
+func newLabelCache(ttl time.Duration) *labelCache {
+	return &labelCache{ttl: ttl, now: time.Now, entries: map[string]labelCacheEntry{}}
+}
+
+// get returns a copy of the cached labels of the key, loading them if they are missing or expired.
+func (c *labelCache) get(key string, load func() map[string]bool) map[string]bool {
+	now := c.now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+	if !ok || !now.Before(entry.expires) {
+		entry = labelCacheEntry{labels: load(), expires: now.Add(c.ttl)}
+		c.mu.Lock()
+		if generation == c.generation {
+			c.entries[key] = entry
+		}
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.mu.Unlock()
+	}
+	return maps.Clone(entry.labels)
+}
+
+// invalidate drops all cached labels.
+func (c *labelCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]labelCacheEntry{}
+	c.generation++
 }
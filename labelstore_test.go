@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -81,3 +82,32 @@ func TestGetLabelsCM(t *testing.T) {
 		})
 	}
 }
+
+func TestLabelCache(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	cache := newLabelCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	loads := 0
+	load := func() map[string]bool {
+		loads++
+		return map[string]bool{"team-a": true}
+	}
+
+	assert.Equal(t, map[string]bool{"team-a": true}, cache.get("jane", load))
+	labels := cache.get("jane", load)
+	assert.Equal(t, 1, loads)
+	labels["team-b"] = true
+	assert.Equal(t, map[string]bool{"team-a": true}, cache.get("jane", load), "callers get a copy")
+
+	cache.get("john", load)
+	assert.Equal(t, 2, loads)
+
+	cache.invalidate()
+	cache.get("jane", load)
+	assert.Equal(t, 3, loads)
+
+	now = now.Add(time.Minute)
+	cache.get("jane", load)
+	assert.Equal(t, 4, loads)
+	assert.NotContains(t, cache.entries, "john")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// LifecycleConfig configures the lifecycle endpoints of the internal router.
+type LifecycleConfig struct {
+	// EnableQuit serves /-/quit, which needs the token of QuitTokenPath as bearer token.
+	EnableQuit    bool   `mapstructure:"enable_quit"`
+	QuitTokenPath string `mapstructure:"quit_token_path"`
+}
+
+// exitProcess terminates the proxy after /-/quit unless the App has its own exit function.
+func exitProcess() {
+	stopPlugins()
+	os.Exit(0)
+}
+
+// quitDelay gives the response of /-/quit time to reach the client before the process exits.
+const quitDelay = 500 * time.Millisecond
+
+// reloadConfig reads config.yaml again and applies it if it is valid. Settings read at startup, like the
+// listeners, routes and label store, still need a restart.
+func (a *App) reloadConfig(paths []string) error {
+	cfg, err := readConfig(paths)
+	if err != nil {
+		return err
+	}
+	if problems := checkConfig(cfg); len(problems) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(problems...))
+	}
+	a.setConfig(cfg)
+	zerolog.SetGlobalLevel(zerolog.Level(cfg.Log.Level))
+	return nil
+}
+
+// awaitTermination blocks until the proxy receives SIGINT or SIGTERM, then it reports unhealthy and stops
+// the plugin processes so they do not outlive the proxy.
+func (a *App) awaitTermination() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	log.Info().Str("signal", received.String()).Msg("Terminating")
+	a.healthy.Store(false)
+	stopPlugins()
+}
+
+// withLifecycle registers the Prometheus style lifecycle endpoints: POST or PUT /-/reload reloads the config
+// and, if enabled, /-/quit terminates the proxy for orchestrated restarts, see exitProcess.
+func (a *App) withLifecycle(i *mux.Router) {
+	i.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := a.reloadConfig(configPaths); err != nil {
+			log.Error().Err(err).Msg("Config reload failed, keeping the current config")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info().Str("remote", r.RemoteAddr).Msg("Config reloaded")
+		_, _ = w.Write([]byte("Ok"))
+	}).Methods(http.MethodPost, http.MethodPut)
+
+	if !a.Cfg().Web.Lifecycle.EnableQuit {
+		return
+	}
+	token, err := os.ReadFile(a.Cfg().Web.Lifecycle.QuitTokenPath)
+	if err != nil || strings.TrimSpace(string(token)) == "" {
+		log.Fatal().Err(err).Msg("Error reading the quit token, /-/quit needs a token")
+	}
+	expected := []byte("Bearer " + strings.TrimSpace(string(token)))
+	exit := a.exit
+	if exit == nil {
+		exit = exitProcess
+	}
+	i.HandleFunc("/-/quit", func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			log.Warn().Str("remote", r.RemoteAddr).Msg("Rejected /-/quit without a valid token")
+			http.Error(w, "invalid quit token", http.StatusUnauthorized)
+			return
+		}
+		log.Info().Str("remote", r.RemoteAddr).Msg("Termination requested through /-/quit")
+		a.healthy.Store(false)
+		_, _ = w.Write([]byte("Requesting termination... Goodbye!"))
+		time.AfterFunc(quitDelay, exit)
+	}).Methods(http.MethodPost, http.MethodPut)
+}
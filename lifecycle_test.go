@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadConfig(t *testing.T) {
+	shipped, err := os.ReadFile("configs/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	app := newApp(&Config{})
+
+	reloaded := strings.Replace(string(shipped), "dry_run: false", "dry_run: true", 1)
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(reloaded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	app.healthy.Store(false)
+	assert.NoError(t, app.reloadConfig([]string{dir}))
+	assert.True(t, app.Cfg().Web.DryRun)
+	assert.False(t, app.healthy.Load(), "a reload during shutdown keeps the proxy unhealthy")
+
+	invalid := strings.Replace(reloaded, `label_store_kind: "configmap"`, `label_store_kind: ""`, 1)
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(invalid), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorContains(t, app.reloadConfig([]string{dir}), "web.label_store_kind")
+	assert.Equal(t, "configmap", app.Cfg().Web.LabelStoreKind)
+}
+
+func TestReloadConfigUnderLoad(t *testing.T) {
+	env := newE2EEnv(t)
+	shipped, err := os.ReadFile("configs/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), shipped, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				rr := env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+				assert.Equal(t, http.StatusOK, rr.Code)
+			}
+		}()
+	}
+	for range 20 {
+		assert.NoError(t, env.App.reloadConfig([]string{dir}))
+	}
+	wg.Wait()
+}
+
+func TestQuit(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("quit-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	app := newApp(&Config{Web: WebConfig{Lifecycle: LifecycleConfig{EnableQuit: true, QuitTokenPath: tokenPath}}})
+	app.exit = func() { close(exited) }
+	app.WithHealthz()
+
+	rr := httptest.NewRecorder()
+	app.i.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/-/quit", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/-/quit", nil)
+	req.Header.Set("Authorization", "Bearer quit-token")
+	rr = httptest.NewRecorder()
+	app.i.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process did not exit")
+	}
+	assert.False(t, app.healthy.Load())
+}
+
+func TestQuitDisabled(t *testing.T) {
+	app := newApp(&Config{})
+	app.WithHealthz()
+
+	rr := httptest.NewRecorder()
+	app.i.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/-/quit", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+	metrics "github.com/slok/go-http-metrics/metrics/prometheus"
+	"github.com/slok/go-http-metrics/middleware"
+	"github.com/slok/go-http-metrics/middleware/std"
+)
+
+// ListenerConfig is an address the proxy listens on and the router it serves there.
+type ListenerConfig struct {
+	// Address is host:port, IPv6 hosts are written in brackets like [::]:8080. An empty host listens on all addresses.
+	Address string `mapstructure:"address"`
+	// Router is either proxy for the tenant facing routes or internal for metrics and health checks.
+	Router string `mapstructure:"router"`
+	// TLSCert and TLSKey enable TLS on the listener.
+	TLSCert string `mapstructure:"tls_cert"`
+	TLSKey  string `mapstructure:"tls_key"`
+	// ClientCA is a PEM file of the CAs client certificates are verified with. Clients without a certificate
+	// are still accepted, the verified certificates are summarized for the upstreams, see IdentityHeadersConfig.
+	ClientCA string `mapstructure:"client_ca"`
+}
+
+const (
+	routerProxy    = "proxy"
+	routerInternal = "internal"
+)
+
+// listeners returns the configured listeners, or the proxy and metrics ports on the host if none are configured.
+func (w WebConfig) listeners() []ListenerConfig {
+	if len(w.Listeners) > 0 {
+		return w.Listeners
+	}
+	return []ListenerConfig{
+		{Address: net.JoinHostPort(w.Host, strconv.Itoa(w.ProxyPort)), Router: routerProxy},
+		{Address: net.JoinHostPort(w.Host, strconv.Itoa(w.MetricsPort)), Router: routerInternal},
+	}
+}
+
+// validate checks the listener's address, router and TLS files.
+func (l ListenerConfig) validate() error {
+	_, port, err := net.SplitHostPort(l.Address)
+	if err != nil {
+		return err
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %q", port)
+	}
+	if l.Router != routerProxy && l.Router != routerInternal {
+		return fmt.Errorf("router must be proxy or internal, got %q", l.Router)
+	}
+	if (l.TLSCert == "") != (l.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if l.ClientCA != "" && l.TLSCert == "" {
+		return fmt.Errorf("client_ca requires tls_cert and tls_key")
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS settings of the listener that verify client certificates with the client CA, or nil.
+func (l ListenerConfig) tlsConfig() (*tls.Config, error) {
+	if l.ClientCA == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(l.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", l.ClientCA)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
+// StartServer starts an HTTP server for every listener, serving either the proxy or the internal router.
+func (a *App) StartServer() {
+	mdlw := middleware.New(middleware.Config{
+		Recorder: metrics.NewRecorder(metrics.Config{}),
+		Service:  "multena",
+	})
+	proxy := std.Handler("/", mdlw, a.e)
+
+	for _, l := range a.Cfg().Web.listeners() {
+		handler := http.Handler(a.i)
+		if l.Router == routerProxy {
+			handler = proxy
+		}
+		go func(l ListenerConfig, handler http.Handler) {
+			log.Info().Str("address", l.Address).Str("router", l.Router).Bool("tls", l.TLSCert != "").Msg("Starting listener")
+			var err error
+			if l.TLSCert != "" {
+				server := &http.Server{Addr: l.Address, Handler: handler}
+				server.TLSConfig, err = l.tlsConfig()
+				if err != nil {
+					log.Fatal().Err(err).Str("address", l.Address).Msg("Error while loading the client CA")
+				}
+				err = server.ListenAndServeTLS(l.TLSCert, l.TLSKey)
+			} else {
+				err = http.ListenAndServe(l.Address, handler)
+			}
+			log.Fatal().Err(err).Str("address", l.Address).Str("router", l.Router).Msg("Error while serving")
+		}(l, handler)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebConfigListeners(t *testing.T) {
+	web := WebConfig{Host: "::1", ProxyPort: 8080, MetricsPort: 8081}
+	assert.Equal(t, []ListenerConfig{
+		{Address: "[::1]:8080", Router: routerProxy},
+		{Address: "[::1]:8081", Router: routerInternal},
+	}, web.listeners())
+
+	web.Listeners = []ListenerConfig{{Address: "0.0.0.0:9090", Router: routerProxy}}
+	assert.Equal(t, web.Listeners, web.listeners())
+}
+
+func TestListenerConfigValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		listener ListenerConfig
+		err      string
+	}{
+		{"ipv4", ListenerConfig{Address: "0.0.0.0:8080", Router: routerProxy}, ""},
+		{"ipv6", ListenerConfig{Address: "[::]:8081", Router: routerInternal}, ""},
+		{"all addresses with tls", ListenerConfig{Address: ":8443", Router: routerProxy, TLSCert: "tls.crt", TLSKey: "tls.key"}, ""},
+		{"missing port", ListenerConfig{Address: "localhost", Router: routerProxy}, "missing port"},
+		{"invalid port", ListenerConfig{Address: ":0", Router: routerProxy}, "port must be between"},
+		{"unknown router", ListenerConfig{Address: ":8080", Router: "metrics"}, "router must be"},
+		{"cert without key", ListenerConfig{Address: ":8443", Router: routerProxy, TLSCert: "tls.crt"}, "must be set together"},
+		{"client ca without tls", ListenerConfig{Address: ":8080", Router: routerProxy, ClientCA: "ca.crt"}, "client_ca requires"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.listener.validate()
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCheckConfig_Listeners(t *testing.T) {
+	cfg := &Config{Web: WebConfig{Listeners: []ListenerConfig{{Address: ":8081", Router: routerInternal}}}}
+	problems := checkConfig(cfg)
+	var messages []string
+	for _, p := range problems {
+		messages = append(messages, p.Error())
+		assert.NotContains(t, p.Error(), "web.proxy_port", "ports are ignored with listeners")
+	}
+	assert.Contains(t, messages, "web.listeners: at least one listener must serve the proxy router")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type LoadSheddingConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Window is the rolling window the upstream latency and errors are tracked over.
+	Window time.Duration `mapstructure:"window"`
+	// MinRequests is the number of requests in the window needed before an upstream is considered saturated.
+	MinRequests int `mapstructure:"min_requests"`
+	// LatencyThreshold is the mean latency above which an upstream is saturated.
+	LatencyThreshold time.Duration `mapstructure:"latency_threshold"`
+	// ErrorThreshold is the fraction of 5xx responses above which an upstream is saturated.
+	ErrorThreshold float64 `mapstructure:"error_threshold"`
+	// ShedFraction is the fraction of low priority requests rejected while an upstream is saturated.
+	ShedFraction float64       `mapstructure:"shed_fraction"`
+	RetryAfter   time.Duration `mapstructure:"retry_after"`
+	// LowPriorityHeaders maps header names to regular expressions, requests with a matching header are low priority.
+	LowPriorityHeaders map[string]string `mapstructure:"low_priority_headers"`
+}
+
+var shedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_shed_requests_total",
+	Help: "Number of low priority requests rejected because the upstream was saturated.",
+}, []string{"upstream"})
+
+const loadShedBuckets = 10
+
+// loadBucket aggregates the requests of one slice of the rolling window.
+type loadBucket struct {
+	start   time.Time
+	count   int
+	errors  int
+	latency time.Duration
+}
+
+// loadShedder tracks the latency and errors of an upstream in a rolling window and rejects a fraction
+// of the low priority requests while the upstream is saturated.
+type loadShedder struct {
+	name        string
+	cfg         LoadSheddingConfig
+	lowPriority map[string]*regexp.Regexp
+	random      func() float64
+	now         func() time.Time
+
+	mu      sync.Mutex
+	buckets [loadShedBuckets]loadBucket
+}
+
+func newLoadShedder(name string, cfg LoadSheddingConfig) (*loadShedder, error) {
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = 30 * time.Second
+	}
+	lowPriority := make(map[string]*regexp.Regexp, len(cfg.LowPriorityHeaders))
+	for header, pattern := range cfg.LowPriorityHeaders {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		lowPriority[header] = re
+	}
+	return &loadShedder{name: name, cfg: cfg, lowPriority: lowPriority, random: rand.Float64, now: time.Now}, nil
+}
+
+// bucket returns the bucket for the given time, resetting it if it belongs to an earlier window.
+func (s *loadShedder) bucket(now time.Time) *loadBucket {
+	width := s.cfg.Window / loadShedBuckets
+	start := now.Truncate(width)
+	b := &s.buckets[(start.UnixNano()/int64(width))%loadShedBuckets]
+	if !b.start.Equal(start) {
+		*b = loadBucket{start: start}
+	}
+	return b
+}
+
+// observe records a forwarded request.
+func (s *loadShedder) observe(latency time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.bucket(s.now())
+	b.count++
+	b.latency += latency
+	if failed {
+		b.errors++
+	}
+}
+
+// saturated reports whether the mean latency or the error rate in the window are above their thresholds.
+func (s *loadShedder) saturated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	var count, errors int
+	var latency time.Duration
+	for _, b := range s.buckets {
+		if now.Sub(b.start) < s.cfg.Window {
+			count += b.count
+			errors += b.errors
+			latency += b.latency
+		}
+	}
+	if count == 0 || count < s.cfg.MinRequests {
+		return false
+	}
+	if s.cfg.LatencyThreshold > 0 && latency/time.Duration(count) > s.cfg.LatencyThreshold {
+		return true
+	}
+	return s.cfg.ErrorThreshold > 0 && float64(errors)/float64(count) > s.cfg.ErrorThreshold
+}
+
+func (s *loadShedder) isLowPriority(r *http.Request) bool {
+	for header, re := range s.lowPriority {
+		if v := r.Header.Get(header); v != "" && re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// shed rejects the request with 503 and Retry-After if it is low priority, the upstream is saturated
+// and the request falls into the shed fraction. It reports whether the request was rejected.
+func (s *loadShedder) shed(w http.ResponseWriter, r *http.Request) bool {
+	if !s.isLowPriority(r) || !s.saturated() || s.random() >= s.cfg.ShedFraction {
+		return false
+	}
+	shedRequests.WithLabelValues(s.name).Inc()
+	requestLogger(r).Info().Str("upstream", s.name).Str("path", r.URL.Path).Msg("Shedding low priority request")
+	w.Header().Set("Retry-After", strconv.Itoa(int(s.cfg.RetryAfter.Seconds())))
+	logAndWriteError(w, http.StatusServiceUnavailable, nil, "upstream is overloaded, low priority request rejected")
+	return true
+}
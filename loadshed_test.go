@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadShedder(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	shedder, err := newLoadShedder("thanos", LoadSheddingConfig{
+		Window:             time.Minute,
+		MinRequests:        3,
+		LatencyThreshold:   time.Second,
+		ErrorThreshold:     0.5,
+		ShedFraction:       0.5,
+		RetryAfter:         10 * time.Second,
+		LowPriorityHeaders: map[string]string{"X-Dashboard-Uid": ".+"},
+	})
+	assert.NoError(t, err)
+	shedder.now = func() time.Time { return now }
+
+	low := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	low.Header.Set("X-Dashboard-Uid", "abc")
+	high := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+
+	for i := 0; i < 3; i++ {
+		shedder.observe(100*time.Millisecond, false)
+	}
+	assert.False(t, shedder.saturated())
+
+	shedder.observe(5*time.Second, false)
+	assert.True(t, shedder.saturated(), "mean latency above threshold")
+
+	shedder.random = func() float64 { return 0.4 }
+	rr := httptest.NewRecorder()
+	assert.True(t, shedder.shed(rr, low))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "10", rr.Header().Get("Retry-After"))
+	assert.False(t, shedder.shed(httptest.NewRecorder(), high), "interactive requests are never shed")
+
+	shedder.random = func() float64 { return 0.6 }
+	assert.False(t, shedder.shed(httptest.NewRecorder(), low), "outside of the shed fraction")
+
+	now = now.Add(2 * time.Minute)
+	assert.False(t, shedder.saturated(), "the window has passed")
+	for i := 0; i < 4; i++ {
+		shedder.observe(time.Millisecond, i%2 == 0)
+	}
+	assert.False(t, shedder.saturated(), "error rate at threshold")
+	shedder.observe(time.Millisecond, true)
+	assert.True(t, shedder.saturated(), "error rate above threshold")
+}
+
+func TestE2E_LowPriorityRequestsAreShed(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().LoadShedding = LoadSheddingConfig{
+		Enabled:            true,
+		MinRequests:        1,
+		ErrorThreshold:     0.1,
+		ShedFraction:       1,
+		LowPriorityHeaders: map[string]string{"X-Dashboard-Uid": ".+"},
+	}
+	env.App.WithRoutes()
+	env.Thanos.SetResponse("/api/v1/query", http.StatusServiceUnavailable, `{"status":"error"}`)
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Len(t, env.Thanos.Requests(), 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("Authorization", "Bearer "+env.Tokens["userTenant"])
+	req.Header.Set("X-Dashboard-Uid", "abc")
+	rr = httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Len(t, env.Thanos.Requests(), 1, "shed requests never reach the upstream")
+
+	env.Thanos.SetResponse("/api/v1/query", http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// LockoutConfig enables a guard against brute forcing tokens and probing tenants: identities and client
+// addresses with too many failed token validations or enforcement violations are rejected for a while.
+type LockoutConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	Window      time.Duration `mapstructure:"window"`
+	MaxFailures int           `mapstructure:"max_failures"`
+	Cooldown    time.Duration `mapstructure:"cooldown"`
+	// AllowUsers and AllowNetworks are never locked out, e.g. known automation.
+	AllowUsers    []string `mapstructure:"allow_users"`
+	AllowNetworks []string `mapstructure:"allow_networks"`
+}
+
+var (
+	lockouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_lockouts_total",
+		Help: "Number of times a user or client address was locked out after repeated authorization failures.",
+	}, []string{"kind"})
+	lockedOutRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_locked_out_requests_total",
+		Help: "Number of requests rejected because the user or client address is locked out.",
+	}, []string{"kind"})
+)
+
+// lockedOutError is returned for requests of a locked out user or client address.
+type lockedOutError struct {
+	kind  string
+	until time.Time
+	now   time.Time
+}
+
+func (e lockedOutError) Error() string {
+	return fmt.Sprintf("too many authorization failures, %s locked out for %s", e.kind, e.retryAfter())
+}
+
+func (e lockedOutError) retryAfter() time.Duration {
+	return e.until.Sub(e.now).Round(time.Second)
+}
+
+// lockout counts the authorization failures of users and client addresses in a sliding window and
+// locks them out for the cooldown when they reach the maximum.
+type lockout struct {
+	cfg      LockoutConfig
+	networks []*net.IPNet
+	now      func() time.Time
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	locked   map[string]time.Time
+}
+
+func newLockout(cfg LockoutConfig) (*lockout, error) {
+	if cfg.Window <= 0 {
+		cfg.Window = 5 * time.Minute
+	}
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = 20
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 15 * time.Minute
+	}
+	l := &lockout{cfg: cfg, now: time.Now, failures: map[string][]time.Time{}, locked: map[string]time.Time{}}
+	for _, cidr := range cfg.AllowNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		l.networks = append(l.networks, network)
+	}
+	return l, nil
+}
+
+// clientIP returns the address of the client of the request without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// keys returns the lockout keys of the client address and user that are not allowlisted.
+func (l *lockout) keys(r *http.Request, user string) []string {
+	var keys []string
+	ip := clientIP(r)
+	if parsed := net.ParseIP(ip); parsed == nil || !slices.ContainsFunc(l.networks, func(n *net.IPNet) bool { return n.Contains(parsed) }) {
+		keys = append(keys, "ip:"+ip)
+	}
+	if user != "" && !slices.Contains(l.cfg.AllowUsers, user) {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// check returns a lockedOutError if the client address or the user is locked out.
+func (l *lockout) check(r *http.Request, user string) error {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range l.keys(r, user) {
+		until, ok := l.locked[key]
+		if !ok {
+			continue
+		}
+		if !now.Before(until) {
+			delete(l.locked, key)
+			continue
+		}
+		kind := lockoutKind(key)
+		lockedOutRequests.WithLabelValues(kind).Inc()
+		return lockedOutError{kind: kind, until: until, now: now}
+	}
+	return nil
+}
+
+// fail records an authorization failure of the client address and, if known, the user.
+func (l *lockout) fail(r *http.Request, user string) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range l.keys(r, user) {
+		var recent []time.Time
+		for _, at := range l.failures[key] {
+			if now.Sub(at) < l.cfg.Window {
+				recent = append(recent, at)
+			}
+		}
+		recent = append(recent, now)
+		if len(recent) < l.cfg.MaxFailures {
+			l.failures[key] = recent
+			continue
+		}
+		delete(l.failures, key)
+		l.locked[key] = now.Add(l.cfg.Cooldown)
+		lockouts.WithLabelValues(lockoutKind(key)).Inc()
+		log.Warn().Str("audit", "lockout").Str("key", key).Int("failures", len(recent)).Dur("cooldown", l.cfg.Cooldown).Msg("Locking out after repeated authorization failures")
+	}
+	for key, times := range l.failures {
+		if now.Sub(times[len(times)-1]) >= l.cfg.Window {
+			delete(l.failures, key)
+		}
+	}
+}
+
+func lockoutKind(key string) string {
+	if strings.HasPrefix(key, "user:") {
+		return "user"
+	}
+	return "ip"
+}
+
+// writeTokenError writes the error of getToken, 429 with Retry-After for locked out requests and 401 otherwise.
+func writeTokenError(w http.ResponseWriter, err error) {
+	var locked lockedOutError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.retryAfter().Seconds())))
+		logAndWriteError(w, http.StatusTooManyRequests, err, "")
+		return
+	}
+	logAndWriteError(w, http.StatusUnauthorized, err, "")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockout(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	l, err := newLockout(LockoutConfig{Window: time.Minute, MaxFailures: 2, Cooldown: 10 * time.Minute, AllowUsers: []string{"robot"}, AllowNetworks: []string{"10.0.0.0/8"}})
+	assert.NoError(t, err)
+	l.now = func() time.Time { return now }
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	other := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	internal := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	internal.RemoteAddr = "10.1.2.3:1234"
+
+	l.fail(r, "")
+	assert.NoError(t, l.check(r, ""))
+	l.fail(r, "")
+	err = l.check(r, "")
+	assert.ErrorContains(t, err, "ip locked out for 10m0s")
+	assert.NoError(t, l.check(other, ""))
+
+	// failures of a user lock the user out from every address
+	l.fail(other, "jane")
+	now = now.Add(time.Minute)
+	l.fail(other, "jane")
+	assert.NoError(t, l.check(internal, "jane"), "failures outside the window are forgotten")
+	l.fail(other, "jane")
+	assert.ErrorContains(t, l.check(internal, "jane"), "user locked out")
+
+	// allowlisted users and networks are never locked out
+	for range 3 {
+		l.fail(internal, "robot")
+	}
+	assert.NoError(t, l.check(internal, "robot"))
+
+	now = now.Add(10 * time.Minute)
+	assert.NoError(t, l.check(r, ""))
+	assert.NoError(t, l.check(internal, "jane"))
+}
+
+func TestE2E_RepeatedFailuresAreLockedOut(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Lockout = LockoutConfig{Enabled: true, Window: time.Minute, MaxFailures: 2, Cooldown: time.Minute}
+	env.App.WithRoutes()
+
+	query := "/api/v1/query?query=" + url.QueryEscape(`up{tenant_id="forbidden_tenant"}`)
+	for range 2 {
+		rr := env.do(http.MethodGet, query, "userTenant", "")
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	}
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), `"errorType":"too_many_requests"`)
+
+	// requests without a token are not counted
+	env.App.WithRoutes()
+	for range 3 {
+		rr = env.do(http.MethodGet, "/api/v1/query?query=up", "", "")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestE2E_LockedOutUsersAreRejectedOnEveryRoute(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Lockout = LockoutConfig{Enabled: true, Window: time.Minute, MaxFailures: 2, Cooldown: time.Minute}
+	env.App.WithRoutes()
+
+	query := "/api/v1/query?query=" + url.QueryEscape(`up{tenant_id="forbidden_tenant"}`)
+	for range 2 {
+		rr := env.do(http.MethodGet, query, "userTenant", "")
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	}
+
+	for _, route := range []struct{ method, target string }{
+		{http.MethodGet, "/debug/enforce?language=promql&query=up"},
+		{http.MethodGet, "/debug/compare?language=promql&query=up"},
+		{http.MethodPost, "/api/v1/admin/tsdb/snapshot"},
+		{http.MethodPost, "/loki/api/v1/delete?query=" + url.QueryEscape(`{tenant_id="allowed_user"}`)},
+	} {
+		rr := env.do(route.method, route.target, "userTenant", "")
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code, route.target)
+		assert.Equal(t, "60", rr.Header().Get("Retry-After"), route.target)
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -18,20 +20,23 @@ type requestData struct {
 }
 
 // loggingMiddleware returns a middleware that logs details of incoming HTTP requests and passes control to the next HTTP handler in the chain.
+// Every request gets its own logger, see withRequestLogger, so that all log entries of a request share its ID.
 // If configuration allows for logging tokens, the request body is read and logged.
 // Otherwise, the body content is redacted.
 func (a *App) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = withRequestLogger(w, r)
 		var bodyBytes []byte
-		if a.Cfg.Log.LogTokens {
+		if a.Cfg().Log.LogTokens {
 			bodyBytes = readBody(r)
 		} else {
 			bodyBytes = []byte("[REDACTED]")
 		}
 		// log.Trace().Any("Request", r.Headers).Msg("")
-		logRequestData(r, bodyBytes, a.Cfg.Log.LogTokens)
+		logRequestData(r, bodyBytes, a.Cfg().Log.LogTokens)
 		next.ServeHTTP(w, r)
-		log.Debug().Str("path", r.URL.Path).Msg("Request complete")
+		requestLogger(r).Debug().Dur("duration", time.Since(start)).Msg("Request complete")
 	})
 }
 
@@ -65,7 +70,7 @@ func logRequestData(r *http.Request, bodyBytes []byte, logToken bool) {
 		log.Error().Err(err).Msg("Error while marshalling request")
 		return
 	}
-	log.Debug().Str("verb", r.Method).Str("request", string(jsonData)).Str("path", r.URL.Path).Msg("")
+	requestLogger(r).Debug().Str("request", string(jsonData)).Msg("")
 }
 
 // cleanSensitiveHeaders creates and returns a copy of the provided HTTP headers with sensitive headers removed.
@@ -81,13 +86,63 @@ func cleanSensitiveHeaders(headers http.Header) http.Header {
 	return copyHeader
 }
 
-// logAndWriteError logs the provided error and message at the Trace level and writes them to the ResponseWriter along with the specified status code.
+// apiError is the error envelope of the Prometheus HTTP API, which Grafana renders for Prometheus and Loki datasources.
+type apiError struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// badQueryError marks errors caused by a query that cannot be parsed, they are answered with 400 instead of 403.
+type badQueryError struct {
+	err error
+}
+
+func (e badQueryError) Error() string { return e.err.Error() }
+
+func (e badQueryError) Unwrap() error { return e.err }
+
+// enforceStatus returns the status code for an error of enforcing a query.
+func enforceStatus(err error) int {
+	if errors.As(err, &badQueryError{}) {
+		return http.StatusBadRequest
+	}
+	return http.StatusForbidden
+}
+
+// errorType returns the Prometheus API errorType for a status code.
+func errorType(statusCode int) string {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusUnprocessableEntity:
+		return "execution"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	case http.StatusGatewayTimeout:
+		return "timeout"
+	}
+	if statusCode >= http.StatusInternalServerError {
+		return "internal"
+	}
+	return "bad_data"
+}
+
+// logAndWriteError logs the provided error and message at the Trace level and writes them to the ResponseWriter
+// in the Prometheus API error envelope along with the specified status code.
 // If the message is an empty string, the error's message is written instead.
 func logAndWriteError(rw http.ResponseWriter, statusCode int, err error, message string) {
 	if message == "" {
 		message = fmt.Sprint(err)
 	}
 	log.Trace().Err(err).Msg(message)
+	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(statusCode)
-	_, _ = fmt.Fprint(rw, message+"\n")
+	_ = json.NewEncoder(rw).Encode(apiError{Status: "error", ErrorType: errorType(statusCode), Error: message})
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	logqlv2 "github.com/observatorium/api/logql/v2"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// lokiDeleteRequest is the part of a Loki deletion request the proxy needs to decide on ownership.
+type lokiDeleteRequest struct {
+	RequestID string `json:"request_id"`
+	Query     string `json:"query"`
+}
+
+// lokiDelete handles the Loki log deletion API at /loki/api/v1/delete.
+//
+// Creating a deletion request (POST) enforces the selector in the query parameter so that only the
+// caller's tenants can be deleted. Requests without a query are rejected, and rejected selectors count as
+// violations and authorization failures like the enforcement of queries, see datasourceHandler.enforce. Listing (GET) only returns deletion requests whose selectors are
+// restricted to the caller's tenants, and cancelling (DELETE) is only allowed for such requests.
+// Admins and users with cluster-wide access are forwarded without restrictions. Read-only tenant labels can
+// not be deleted from, see TenantSuspension.
+func (a *App) lokiDelete(upstreamURL *url.URL) func(http.ResponseWriter, *http.Request) {
+	tl := a.Cfg().Loki.TenantLabel
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.Cfg()
+		oauthToken, err := getToken(r, cfg, a)
+		if err != nil {
+			writeTokenError(w, err)
+			return
+		}
+		tenantLabels, skip, err := validateLabels(oauthToken, cfg, a)
+		if err != nil {
+			logAndWriteError(w, http.StatusForbidden, err, "")
+			return
+		}
+		event := requestLogger(r).Info().Str("user", oauthToken.PreferredUsername).Str("method", r.Method)
+		if skip {
+			if isAdmin(oauthToken, cfg) {
+				a.securityEvents.emit(r, securityAdminBypass, oauthToken, nil)
+			}
+			event.Str("query", r.URL.Query().Get("query")).Str("request_id", r.URL.Query().Get("request_id")).Msg("Unrestricted Loki delete request")
+			streamUp(w, r, upstreamURL, cfg.Loki.UseMutualTLS, cfg.Loki.Headers, a)
+			return
+		}
+		if r.Method != http.MethodGet {
+			var suspended []string
+			tenantLabels, suspended = a.suspensions.remove(oauthToken, tenantLabels, cfg.Suspensions, suspendReadOnly)
+			if len(tenantLabels) == 0 {
+				suspendedRequests.WithLabelValues(suspendReadOnly).Inc()
+				logAndWriteError(w, http.StatusForbidden, errors.New(strings.Join(suspended, "; ")), "")
+				return
+			}
+		}
+
+		switch r.Method {
+		case http.MethodPost, http.MethodPut:
+			values := r.URL.Query()
+			// an empty query would be enforced to a selector of all tenant labels of the caller
+			if strings.TrimSpace(values.Get("query")) == "" {
+				logAndWriteError(w, http.StatusBadRequest, nil, "the query of a delete request must not be empty")
+				return
+			}
+			query, err := LogQLEnforcer{TenantSets: a.tenantSets}.Enforce(values.Get("query"), tenantLabels, tl)
+			if err != nil {
+				status := enforceStatus(err)
+				if status == http.StatusForbidden {
+					if a.violations != nil {
+						a.violations.record(r, oauthToken.PreferredUsername, "logql", err)
+					}
+					if a.lockout != nil {
+						a.lockout.fail(r, oauthToken.PreferredUsername)
+					}
+					a.securityEvents.emit(r, securityEnforcementViolation, oauthToken, err)
+				}
+				logAndWriteError(w, status, err, "")
+				return
+			}
+			values.Set("query", query)
+			r.URL.RawQuery = values.Encode()
+			event.Str("query", query).Msg("Loki delete request created")
+			streamUp(w, r, upstreamURL, cfg.Loki.UseMutualTLS, cfg.Loki.Headers, a)
+		case http.MethodGet:
+			requests, status, err := a.listLokiDeleteRequests(r, upstreamURL)
+			if err != nil {
+				logAndWriteError(w, status, err, "")
+				return
+			}
+			owned := make([]json.RawMessage, 0, len(requests))
+			for _, raw := range requests {
+				var req lokiDeleteRequest
+				if err := json.Unmarshal(raw, &req); err == nil && restrictedToTenants(req.Query, tenantLabels, tl) {
+					owned = append(owned, raw)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(owned)
+		case http.MethodDelete:
+			id := r.URL.Query().Get("request_id")
+			requests, status, err := a.listLokiDeleteRequests(r, upstreamURL)
+			if err != nil {
+				logAndWriteError(w, status, err, "")
+				return
+			}
+			for _, raw := range requests {
+				var req lokiDeleteRequest
+				if err := json.Unmarshal(raw, &req); err == nil && req.RequestID == id {
+					if !restrictedToTenants(req.Query, tenantLabels, tl) {
+						break
+					}
+					event.Str("request_id", id).Msg("Loki delete request cancelled")
+					streamUp(w, r, upstreamURL, cfg.Loki.UseMutualTLS, cfg.Loki.Headers, a)
+					return
+				}
+			}
+			logAndWriteError(w, http.StatusForbidden, nil, fmt.Sprintf("delete request %s not found for user", id))
+		default:
+			logAndWriteError(w, http.StatusMethodNotAllowed, nil, "invalid method")
+		}
+	}
+}
+
+// listLokiDeleteRequests fetches all deletion requests from the upstream on behalf of the request.
+func (a *App) listLokiDeleteRequests(r *http.Request, upstreamURL *url.URL) ([]json.RawMessage, int, error) {
+	listURL := *upstreamURL
+	listURL.Path = strings.TrimSuffix(listURL.Path, "/") + r.URL.Path
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, listURL.String(), nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	req.Header = r.Header.Clone()
+	setHeaders(req, a.Cfg().Loki.UseMutualTLS, a.Cfg().Loki.Headers, a.ServiceAccountToken)
+	resp, err := a.upstreams.httpClient(upstreamURL).Do(req)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, resp.StatusCode, fmt.Errorf("upstream error: %s", strings.TrimSpace(string(body)))
+	}
+	var requests []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&requests); err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	return requests, http.StatusOK, nil
+}
+
+// restrictedToTenants reports whether every stream selector of the LogQL query restricts the
+// tenant label to a subset of the given tenant labels.
+func restrictedToTenants(query string, tenantLabels map[string]bool, tl string) bool {
+	expr, err := logqlv2.ParseExpr(query)
+	if err != nil {
+		return false
+	}
+	restricted := true
+	expr.Walk(func(e interface{}) {
+		stream, ok := e.(*logqlv2.StreamMatcherExpr)
+		if !ok {
+			return
+		}
+		found := false
+		for _, m := range stream.Matchers() {
+			if m.Name != tl || (m.Type != labels.MatchEqual && m.Type != labels.MatchRegexp) {
+				continue
+			}
+			found = true
+			for _, v := range strings.Split(m.Value, "|") {
+				if !tenantLabels[v] {
+					restricted = false
+				}
+			}
+		}
+		restricted = restricted && found
+	})
+	return restricted
+}
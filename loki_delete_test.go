@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const lokiDeleteRequests = `[
+	{"request_id":"own","query":"{tenant_id=\"allowed_user\"} |= \"secret\"","status":"received"},
+	{"request_id":"own-both","query":"{tenant_id=~\"allowed_user|also_allowed_user\"}","status":"processed"},
+	{"request_id":"foreign","query":"{tenant_id=\"other\"}","status":"received"},
+	{"request_id":"unrestricted","query":"{app=\"x\"}","status":"received"}
+]`
+
+func TestLokiDelete_Create(t *testing.T) {
+	env := newE2EEnv(t)
+
+	rr := env.do(http.MethodPost, "/loki/api/v1/delete?start=1&query="+url.QueryEscape(`{app="x"} |= "password"`), "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, ok := env.Loki.LastRequest()
+	assert.True(t, ok)
+	assert.Contains(t, req.Params.Get("query"), `tenant_id=~"`)
+	assert.Contains(t, req.Params.Get("query"), `app="x"`)
+	assert.Equal(t, "1", req.Params.Get("start"))
+
+	env.Loki.Reset()
+	rr = env.do(http.MethodPost, "/loki/api/v1/delete?query="+url.QueryEscape(`{tenant_id="other"}`), "userTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Empty(t, env.Loki.Requests())
+}
+
+func TestLokiDelete_CreateWithoutQuery(t *testing.T) {
+	env := newE2EEnv(t)
+
+	for _, target := range []string{"/loki/api/v1/delete?start=1", "/loki/api/v1/delete?start=1&query=%20"} {
+		rr := env.do(http.MethodPost, target, "userTenant", "")
+		assert.Equal(t, http.StatusBadRequest, rr.Code, target)
+	}
+	assert.Empty(t, env.Loki.Requests())
+}
+
+func TestLokiDelete_RejectedSelectorsAreLockedOut(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Lockout = LockoutConfig{Enabled: true, Window: time.Minute, MaxFailures: 2, Cooldown: time.Minute}
+	env.App.WithRoutes()
+
+	for range 2 {
+		rr := env.do(http.MethodPost, "/loki/api/v1/delete?query="+url.QueryEscape(`{tenant_id="other"}`), "userTenant", "")
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	}
+	rr := env.do(http.MethodPost, "/loki/api/v1/delete?query="+url.QueryEscape(`{tenant_id="allowed_user"}`), "userTenant", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	assert.Empty(t, env.Loki.Requests())
+}
+
+func TestLokiDelete_ListOnlyOwnRequests(t *testing.T) {
+	env := newE2EEnv(t)
+	env.Loki.SetResponse("/loki/api/v1/delete", http.StatusOK, lokiDeleteRequests)
+
+	rr := env.do(http.MethodGet, "/loki/api/v1/delete", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var requests []lokiDeleteRequest
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &requests))
+	assert.Len(t, requests, 2)
+	assert.Equal(t, "own", requests[0].RequestID)
+	assert.Equal(t, "own-both", requests[1].RequestID)
+
+	rr = env.do(http.MethodGet, "/loki/api/v1/delete", "adminUserToken", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &requests))
+	assert.Len(t, requests, 4)
+}
+
+func TestLokiDelete_Cancel(t *testing.T) {
+	env := newE2EEnv(t)
+	env.Loki.SetResponse("/loki/api/v1/delete", http.StatusOK, lokiDeleteRequests)
+
+	rr := env.do(http.MethodDelete, "/loki/api/v1/delete?request_id=own", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ := env.Loki.LastRequest()
+	assert.Equal(t, http.MethodDelete, req.Method)
+	assert.Equal(t, "own", req.Params.Get("request_id"))
+
+	for _, id := range []string{"foreign", "unrestricted", "missing"} {
+		env.Loki.Reset()
+		rr = env.do(http.MethodDelete, "/loki/api/v1/delete?request_id="+id, "userTenant", "")
+		assert.Equal(t, http.StatusForbidden, rr.Code, id)
+		for _, req := range env.Loki.Requests() {
+			assert.Equal(t, http.MethodGet, req.Method)
+		}
+	}
+}
@@ -2,30 +2,64 @@ package main
 
 import (
 	"crypto/tls"
-	"fmt"
 	"net/http"
+	"os"
 	"runtime"
+	"sync/atomic"
+	"text/template"
 
 	"github.com/MicahParks/keyfunc/v3"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/rs/zerolog/pkgerrors"
-
-	metrics "github.com/slok/go-http-metrics/metrics/prometheus"
-	"github.com/slok/go-http-metrics/middleware"
-	"github.com/slok/go-http-metrics/middleware/std"
 )
 
 type App struct {
 	Jwks                keyfunc.Keyfunc
-	Cfg                 *Config
+	cfg                 atomic.Pointer[Config]
 	TlS                 *tls.Config
+	client              *http.Client
+	upstreams           *upstreamClients
 	ServiceAccountToken string
 	LabelStore          Labelstore
 	i                   *mux.Router
 	e                   *mux.Router
-	healthy             bool
+	healthy             atomic.Bool
+	plugins             map[string]string
+	pluginImpls         map[string]interface{}
+	enforcers           map[string]EnforceQL
+	tenantSets          *tenantSetCache
+	tenantHeaders       map[string]map[string]*template.Template
+	preflight           *preflight
+	shedders            map[string]*loadShedder
+	streams             *streamLimiter
+	labelIndex          *labelIndex
+	violations          *violationTracker
+	securityEvents      *securityEvents
+	lockout             *lockout
+	suspensions         *suspensions
+	forwardAuth         *forwardAuth
+	oidc                *oidcLogin
+	dns                 dnsResolver
+	exit                func()
+}
+
+// newApp returns an App with the configuration, the builder methods set up the rest.
+func newApp(cfg *Config) *App {
+	a := &App{}
+	a.setConfig(cfg)
+	return a
+}
+
+// Cfg returns the active configuration. It is swapped as a whole on reloads, a request that reads several
+// settings should keep the returned configuration instead of calling Cfg again.
+func (a *App) Cfg() *Config {
+	return a.cfg.Load()
+}
+
+func (a *App) setConfig(cfg *Config) {
+	a.cfg.Store(cfg)
 }
 
 var Commit string
@@ -33,43 +67,41 @@ var Commit string
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(runReplay(os.Args[2:], os.Stdout))
+		case "validate":
+			os.Exit(runValidate(os.Args[2:], os.Stdout))
+		case "tenant":
+			os.Exit(runTenant(os.Args[2:], os.Stdout))
+		case "bench":
+			os.Exit(runBench(os.Args[2:], os.Stdout))
+		}
+	}
 	log.Info().Msg("-------Init Proxy-------")
 	log.Info().Msgf("Commit: %s", Commit)
+	log.Info().Str("version", Version).Str("build_date", BuildDate).Msg("")
 	log.Debug().Str("go_version", runtime.Version()).Msg("")
 	log.Debug().Str("go_os", runtime.GOOS).Str("go_arch", runtime.GOARCH).Msg("")
 	log.Debug().Str("go_compiler", runtime.Compiler).Msg("")
 
-	app := App{}
+	app := &App{}
 	app.WithConfig().
 		WithSAT().
 		WithTLSConfig().
+		WithUpstreamClients().
+		WithEgressProxies().
+		WithDiscovery().
 		WithJWKS().
+		WithPlugins().
 		WithLabelStore().
 		WithHealthz().
 		WithRoutes().
+		WithPreflight().
 		StartServer()
 
-	log.Info().Any("config", app.Cfg)
+	log.Info().Any("config", app.Cfg())
 	log.Info().Msg("------Init Complete------")
-	select {}
-}
-
-// StartServer starts the HTTP server for the proxy and metrics.
-func (a *App) StartServer() {
-	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf("%s:%d", a.Cfg.Web.Host, a.Cfg.Web.MetricsPort), a.i); err != nil {
-			log.Fatal().Err(err).Msg("Error while serving metrics")
-		}
-	}()
-
-	go func() {
-		mdlw := middleware.New(middleware.Config{
-			Recorder: metrics.NewRecorder(metrics.Config{}),
-			Service:  "multena",
-		})
-
-		if err := http.ListenAndServe(fmt.Sprintf("%s:%d", a.Cfg.Web.Host, a.Cfg.Web.ProxyPort), std.Handler("/", mdlw, a.e)); err != nil {
-			log.Fatal().Err(err).Msg("Error while serving proxy")
-		}
-	}()
+	app.awaitTermination()
 }
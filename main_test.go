@@ -7,6 +7,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -28,19 +29,19 @@ func genJWKS(username, email string, groups []string, pk *ecdsa.PrivateKey) (str
 	return token.SignedString(pk)
 }
 
-func setupTestMain() (App, map[string]string) {
+func setupTestMain() (*App, map[string]string) {
 	// Generate a new private key.
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		fmt.Printf("Failed to generate private key: %s\n", err)
-		return App{}, nil
+		return nil, nil
 	}
 
 	// Encode the private key to PEM format.
 	privateKeyBytes, err := x509.MarshalECPrivateKey(privateKey)
 	if err != nil {
 		fmt.Printf("Failed to marshal private key: %s\n", err)
-		return App{}, nil
+		return nil, nil
 	}
 	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
 		Type:  "EC PRIVATE KEY",
@@ -51,7 +52,7 @@ func setupTestMain() (App, map[string]string) {
 	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
 	if err != nil {
 		fmt.Printf("Failed to marshal public key: %s\n", err)
-		return App{}, nil
+		return nil, nil
 	}
 	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
 		Type:  "PUBLIC KEY",
@@ -134,10 +135,10 @@ func setupTestMain() (App, map[string]string) {
 			return
 		}
 	}))
-	app := App{}
+	app := &App{}
 	app.WithConfig()
 	// defer jwksServer.Close()
-	app.Cfg.Web.JwksCertURL = jwksServer.URL
+	app.Cfg().Web.JwksCertURL = jwksServer.URL
 	app.WithJWKS()
 
 	// Set up the upstream server
@@ -148,10 +149,10 @@ func setupTestMain() (App, map[string]string) {
 		}
 	}))
 	// defer upstreamServer.Close()
-	app.Cfg.Thanos.URL = upstreamServer.URL
-	app.Cfg.Loki.URL = upstreamServer.URL
-	app.Cfg.Thanos.TenantLabel = "tenant_id"
-	app.Cfg.Loki.TenantLabel = "tenant_id"
+	app.Cfg().Thanos.URL = upstreamServer.URL
+	app.Cfg().Loki.URL = upstreamServer.URL
+	app.Cfg().Thanos.TenantLabel = "tenant_id"
+	app.Cfg().Loki.TenantLabel = "tenant_id"
 
 	cmh := ConfigMapHandler{
 		labels: map[string]map[string]bool{
@@ -181,32 +182,32 @@ func Test_reverseProxy(t *testing.T) {
 		{
 			name:           "Missing_headers",
 			URL:            "/api/v1/query_range",
-			expectedStatus: http.StatusForbidden,
-			expectedBody:   "no Authorization header found\n",
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   "no Authorization header found",
 		},
 		{
 			name:             "Malformed_authorization_header:_B",
-			expectedStatus:   http.StatusForbidden,
+			expectedStatus:   http.StatusUnauthorized,
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "B",
-			expectedBody:     "invalid Authorization header\n",
+			expectedBody:     "invalid Authorization header",
 		},
 		{
 			name:             "Malformed_authorization_header:_Bearer",
-			expectedStatus:   http.StatusForbidden,
+			expectedStatus:   http.StatusUnauthorized,
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "Bearer ",
-			expectedBody:     "error parsing token\nno tenant labels found\n",
+			expectedBody:     "error parsing token",
 		},
 		{
 			name:             "Malformed_authorization_header:_Bearer_skk",
-			expectedStatus:   http.StatusForbidden,
+			expectedStatus:   http.StatusUnauthorized,
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "Bearer " + "skk",
-			expectedBody:     "error parsing token\nno tenant labels found\n",
+			expectedBody:     "error parsing token",
 		},
 		{
 			name:             "Missing_tenant_labels_for_user",
@@ -214,7 +215,7 @@ func Test_reverseProxy(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "Bearer " + tokens["noTenant"],
-			expectedBody:     "no tenant labels found\n",
+			expectedBody:     "no tenant labels found",
 		},
 		{
 			name:             "Valid_token_and_headers_no_query",
@@ -230,7 +231,7 @@ func Test_reverseProxy(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query_range?query=up{tenant_id=\"forbidden_tenant\"}",
 			expectedStatus:   http.StatusForbidden,
-			expectedBody:     "user not allowed with tenant label forbidden_tenant\n",
+			expectedBody:     "user not allowed with tenant label forbidden_tenant",
 		},
 		{
 			name:             "Not_a_User_accessing_forbidden_tenant",
@@ -238,7 +239,7 @@ func Test_reverseProxy(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query_range?query=up{tenant_id=\"forbidden_tenant\"}",
 			expectedStatus:   http.StatusForbidden,
-			expectedBody:     "no tenant labels found\n",
+			expectedBody:     "no tenant labels found",
 		},
 		{
 			name:             "User_belongs_to_no_groups_accessing_forbidden_tenant",
@@ -246,7 +247,7 @@ func Test_reverseProxy(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query?query=up{tenant_id=\"forbidden_tenant\"}",
 			expectedStatus:   http.StatusForbidden,
-			expectedBody:     "no tenant labels found\n",
+			expectedBody:     "no tenant labels found",
 		},
 		{
 			name:             "User_belongs_to_multiple_groups_accessing_allowed_tenant",
@@ -302,7 +303,7 @@ func Test_reverseProxy(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/loki/api/v1/query_range?direction=backward&end=1690463973693000000&limit=10&query={tenant_id=\"forbidden_tenant\"} |= `path` |= `label` | json | line_format `{{.message}}` | json | line_format `{{.request}}` | json | line_format `{{.method}} {{.path}} {{.url | urldecode}}`&start=1690377573693000000&step=86400000ms",
 			expectedStatus:   http.StatusForbidden,
-			expectedBody:     "unauthorized label forbidden_tenant\n",
+			expectedBody:     "unauthorized label forbidden_tenant",
 		},
 		//{
 		//	name:             "Email_query",
@@ -348,9 +349,9 @@ func Test_reverseProxy(t *testing.T) {
 
 func TestAlertAuth(t *testing.T) {
 	app, tokens := setupTestMain()
-	app.Cfg.Alert.Enabled = true
-	app.Cfg.Alert.TokenHeader = "X-Multena-Alert-Token"
-	app.Cfg.Alert.CertURL = "http://localhost:8080/jwks"
+	app.Cfg().Alert.Enabled = true
+	app.Cfg().Alert.TokenHeader = "X-Multena-Alert-Token"
+	app.Cfg().Alert.CertURL = "http://localhost:8080/jwks"
 
 	log.Level(2)
 
@@ -365,32 +366,32 @@ func TestAlertAuth(t *testing.T) {
 		{
 			name:           "Missing_headers",
 			URL:            "/api/v1/query_range",
-			expectedStatus: http.StatusForbidden,
-			expectedBody:   "no Authorization header found\n",
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   "no Authorization header found",
 		},
 		{
 			name:             "Malformed_authorization_header:_B",
-			expectedStatus:   http.StatusForbidden,
+			expectedStatus:   http.StatusUnauthorized,
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "B",
-			expectedBody:     "invalid Authorization header\n",
+			expectedBody:     "invalid Authorization header",
 		},
 		{
 			name:             "Malformed_authorization_header:_Bearer",
-			expectedStatus:   http.StatusForbidden,
+			expectedStatus:   http.StatusUnauthorized,
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "Bearer ",
-			expectedBody:     "error parsing token\nno tenant labels found\n",
+			expectedBody:     "error parsing token",
 		},
 		{
 			name:             "Malformed_authorization_header:_Bearer_skk",
-			expectedStatus:   http.StatusForbidden,
+			expectedStatus:   http.StatusUnauthorized,
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "Bearer skk",
-			expectedBody:     "error parsing token\nno tenant labels found\n",
+			expectedBody:     "error parsing token",
 		},
 		{
 			name:             "Missing_tenant_labels_for_user",
@@ -398,7 +399,7 @@ func TestAlertAuth(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query_range",
 			authorization:    "Bearer " + tokens["noTenant"],
-			expectedBody:     "no tenant labels found\n",
+			expectedBody:     "no tenant labels found",
 		},
 		{
 			name:             "Valid_token_and_headers,_no_query",
@@ -414,7 +415,7 @@ func TestAlertAuth(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query_range?query=up{tenant_id=\"forbidden_tenant\"}",
 			expectedStatus:   http.StatusForbidden,
-			expectedBody:     "user not allowed with tenant label forbidden_tenant\n",
+			expectedBody:     "user not allowed with tenant label forbidden_tenant",
 		},
 		{
 			name:             "Not_a_User,_accessing_forbidden_tenant",
@@ -422,7 +423,7 @@ func TestAlertAuth(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query_range?query=up{tenant_id=\"forbidden_tenant\"}",
 			expectedStatus:   http.StatusForbidden,
-			expectedBody:     "no tenant labels found\n",
+			expectedBody:     "no tenant labels found",
 		},
 		{
 			name:             "User_belongs_to_no_groups,_accessing_forbidden_tenant",
@@ -430,7 +431,7 @@ func TestAlertAuth(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/api/v1/query?query=up{tenant_id=\"forbidden_tenant\"}",
 			expectedStatus:   http.StatusForbidden,
-			expectedBody:     "no tenant labels found\n",
+			expectedBody:     "no tenant labels found",
 		},
 		{
 			name:             "User_belongs_to_multiple_groups,_accessing_allowed_tenant",
@@ -486,7 +487,7 @@ func TestAlertAuth(t *testing.T) {
 			setAuthorization: true,
 			URL:              "/loki/api/v1/query_range?direction=backward&end=1690463973693000000&limit=10&query={tenant_id=\"forbidden_tenant\"} |= `path` |= `label` | json | line_format `{{.message}}` | json | line_format `{{.request}}` | json | line_format `{{.method}} {{.path}} {{.url | urldecode}}`&start=1690377573693000000&step=86400000ms",
 			expectedStatus:   http.StatusForbidden,
-			expectedBody:     "unauthorized label forbidden_tenant\n",
+			expectedBody:     "unauthorized label forbidden_tenant",
 		},
 	}
 
@@ -501,7 +502,7 @@ func TestAlertAuth(t *testing.T) {
 			}
 			// IMPORTANT: We set the alert token header instead of “Authorization”
 			if tc.setAuthorization {
-				req.Header.Add(app.Cfg.Alert.TokenHeader, tc.authorization)
+				req.Header.Add(app.Cfg().Alert.TokenHeader, tc.authorization)
 			}
 
 			// Prepare the response recorder
@@ -527,13 +528,13 @@ func TestIsAdminSkip(t *testing.T) {
 
 	app := &App{}
 	app.WithConfig()
-	app.Cfg.Admin.Bypass = true
-	app.Cfg.Admin.Group = "gepardec-run-admins"
+	app.Cfg().Admin.Bypass = true
+	app.Cfg().Admin.Group = "gepardec-run-admins"
 	token := &OAuthToken{Groups: []string{"gepardec-run-admins"}}
-	a.True(isAdmin(*token, app))
+	a.True(isAdmin(*token, app.Cfg()))
 
 	token.Groups = []string{"user"}
-	a.False(isAdmin(*token, app))
+	a.False(isAdmin(*token, app.Cfg()))
 }
 
 func TestLogAndWriteError(t *testing.T) {
@@ -542,5 +543,11 @@ func TestLogAndWriteError(t *testing.T) {
 	rw := httptest.NewRecorder()
 	logAndWriteError(rw, http.StatusInternalServerError, nil, "test error")
 	a.Equal(http.StatusInternalServerError, rw.Code)
-	a.Equal("test error\n", rw.Body.String())
+	a.Equal("application/json", rw.Header().Get("Content-Type"))
+	a.JSONEq(`{"status":"error","errorType":"internal","error":"test error"}`, rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	logAndWriteError(rw, http.StatusForbidden, errors.New("unauthorized label a"), "")
+	a.Equal(http.StatusForbidden, rw.Code)
+	a.JSONEq(`{"status":"error","errorType":"forbidden","error":"unauthorized label a"}`, rw.Body.String())
 }
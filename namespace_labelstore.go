@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// NamespacesConfig configures the namespaces label store, which grants access to namespaces by their annotations.
+type NamespacesConfig struct {
+	// APIServer defaults to the in-cluster API server.
+	APIServer string `mapstructure:"api_server"`
+	TokenPath string `mapstructure:"token_path"`
+	CAPath    string `mapstructure:"ca_path"`
+	// OwnerKeys are the annotations and labels whose comma separated values are the users and groups owning the namespace.
+	OwnerKeys []string `mapstructure:"owner_keys"`
+	// LabelSelector restricts the watched namespaces.
+	LabelSelector string `mapstructure:"label_selector"`
+	// RetryInterval is the wait before the namespaces are listed again after the watch failed.
+	RetryInterval time.Duration `mapstructure:"retry_interval"`
+}
+
+var defaultOwnerKeys = []string{"observability.gepaplexx.com/owner-group", "observability.gepaplexx.com/owner-user"}
+
+var namespaceWatchEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_namespace_watch_events_total",
+	Help: "Number of namespace events of the namespaces label store, by type.",
+}, []string{"type"})
+
+// namespaceMeta is the part of a Namespace the label store reads.
+type namespaceMeta struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+type namespaceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []namespaceMeta `json:"items"`
+}
+
+type namespaceEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// errWatchExpired is returned when the API server no longer has the resource version of the watch.
+var errWatchExpired = fmt.Errorf("watch expired")
+
+// NamespaceHandler grants the owners named in the annotations or labels of a namespace access to it.
+// The namespaces are listed at startup and watched afterwards, so a new namespace with an owner annotation
+// is visible to its team without changing the proxy config.
+type NamespaceHandler struct {
+	cfg    NamespacesConfig
+	client *http.Client
+
+	mu     sync.RWMutex
+	owners map[string][]string
+	labels map[string]map[string]bool
+}
+
+func (n *NamespaceHandler) Connect(a *App) error {
+	n.cfg = a.Cfg().Namespaces
+	if n.cfg.APIServer == "" {
+		n.cfg.APIServer = "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	}
+	if n.cfg.TokenPath == "" {
+		n.cfg.TokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	if n.cfg.CAPath == "" {
+		n.cfg.CAPath = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	}
+	if len(n.cfg.OwnerKeys) == 0 {
+		n.cfg.OwnerKeys = defaultOwnerKeys
+	}
+	if n.cfg.RetryInterval <= 0 {
+		n.cfg.RetryInterval = 10 * time.Second
+	}
+	if n.client == nil {
+		client, err := kubernetesClient(n.cfg.CAPath)
+		if err != nil {
+			return err
+		}
+		n.client = client
+	}
+	resourceVersion, err := n.list(context.Background())
+	if err != nil {
+		return err
+	}
+	go n.run(context.Background(), resourceVersion)
+	return nil
+}
+
+func (n *NamespaceHandler) GetLabels(token OAuthToken) (map[string]bool, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return mergeLabels(n.labels, token)
+}
+
+// kubernetesClient returns a client trusting the CA of the API server.
+func kubernetesClient(caPath string) (*http.Client, error) {
+	ca, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the API server CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", caPath)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// run watches the namespaces from the resource version and lists them again whenever the watch fails.
+func (n *NamespaceHandler) run(ctx context.Context, resourceVersion string) {
+	for {
+		err := n.watch(ctx, resourceVersion)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && err != errWatchExpired {
+			log.Warn().Err(err).Msg("Namespace watch failed")
+			time.Sleep(n.cfg.RetryInterval)
+		}
+		for {
+			resourceVersion, err = n.list(ctx)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			log.Error().Err(err).Msg("Could not list namespaces, keeping the last known grants")
+			time.Sleep(n.cfg.RetryInterval)
+		}
+	}
+}
+
+// request sends a GET to the namespaces API with the service account token, which is read on every
+// request as projected tokens are rotated.
+func (n *NamespaceHandler) request(ctx context.Context, params url.Values) (*http.Response, error) {
+	if n.cfg.LabelSelector != "" {
+		params.Set("labelSelector", n.cfg.LabelSelector)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(n.cfg.APIServer, "/")+"/api/v1/namespaces?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := os.ReadFile(n.cfg.TokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d listing namespaces: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// list replaces the grants with those of all namespaces and returns the resource version of the list.
+func (n *NamespaceHandler) list(ctx context.Context) (string, error) {
+	resp, err := n.request(ctx, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var list namespaceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("could not decode namespaces: %w", err)
+	}
+	owners := make(map[string][]string, len(list.Items))
+	for _, ns := range list.Items {
+		if o := n.namespaceOwners(ns); len(o) > 0 {
+			owners[ns.Metadata.Name] = o
+		}
+	}
+	n.mu.Lock()
+	n.owners = owners
+	n.rebuild()
+	n.mu.Unlock()
+	log.Info().Int("namespaces", len(list.Items)).Int("owned", len(owners)).Msg("Listed namespaces")
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies the namespace events from the resource version until the watch ends.
+func (n *NamespaceHandler) watch(ctx context.Context, resourceVersion string) error {
+	resp, err := n.request(ctx, url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event namespaceEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return errWatchExpired
+			}
+			return err
+		}
+		namespaceWatchEvents.WithLabelValues(strings.ToLower(event.Type)).Inc()
+		if event.Type == "ERROR" {
+			// usually 410 Gone, the resource version is too old
+			return errWatchExpired
+		}
+		var ns namespaceMeta
+		if err := json.Unmarshal(event.Object, &ns); err != nil {
+			return err
+		}
+		if event.Type == "BOOKMARK" {
+			continue
+		}
+		n.mu.Lock()
+		if owners := n.namespaceOwners(ns); event.Type != "DELETED" && len(owners) > 0 {
+			n.owners[ns.Metadata.Name] = owners
+		} else {
+			delete(n.owners, ns.Metadata.Name)
+		}
+		n.rebuild()
+		n.mu.Unlock()
+		log.Debug().Str("type", event.Type).Str("namespace", ns.Metadata.Name).Msg("Namespace grants changed")
+	}
+}
+
+// namespaceOwners returns the owners named in the owner annotations and labels of the namespace.
+func (n *NamespaceHandler) namespaceOwners(ns namespaceMeta) []string {
+	var owners []string
+	for _, key := range n.cfg.OwnerKeys {
+		for _, values := range []map[string]string{ns.Metadata.Annotations, ns.Metadata.Labels} {
+			for _, owner := range strings.Split(values[key], ",") {
+				if owner = strings.TrimSpace(owner); owner != "" {
+					owners = append(owners, owner)
+				}
+			}
+		}
+	}
+	return owners
+}
+
+// rebuild derives the namespaces of every owner, it must be called with the lock held.
+func (n *NamespaceHandler) rebuild() {
+	labels := make(map[string]map[string]bool, len(n.owners))
+	for namespace, owners := range n.owners {
+		for _, owner := range owners {
+			if labels[owner] == nil {
+				labels[owner] = map[string]bool{}
+			}
+			labels[owner][namespace] = true
+		}
+	}
+	n.labels = labels
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceHandler(t *testing.T) {
+	var authorization, selector string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization, selector = r.Header.Get("Authorization"), r.URL.Query().Get("labelSelector")
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprint(w, `{"metadata":{"resourceVersion":"10"},"items":[
+				{"metadata":{"name":"team-a-prod","annotations":{"observability.gepaplexx.com/owner-group":"team-a, team-a-oncall"}}},
+				{"metadata":{"name":"team-a-dev","labels":{"observability.gepaplexx.com/owner-user":"jane"}}},
+				{"metadata":{"name":"kube-system"}}]}`)
+			return
+		}
+		assert.Equal(t, "10", r.URL.Query().Get("resourceVersion"))
+		fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"name":"team-b","annotations":{"observability.gepaplexx.com/owner-group":"team-b"}}}}`)
+		fmt.Fprintln(w, `{"type":"MODIFIED","object":{"metadata":{"name":"team-a-prod","annotations":{"observability.gepaplexx.com/owner-group":"team-a"}}}}`)
+		fmt.Fprintln(w, `{"type":"DELETED","object":{"metadata":{"name":"team-a-dev"}}}`)
+		fmt.Fprintln(w, `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"12"}}}`)
+		fmt.Fprintln(w, `{"type":"ERROR","object":{"kind":"Status","code":410}}`)
+	}))
+	defer api.Close()
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("sa-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	n := &NamespaceHandler{client: api.Client(), cfg: NamespacesConfig{APIServer: api.URL, TokenPath: tokenPath, OwnerKeys: defaultOwnerKeys, LabelSelector: "tenant=true"}}
+	rv, err := n.list(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "10", rv)
+	assert.Equal(t, "Bearer sa-token", authorization)
+	assert.Equal(t, "tenant=true", selector)
+
+	labels, skip := n.GetLabels(OAuthToken{PreferredUsername: "jane", Groups: []string{"team-a"}})
+	assert.False(t, skip)
+	assert.Equal(t, map[string]bool{"team-a-prod": true, "team-a-dev": true}, labels)
+	labels, _ = n.GetLabels(OAuthToken{PreferredUsername: "john", Groups: []string{"team-a-oncall"}})
+	assert.Equal(t, map[string]bool{"team-a-prod": true}, labels)
+	labels, _ = n.GetLabels(OAuthToken{PreferredUsername: "john"})
+	assert.Empty(t, labels)
+
+	assert.Equal(t, errWatchExpired, n.watch(context.Background(), rv))
+	labels, _ = n.GetLabels(OAuthToken{PreferredUsername: "jane", Groups: []string{"team-a"}})
+	assert.Equal(t, map[string]bool{"team-a-prod": true}, labels)
+	labels, _ = n.GetLabels(OAuthToken{PreferredUsername: "john", Groups: []string{"team-a-oncall", "team-b"}})
+	assert.Equal(t, map[string]bool{"team-b": true}, labels)
+}
+
+func TestNamespaceHandlerConnectFails(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "namespaces is forbidden", http.StatusForbidden)
+	}))
+	defer api.Close()
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("sa-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	n := &NamespaceHandler{client: api.Client()}
+	err := n.Connect(newApp(&Config{Namespaces: NamespacesConfig{APIServer: api.URL, TokenPath: tokenPath}}))
+	assert.ErrorContains(t, err, "403")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// resolveNegativeTenantMatchers replaces the matchers on the tenant label of a selector by a single positive
+// matcher if one of them is negative. A negative matcher like namespace!="a" or namespace!~"kube-.*" selects
+// every tenant it does not exclude, including the ones the user is not allowed to see, so it is evaluated
+// against the user's tenants instead: the result selects the tenants matching all matchers on the label.
+// Values of positive matchers still have to be tenants of the user. Selectors without negative matchers
+// on the tenant label are returned unchanged.
+func resolveNegativeTenantMatchers(matchers []*labels.Matcher, tenantLabels map[string]bool, labelMatch string) ([]*labels.Matcher, error) {
+	negative := false
+	for _, m := range matchers {
+		if m.Name == labelMatch && (m.Type == labels.MatchNotEqual || m.Type == labels.MatchNotRegexp) {
+			negative = true
+			break
+		}
+	}
+	if !negative {
+		return matchers, nil
+	}
+
+	var tenant, rest []*labels.Matcher
+	for _, m := range matchers {
+		if m.Name != labelMatch {
+			rest = append(rest, m)
+			continue
+		}
+		tenant = append(tenant, m)
+		if m.Type == labels.MatchEqual || m.Type == labels.MatchRegexp {
+			for _, v := range strings.Split(m.Value, "|") {
+				if !tenantLabels[v] {
+					return nil, fmt.Errorf("unauthorized label %s", v)
+				}
+			}
+		}
+	}
+
+	var selected []string
+	for value := range tenantLabels {
+		matches := true
+		for _, m := range tenant {
+			if !m.Matches(value) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			selected = append(selected, value)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("the matchers on %s exclude all tenants of the user", labelMatch)
+	}
+	sort.Strings(selected)
+	matchType := labels.MatchEqual
+	if len(selected) > 1 {
+		matchType = labels.MatchRegexp
+	}
+	resolved, err := labels.NewMatcher(matchType, labelMatch, strings.Join(selected, "|"))
+	if err != nil {
+		return nil, err
+	}
+	return append(rest, resolved), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegativeTenantMatchers(t *testing.T) {
+	tenants := map[string]bool{"team-a": true, "team-b": true, "kube-system": true}
+	cases := []struct {
+		name   string
+		query  string
+		promql string
+		logql  string
+		err    string
+	}{
+		{
+			name:   "equal",
+			query:  `{app="x",namespace="team-a"}`,
+			promql: `{app="x",namespace="team-a"}`,
+			logql:  `{app="x", namespace="team-a"}`,
+		},
+		{
+			name:  "equal to a foreign tenant",
+			query: `{app="x",namespace="other-team"}`,
+			err:   "other-team",
+		},
+		{
+			name:   "regexp",
+			query:  `{app="x",namespace=~"team-a|team-b"}`,
+			promql: `{app="x",namespace=~"team-a|team-b"}`,
+			logql:  `{app="x", namespace=~"team-a|team-b"}`,
+		},
+		{
+			name:   "not equal selects the remaining tenants only",
+			query:  `{app="x",namespace!="team-a"}`,
+			promql: `{app="x",namespace=~"kube-system|team-b"}`,
+			logql:  `{app="x", namespace=~"kube-system|team-b"}`,
+		},
+		{
+			name:   "not equal a foreign tenant",
+			query:  `{app="x",namespace!="other-team"}`,
+			promql: `{app="x",namespace=~"kube-system|team-a|team-b"}`,
+			logql:  `{app="x", namespace=~"kube-system|team-a|team-b"}`,
+		},
+		{
+			name:   "not regexp",
+			query:  `{app="x",namespace!~"kube-.*"}`,
+			promql: `{app="x",namespace=~"team-a|team-b"}`,
+			logql:  `{app="x", namespace=~"team-a|team-b"}`,
+		},
+		{
+			name:   "positive and negative",
+			query:  `{app="x",namespace=~"team-a|team-b",namespace!="team-b"}`,
+			promql: `{app="x",namespace="team-a"}`,
+			logql:  `{app="x", namespace="team-a"}`,
+		},
+		{
+			name:  "positive foreign tenant with negative",
+			query: `{app="x",namespace="other-team",namespace!="team-a"}`,
+			err:   "other-team",
+		},
+		{
+			name:  "excludes all tenants",
+			query: `{app="x",namespace!~".+"}`,
+			err:   "exclude all tenants",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			promql, err := PromQLEnforcer{}.Enforce(tc.query, tenants, "namespace")
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.promql, promql)
+			}
+
+			logql, err := LogQLEnforcer{}.Enforce(tc.query, tenants, "namespace")
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.logql, logql)
+			}
+		})
+	}
+}
+
+func TestNegativeTenantMatchersInExpressions(t *testing.T) {
+	tenants := map[string]bool{"team-a": true, "team-b": true}
+
+	promql, err := PromQLEnforcer{}.Enforce(`sum(rate(http_requests_total{namespace!="team-a"}[5m])) / sum(up)`, tenants, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, `sum(rate(http_requests_total{namespace="team-b"}[5m])) / sum(up{namespace="team-b"})`, promql)
+
+	logql, err := LogQLEnforcer{}.Enforce(`sum(count_over_time({app="x", namespace!="team-a"}[5m]))`, tenants, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, `sum(count_over_time({app="x", namespace="team-b"}[5m]))`, logql)
+}
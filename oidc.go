@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// OIDCConfig enables a browser login with the OIDC authorization code flow. The identity of the access token
+// is kept in an encrypted session cookie, which authenticates requests without an Authorization header.
+type OIDCConfig struct {
+	Enabled   bool   `mapstructure:"enabled"`
+	IssuerURL string `mapstructure:"issuer_url"`
+	ClientID  string `mapstructure:"client_id"`
+	// ClientSecretPath is optional for public clients, which are protected by PKCE.
+	ClientSecretPath string `mapstructure:"client_secret_path"`
+	// RedirectURL is the external URL of /oauth/callback.
+	RedirectURL string   `mapstructure:"redirect_url"`
+	Scopes      []string `mapstructure:"scopes"`
+	CookieName  string   `mapstructure:"cookie_name"`
+	// CookieKeyPath is a file with the secret the session cookie is encrypted with.
+	CookieKeyPath  string        `mapstructure:"cookie_key_path"`
+	SessionTTL     time.Duration `mapstructure:"session_ttl"`
+	InsecureCookie bool          `mapstructure:"insecure_cookie"`
+}
+
+// loginStateTTL is how long a user has to complete the login at the identity provider.
+const loginStateTTL = 10 * time.Minute
+
+// maxCookieSize is the largest cookie browsers are guaranteed to store.
+const maxCookieSize = 4000
+
+// oidcSession is the content of the session cookie.
+type oidcSession struct {
+	Username string   `json:"u"`
+	Email    string   `json:"e,omitempty"`
+	Groups   []string `json:"g,omitempty"`
+	Expires  int64    `json:"exp"`
+}
+
+// oidcState is the content of the state cookie of a login in progress.
+type oidcState struct {
+	State    string `json:"s"`
+	Verifier string `json:"v"`
+	Redirect string `json:"r"`
+	Expires  int64  `json:"exp"`
+}
+
+// oidcLogin implements the login, callback and logout endpoints and reads the session cookie.
+type oidcLogin struct {
+	cfg           OIDCConfig
+	aead          cipher.AEAD
+	clientSecret  string
+	authEndpoint  string
+	tokenEndpoint string
+	client        *http.Client
+	now           func() time.Time
+}
+
+func newOIDCLogin(ctx context.Context, cfg OIDCConfig, client *http.Client) (*oidcLogin, error) {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if cfg.CookieName == "" {
+		cfg.CookieName = "multena_session"
+	}
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = time.Hour
+	}
+	o := &oidcLogin{cfg: cfg, client: client, now: time.Now}
+
+	key, err := os.ReadFile(cfg.CookieKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read cookie key: %w", err)
+	}
+	if len(strings.TrimSpace(string(key))) < 16 {
+		return nil, errors.New("cookie key must have at least 16 characters")
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(string(key))))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	if o.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	if cfg.ClientSecretPath != "" {
+		secret, err := os.ReadFile(cfg.ClientSecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client secret: %w", err)
+		}
+		o.clientSecret = strings.TrimSpace(string(secret))
+	}
+	return o, o.discover(ctx)
+}
+
+// discover reads the endpoints of the identity provider from its discovery document.
+func (o *oidcLogin) discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(o.cfg.IssuerURL, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d of the discovery document", resp.StatusCode)
+	}
+	var doc struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("could not decode the discovery document: %w", err)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" {
+		return errors.New("discovery document lacks the authorization or token endpoint")
+	}
+	o.authEndpoint, o.tokenEndpoint = doc.AuthorizationEndpoint, doc.TokenEndpoint
+	return nil
+}
+
+// WithOIDC registers the login endpoints under /oauth/, if the OIDC login is enabled.
+func (a *App) WithOIDC() *App {
+	a.oidc = nil
+	if !a.Cfg().OIDC.Enabled {
+		return a
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	o, err := newOIDCLogin(ctx, a.Cfg().OIDC, a.httpClient())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error configuring the OIDC login")
+	}
+	a.oidc = o
+	a.e.HandleFunc("/oauth/login", o.login).Methods(http.MethodGet).Name("/oauth/login")
+	a.e.HandleFunc("/oauth/callback", o.callback(a)).Methods(http.MethodGet).Name("/oauth/callback")
+	a.e.HandleFunc("/oauth/logout", o.logout).Methods(http.MethodGet, http.MethodPost).Name("/oauth/logout")
+	return a
+}
+
+// login redirects to the identity provider. The rd parameter is the path the user returns to after the login.
+func (o *oidcLogin) login(w http.ResponseWriter, r *http.Request) {
+	redirect := r.URL.Query().Get("rd")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = "/"
+	}
+	state := oidcState{State: randomString(), Verifier: randomString(), Redirect: redirect, Expires: o.now().Add(loginStateTTL).Unix()}
+	value, err := o.seal(o.stateCookieName(), state)
+	if err != nil {
+		logAndWriteError(w, http.StatusInternalServerError, err, "")
+		return
+	}
+	http.SetCookie(w, o.cookie(o.stateCookieName(), value, loginStateTTL))
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.ClientID},
+		"redirect_uri":          {o.cfg.RedirectURL},
+		"scope":                 {strings.Join(o.cfg.Scopes, " ")},
+		"state":                 {state.State},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(o.authEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, o.authEndpoint+separator+params.Encode(), http.StatusFound)
+}
+
+// callback exchanges the code for an access token, validates it like a bearer token and sets the session cookie.
+func (o *oidcLogin) callback(a *App) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if e := r.URL.Query().Get("error"); e != "" {
+			logAndWriteError(w, http.StatusUnauthorized, nil, fmt.Sprintf("login failed: %s %s", e, r.URL.Query().Get("error_description")))
+			return
+		}
+		var state oidcState
+		cookie, err := r.Cookie(o.stateCookieName())
+		if err == nil {
+			err = o.open(o.stateCookieName(), cookie.Value, &state)
+		}
+		if err != nil || state.State != r.URL.Query().Get("state") || o.now().Unix() > state.Expires {
+			logAndWriteError(w, http.StatusUnauthorized, err, "invalid or expired login state, please log in again")
+			return
+		}
+		http.SetCookie(w, o.expireCookie(o.stateCookieName()))
+
+		accessToken, err := o.exchange(r.Context(), r.URL.Query().Get("code"), state.Verifier)
+		if err != nil {
+			log.Warn().Err(err).Msg("OIDC code exchange failed")
+			logAndWriteError(w, http.StatusUnauthorized, err, "login failed")
+			return
+		}
+		oauthToken, token, err := parseJwtToken(accessToken, a.Cfg(), a)
+		if err != nil || !token.Valid {
+			logAndWriteError(w, http.StatusUnauthorized, err, "login failed, invalid access token")
+			return
+		}
+		session := oidcSession{
+			Username: oauthToken.PreferredUsername,
+			Email:    oauthToken.Email,
+			Groups:   oauthToken.Groups,
+			Expires:  o.now().Add(o.cfg.SessionTTL).Unix(),
+		}
+		value, err := o.seal(o.cfg.CookieName, session)
+		if err == nil && len(value) > maxCookieSize {
+			err = fmt.Errorf("session of %d bytes does not fit into a cookie, the user has too many groups", len(value))
+		}
+		if err != nil {
+			logAndWriteError(w, http.StatusInternalServerError, err, "")
+			return
+		}
+		http.SetCookie(w, o.cookie(o.cfg.CookieName, value, o.cfg.SessionTTL))
+		log.Info().Str("user", session.Username).Strs("groups", session.Groups).Msg("OIDC login")
+		http.Redirect(w, r, state.Redirect, http.StatusFound)
+	}
+}
+
+// logout removes the session cookie.
+func (o *oidcLogin) logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, o.expireCookie(o.cfg.CookieName))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// exchange redeems the authorization code at the token endpoint and returns the access token.
+func (o *oidcLogin) exchange(ctx context.Context, code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"client_id":     {o.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	if o.clientSecret != "" {
+		form.Set("client_secret", o.clientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d of the token endpoint: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", err
+	}
+	if tokens.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access token")
+	}
+	return tokens.AccessToken, nil
+}
+
+// session returns the identity of the session cookie and whether the request has one.
+// The cookie is removed from the request, so it is not forwarded upstream.
+func (o *oidcLogin) session(r *http.Request) (OAuthToken, bool, error) {
+	cookie, err := r.Cookie(o.cfg.CookieName)
+	if err != nil {
+		return OAuthToken{}, false, nil
+	}
+	var others []string
+	for _, c := range r.Cookies() {
+		if c.Name != o.cfg.CookieName {
+			others = append(others, c.String())
+		}
+	}
+	r.Header.Del("Cookie")
+	if len(others) > 0 {
+		r.Header.Set("Cookie", strings.Join(others, "; "))
+	}
+
+	var session oidcSession
+	if err := o.open(o.cfg.CookieName, cookie.Value, &session); err != nil {
+		return OAuthToken{}, true, errors.New("invalid session cookie")
+	}
+	if o.now().Unix() > session.Expires {
+		return OAuthToken{}, true, errors.New("session expired, please log in again")
+	}
+	return OAuthToken{PreferredUsername: session.Username, Email: session.Email, Groups: session.Groups}, true, nil
+}
+
+func (o *oidcLogin) stateCookieName() string {
+	return o.cfg.CookieName + "_state"
+}
+
+func (o *oidcLogin) cookie(name string, value string, ttl time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   !o.cfg.InsecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// expireCookie returns the cookie deleting the cookie of the name in the browser, which is sent as Max-Age=0.
+func (o *oidcLogin) expireCookie(name string) *http.Cookie {
+	cookie := o.cookie(name, "", 0)
+	cookie.MaxAge = -1
+	return cookie
+}
+
+// seal encrypts the value as JSON, bound to the cookie name so a state cookie cannot be used as session.
+func (o *oidcLogin) seal(name string, value any) (string, error) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, o.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(o.aead.Seal(nonce, nonce, plain, []byte(name))), nil
+}
+
+func (o *oidcLogin) open(name string, sealed string, value any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return err
+	}
+	if len(raw) < o.aead.NonceSize() {
+		return errors.New("cookie too short")
+	}
+	plain, err := o.aead.Open(nil, raw[:o.aead.NonceSize()], raw[o.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, value)
+}
+
+// randomString returns 32 random bytes, URL safe encoded.
+func randomString() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newOIDCProvider serves a discovery document and a token endpoint that returns the access token for any code.
+func newOIDCProvider(t *testing.T, accessToken string) *httptest.Server {
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"authorization_endpoint": provider.URL + "/auth",
+				"token_endpoint":         provider.URL + "/token",
+			})
+		case "/token":
+			assert.Equal(t, "authorization_code", r.PostFormValue("grant_type"))
+			assert.NotEmpty(t, r.PostFormValue("code_verifier"))
+			_ = json.NewEncoder(w).Encode(map[string]string{"access_token": accessToken})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(provider.Close)
+	return provider
+}
+
+func TestE2E_OIDCLogin(t *testing.T) {
+	env := newE2EEnv(t)
+	provider := newOIDCProvider(t, env.Tokens["userTenant"])
+	keyPath := filepath.Join(t.TempDir(), "cookie-key")
+	if err := os.WriteFile(keyPath, []byte("a-cookie-key-for-tests"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env.App.Cfg().OIDC = OIDCConfig{Enabled: true, IssuerURL: provider.URL, ClientID: "multena", RedirectURL: "https://multena.example.com/oauth/callback", CookieKeyPath: keyPath}
+	env.App.WithRoutes()
+
+	rr := env.do(http.MethodGet, "/oauth/login?rd="+url.QueryEscape("/api/v1/query?query=up"), "", "")
+	assert.Equal(t, http.StatusFound, rr.Code)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, provider.URL+"/auth", location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+	stateCookie := rr.Result().Cookies()[0]
+
+	// a forged state is rejected
+	req := httptest.NewRequest(http.MethodGet, "/oauth/callback?code=abc&state=forged", nil)
+	req.AddCookie(stateCookie)
+	rr = httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/oauth/callback?code=abc&state="+location.Query().Get("state"), nil)
+	req.AddCookie(stateCookie)
+	rr = httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "/api/v1/query?query=up", rr.Header().Get("Location"))
+	var session *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "multena_session" {
+			session = c
+		}
+		if c.Name == stateCookie.Name {
+			assert.Negative(t, c.MaxAge, "the state cookie is deleted")
+		}
+	}
+	if session == nil {
+		t.Fatal("no session cookie set")
+	}
+	assert.True(t, session.HttpOnly)
+	assert.True(t, session.Secure)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.AddCookie(session)
+	req.AddCookie(&http.Cookie{Name: "other", Value: "kept"})
+	rr = httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	last, _ := env.Thanos.LastRequest()
+	assert.Contains(t, last.Params.Get("query"), "allowed_user")
+	assert.Equal(t, "other=kept", last.Header.Get("Cookie"))
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.AddCookie(&http.Cookie{Name: "multena_session", Value: session.Value[:len(session.Value)-2] + "AA"})
+	rr = httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// the browser deletes the session on logout and is asked to log in again
+	jar, err := cookiejar.New(nil)
+	assert.NoError(t, err)
+	proxyURL, _ := url.Parse("https://multena.example.com/")
+	jar.SetCookies(proxyURL, []*http.Cookie{session})
+	req = httptest.NewRequest(http.MethodGet, "/oauth/logout", nil)
+	req.AddCookie(session)
+	rr = httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Contains(t, rr.Header().Get("Set-Cookie"), "Max-Age=0")
+	jar.SetCookies(proxyURL, rr.Result().Cookies())
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	for _, c := range jar.Cookies(proxyURL) {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "log in at /oauth/login")
+	assert.NotContains(t, rr.Body.String(), "invalid session cookie")
+}
+
+func TestOIDCLoginRejectsOpenRedirects(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "cookie-key")
+	if err := os.WriteFile(keyPath, []byte("a-cookie-key-for-tests"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	provider := newOIDCProvider(t, "")
+	o, err := newOIDCLogin(context.Background(), OIDCConfig{IssuerURL: provider.URL, CookieKeyPath: keyPath}, http.DefaultClient)
+	assert.NoError(t, err)
+
+	for _, rd := range []string{"https://evil.example.com", "//evil.example.com", "/\\evil.example.com"} {
+		rr := httptest.NewRecorder()
+		o.login(rr, httptest.NewRequest(http.MethodGet, "/oauth/login?rd="+url.QueryEscape(rd), nil))
+		var state oidcState
+		assert.NoError(t, o.open(o.stateCookieName(), rr.Result().Cookies()[0].Value, &state))
+		assert.Equal(t, "/", state.Redirect, rd)
+	}
+}
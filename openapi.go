@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// OpenAPI is the OpenAPI 3 document served by /openapi.json. It is generated from the registered routes, so it
+// always describes the routes of the running configuration.
+type OpenAPI struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+	// DryRun is set if requests are forwarded without enforcement, see dryRunEvaluate.
+	DryRun bool `json:"x-multena-dry-run"`
+}
+
+type OpenAPIOperation struct {
+	Tags        []string                   `json:"tags"`
+	Summary     string                     `json:"summary,omitempty"`
+	OperationID string                     `json:"operationId"`
+	Parameters  []OpenAPIParameter         `json:"parameters,omitempty"`
+	Security    []map[string][]string      `json:"security"`
+	Responses   map[string]OpenAPIResponse `json:"responses"`
+}
+
+// OpenAPIParameter is a parameter or, with only Ref set, a reference to a parameter of the components.
+type OpenAPIParameter struct {
+	Ref         string         `json:"$ref,omitempty"`
+	Name        string         `json:"name,omitempty"`
+	In          string         `json:"in,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Schema      *OpenAPISchema `json:"schema,omitempty"`
+}
+
+type OpenAPISchema struct {
+	Type  string         `json:"type"`
+	Enum  []string       `json:"enum,omitempty"`
+	Items *OpenAPISchema `json:"items,omitempty"`
+}
+
+type OpenAPIResponse struct {
+	Description string                `json:"description"`
+	Headers     map[string]OpenAPIRef `json:"headers,omitempty"`
+}
+
+type OpenAPIRef struct {
+	Ref string `json:"$ref"`
+}
+
+type OpenAPIComponents struct {
+	SecuritySchemes map[string]OpenAPISecurityScheme `json:"securitySchemes"`
+	Parameters      map[string]OpenAPIParameter      `json:"parameters"`
+	Headers         map[string]OpenAPIHeader         `json:"headers"`
+}
+
+type OpenAPISecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+type OpenAPIHeader struct {
+	Description string        `json:"description"`
+	Schema      OpenAPISchema `json:"schema"`
+}
+
+// openAPISummaries describe the routes that are not proxied query APIs.
+var openAPISummaries = map[string]string{
+	"/healthz":                     "Liveness of the proxy",
+	"/readyz":                      "Readiness of the proxy, fails while an upstream preflight check fails",
+	"/version":                     "Build information of the proxy",
+	"/metrics":                     "Prometheus metrics of the proxy",
+	"/debug/pprof/":                "Go profiling data",
+	"/-/reload":                    "Reloads config.yaml",
+	"/-/quit":                      "Terminates the proxy",
+	"/openapi.json":                "This document",
+	"/debug/enforce":               "Previews the enforcement of a query",
+	"/debug/compare":               "Compares the results of a query with and without enforcement, admins only",
+	"/admin/tenants/{user}/labels": "Adds or removes tenant labels of an identity, tenant admin groups only",
+	"/admin/suspensions":           "Lists the active tenant suspensions, tenant admin groups only",
+	"/admin/suspensions/{tenant}":  "Suspends a tenant label or lifts its suspension, tenant admin groups only",
+	"/api/v1/admin/tsdb/{action}":  "Prometheus TSDB admin APIs, TSDB admin groups only",
+	"/api/v1/{endpoint}":           "Operational Thanos APIs, operator groups only",
+	"/api/v1/status/{status}":      "Operational Thanos status APIs, operator groups only",
+	"/loki/api/v1/delete":          "Loki log deletion, the selectors are enforced",
+	"/ready":                       "Readiness of Loki",
+	"/oauth/login":                 "Starts the login at the identity provider",
+	"/oauth/callback":              "Completes the login and sets the session cookie",
+	"/oauth/logout":                "Removes the session cookie",
+}
+
+// openAPIPathVariable matches the variables of mux path templates, which may carry a regular expression.
+var openAPIPathVariable = regexp.MustCompile(`\{([^}:]+)(?::([^}]+))?\}`)
+
+// openAPIAlternatives matches regular expressions of path variables that are a list of alternatives.
+var openAPIAlternatives = regexp.MustCompile(`^[\w/.-]+(\|[\w/.-]+)*$`)
+
+// openAPI generates the document from the proxy and the internal router.
+func (a *App) openAPI() OpenAPI {
+	cfg := a.Cfg()
+	doc := OpenAPI{
+		OpenAPI: "3.0.3",
+		Info: OpenAPIInfo{
+			Title:   "Multena Proxy",
+			Version: buildInfo().Version,
+			Description: "Multi-tenancy proxy for Thanos and Loki. Queries are enforced with the tenant labels of the " +
+				"caller before they are forwarded. Routes tagged internal are served on the internal listener.",
+			DryRun: cfg.Web.DryRun,
+		},
+		Paths: map[string]map[string]*OpenAPIOperation{},
+		Components: OpenAPIComponents{
+			SecuritySchemes: map[string]OpenAPISecurityScheme{
+				"bearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT", Description: "Access token of the identity provider"},
+				"quitToken":  {Type: "http", Scheme: "bearer", Description: "Token of web.lifecycle.quit_token_path"},
+			},
+			Parameters: map[string]OpenAPIParameter{
+				"RequestID": {Name: requestIDHeader, In: "header", Description: "ID of the request, generated if missing or invalid", Schema: &OpenAPISchema{Type: "string"}},
+			},
+			Headers: map[string]OpenAPIHeader{
+				requestIDHeader: {Description: "ID of the request, also forwarded to the upstream and logged", Schema: OpenAPISchema{Type: "string"}},
+			},
+		},
+	}
+	if a.oidc != nil {
+		doc.Components.SecuritySchemes["sessionCookie"] = OpenAPISecurityScheme{Type: "apiKey", In: "cookie", Name: cfg.OIDC.CookieName, Description: "Session of /oauth/login"}
+	}
+	a.addOpenAPIRoutes(doc, a.e, false)
+	a.addOpenAPIRoutes(doc, a.i, true)
+	return doc
+}
+
+// addOpenAPIRoutes adds the routes of the router with a handler to the document.
+func (a *App) addOpenAPIRoutes(doc OpenAPI, router *mux.Router, internal bool) {
+	if router == nil {
+		return
+	}
+	cfg := a.Cfg()
+	exempt := map[string]map[string]bool{
+		"loki":   mustExemptRoutes("loki", cfg.Loki.ExemptRoutes),
+		"thanos": mustExemptRoutes("thanos", cfg.Thanos.ExemptRoutes),
+	}
+	_ = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		var params []OpenAPIParameter
+		path := openAPIPathVariable.ReplaceAllStringFunc(template, func(variable string) string {
+			match := openAPIPathVariable.FindStringSubmatch(variable)
+			schema := &OpenAPISchema{Type: "string"}
+			if openAPIAlternatives.MatchString(match[2]) {
+				schema.Enum = strings.Split(match[2], "|")
+			}
+			params = append(params, OpenAPIParameter{Name: match[1], In: "path", Required: true, Schema: schema})
+			return "{" + match[1] + "}"
+		})
+		if _, ok := doc.Paths[path]; ok {
+			return nil
+		}
+
+		tag, summary := openAPITag(path, internal), openAPISummaries[path]
+		if datasource, proxied, ok := proxiedRoute(path); ok && !internal {
+			if exempt[datasource][proxied.Url] {
+				summary = "Forwarded to " + datasource + ", authenticated but not enforced"
+			} else {
+				summary = "Forwarded to " + datasource + " after " + proxied.MatchWord + " is enforced"
+				params = append(params, openAPIQueryParameter(proxied.MatchWord, datasource))
+			}
+		}
+		security := []map[string][]string{}
+		switch {
+		case path == "/-/quit":
+			security = append(security, map[string][]string{"quitToken": {}})
+		case !internal && tag != "auth" && path != "/openapi.json":
+			security = append(security, map[string][]string{"bearerAuth": {}})
+			if a.oidc != nil {
+				security = append(security, map[string][]string{"sessionCookie": {}})
+			}
+		}
+		responses := map[string]OpenAPIResponse{"200": {Description: "OK"}}
+		if !internal {
+			params = append(params, OpenAPIParameter{Ref: "#/components/parameters/RequestID"})
+			requestID := map[string]OpenAPIRef{requestIDHeader: {Ref: "#/components/headers/" + requestIDHeader}}
+			responses = map[string]OpenAPIResponse{"200": {Description: "OK", Headers: requestID}}
+			if len(security) > 0 {
+				responses["403"] = OpenAPIResponse{Description: "Missing or invalid token, or a query outside of the tenant labels of the caller", Headers: requestID}
+				responses["429"] = OpenAPIResponse{Description: "Rejected by quotas, load shedding or a lockout", Headers: requestID}
+				responses["502"] = OpenAPIResponse{Description: "The upstream is not reachable", Headers: requestID}
+			}
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = openAPIDefaultMethods(path, internal)
+		}
+		doc.Paths[path] = map[string]*OpenAPIOperation{}
+		for _, method := range methods {
+			method = strings.ToLower(method)
+			doc.Paths[path][method] = &OpenAPIOperation{
+				Tags:        []string{tag},
+				Summary:     summary,
+				OperationID: method + strings.NewReplacer("/", "_", "{", "", "}", "", ".", "_", "-", "_").Replace(path),
+				Parameters:  params,
+				Security:    security,
+				Responses:   responses,
+			}
+		}
+		return nil
+	})
+}
+
+// proxiedRoute returns the datasource and the route of a proxied query API path.
+func proxiedRoute(path string) (string, Route, bool) {
+	datasource, routes := "thanos", thanosRoutes
+	if strings.HasPrefix(path, "/loki/") {
+		datasource, routes, path = "loki", lokiRoutes, strings.TrimPrefix(path, "/loki")
+	}
+	for _, route := range routes {
+		if route.Url == path {
+			return datasource, route, true
+		}
+	}
+	if path == "/ready" {
+		return "loki", Route{Url: path}, true
+	}
+	return "", Route{}, false
+}
+
+func openAPIQueryParameter(name string, datasource string) OpenAPIParameter {
+	param := OpenAPIParameter{
+		Name:        name,
+		In:          "query",
+		Description: "Restricted to the tenant labels of the caller before the request is forwarded to " + datasource + ", also accepted in a form encoded body",
+		Schema:      &OpenAPISchema{Type: "string"},
+	}
+	if strings.HasSuffix(name, "[]") {
+		param.Schema = &OpenAPISchema{Type: "array", Items: &OpenAPISchema{Type: "string"}}
+	}
+	return param
+}
+
+func openAPITag(path string, internal bool) string {
+	switch {
+	case internal:
+		return "internal"
+	case strings.HasPrefix(path, "/loki/") || path == "/ready":
+		return "loki"
+	case strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/api/v1/admin/"):
+		return "admin"
+	case strings.HasPrefix(path, "/debug/"):
+		return "debug"
+	case strings.HasPrefix(path, "/oauth/"):
+		return "auth"
+	case strings.HasPrefix(path, "/api/"):
+		return "thanos"
+	default:
+		return "proxy"
+	}
+}
+
+// openAPIDefaultMethods returns the methods of routes that accept every method.
+func openAPIDefaultMethods(path string, internal bool) []string {
+	switch {
+	case internal:
+		return []string{http.MethodGet}
+	case path == "/loki/api/v1/delete":
+		return []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+	default:
+		return []string{http.MethodGet, http.MethodPost}
+	}
+}
+
+// openAPIHandler serves the generated OpenAPI document.
+func (a *App) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	doc := a.openAPI()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		requestLogger(r).Error().Err(err).Msg("Error while writing the OpenAPI document")
+	}
+}
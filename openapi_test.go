@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestE2E_OpenAPI(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.WithHealthz()
+
+	rr := env.do(http.MethodGet, "/openapi.json", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var doc OpenAPI
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+
+	query := doc.Paths["/api/v1/query"]["post"]
+	if query == nil {
+		t.Fatal("missing POST /api/v1/query")
+	}
+	assert.Equal(t, []string{"thanos"}, query.Tags)
+	assert.Equal(t, "post_api_v1_query", query.OperationID)
+	assert.Equal(t, []map[string][]string{{"bearerAuth": {}}}, query.Security)
+	assert.Equal(t, "query", query.Parameters[0].Name)
+	assert.Equal(t, "#/components/parameters/RequestID", query.Parameters[1].Ref)
+	assert.Contains(t, query.Responses, "403")
+
+	series := doc.Paths["/loki/api/v1/series"]["get"]
+	assert.Equal(t, []string{"loki"}, series.Tags)
+	assert.Equal(t, &OpenAPISchema{Type: "array", Items: &OpenAPISchema{Type: "string"}}, series.Parameters[0].Schema)
+	assert.Equal(t, "Forwarded to loki, authenticated but not enforced", doc.Paths["/loki/api/v1/status/buildinfo"]["get"].Summary)
+
+	tsdb := doc.Paths["/api/v1/admin/tsdb/{action}"]
+	assert.Contains(t, tsdb, "put")
+	assert.NotContains(t, tsdb, "get")
+	assert.Equal(t, OpenAPIParameter{Name: "action", In: "path", Required: true,
+		Schema: &OpenAPISchema{Type: "string", Enum: []string{"delete_series", "snapshot", "clean_tombstones"}}}, tsdb["post"].Parameters[0])
+	assert.Contains(t, doc.Paths["/loki/api/v1/delete"], "delete")
+
+	healthz := doc.Paths["/healthz"]["get"]
+	assert.Equal(t, []string{"internal"}, healthz.Tags)
+	assert.Empty(t, healthz.Security)
+	assert.Empty(t, doc.Paths["/openapi.json"]["get"].Security)
+}
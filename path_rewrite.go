@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PathRewriteConfig rewrites the paths of requests before they are forwarded to an upstream, so that the
+// external URL layout of the proxy stays the same while the API prefixes of the upstreams differ.
+// The prefix is stripped first, then the first matching rule is applied and finally the prefix is added.
+type PathRewriteConfig struct {
+	StripPrefix string            `mapstructure:"strip_prefix"`
+	AddPrefix   string            `mapstructure:"add_prefix"`
+	Rules       []PathRewriteRule `mapstructure:"rules"`
+}
+
+// PathRewriteRule replaces the paths matching the regular expression, the replacement may refer to groups like $1.
+type PathRewriteRule struct {
+	Match   string `mapstructure:"match"`
+	Replace string `mapstructure:"replace"`
+}
+
+type compiledRewriteRule struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// pathRewriter applies a PathRewriteConfig.
+type pathRewriter struct {
+	cfg   PathRewriteConfig
+	rules []compiledRewriteRule
+}
+
+func newPathRewriter(cfg PathRewriteConfig) (*pathRewriter, error) {
+	p := &pathRewriter{cfg: cfg}
+	for i, rule := range cfg.Rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		p.rules = append(p.rules, compiledRewriteRule{re: re, replace: rule.Replace})
+	}
+	return p, nil
+}
+
+// rewrite returns the upstream path of the given path.
+func (p *pathRewriter) rewrite(path string) string {
+	if p.cfg.StripPrefix != "" && strings.HasPrefix(path, p.cfg.StripPrefix) {
+		path = strings.TrimPrefix(path, p.cfg.StripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	for _, rule := range p.rules {
+		if rule.re.MatchString(path) {
+			path = rule.re.ReplaceAllString(path, rule.replace)
+			break
+		}
+	}
+	if p.cfg.AddPrefix != "" {
+		path = strings.TrimSuffix(p.cfg.AddPrefix, "/") + path
+	}
+	return path
+}
+
+// middleware rewrites the path of routed requests. It runs after routing, so only the upstream path changes.
+func (p *pathRewriter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rewritten := p.rewrite(r.URL.Path)
+		if rewritten != r.URL.Path {
+			requestLogger(r).Trace().Str("path", r.URL.Path).Str("rewritten", rewritten).Msg("Rewriting upstream path")
+			if r.URL.RawPath != "" {
+				raw := p.rewrite(r.URL.RawPath)
+				if unescaped, err := url.PathUnescape(raw); err == nil && unescaped == rewritten {
+					r.URL.RawPath = raw
+				} else {
+					r.URL.RawPath = ""
+				}
+			}
+			r.URL.Path = rewritten
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mustPathRewriter returns the path rewriter of an upstream and exits if its rules are invalid.
+func mustPathRewriter(upstream string, cfg PathRewriteConfig) *pathRewriter {
+	p, err := newPathRewriter(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Str("upstream", upstream).Msg("Error parsing path rewrite rules")
+	}
+	return p
+}
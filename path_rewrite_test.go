@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathRewriter(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  PathRewriteConfig
+		path string
+		want string
+	}{
+		{"unchanged", PathRewriteConfig{}, "/loki/api/v1/query", "/loki/api/v1/query"},
+		{"strip prefix", PathRewriteConfig{StripPrefix: "/loki"}, "/loki/api/v1/query", "/api/v1/query"},
+		{"add prefix", PathRewriteConfig{AddPrefix: "/prometheus/"}, "/api/v1/query", "/prometheus/api/v1/query"},
+		{"strip and add", PathRewriteConfig{StripPrefix: "/loki", AddPrefix: "/logs"}, "/loki/api/v1/tail", "/logs/api/v1/tail"},
+		{
+			"victoriametrics",
+			PathRewriteConfig{Rules: []PathRewriteRule{{Match: "^/api/v1/(.*)$", Replace: "/select/0/prometheus/api/v1/$1"}}},
+			"/api/v1/query_range",
+			"/select/0/prometheus/api/v1/query_range",
+		},
+		{
+			"first matching rule",
+			PathRewriteConfig{Rules: []PathRewriteRule{{Match: "^/api/v1/labels$", Replace: "/labels"}, {Match: "^/api/v1/(.*)$", Replace: "/other/$1"}}},
+			"/api/v1/labels",
+			"/labels",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := newPathRewriter(tc.cfg)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, p.rewrite(tc.path))
+		})
+	}
+
+	_, err := newPathRewriter(PathRewriteConfig{Rules: []PathRewriteRule{{Match: "("}}})
+	assert.ErrorContains(t, err, "rules[0]")
+}
+
+func TestE2E_PathRewrite(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Loki.PathRewrite = PathRewriteConfig{StripPrefix: "/loki"}
+	env.App.Cfg().Thanos.PathRewrite = PathRewriteConfig{Rules: []PathRewriteRule{{Match: "^/api/v1/(.*)$", Replace: "/select/0/prometheus/api/v1/$1"}}}
+	env.App.WithRoutes()
+
+	rr := env.do(http.MethodGet, "/loki/api/v1/query?query=%7Bapp%3D%22a%22%7D", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, ok := env.Loki.LastRequest()
+	assert.True(t, ok)
+	assert.Equal(t, "/api/v1/query", req.Path)
+	assert.Contains(t, req.Params.Get("query"), "tenant_id", "rewritten requests are still enforced")
+
+	env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	req, _ = env.Thanos.LastRequest()
+	assert.Equal(t, "/select/0/prometheus/api/v1/query", req.Path)
+}
@@ -0,0 +1,165 @@
+// Package plugin contains the protocol shared between multena-proxy and
+// external plugin binaries. Plugins are separate executables that are started
+// by the proxy and talk to it over hashicorp/go-plugin's net/rpc transport, so
+// site-specific enforcers and tenant providers can be built and upgraded out
+// of tree.
+//
+// A plugin binary implements Enforcer or Labelstore and hands it to
+// ServeEnforcer or ServeLabelstore from its main function.
+package plugin
+
+import (
+	"net/rpc"
+
+	goplugin "github.com/hashicorp/go-plugin"
+)
+
+const (
+	// EnforcerName is the name under which enforcer plugins are dispensed.
+	EnforcerName = "enforcer"
+	// LabelstoreName is the name under which labelstore plugins are dispensed.
+	LabelstoreName = "labelstore"
+)
+
+// Handshake is used by the proxy and plugins to verify that they speak the same protocol.
+// It is not a security measure.
+var Handshake = goplugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "MULTENA_PLUGIN",
+	MagicCookieValue: "5e1c0a3a-multena-proxy",
+}
+
+// PluginMap holds every plugin kind the proxy knows how to dispense.
+var PluginMap = map[string]goplugin.Plugin{
+	EnforcerName:   &EnforcerPlugin{},
+	LabelstoreName: &LabelstorePlugin{},
+}
+
+// Identity carries the user information extracted from a validated token.
+type Identity struct {
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// Enforcer is implemented by plugins that rewrite queries to be tenant-safe.
+// It mirrors the proxy's built-in EnforceQL interface.
+type Enforcer interface {
+	Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error)
+}
+
+// Labelstore is implemented by plugins that resolve the tenant labels of an identity.
+type Labelstore interface {
+	// Connect is called once at startup with the plugin's settings from the proxy configuration.
+	Connect(settings map[string]string) error
+	// GetLabels returns the allowed labels of the identity and whether enforcement should be skipped.
+	GetLabels(identity Identity) (map[string]bool, bool, error)
+}
+
+// ServeEnforcer serves the given enforcer to the proxy. It blocks until the proxy terminates the plugin.
+func ServeEnforcer(impl Enforcer) {
+	goplugin.Serve(&goplugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         map[string]goplugin.Plugin{EnforcerName: &EnforcerPlugin{Impl: impl}},
+	})
+}
+
+// ServeLabelstore serves the given labelstore to the proxy. It blocks until the proxy terminates the plugin.
+func ServeLabelstore(impl Labelstore) {
+	goplugin.Serve(&goplugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         map[string]goplugin.Plugin{LabelstoreName: &LabelstorePlugin{Impl: impl}},
+	})
+}
+
+// EnforceArgs are the arguments of the Plugin.Enforce RPC call.
+type EnforceArgs struct {
+	Query        string
+	TenantLabels map[string]bool
+	LabelMatch   string
+}
+
+// EnforcerPlugin implements goplugin.Plugin for enforcers.
+type EnforcerPlugin struct {
+	Impl Enforcer
+}
+
+func (p *EnforcerPlugin) Server(*goplugin.MuxBroker) (interface{}, error) {
+	return &EnforcerRPCServer{Impl: p.Impl}, nil
+}
+
+func (*EnforcerPlugin) Client(_ *goplugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &EnforcerRPC{client: c}, nil
+}
+
+// EnforcerRPC is the proxy side of an enforcer plugin.
+type EnforcerRPC struct {
+	client *rpc.Client
+}
+
+func (e *EnforcerRPC) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
+	var resp string
+	err := e.client.Call("Plugin.Enforce", EnforceArgs{Query: query, TenantLabels: tenantLabels, LabelMatch: labelMatch}, &resp)
+	return resp, err
+}
+
+// EnforcerRPCServer is the plugin side of an enforcer plugin.
+type EnforcerRPCServer struct {
+	Impl Enforcer
+}
+
+func (s *EnforcerRPCServer) Enforce(args EnforceArgs, resp *string) error {
+	query, err := s.Impl.Enforce(args.Query, args.TenantLabels, args.LabelMatch)
+	*resp = query
+	return err
+}
+
+// GetLabelsReply is the reply of the Plugin.GetLabels RPC call.
+type GetLabelsReply struct {
+	Labels map[string]bool
+	Skip   bool
+}
+
+// LabelstorePlugin implements goplugin.Plugin for labelstores.
+type LabelstorePlugin struct {
+	Impl Labelstore
+}
+
+func (p *LabelstorePlugin) Server(*goplugin.MuxBroker) (interface{}, error) {
+	return &LabelstoreRPCServer{Impl: p.Impl}, nil
+}
+
+func (*LabelstorePlugin) Client(_ *goplugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &LabelstoreRPC{client: c}, nil
+}
+
+// LabelstoreRPC is the proxy side of a labelstore plugin.
+type LabelstoreRPC struct {
+	client *rpc.Client
+}
+
+func (l *LabelstoreRPC) Connect(settings map[string]string) error {
+	return l.client.Call("Plugin.Connect", settings, &struct{}{})
+}
+
+func (l *LabelstoreRPC) GetLabels(identity Identity) (map[string]bool, bool, error) {
+	var resp GetLabelsReply
+	err := l.client.Call("Plugin.GetLabels", identity, &resp)
+	return resp.Labels, resp.Skip, err
+}
+
+// LabelstoreRPCServer is the plugin side of a labelstore plugin.
+type LabelstoreRPCServer struct {
+	Impl Labelstore
+}
+
+func (s *LabelstoreRPCServer) Connect(settings map[string]string, _ *struct{}) error {
+	return s.Impl.Connect(settings)
+}
+
+func (s *LabelstoreRPCServer) GetLabels(identity Identity, resp *GetLabelsReply) error {
+	labels, skip, err := s.Impl.GetLabels(identity)
+	resp.Labels = labels
+	resp.Skip = skip
+	return err
+}
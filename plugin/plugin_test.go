@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	goplugin "github.com/hashicorp/go-plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+type upperEnforcer struct{}
+
+func (upperEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
+	if tenantLabels["forbidden"] {
+		return "", errors.New("forbidden tenant")
+	}
+	return strings.ToUpper(query) + labelMatch, nil
+}
+
+type staticLabelstore struct {
+	settings map[string]string
+}
+
+func (s *staticLabelstore) Connect(settings map[string]string) error {
+	s.settings = settings
+	return nil
+}
+
+func (s *staticLabelstore) GetLabels(identity Identity) (map[string]bool, bool, error) {
+	if identity.Username == "admin" {
+		return nil, true, nil
+	}
+	return map[string]bool{s.settings["prefix"] + identity.Username: true}, false, nil
+}
+
+func TestEnforcerRPC(t *testing.T) {
+	client, _ := goplugin.TestPluginRPCConn(t, map[string]goplugin.Plugin{
+		EnforcerName: &EnforcerPlugin{Impl: upperEnforcer{}},
+	}, nil)
+	defer client.Close()
+
+	raw, err := client.Dispense(EnforcerName)
+	assert.NoError(t, err)
+	enforcer := raw.(Enforcer)
+
+	query, err := enforcer.Enforce("up", map[string]bool{"a": true}, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, "UPnamespace", query)
+
+	_, err = enforcer.Enforce("up", map[string]bool{"forbidden": true}, "namespace")
+	assert.EqualError(t, err, "forbidden tenant")
+}
+
+func TestLabelstoreRPC(t *testing.T) {
+	client, _ := goplugin.TestPluginRPCConn(t, map[string]goplugin.Plugin{
+		LabelstoreName: &LabelstorePlugin{Impl: &staticLabelstore{}},
+	}, nil)
+	defer client.Close()
+
+	raw, err := client.Dispense(LabelstoreName)
+	assert.NoError(t, err)
+	labelstore := raw.(Labelstore)
+
+	assert.NoError(t, labelstore.Connect(map[string]string{"prefix": "ns-"}))
+
+	labels, skip, err := labelstore.GetLabels(Identity{Username: "user"})
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.Equal(t, map[string]bool{"ns-user": true}, labels)
+
+	labels, skip, err = labelstore.GetLabels(Identity{Username: "admin"})
+	assert.NoError(t, err)
+	assert.True(t, skip)
+	assert.Nil(t, labels)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	goplugin "github.com/hashicorp/go-plugin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/gepaplexx/multena-proxy/plugin"
+)
+
+const (
+	enforcerPluginPrefix   = "multena-enforcer-"
+	labelstorePluginPrefix = "multena-labelstore-"
+)
+
+// WithPlugins discovers external plugin binaries in the configured plugin directory.
+// Enforcer plugins are named multena-enforcer-<name> and labelstore plugins
+// multena-labelstore-<name>. Only the plugins referenced by the configuration are started,
+// each of them once, rebuilding the routes reuses the running plugin.
+func (a *App) WithPlugins() *App {
+	a.plugins = map[string]string{}
+	a.pluginImpls = map[string]interface{}{}
+	if a.Cfg().Plugins.Dir == "" {
+		return a
+	}
+	paths, err := goplugin.Discover("multena-*", a.Cfg().Plugins.Dir)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", a.Cfg().Plugins.Dir).Msg("Error while discovering plugins")
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if !strings.HasPrefix(name, enforcerPluginPrefix) && !strings.HasPrefix(name, labelstorePluginPrefix) {
+			log.Warn().Str("path", path).Msg("Ignoring file with unknown plugin prefix")
+			continue
+		}
+		log.Info().Str("path", path).Msg("Discovered plugin")
+		a.plugins[name] = path
+	}
+	for _, name := range referencedEnforcerPlugins(a.Cfg()) {
+		if _, err := a.dispensePlugin(enforcerPluginPrefix+name, plugin.EnforcerName); err != nil {
+			log.Fatal().Err(err).Str("plugin", name).Msg("Error while loading enforcer plugin")
+		}
+	}
+	return a
+}
+
+// referencedEnforcerPlugins returns the names of the enforcer plugins used by the configuration,
+// either as enforcer or as shadow enforcer.
+func referencedEnforcerPlugins(cfg *Config) []string {
+	var names []string
+	for _, name := range []string{cfg.Loki.Enforcer, cfg.Thanos.Enforcer, cfg.Loki.ShadowEnforcer, cfg.Thanos.ShadowEnforcer} {
+		if name != "" && name != builtinEnforcer && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// dispensePlugin returns the dispensed implementation of the plugin binary with the given file name.
+// The binary is started on first use, later calls return the same implementation.
+func (a *App) dispensePlugin(name string, kind string) (interface{}, error) {
+	if raw, ok := a.pluginImpls[name]; ok {
+		return raw, nil
+	}
+	path, ok := a.plugins[name]
+	if !ok {
+		return nil, fmt.Errorf("plugin %s not found in %s", name, a.Cfg().Plugins.Dir)
+	}
+	client := goplugin.NewClient(&goplugin.ClientConfig{
+		HandshakeConfig:  plugin.Handshake,
+		Plugins:          plugin.PluginMap,
+		Cmd:              exec.Command(path),
+		AllowedProtocols: []goplugin.Protocol{goplugin.ProtocolNetRPC},
+		Managed:          true,
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Name:   name,
+			Output: log.Logger,
+			Level:  hclog.Info,
+		}),
+	})
+	rpcClient, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+	raw, err := rpcClient.Dispense(kind)
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+	a.pluginImpls[name] = raw
+	return raw, nil
+}
+
+// stopPlugins kills the processes of all started plugins, it is called before the proxy exits.
+func stopPlugins() {
+	goplugin.CleanupClients()
+}
+
+// enforcerFor returns the built-in enforcer if no plugin name is configured,
+// otherwise the named enforcer plugin in place of the built-in one.
+func (a *App) enforcerFor(name string, builtin EnforceQL) EnforceQL {
+	if name == "" {
+		return builtin
+	}
+	raw, err := a.dispensePlugin(enforcerPluginPrefix+name, plugin.EnforcerName)
+	if err != nil {
+		log.Fatal().Err(err).Str("plugin", name).Msg("Error while loading enforcer plugin")
+	}
+	return PluginEnforcer{
+		Name:     name,
+		Language: queryLanguage(builtin),
+		impl:     raw.(plugin.Enforcer),
+	}
+}
+
+// PluginEnforcer delegates enforcement to an external enforcer plugin.
+// Language records which query language the plugin replaces so that
+// language-specific request handling keeps working.
+type PluginEnforcer struct {
+	Name     string
+	Language string
+	impl     plugin.Enforcer
+}
+
+func (p PluginEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
+	return p.impl.Enforce(query, tenantLabels, labelMatch)
+}
+
+// queryLanguage returns the query language handled by the enforcer, either logql or promql.
+func queryLanguage(enforcer EnforceQL) string {
+	switch e := enforcer.(type) {
+	case LogQLEnforcer:
+		return "logql"
+	case PromQLEnforcer:
+		return "promql"
+	case PluginEnforcer:
+		return e.Language
+	case ShadowEnforcer:
+		return queryLanguage(e.Current)
+	case StructuredMetadataEnforcer:
+		return queryLanguage(e.Enforcer)
+	default:
+		return ""
+	}
+}
+
+// PluginLabelstore delegates label lookup to an external labelstore plugin.
+type PluginLabelstore struct {
+	Name string
+	impl plugin.Labelstore
+}
+
+func (p *PluginLabelstore) Connect(a *App) error {
+	raw, err := a.dispensePlugin(labelstorePluginPrefix+p.Name, plugin.LabelstoreName)
+	if err != nil {
+		return err
+	}
+	p.impl = raw.(plugin.Labelstore)
+	return p.impl.Connect(a.Cfg().Plugins.Settings[p.Name])
+}
+
+func (p *PluginLabelstore) GetLabels(token OAuthToken) (map[string]bool, bool) {
+	labels, skip, err := p.impl.GetLabels(plugin.Identity{
+		Username: token.PreferredUsername,
+		Email:    token.Email,
+		Groups:   token.Groups,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("plugin", p.Name).Msg("Error while getting labels from plugin")
+		return nil, false
+	}
+	return labels, skip
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithPlugins(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"multena-enforcer-custom", "multena-labelstore-ldap", "multena-unknown", "other"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0o755)
+		assert.NoError(t, err)
+	}
+
+	app := newApp(&Config{Plugins: PluginConfig{Dir: dir}})
+	app.WithPlugins()
+
+	assert.Equal(t, map[string]string{
+		"multena-enforcer-custom": filepath.Join(dir, "multena-enforcer-custom"),
+		"multena-labelstore-ldap": filepath.Join(dir, "multena-labelstore-ldap"),
+	}, app.plugins)
+
+	_, err := app.dispensePlugin("multena-enforcer-missing", "enforcer")
+	assert.Error(t, err)
+}
+
+func TestReferencedEnforcerPlugins(t *testing.T) {
+	cfg := &Config{
+		Loki:   LokiConfig{Enforcer: "custom", ShadowEnforcer: "builtin"},
+		Thanos: ThanosConfig{Enforcer: "custom", ShadowEnforcer: "candidate"},
+	}
+	assert.Equal(t, []string{"custom", "candidate"}, referencedEnforcerPlugins(cfg))
+	assert.Empty(t, referencedEnforcerPlugins(&Config{}))
+}
+
+func TestQueryLanguage(t *testing.T) {
+	assert.Equal(t, "logql", queryLanguage(LogQLEnforcer{}))
+	assert.Equal(t, "promql", queryLanguage(PromQLEnforcer{}))
+	assert.Equal(t, "logql", queryLanguage(PluginEnforcer{Language: "logql"}))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+type PreflightConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Interval time.Duration `mapstructure:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+}
+
+var (
+	upstreamUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "multena_upstream_up",
+		Help: "Whether the last preflight probe of the upstream succeeded.",
+	}, []string{"upstream"})
+	upstreamProbeDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "multena_upstream_probe_duration_seconds",
+		Help: "Duration of the last preflight probe of the upstream.",
+	}, []string{"upstream"})
+)
+
+// upstreamProbe is a request that is expected to answer with 200 if the upstream is reachable and configured correctly.
+type upstreamProbe struct {
+	Name    string
+	URL     string
+	TLS     bool
+	Headers map[string]string
+}
+
+// preflight holds the results of the last probes of all upstreams.
+type preflight struct {
+	mu      sync.RWMutex
+	results map[string]error
+}
+
+// ready returns an error describing all upstreams whose last probe failed.
+func (p *preflight) ready() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var failed []string
+	for name, err := range p.results {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("upstreams not ready: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// WithPreflight probes the configured upstreams once at startup and then on the configured interval,
+// if preflight checks are enabled. The results are logged, exported as metrics and reported by /readyz.
+func (a *App) WithPreflight() *App {
+	if !a.Cfg().Preflight.Enabled {
+		return a
+	}
+	var probes []upstreamProbe
+	if a.Cfg().Thanos.URL != "" {
+		probes = append(probes, upstreamProbe{
+			Name:    "thanos",
+			URL:     strings.TrimSuffix(a.Cfg().Thanos.URL, "/") + mustPathRewriter("thanos", a.Cfg().Thanos.PathRewrite).rewrite("/api/v1/status/buildinfo"),
+			TLS:     a.Cfg().Thanos.UseMutualTLS,
+			Headers: a.Cfg().Thanos.Headers,
+		})
+	}
+	if a.Cfg().Loki.URL != "" {
+		probes = append(probes, upstreamProbe{
+			Name:    "loki",
+			URL:     strings.TrimSuffix(a.Cfg().Loki.URL, "/") + mustPathRewriter("loki", a.Cfg().Loki.PathRewrite).rewrite("/ready"),
+			TLS:     a.Cfg().Loki.UseMutualTLS,
+			Headers: a.Cfg().Loki.Headers,
+		})
+	}
+	a.preflight = &preflight{results: map[string]error{}}
+	a.probeUpstreams(probes)
+	if a.Cfg().Preflight.Interval > 0 {
+		go func() {
+			ticker := time.NewTicker(a.Cfg().Preflight.Interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				a.probeUpstreams(probes)
+			}
+		}()
+	}
+	return a
+}
+
+// probeUpstreams runs all probes and records their results.
+func (a *App) probeUpstreams(probes []upstreamProbe) {
+	for _, probe := range probes {
+		start := time.Now()
+		err := a.probeUpstream(probe)
+		upstreamProbeDuration.WithLabelValues(probe.Name).Set(time.Since(start).Seconds())
+		if err != nil {
+			upstreamUp.WithLabelValues(probe.Name).Set(0)
+			log.Error().Err(err).Str("upstream", probe.Name).Str("url", probe.URL).Msg("Upstream preflight check failed")
+		} else {
+			upstreamUp.WithLabelValues(probe.Name).Set(1)
+			log.Debug().Str("upstream", probe.Name).Str("url", probe.URL).Msg("Upstream preflight check succeeded")
+		}
+		a.preflight.mu.Lock()
+		a.preflight.results[probe.Name] = err
+		a.preflight.mu.Unlock()
+	}
+}
+
+func (a *App) probeUpstream(probe upstreamProbe) error {
+	timeout := a.Cfg().Preflight.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe.URL, nil)
+	if err != nil {
+		return err
+	}
+	setHeaders(req, probe.TLS, probe.Headers, a.ServiceAccountToken)
+	resp, err := a.upstreams.httpClient(req.URL).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
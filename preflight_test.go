@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gepaplexx/multena-proxy/internal/mockupstream"
+)
+
+func TestWithPreflight(t *testing.T) {
+	thanos := mockupstream.NewThanos()
+	defer thanos.Close()
+	loki := mockupstream.New(mockupstream.Response{Status: http.StatusServiceUnavailable, Body: "Ingester not ready"})
+	defer loki.Close()
+
+	app := newApp(&Config{
+		Preflight: PreflightConfig{Enabled: true},
+		Thanos:    ThanosConfig{URL: thanos.URL, Headers: map[string]string{"X-Test": "thanos"}},
+		Loki:      LokiConfig{URL: loki.URL},
+	})
+	app.ServiceAccountToken = "service-account-token"
+	app.WithHealthz().WithPreflight()
+
+	req, ok := thanos.LastRequest()
+	assert.True(t, ok)
+	assert.Equal(t, "/api/v1/status/buildinfo", req.Path)
+	assert.Equal(t, "Bearer service-account-token", req.Header.Get("Authorization"))
+	assert.Equal(t, "thanos", req.Header.Get("X-Test"))
+	req, ok = loki.LastRequest()
+	assert.True(t, ok)
+	assert.Equal(t, "/ready", req.Path)
+
+	rr := httptest.NewRecorder()
+	app.i.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "upstreams not ready: loki: unexpected status 503", rr.Body.String())
+
+	loki.SetResponse("/ready", http.StatusOK, "ready")
+	app.probeUpstreams([]upstreamProbe{{Name: "loki", URL: loki.URL + "/ready"}})
+	rr = httptest.NewRecorder()
+	app.i.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestWithPreflight_Disabled(t *testing.T) {
+	app := newApp(&Config{})
+	app.WithHealthz().WithPreflight()
+
+	rr := httptest.NewRecorder()
+	app.i.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, app.preflight)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// QuotaConfig limits the size of the results a tenant can request. Zero means unlimited.
+type QuotaConfig struct {
+	// MaxSeries is injected or clamped as limit on the Thanos series, labels and label values APIs
+	// and, with truncation enabled, caps the number of series returned by queries.
+	MaxSeries int `mapstructure:"max_series"`
+	// MaxSamples caps the number of samples returned by queries, with truncation enabled.
+	MaxSamples int `mapstructure:"max_samples"`
+	// MaxEntries is clamped as limit on Loki queries and tails.
+	MaxEntries int `mapstructure:"max_entries"`
+	// DefaultEntries is injected as limit on Loki queries and tails that do not set one.
+	DefaultEntries int `mapstructure:"default_entries"`
+	// MinStep is the smallest step allowed for range queries.
+	MinStep time.Duration `mapstructure:"min_step"`
+	// MaxPoints is the largest number of points per series a range query may request, the step is raised to match.
+	MaxPoints int `mapstructure:"max_points"`
+	// MaxSourceResolution is the lowest max_source_resolution allowed for Thanos range queries.
+	MaxSourceResolution time.Duration `mapstructure:"max_source_resolution"`
+	// DefaultRange is injected as time range into range requests without start and end.
+	DefaultRange time.Duration `mapstructure:"default_range"`
+}
+
+// QuotasConfig holds the default quota and the quotas of individual tenant labels.
+type QuotasConfig struct {
+	Default QuotaConfig            `mapstructure:"default"`
+	Tenants map[string]QuotaConfig `mapstructure:"tenants"`
+	// Truncate enables cutting oversized Thanos query responses down to the quota.
+	Truncate bool `mapstructure:"truncate"`
+}
+
+var quotaTruncations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_quota_truncations_total",
+	Help: "Number of upstream responses truncated to the tenant quota, by the limit that was hit.",
+}, []string{"limit"})
+
+// forLabels returns the quota of a user with the given tenant labels. Each limit is the most permissive
+// limit of the user's labels, labels without a quota of their own use the default.
+// For the minimum step and source resolution the most permissive limit is the smallest, for the default
+// range it is the longest, where zero leaves the range to the upstream.
+func (q QuotasConfig) forLabels(tenantLabels map[string]bool) QuotaConfig {
+	var quota QuotaConfig
+	first := true
+	for label := range tenantLabels {
+		tq, ok := q.Tenants[label]
+		if !ok {
+			tq = q.Default
+		}
+		if first {
+			quota, first = tq, false
+			continue
+		}
+		quota.MaxSeries = maxLimit(quota.MaxSeries, tq.MaxSeries)
+		quota.MaxSamples = maxLimit(quota.MaxSamples, tq.MaxSamples)
+		quota.MaxEntries = maxLimit(quota.MaxEntries, tq.MaxEntries)
+		quota.DefaultEntries = max(quota.DefaultEntries, tq.DefaultEntries)
+		quota.MaxPoints = maxLimit(quota.MaxPoints, tq.MaxPoints)
+		quota.MinStep = min(quota.MinStep, tq.MinStep)
+		quota.MaxSourceResolution = min(quota.MaxSourceResolution, tq.MaxSourceResolution)
+		quota.DefaultRange = maxLimit(quota.DefaultRange, tq.DefaultRange)
+	}
+	if first {
+		return q.Default
+	}
+	return quota
+}
+
+// maxLimit returns the more permissive of two limits, where zero is unlimited.
+func maxLimit[T int | time.Duration](a T, b T) T {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// applyQuotaParams rewrites the limit parameters of an enforced request to stay within the quota.
+// Loki requests without a limit get the default limit of the quota, which is clamped like a requested one.
+// Range requests without start and end get the default range of the quota, see injectTimeRange.
+// The step of range queries is clamped for both, see clampRangeParams.
+func applyQuotaParams(r *http.Request, quota QuotaConfig, language string) {
+	if quota.DefaultRange > 0 && isRangeEndpoint(r.URL.Path) {
+		rewriteRequestParams(r, func(values url.Values) {
+			injectTimeRange(values, quota.DefaultRange, time.Now())
+		})
+	}
+	if strings.HasSuffix(r.URL.Path, "/query_range") && (quota.MinStep > 0 || quota.MaxPoints > 0 || quota.MaxSourceResolution > 0) {
+		rewriteRequestParams(r, func(values url.Values) {
+			clampRangeParams(values, quota, language)
+		})
+	}
+	switch language {
+	case "promql":
+		if !isSeriesEndpoint(r.URL.Path) {
+			return
+		}
+		rewriteRequestParams(r, func(values url.Values) {
+			clampParam(values, "limit", quota.MaxSeries, true)
+		})
+	case "logql":
+		if !strings.HasSuffix(r.URL.Path, "/query") && !strings.HasSuffix(r.URL.Path, "/query_range") && !isTailRequest(r) {
+			return
+		}
+		rewriteRequestParams(r, func(values url.Values) {
+			if values.Get("limit") == "" && quota.DefaultEntries > 0 {
+				values.Set("limit", strconv.Itoa(quota.DefaultEntries))
+			}
+			clampParam(values, "limit", quota.MaxEntries, false)
+		})
+	}
+}
+
+// isSeriesEndpoint reports whether the path is one of the Prometheus APIs that accept a limit on returned series or labels.
+func isSeriesEndpoint(path string) bool {
+	return strings.HasSuffix(path, "/api/v1/series") ||
+		strings.HasSuffix(path, "/api/v1/labels") ||
+		(strings.Contains(path, "/api/v1/label/") && strings.HasSuffix(path, "/values"))
+}
+
+// clampParam lowers the integer parameter to limit if it is larger, not a positive integer or,
+// if inject is set, missing. Nothing is changed for a limit of zero.
+func clampParam(values url.Values, name string, limit int, inject bool) {
+	if limit <= 0 {
+		return
+	}
+	raw := values.Get(name)
+	if raw == "" {
+		if inject {
+			values.Set(name, strconv.Itoa(limit))
+		}
+		return
+	}
+	if n, err := strconv.Atoi(raw); err != nil || n <= 0 || n > limit {
+		log.Debug().Str("param", name).Str("value", raw).Int("limit", limit).Msg("Clamping request parameter")
+		values.Set(name, strconv.Itoa(limit))
+	}
+}
+
+// truncateResponse returns a response modifier that cuts Prometheus API responses down to the
+// quota's series and sample limits and adds a warning to truncated responses.
+func truncateResponse(quota QuotaConfig) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+			return nil
+		}
+		if quota.MaxSeries == 0 && quota.MaxSamples == 0 {
+			return nil
+		}
+		body, err := readResponseBody(resp)
+		if err != nil {
+			return err
+		}
+		truncated, limit, err := truncateBody(body, quota)
+		if err != nil {
+			log.Debug().Err(err).Msg("Response not truncated, it is not a Prometheus API response")
+			truncated = body
+		} else if limit != "" {
+			quotaTruncations.WithLabelValues(limit).Inc()
+			requestLogger(resp.Request).Info().Str("path", resp.Request.URL.Path).Str("limit", limit).Msg("Response truncated to quota")
+		}
+		setResponseBody(resp, truncated)
+		return nil
+	}
+}
+
+// setResponseBody replaces the body of the response and its length.
+func setResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// readResponseBody reads the response body, decompressing it if it is gzip encoded.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return io.ReadAll(resp.Body)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Del("Content-Encoding")
+	return io.ReadAll(gz)
+}
+
+// truncateBody truncates the result of a Prometheus API response. It returns the new body and the
+// name of the limit that was hit, or an empty name if the body was within the quota.
+func truncateBody(body []byte, quota QuotaConfig) ([]byte, string, error) {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, "", err
+	}
+
+	var limit string
+	var items []json.RawMessage
+	if err := json.Unmarshal(envelope["data"], &items); err == nil {
+		// series, labels and label values
+		if quota.MaxSeries > 0 && len(items) > quota.MaxSeries {
+			items, limit = items[:quota.MaxSeries], "max_series"
+		}
+		if limit == "" {
+			return body, "", nil
+		}
+		if envelope["data"], err = json.Marshal(items); err != nil {
+			return nil, "", err
+		}
+	} else {
+		var data map[string]json.RawMessage
+		if err := json.Unmarshal(envelope["data"], &data); err != nil {
+			return nil, "", err
+		}
+		if err := json.Unmarshal(data["result"], &items); err != nil {
+			// scalar and string results are small
+			return body, "", nil
+		}
+		items, limit = truncateSeries(items, quota)
+		if limit == "" {
+			return body, "", nil
+		}
+		if data["result"], err = json.Marshal(items); err != nil {
+			return nil, "", err
+		}
+		if envelope["data"], err = json.Marshal(data); err != nil {
+			return nil, "", err
+		}
+	}
+
+	appendWarning(envelope, fmt.Sprintf("result truncated by multena: %s quota exceeded", limit))
+	truncated, err := json.Marshal(envelope)
+	return truncated, limit, err
+}
+
+// truncateSeries keeps whole series of a vector or matrix result as long as they fit into the quota.
+func truncateSeries(series []json.RawMessage, quota QuotaConfig) ([]json.RawMessage, string) {
+	samples := 0
+	for i, raw := range series {
+		if quota.MaxSeries > 0 && i >= quota.MaxSeries {
+			return series[:i], "max_series"
+		}
+		var s struct {
+			Values     []json.RawMessage `json:"values"`
+			Histograms []json.RawMessage `json:"histograms"`
+		}
+		_ = json.Unmarshal(raw, &s)
+		n := len(s.Values) + len(s.Histograms)
+		if n == 0 {
+			// vector sample
+			n = 1
+		}
+		if quota.MaxSamples > 0 && samples+n > quota.MaxSamples {
+			return series[:i], "max_samples"
+		}
+		samples += n
+	}
+	return series, ""
+}
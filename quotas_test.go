@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotasForLabels(t *testing.T) {
+	quotas := QuotasConfig{
+		Default: QuotaConfig{MaxSeries: 100, MaxSamples: 1000, MaxEntries: 500},
+		Tenants: map[string]QuotaConfig{
+			"big":       {MaxSeries: 1000, MaxSamples: 500, MaxEntries: 0, DefaultEntries: 50},
+			"unlimited": {},
+		},
+	}
+
+	assert.Equal(t, quotas.Default, quotas.forLabels(map[string]bool{"small": true}))
+	assert.Equal(t, QuotaConfig{MaxSeries: 1000, MaxSamples: 1000, DefaultEntries: 50}, quotas.forLabels(map[string]bool{"small": true, "big": true}))
+	assert.Equal(t, QuotaConfig{DefaultEntries: 50}, quotas.forLabels(map[string]bool{"big": true, "unlimited": true}))
+	assert.Equal(t, quotas.Default, quotas.forLabels(nil))
+
+	ranges := QuotasConfig{
+		Default: QuotaConfig{DefaultRange: time.Hour},
+		Tenants: map[string]QuotaConfig{
+			"long": {DefaultRange: 24 * time.Hour},
+			"none": {},
+		},
+	}
+	assert.Equal(t, 24*time.Hour, ranges.forLabels(map[string]bool{"small": true, "long": true}).DefaultRange)
+	assert.Zero(t, ranges.forLabels(map[string]bool{"long": true, "none": true}).DefaultRange)
+}
+
+func TestCheckConfig_MaxSamplesNeedsTruncate(t *testing.T) {
+	messages := func(quotas QuotasConfig) []string {
+		var messages []string
+		for _, p := range checkConfig(&Config{Quotas: quotas}) {
+			messages = append(messages, p.Error())
+		}
+		return messages
+	}
+	quotas := QuotasConfig{Tenants: map[string]QuotaConfig{"big": {MaxSamples: 1000}}}
+	assert.Contains(t, messages(quotas), "quotas.tenants.big.max_samples: has no effect without quotas.truncate")
+
+	quotas.Truncate = true
+	for _, m := range messages(quotas) {
+		assert.NotContains(t, m, "max_samples")
+	}
+}
+
+func TestClampParam(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		limit  int
+		inject bool
+		want   string
+	}{
+		{name: "within limit", value: "10", limit: 100, want: "10"},
+		{name: "above limit", value: "1000", limit: 100, want: "100"},
+		{name: "unlimited request", value: "0", limit: 100, want: "100"},
+		{name: "invalid", value: "lots", limit: 100, want: "100"},
+		{name: "missing", value: "", limit: 100, want: ""},
+		{name: "missing injected", value: "", limit: 100, inject: true, want: "100"},
+		{name: "no limit", value: "1000", limit: 0, want: "1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := url.Values{}
+			if tt.value != "" {
+				values.Set("limit", tt.value)
+			}
+			clampParam(values, "limit", tt.limit, tt.inject)
+			assert.Equal(t, tt.want, values.Get("limit"))
+		})
+	}
+}
+
+func TestTruncateBody(t *testing.T) {
+	matrix := `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"a":"1"},"values":[[1,"1"],[2,"1"]]},
+		{"metric":{"a":"2"},"values":[[1,"1"],[2,"1"]]},
+		{"metric":{"a":"3"},"values":[[1,"1"],[2,"1"]]}]}}`
+
+	body, limit, err := truncateBody([]byte(matrix), QuotaConfig{MaxSeries: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, "max_series", limit)
+	assert.JSONEq(t, `{"status":"success","warnings":["result truncated by multena: max_series quota exceeded"],"data":{"resultType":"matrix","result":[
+		{"metric":{"a":"1"},"values":[[1,"1"],[2,"1"]]},
+		{"metric":{"a":"2"},"values":[[1,"1"],[2,"1"]]}]}}`, string(body))
+
+	body, limit, err = truncateBody([]byte(matrix), QuotaConfig{MaxSamples: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, "max_samples", limit)
+	assert.Contains(t, string(body), `"a":"2"`)
+	assert.NotContains(t, string(body), `"a":"3"`)
+
+	body, limit, err = truncateBody([]byte(matrix), QuotaConfig{MaxSeries: 3, MaxSamples: 6})
+	assert.NoError(t, err)
+	assert.Empty(t, limit)
+	assert.Equal(t, matrix, string(body))
+
+	body, limit, err = truncateBody([]byte(`{"status":"success","data":["a","b","c"]}`), QuotaConfig{MaxSeries: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, "max_series", limit)
+	assert.JSONEq(t, `{"status":"success","data":["a"],"warnings":["result truncated by multena: max_series quota exceeded"]}`, string(body))
+
+	_, _, err = truncateBody([]byte(`not json`), QuotaConfig{MaxSeries: 1})
+	assert.Error(t, err)
+}
+
+func TestE2E_QuotaLimitsAreApplied(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Quotas = QuotasConfig{Default: QuotaConfig{MaxSeries: 2, MaxEntries: 50}, Truncate: true}
+	env.Thanos.SetResponse("/api/v1/query", http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"a":"1"},"value":[1,"1"]},{"metric":{"a":"2"},"value":[1,"1"]},{"metric":{"a":"3"},"value":[1,"1"]}]}}`)
+
+	rr := env.do(http.MethodGet, "/api/v1/series?match[]=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ := env.Thanos.LastRequest()
+	assert.Equal(t, "2", req.Params.Get("limit"))
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "max_series quota exceeded")
+	assert.NotContains(t, rr.Body.String(), `"a":"3"`)
+
+	rr = env.do(http.MethodPost, "/loki/api/v1/query_range", "userTenant", url.Values{"query": {`{app="a"}`}, "limit": {"5000"}}.Encode())
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ = env.Loki.LastRequest()
+	assert.Equal(t, "50", req.Params.Get("limit"))
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "adminUserToken", "")
+	assert.Contains(t, rr.Body.String(), `"a":"3"`)
+}
+
+func TestE2E_LokiLimitDefaults(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Quotas = QuotasConfig{
+		Default: QuotaConfig{MaxEntries: 1000, DefaultEntries: 100},
+		Tenants: map[string]QuotaConfig{"allowed_user": {MaxEntries: 20, DefaultEntries: 100}, "also_allowed_user": {MaxEntries: 20}},
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		token  string
+		want   string
+	}{
+		{name: "default injected", target: "/loki/api/v1/query_range?query=" + url.QueryEscape(`{app="a"}`), token: "groupTenant", want: "100"},
+		{name: "requested limit kept", target: "/loki/api/v1/query?limit=500&query=" + url.QueryEscape(`{app="a"}`), token: "groupTenant", want: "500"},
+		{name: "tail clamped", target: "/loki/api/v1/tail?limit=5000&query=" + url.QueryEscape(`{app="a"}`), token: "groupTenant", want: "1000"},
+		{name: "tenant default clamped to tenant maximum", target: "/loki/api/v1/query_range?query=" + url.QueryEscape(`{app="a"}`), token: "userTenant", want: "20"},
+		{name: "labels untouched", target: "/loki/api/v1/labels", token: "groupTenant", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := env.do(http.MethodGet, tt.target, tt.token, "")
+			assert.Equal(t, http.StatusOK, rr.Code)
+			req, _ := env.Loki.LastRequest()
+			assert.Equal(t, tt.want, req.Params.Get("limit"))
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logfmt/logfmt"
+	"github.com/rs/zerolog"
+)
+
+// ReplayRecord is a single query read from a replay input. The JSON form matches the
+// decision log lines written by the proxy in dry-run mode.
+type ReplayRecord struct {
+	Line     int      `json:"-"`
+	Path     string   `json:"path"`
+	Language string   `json:"language"`
+	User     string   `json:"user"`
+	Labels   []string `json:"labels"`
+	Original string   `json:"original"`
+	Enforced string   `json:"enforced"`
+	Decision string   `json:"decision"`
+	Reason   string   `json:"reason"`
+	Error    string   `json:"error"`
+}
+
+// deniedBeforeEnforcement reports whether the record was denied before its query reached the enforcement,
+// because of the token or the labels of the user. Decision logs without a reason carry no labels for them.
+func (r ReplayRecord) deniedBeforeEnforcement() bool {
+	if r.Decision != "deny" {
+		return false
+	}
+	return r.Reason == "token" || r.Reason == "labels" || (r.Reason == "" && len(r.Labels) == 0)
+}
+
+// replayResult is the outcome of re-running a record through the current enforcers.
+type replayResult struct {
+	Record   ReplayRecord
+	Before   string
+	After    string
+	Changed  bool
+	Upstream string
+}
+
+// runReplay implements the replay subcommand. It reads recorded queries, re-runs enforcement
+// with the current code and reports every query whose rewriting changed. Requests denied before the
+// enforcement are counted on their own, their queries were never enforced.
+// It returns the process exit code: 0 if nothing changed, 1 if there are differences and 2 on usage errors.
+func runReplay(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	configDir := fs.String("config", "", "directory containing config.yaml, defaults to the standard search paths")
+	input := fs.String("input", "-", "file to read queries from, - for stdin")
+	format := fs.String("format", "json", "input format: json for proxy decision logs, logfmt for Loki query logs")
+	labelList := fs.String("labels", "", "comma separated tenant labels for records that do not carry labels")
+	upstream := fs.String("upstream", "", "optional upstream URL to execute changed queries against")
+	token := fs.String("token", "", "bearer token used for the upstream")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	paths := configPaths
+	if *configDir != "" {
+		paths = []string{*configDir}
+	}
+	cfg, err := readConfig(paths)
+	if err != nil {
+		_, _ = fmt.Fprintf(stdout, "error reading config: %v\n", err)
+		return 2
+	}
+	zerolog.SetGlobalLevel(zerolog.Level(cfg.Log.Level))
+	app := newApp(cfg)
+	app.tenantSets = newTenantSetCache()
+	app.WithPlugins()
+	defer stopPlugins()
+
+	var in io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			_, _ = fmt.Fprintf(stdout, "error opening input: %v\n", err)
+			return 2
+		}
+		defer f.Close()
+		in = f
+	}
+	records, err := readReplayRecords(in, *format)
+	if err != nil {
+		_, _ = fmt.Fprintf(stdout, "error reading input: %v\n", err)
+		return 2
+	}
+
+	var defaultLabels []string
+	if *labelList != "" {
+		defaultLabels = strings.Split(*labelList, ",")
+	}
+	enforcers := map[string]EnforceQL{
+		"logql":  app.enforcerFor(cfg.Loki.Enforcer, LogQLEnforcer{TenantSets: app.tenantSets}),
+		"promql": app.enforcerFor(cfg.Thanos.Enforcer, PromQLEnforcer{CrossTenantPolicy: cfg.Thanos.CrossTenantPolicy, TenantSets: app.tenantSets}),
+	}
+	tenantLabels := map[string]string{
+		"logql":  cfg.Loki.TenantLabel,
+		"promql": cfg.Thanos.TenantLabel,
+	}
+
+	changed, denied, skipped := 0, 0, 0
+	for _, record := range records {
+		if record.Decision == "skip" {
+			skipped++
+			continue
+		}
+		if record.deniedBeforeEnforcement() {
+			denied++
+			continue
+		}
+		if len(record.Labels) == 0 {
+			record.Labels = defaultLabels
+		}
+		if len(record.Labels) == 0 {
+			_, _ = fmt.Fprintf(stdout, "SKIPPED line %d: no tenant labels\n", record.Line)
+			skipped++
+			continue
+		}
+		res := replayOne(record, enforcers[record.Language], tenantLabels[record.Language])
+		if !res.Changed {
+			continue
+		}
+		changed++
+		if *upstream != "" {
+			res.Upstream = compareUpstream(*upstream, *token, res)
+		}
+		printReplayResult(stdout, res)
+	}
+	_, _ = fmt.Fprintf(stdout, "%d records, %d changed, %d denied before enforcement, %d skipped\n", len(records), changed, denied, skipped)
+	if changed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readReplayRecords parses the replay input in the given format.
+// Records without an explicit language are assigned one based on their path.
+func readReplayRecords(r io.Reader, format string) ([]ReplayRecord, error) {
+	var records []ReplayRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var record ReplayRecord
+		switch format {
+		case "json":
+			if err := json.Unmarshal([]byte(text), &record); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if record.Original == "" && record.Enforced == "" && record.Decision == "" {
+				continue
+			}
+		case "logfmt":
+			query, ok := logfmtValue(text, "query")
+			if !ok {
+				continue
+			}
+			// Loki logs the query as it received it, which is already enforced.
+			record.Language = "logql"
+			record.Original = query
+			record.Enforced = query
+			record.Decision = "allow"
+		default:
+			return nil, fmt.Errorf("unknown format %q", format)
+		}
+		if record.Language == "" {
+			record.Language = "promql"
+			if strings.HasPrefix(record.Path, "/loki") {
+				record.Language = "logql"
+			}
+		}
+		record.Line = line
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// logfmtValue returns the value of the given key in a logfmt encoded line.
+func logfmtValue(line string, key string) (string, bool) {
+	d := logfmt.NewDecoder(strings.NewReader(line))
+	for d.ScanRecord() {
+		for d.ScanKeyval() {
+			if string(d.Key()) == key {
+				return string(d.Value()), true
+			}
+		}
+	}
+	return "", false
+}
+
+// replayOne re-runs enforcement for the record and compares the outcome to the recorded one.
+// Outcomes are compared as the enforced query or, for denied requests, as the denial.
+func replayOne(record ReplayRecord, enforcer EnforceQL, tl string) replayResult {
+	labels := make(map[string]bool, len(record.Labels))
+	for _, l := range record.Labels {
+		labels[l] = true
+	}
+	res := replayResult{Record: record, Before: "denied"}
+	if record.Decision != "deny" {
+		res.Before = record.Enforced
+	}
+	enforced, err := enforcer.Enforce(record.Original, labels, tl)
+	if err != nil {
+		res.After = "denied"
+	} else {
+		res.After = enforced
+	}
+	res.Changed = canonicalQuery(res.Before, tl) != canonicalQuery(res.After, tl)
+	return res
+}
+
+// regexMatcher matches the regex matchers of a query, with the label name and the regular expression as groups.
+var regexMatcher = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)=~"([^"]*)"`)
+
+// canonicalQuery sorts the alternatives of regex matchers on the tenant label, as their order
+// depends on map iteration and is irrelevant for the result.
+func canonicalQuery(query string, tl string) string {
+	return regexMatcher.ReplaceAllStringFunc(query, func(m string) string {
+		match := regexMatcher.FindStringSubmatch(m)
+		if match[1] != tl {
+			return m
+		}
+		values := strings.Split(match[2], "|")
+		sort.Strings(values)
+		return fmt.Sprintf(`%s=~"%s"`, tl, strings.Join(values, "|"))
+	})
+}
+
+// compareUpstream executes the recorded and the new query against the upstream and
+// reports whether the returned data differs.
+func compareUpstream(upstream string, token string, res replayResult) string {
+	if res.Before == "denied" || res.After == "denied" {
+		return "not executed, one side was denied"
+	}
+	before, err := queryUpstream(upstream, token, res.Record.Language, res.Before)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	after, err := queryUpstream(upstream, token, res.Record.Language, res.After)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if bytes.Equal(before, after) {
+		return "results identical"
+	}
+	return "results differ"
+}
+
+// queryUpstream runs the query and returns the data field of the response.
+func queryUpstream(upstream string, token string, language string, query string) (json.RawMessage, error) {
+	params := url.Values{"query": {query}}
+	path := "/api/v1/query"
+	if language == "logql" {
+		path = "/loki/api/v1/query_range"
+		now := time.Now()
+		params.Set("start", fmt.Sprint(now.Add(-time.Hour).UnixNano()))
+		params.Set("end", fmt.Sprint(now.UnixNano()))
+		params.Set("limit", "100")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(upstream, "/")+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return decodeAPIResponse(resp.Body)
+}
+
+// decodeAPIResponse returns the data field of a Prometheus or Loki API response, or its error.
+func decodeAPIResponse(r io.Reader) (json.RawMessage, error) {
+	var body struct {
+		Status string          `json:"status"`
+		Error  string          `json:"error"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Status != "success" {
+		return nil, errors.New(body.Error)
+	}
+	return body.Data, nil
+}
+
+func printReplayResult(w io.Writer, res replayResult) {
+	_, _ = fmt.Fprintf(w, "CHANGED line %d user=%q language=%s labels=%s\n", res.Record.Line, res.Record.User, res.Record.Language, strings.Join(res.Record.Labels, ","))
+	_, _ = fmt.Fprintf(w, "  query:  %s\n", res.Record.Original)
+	_, _ = fmt.Fprintf(w, "  before: %s\n", res.Before)
+	_, _ = fmt.Fprintf(w, "  after:  %s\n", res.After)
+	if res.Upstream != "" {
+		_, _ = fmt.Fprintf(w, "  upstream: %s\n", res.Upstream)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadReplayRecords(t *testing.T) {
+	input := strings.Join([]string{
+		`{"level":"info","dry_run":true,"path":"/api/v1/query","original":"up","user":"u","labels":["a"],"decision":"allow","enforced":"up{namespace=\"a\"}"}`,
+		`{"level":"info","message":"unrelated"}`,
+		`{"level":"info","dry_run":true,"path":"/loki/api/v1/query","original":"{app=\"x\"}","labels":["a"],"decision":"deny"}`,
+	}, "\n")
+	records, err := readReplayRecords(strings.NewReader(input), "json")
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "promql", records[0].Language)
+	assert.Equal(t, 1, records[0].Line)
+	assert.Equal(t, "logql", records[1].Language)
+	assert.Equal(t, 3, records[1].Line)
+
+	lokiLog := `level=info ts=2024-01-01T00:00:00Z caller=metrics.go:159 component=frontend org_id=fake query="{kubernetes_namespace_name=\"a\"} |= \"error\"" status=200 limit=100`
+	records, err = readReplayRecords(strings.NewReader(lokiLog), "logfmt")
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, `{kubernetes_namespace_name="a"} |= "error"`, records[0].Original)
+	assert.Equal(t, records[0].Original, records[0].Enforced)
+
+	_, err = readReplayRecords(strings.NewReader(lokiLog), "csv")
+	assert.Error(t, err)
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	assert.Equal(t, canonicalQuery(`up{namespace=~"b|a"}`, "namespace"), canonicalQuery(`up{namespace=~"a|b"}`, "namespace"))
+	assert.NotEqual(t, canonicalQuery(`up{namespace=~"a|c"}`, "namespace"), canonicalQuery(`up{namespace=~"a|b"}`, "namespace"))
+	assert.Equal(t, `up{sub_namespace=~"b|a"}`, canonicalQuery(`up{sub_namespace=~"b|a"}`, "namespace"), "other labels are not sorted")
+}
+
+func TestRunReplay(t *testing.T) {
+	input := strings.Join([]string{
+		`{"path":"/api/v1/query","original":"up","labels":["a","b"],"decision":"allow","enforced":"up{namespace=~\"b|a\"}"}`,
+		`{"path":"/api/v1/query","original":"up{namespace=\"c\"}","labels":["a"],"decision":"deny"}`,
+		`{"path":"/api/v1/query","original":"up","labels":["a"],"decision":"allow","enforced":"up"}`,
+		`{"path":"/api/v1/query","original":"up","decision":"skip"}`,
+		`{"path":"/api/v1/query","original":"up","user":"u","decision":"deny","reason":"labels","error":"no tenant labels"}`,
+		`{"path":"/api/v1/query","original":"up","decision":"deny","error":"token expired"}`,
+	}, "\n")
+	file := filepath.Join(t.TempDir(), "decisions.log")
+	assert.NoError(t, os.WriteFile(file, []byte(input), 0o600))
+
+	var out bytes.Buffer
+	code := runReplay([]string{"--config", "./configs", "--input", file, "--labels", "a"}, &out)
+
+	assert.Equal(t, 1, code)
+	assert.Contains(t, out.String(), "CHANGED line 3")
+	assert.Contains(t, out.String(), `after:  up{namespace="a"}`)
+	assert.NotContains(t, out.String(), "CHANGED line 1")
+	assert.NotContains(t, out.String(), "CHANGED line 2")
+	assert.NotContains(t, out.String(), "CHANGED line 5", "denials before the enforcement are not changes")
+	assert.NotContains(t, out.String(), "CHANGED line 6")
+	assert.Contains(t, out.String(), "6 records, 1 changed, 2 denied before enforcement, 1 skipped")
+}
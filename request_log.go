@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// requestIDHeader carries the ID of a request. An ID sent by the client, e.g. by a load balancer, is kept,
+// otherwise one is generated. It is returned to the client and forwarded to the upstream.
+const requestIDHeader = "X-Request-Id"
+
+// validRequestID limits the IDs taken from clients to what is safe to log and forward.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID returns the ID of the request from its header or a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// withRequestLogger derives the logger of the request, which carries its ID, method, path and route, and
+// stores it in the request's context. Later stages add the identity and tenant labels with addLogFields.
+func withRequestLogger(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := requestID(r)
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+	c := log.With().Str("request_id", id).Str("method", r.Method).Str("path", r.URL.Path)
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+		c = c.Str("route", route.GetName())
+	}
+	logger := c.Logger()
+	return r.WithContext(logger.WithContext(r.Context()))
+}
+
+// requestLogger returns the logger of the request, or the global logger for requests that did not pass the
+// logging middleware.
+func requestLogger(r *http.Request) *zerolog.Logger {
+	return contextLogger(r.Context())
+}
+
+func contextLogger(ctx context.Context) *zerolog.Logger {
+	if logger, ok := storedLogger(ctx); ok {
+		return logger
+	}
+	return &log.Logger
+}
+
+// storedLogger returns the logger stored in the context, zerolog.Ctx returns a disabled logger without one.
+func storedLogger(ctx context.Context) (*zerolog.Logger, bool) {
+	logger := zerolog.Ctx(ctx)
+	return logger, logger != zerolog.DefaultContextLogger && logger.GetLevel() != zerolog.Disabled
+}
+
+// addLogFields adds fields to the logger of the request, all following log entries of the request carry them.
+func addLogFields(r *http.Request, fields func(zerolog.Context) zerolog.Context) {
+	if logger, ok := storedLogger(r.Context()); ok {
+		logger.UpdateContext(fields)
+	}
+}
+
+// logIdentity adds the user and groups of the token to the logger of the request.
+func logIdentity(r *http.Request, token OAuthToken) {
+	addLogFields(r, func(c zerolog.Context) zerolog.Context {
+		return c.Str("user", token.PreferredUsername).Strs("groups", token.Groups)
+	})
+}
+
+// logTenantLabels adds the tenant labels resolved for the request, sorted, to the logger of the request.
+func logTenantLabels(r *http.Request, labels map[string]bool) {
+	sorted := MapKeysToArray(labels)
+	slices.Sort(sorted)
+	addLogFields(r, func(c zerolog.Context) zerolog.Context {
+		return c.Strs("tenant_labels", sorted)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLogs writes the global logger to the returned buffer at debug level for the duration of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+	return &buf
+}
+
+func TestRequestID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	req.Header.Set(requestIDHeader, "lb-1234")
+	assert.Equal(t, "lb-1234", requestID(req))
+
+	req.Header.Set(requestIDHeader, "not valid\n")
+	assert.Len(t, requestID(req), 32)
+	req.Header.Del(requestIDHeader)
+	assert.NotEqual(t, requestID(req), requestID(req))
+}
+
+func TestE2E_RequestLogger(t *testing.T) {
+	env := newE2EEnv(t)
+	buf := captureLogs(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("Authorization", "Bearer "+env.Tokens["userTenant"])
+	req.Header.Set(requestIDHeader, "trace-me")
+	rr := httptest.NewRecorder()
+	env.App.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "trace-me", rr.Header().Get(requestIDHeader))
+	upstream, _ := env.Thanos.LastRequest()
+	assert.Equal(t, "trace-me", upstream.Header.Get(requestIDHeader))
+
+	var messages []string
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry["request_id"] != "trace-me" {
+			continue
+		}
+		message, _ := entry["message"].(string)
+		messages = append(messages, message)
+		if entry["message"] == "Forwarding request upstream" {
+			assert.Equal(t, "user", entry["user"])
+			assert.Equal(t, []any{"allowed_user", "also_allowed_user"}, entry["tenant_labels"])
+			assert.Equal(t, "/api/v1/query", entry["route"])
+		}
+	}
+	assert.Contains(t, messages, "Query enforced")
+	assert.Contains(t, messages, "Forwarding request upstream")
+	assert.Contains(t, messages, "Request complete")
+}
+
+func TestRequestLogger_WithoutMiddleware(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Same(t, &log.Logger, requestLogger(req))
+	addLogFields(req, func(c zerolog.Context) zerolog.Context { return c.Str("user", "x") })
+}
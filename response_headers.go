@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/http/httpguts"
+)
+
+// ResponseHeaderPolicy sets headers on the responses to the requests of matching routes and tenants, e.g.
+// Cache-Control for downstream caches or a data classification for browsers and gateways.
+type ResponseHeaderPolicy struct {
+	// Routes are the route paths the policy applies to, like /api/v1/query or /loki/api/v1/query_range.
+	// A trailing * matches all routes with the prefix, no routes match all routes.
+	Routes []string `mapstructure:"routes"`
+	// Tenants are the tenant labels the policy applies to. It applies to users with any of them,
+	// since their results may contain the data of each. No tenants match all users.
+	Tenants []string `mapstructure:"tenants"`
+	// Headers replace the headers of the upstream response, an empty value removes the header.
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+// validate reports header names that cannot be sent.
+func (p ResponseHeaderPolicy) validate() error {
+	if len(p.Headers) == 0 {
+		return fmt.Errorf("headers must be set")
+	}
+	for name := range p.Headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the policy applies to the route and a user with the tenant labels.
+func (p ResponseHeaderPolicy) matches(route string, tenantLabels map[string]bool) bool {
+	routeMatch := len(p.Routes) == 0
+	for _, pattern := range p.Routes {
+		prefix, wildcard := strings.CutSuffix(pattern, "*")
+		routeMatch = routeMatch || pattern == route || wildcard && strings.HasPrefix(route, prefix)
+	}
+	if !routeMatch {
+		return false
+	}
+	if len(p.Tenants) == 0 {
+		return true
+	}
+	for _, tenant := range p.Tenants {
+		if tenantLabels[tenant] {
+			return true
+		}
+	}
+	return false
+}
+
+// policyResponseHeaders returns the headers of the policies that apply to the request of a user with the
+// tenant labels. The route is the path template of the matched route, so it is not affected by path rewrites.
+// Policies later in the list override the headers of earlier ones.
+func policyResponseHeaders(policies []ResponseHeaderPolicy, r *http.Request, tenantLabels map[string]bool) map[string]string {
+	if len(policies) == 0 {
+		return nil
+	}
+	route := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			route = template
+		}
+	}
+	var headers map[string]string
+	for _, p := range policies {
+		if !p.matches(route, tenantLabels) {
+			continue
+		}
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		for name, value := range p.Headers {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// headerPolicyWriter applies the headers of the response header policies right before the response is written,
+// after the reverse proxy copied the upstream headers.
+type headerPolicyWriter struct {
+	http.ResponseWriter
+	headers     map[string]string
+	wroteHeader bool
+}
+
+func (w *headerPolicyWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for name, value := range w.headers {
+			if value == "" {
+				w.Header().Del(name)
+			} else {
+				w.Header().Set(name, value)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerPolicyWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *headerPolicyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *headerPolicyWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands out the connection of WebSocket live tails, whose handshake response does not carry the headers.
+func (w *headerPolicyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gepaplexx/multena-proxy/internal/mockupstream"
+)
+
+func TestResponseHeaderPolicyMatches(t *testing.T) {
+	user := map[string]bool{"team-a": true, "team-b": true}
+	assert.True(t, ResponseHeaderPolicy{}.matches("/api/v1/query", user))
+	assert.True(t, ResponseHeaderPolicy{Routes: []string{"/loki/*"}}.matches("/loki/api/v1/query", user))
+	assert.False(t, ResponseHeaderPolicy{Routes: []string{"/loki/*"}}.matches("/api/v1/query", user))
+	assert.True(t, ResponseHeaderPolicy{Routes: []string{"/api/v1/series", "/api/v1/query"}}.matches("/api/v1/query", user))
+	assert.False(t, ResponseHeaderPolicy{Routes: []string{"/api/v1/query"}}.matches("/api/v1/query_range", user))
+	assert.True(t, ResponseHeaderPolicy{Tenants: []string{"team-c", "team-b"}}.matches("/api/v1/query", user))
+	assert.False(t, ResponseHeaderPolicy{Tenants: []string{"team-c"}}.matches("/api/v1/query", user))
+
+	assert.NoError(t, ResponseHeaderPolicy{Headers: map[string]string{"Cache-Control": "no-store"}}.validate())
+	assert.Error(t, ResponseHeaderPolicy{}.validate())
+	assert.Error(t, ResponseHeaderPolicy{Headers: map[string]string{"Bad Header": "x"}}.validate())
+}
+
+func TestE2E_ResponseHeaderPolicies(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().ResponseHeaders = []ResponseHeaderPolicy{
+		{Headers: map[string]string{"Cache-Control": "private, max-age=30", "X-Content-Type-Options": "nosniff"}},
+		{Routes: []string{"/api/v1/*"}, Tenants: []string{"allowed_user"}, Headers: map[string]string{
+			"Cache-Control":         "no-store",
+			"X-Data-Classification": "confidential",
+			"X-Upstream-Version":    "",
+		}},
+	}
+	env.Thanos.SetRawResponse("/api/v1/query", mockupstream.Response{
+		Status: http.StatusOK,
+		Header: http.Header{"Cache-Control": {"max-age=300"}, "X-Upstream-Version": {"0.35"}},
+		Body:   `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+	})
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"), "later policies override earlier ones")
+	assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "confidential", rr.Header().Get("X-Data-Classification"))
+	assert.Empty(t, rr.Header().Values("X-Upstream-Version"))
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "groupTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "private, max-age=30", rr.Header().Get("Cache-Control"))
+	assert.Empty(t, rr.Header().Get("X-Data-Classification"))
+	assert.Equal(t, "0.35", rr.Header().Get("X-Upstream-Version"))
+
+	rr = env.do(http.MethodGet, "/loki/api/v1/query?query="+"%7Bapp%3D%22a%22%7D", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "private, max-age=30", rr.Header().Get("Cache-Control"))
+	assert.Empty(t, rr.Header().Get("X-Data-Classification"))
+}
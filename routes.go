@@ -7,6 +7,10 @@ import (
 	"net/http/httputil"
 	"net/http/pprof"
 	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
@@ -19,13 +23,150 @@ type Route struct {
 	MatchWord string
 }
 
-// WithHealthz sets up and adds health check endpoints (/healthz and /debug/pprof/)
-// and metrics endpoint (/metrics) to a new router
+// lokiRoutes are the enforced Loki API routes below /loki and the parameter holding their query.
+var lokiRoutes = []Route{
+	{Url: "/api/v1/query", MatchWord: "query"},
+	{Url: "/api/v1/query_range", MatchWord: "query"},
+	{Url: "/api/v1/series", MatchWord: "match[]"},
+	{Url: "/api/v1/tail", MatchWord: "query"},
+	{Url: "/api/v1/tail/sse", MatchWord: "query"},
+	{Url: "/api/v1/index/stats", MatchWord: "query"},
+	{Url: "/api/v1/format_query", MatchWord: "query"},
+	{Url: "/api/v1/labels", MatchWord: "query"},
+	{Url: "/api/v1/label/{label}/values", MatchWord: "query"},
+	{Url: "/api/v1/query_exemplars", MatchWord: "query"},
+	{Url: "/api/v1/status/buildinfo", MatchWord: "query"},
+}
+
+// thanosRoutes are the enforced Thanos API routes and the parameter holding their query.
+var thanosRoutes = []Route{
+	{Url: "/api/v1/query", MatchWord: "query"},
+	{Url: "/api/v1/query_range", MatchWord: "query"},
+	{Url: "/api/v1/series", MatchWord: "match[]"},
+	{Url: "/api/v1/tail", MatchWord: "query"},
+	{Url: "/api/v1/index/stats", MatchWord: "query"},
+	{Url: "/api/v1/format_query", MatchWord: "query"},
+	{Url: "/api/v1/labels", MatchWord: "match[]"},
+	{Url: "/api/v1/label/{label}/values", MatchWord: "match[]"},
+	{Url: "/api/v1/query_exemplars", MatchWord: "query"},
+	{Url: "/api/v1/status/buildinfo", MatchWord: "query"},
+	{Url: "/api/v1/metadata", MatchWord: "query"},
+	{Url: "/api/v1/status/runtimeinfo", MatchWord: "query"},
+}
+
+// defaultExemptRoutes are the routes that are only authenticated, not enforced, unless exempt_routes
+// is configured for the datasource. They answer the status requests Grafana uses for health checks
+// and version detection.
+var defaultExemptRoutes = map[string][]string{
+	"loki":   {"/api/v1/status/buildinfo", "/ready"},
+	"thanos": {"/api/v1/status/buildinfo", "/api/v1/status/runtimeinfo"},
+}
+
+// exemptRoutes returns the set of exempt routes of the datasource, the configured ones or the defaults.
+// Only the default routes can be configured, all other routes carry a query and always need enforcement.
+func exemptRoutes(datasource string, configured []string) (map[string]bool, error) {
+	if configured == nil {
+		configured = defaultExemptRoutes[datasource]
+	}
+	exempt := make(map[string]bool, len(configured))
+	for _, route := range configured {
+		if !slices.Contains(defaultExemptRoutes[datasource], route) {
+			return nil, fmt.Errorf("route %q is enforced, only %s can be exempt", route, strings.Join(defaultExemptRoutes[datasource], ", "))
+		}
+		exempt[route] = true
+	}
+	return exempt, nil
+}
+
+// mustExemptRoutes returns the exempt routes of the datasource and exits if they are invalid.
+func mustExemptRoutes(datasource string, configured []string) map[string]bool {
+	exempt, err := exemptRoutes(datasource, configured)
+	if err != nil {
+		log.Fatal().Err(err).Str("datasource", datasource).Msg("Error parsing exempt routes")
+	}
+	return exempt
+}
+
+// defaultRouteMethods are the methods of the datasource routes unless route_methods is configured for them.
+// The enforcement reads the query of GET and HEAD requests from the URL and of POST requests from the form.
+var defaultRouteMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// routeMethods returns the allowed methods of every route of the datasource, the configured ones or the defaults.
+// Only the methods the enforcement understands can be configured.
+func routeMethods(routes []Route, configured map[string][]string) (map[string][]string, error) {
+	methods := make(map[string][]string, len(routes))
+	for _, route := range routes {
+		methods[route.Url] = defaultRouteMethods
+	}
+	for route, allowed := range configured {
+		if _, ok := methods[route]; !ok {
+			return nil, fmt.Errorf("unknown route %q", route)
+		}
+		if len(allowed) == 0 {
+			return nil, fmt.Errorf("route %q must allow at least one method", route)
+		}
+		methods[route] = nil
+		for _, method := range allowed {
+			method = strings.ToUpper(method)
+			if !slices.Contains(defaultRouteMethods, method) {
+				return nil, fmt.Errorf("route %q: method %q is not one of GET, HEAD or POST", route, method)
+			}
+			methods[route] = append(methods[route], method)
+		}
+	}
+	return methods, nil
+}
+
+// mustRouteMethods returns the allowed methods of the datasource routes and exits if they are invalid.
+func mustRouteMethods(datasource string, routes []Route, configured map[string][]string) map[string][]string {
+	methods, err := routeMethods(routes, configured)
+	if err != nil {
+		log.Fatal().Err(err).Str("datasource", datasource).Msg("Error parsing route methods")
+	}
+	return methods
+}
+
+// headAsGet serves HEAD requests like GET requests. The server drops the body of the response to a HEAD request,
+// so neither the enforcement nor the upstream have to support HEAD.
+func headAsGet(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			r = r.WithContext(r.Context())
+			r.Method = http.MethodGet
+		}
+		next(w, r)
+	}
+}
+
+// notRouted answers requests that match no route. If their path is routed for other methods, they are answered
+// with 405 and the methods of the path in the Allow header, otherwise with 404. The method mismatches reported by
+// the router are not relied on, they get lost in subrouters with several routes.
+func (a *App) notRouted(w http.ResponseWriter, r *http.Request) {
+	var allowed []string
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete} {
+		var match mux.RouteMatch
+		probe := r.WithContext(r.Context())
+		probe.Method = method
+		if a.e.Match(probe, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	if len(allowed) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	logAndWriteError(w, http.StatusMethodNotAllowed, nil, fmt.Sprintf("method %s is not allowed", r.Method))
+}
+
+// WithHealthz sets up and adds health check endpoints (/healthz, /readyz and /debug/pprof/)
+// and metrics endpoint (/metrics) to a new router. /readyz also fails while an upstream
+// preflight check fails, see WithPreflight.
 func (a *App) WithHealthz() *App {
 	i := mux.NewRouter()
-	a.healthy = true
+	a.healthy.Store(true)
 	i.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		if a.healthy {
+		if a.healthy.Load() {
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write([]byte("Ok"))
 		} else {
@@ -33,6 +174,24 @@ func (a *App) WithHealthz() *App {
 			_, _ = w.Write([]byte("Not Ok"))
 		}
 	})
+	i.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !a.healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("Not Ok"))
+			return
+		}
+		if a.preflight != nil {
+			if err := a.preflight.ready(); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("Ok"))
+	})
+	i.HandleFunc("/version", versionHandler).Methods(http.MethodGet)
+	a.withLifecycle(i)
 	i.HandleFunc("/debug/pprof/", pprof.Index)
 	i.Handle("/metrics", promhttp.Handler())
 	a.i = i
@@ -41,11 +200,63 @@ func (a *App) WithHealthz() *App {
 
 // WithRoutes initializes a new router, sets up logging middleware, and assigns
 // the router to the App's router field, returning the updated App.
+// Besides the datasource routes it registers the /debug/enforce preview endpoint, the /debug/compare endpoint,
+// the generated OpenAPI document and the tenant admin API.
 func (a *App) WithRoutes() *App {
 	e := mux.NewRouter()
 	e.Use(a.loggingMiddleware)
+	e.Use(a.identityHeaderGuard)
 	e.SkipClean(true)
+	e.NotFoundHandler = http.HandlerFunc(a.notRouted)
+	e.MethodNotAllowedHandler = http.HandlerFunc(a.notRouted)
 	a.e = e
+	a.enforcers = map[string]EnforceQL{}
+	a.tenantSets = newTenantSetCache()
+	a.tenantHeaders = map[string]map[string]*template.Template{}
+	a.shedders = map[string]*loadShedder{}
+	if a.Cfg().LoadShedding.Enabled {
+		for language, name := range map[string]string{"logql": "loki", "promql": "thanos"} {
+			shedder, err := newLoadShedder(name, a.Cfg().LoadShedding)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error parsing load shedding low priority headers")
+			}
+			a.shedders[language] = shedder
+		}
+	}
+	a.violations = nil
+	if a.Cfg().Violations.Enabled {
+		a.violations = newViolationTracker(a.Cfg().Violations, a.httpClient())
+	}
+	a.securityEvents.close()
+	a.securityEvents = nil
+	if a.Cfg().SecurityEvents.Enabled {
+		a.securityEvents = newSecurityEvents(a.Cfg().SecurityEvents, a.httpClient(), a.TlS)
+	}
+	a.lockout = nil
+	if a.Cfg().Lockout.Enabled {
+		l, err := newLockout(a.Cfg().Lockout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error parsing lockout allow_networks")
+		}
+		a.lockout = l
+	}
+	a.suspensions = newSuspensions()
+	a.labelIndex.close()
+	a.labelIndex = nil
+	a.forwardAuth = nil
+	if a.Cfg().ForwardAuth.Enabled {
+		f, err := newForwardAuth(a.Cfg().ForwardAuth)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error configuring forward-auth")
+		}
+		a.forwardAuth = f
+	}
+	e.HandleFunc("/debug/enforce", a.enforcePreview).Methods(http.MethodGet, http.MethodPost)
+	e.HandleFunc("/debug/compare", a.enforceComparison).Methods(http.MethodGet, http.MethodPost)
+	e.HandleFunc("/openapi.json", a.openAPIHandler).Methods(http.MethodGet)
+	a.WithTenantAdmin()
+	a.WithSuspensionAdmin()
+	a.WithOIDC()
 	a.WithLoki()
 	a.WithThanos()
 	return a
@@ -53,159 +264,420 @@ func (a *App) WithRoutes() *App {
 
 // WithLoki configures and adds a set of Loki API routes to the App's router,
 // logging warnings if the Loki URL is not set, and returns the updated App.
+// The log deletion API is served by its own handler, see lokiDelete. Exempt routes are only authenticated.
+// Routes only accept their methods, see routeMethods, other methods are answered by notRouted.
+// Paths are rewritten for the upstream after routing, see pathRewriter.
+// Log queries are additionally constrained on the structured metadata keys, see StructuredMetadataEnforcer.
 func (a *App) WithLoki() *App {
-	if a.Cfg.Loki.URL == "" {
+	if a.Cfg().Loki.URL == "" {
 		log.Warn().Msg("Loki URL not set, skipping Loki routes")
 		return a
 	}
-	routes := []Route{
-		{Url: "/api/v1/query", MatchWord: "query"},
-		{Url: "/api/v1/query_range", MatchWord: "query"},
-		{Url: "/api/v1/series", MatchWord: "match[]"},
-		{Url: "/api/v1/tail", MatchWord: "query"},
-		{Url: "/api/v1/index/stats", MatchWord: "query"},
-		{Url: "/api/v1/format_query", MatchWord: "query"},
-		{Url: "/api/v1/labels", MatchWord: "query"},
-		{Url: "/api/v1/label/{label}/values", MatchWord: "query"},
-		{Url: "/api/v1/query_exemplars", MatchWord: "query"},
-		{Url: "/api/v1/status/buildinfo", MatchWord: "query"},
+	exempt := mustExemptRoutes("loki", a.Cfg().Loki.ExemptRoutes)
+	builtin := LogQLEnforcer{TenantSets: a.tenantSets}
+	enforcer := a.shadowEnforcerFor(a.Cfg().Loki.ShadowEnforcer, a.enforcerFor(a.Cfg().Loki.Enforcer, builtin), builtin)
+	a.enforcers["logql"] = enforcer
+	tenantHeaders, err := compileTenantHeaders(a.Cfg().Loki.TenantHeaders)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error parsing Loki tenant headers")
+	}
+	a.tenantHeaders["logql"] = tenantHeaders
+	a.streams = newStreamLimiter(a.Cfg().Loki.Tail)
+	rewriter := mustPathRewriter("loki", a.Cfg().Loki.PathRewrite)
+	methods := mustRouteMethods("loki", lokiRoutes, a.Cfg().Loki.RouteMethods)
+	if exempt["/ready"] {
+		a.e.Handle("/ready", rewriter.middleware(headAsGet(authenticatedHandler(a.Cfg().Loki.URL, a.Cfg().Loki.UseMutualTLS, a.Cfg().Loki.Headers, a)))).
+			Methods(http.MethodGet, http.MethodHead).
+			Name("/ready")
 	}
 	lokiRouter := a.e.PathPrefix("/loki").Subrouter()
-	for _, route := range routes {
+	lokiRouter.Use(rewriter.middleware)
+	for _, route := range lokiRoutes {
 		log.Trace().Any("route", route).Msg("Loki route")
-		lokiRouter.HandleFunc(route.Url, handler(route.MatchWord,
-			LogQLEnforcer(struct{}{}),
-			a.Cfg.Loki.TenantLabel,
-			a.Cfg.Loki.URL,
-			a.Cfg.Loki.UseMutualTLS,
-			a.Cfg.Loki.Headers,
-			a)).Name(route.Url)
+		if exempt[route.Url] {
+			lokiRouter.HandleFunc(route.Url, headAsGet(authenticatedHandler(a.Cfg().Loki.URL, a.Cfg().Loki.UseMutualTLS, a.Cfg().Loki.Headers, a))).
+				Methods(methods[route.Url]...).
+				Name(route.Url)
+			continue
+		}
+		routeEnforcer := enforcer
+		if len(a.Cfg().Loki.StructuredMetadataKeys) > 0 && structuredMetadataRoutes[route.Url] {
+			routeEnforcer = StructuredMetadataEnforcer{Enforcer: enforcer, Keys: a.Cfg().Loki.StructuredMetadataKeys}
+		}
+		lokiRouter.HandleFunc(route.Url, headAsGet(handler(route.MatchWord,
+			routeEnforcer,
+			a.Cfg().Loki.TenantLabel,
+			a.Cfg().Loki.URL,
+			a.Cfg().Loki.UseMutualTLS,
+			a.Cfg().Loki.Headers,
+			a))).Methods(methods[route.Url]...).Name(route.Url)
+	}
+	lokiURL, err := url.Parse(a.Cfg().Loki.URL)
+	if err != nil {
+		log.Fatal().Err(err).Str("url", a.Cfg().Loki.URL).Msg("Error parsing URL")
 	}
+	lokiRouter.HandleFunc("/api/v1/delete", a.lokiDelete(lokiURL)).Name("/api/v1/delete")
 	return a
 }
 
 // WithThanos configures and adds a set of Thanos API routes to the App's router,
 // logging warnings if the Thanos URL is not set, and returns the updated App.
+// The TSDB admin APIs are only reachable by the TSDB admin groups, see tsdbAdmin, and the operational APIs
+// only by the operator groups, see operatorAPI. Exempt routes are only authenticated.
+// Routes only accept their methods, see routeMethods, other methods are answered by notRouted.
+// Paths are rewritten for the upstream after routing, see pathRewriter.
+// With the label index enabled, label lookups are answered from the precomputed index, see labelIndex.
 func (a *App) WithThanos() *App {
-	if a.Cfg.Thanos.URL == "" {
+	if a.Cfg().Thanos.URL == "" {
 		log.Warn().Msg("Thanos URL not set, skipping Thanos routes")
 		return a
 	}
-	routes := []Route{
-		{Url: "/api/v1/query", MatchWord: "query"},
-		{Url: "/api/v1/query_range", MatchWord: "query"},
-		{Url: "/api/v1/series", MatchWord: "match[]"},
-		{Url: "/api/v1/tail", MatchWord: "query"},
-		{Url: "/api/v1/index/stats", MatchWord: "query"},
-		{Url: "/api/v1/format_query", MatchWord: "query"},
-		{Url: "/api/v1/labels", MatchWord: "match[]"},
-		{Url: "/api/v1/label/{label}/values", MatchWord: "match[]"},
-		{Url: "/api/v1/query_exemplars", MatchWord: "query"},
-		{Url: "/api/v1/status/buildinfo", MatchWord: "query"},
-		{Url: "/api/v1/metadata", MatchWord: "query"},
+	exempt := mustExemptRoutes("thanos", a.Cfg().Thanos.ExemptRoutes)
+	builtin := PromQLEnforcer{CrossTenantPolicy: a.Cfg().Thanos.CrossTenantPolicy, TenantSets: a.tenantSets}
+	enforcer := a.shadowEnforcerFor(a.Cfg().Thanos.ShadowEnforcer, a.enforcerFor(a.Cfg().Thanos.Enforcer, builtin), builtin)
+	a.enforcers["promql"] = enforcer
+	tenantHeaders, err := compileTenantHeaders(a.Cfg().Thanos.TenantHeaders)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error parsing Thanos tenant headers")
+	}
+	a.tenantHeaders["promql"] = tenantHeaders
+	if a.Cfg().Thanos.LabelIndex.Enabled {
+		a.labelIndex, err = newLabelIndex(a.Cfg().Thanos, tenantHeaders, a)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error configuring the Thanos label index")
+		}
 	}
 	thanosRouter := a.e.PathPrefix("").Subrouter()
-	for _, route := range routes {
+	thanosRouter.Use(mustPathRewriter("thanos", a.Cfg().Thanos.PathRewrite).middleware)
+	methods := mustRouteMethods("thanos", thanosRoutes, a.Cfg().Thanos.RouteMethods)
+	for _, route := range thanosRoutes {
 		log.Trace().Any("route", route).Msg("Thanos route")
+		if exempt[route.Url] {
+			thanosRouter.HandleFunc(route.Url, headAsGet(authenticatedHandler(a.Cfg().Thanos.URL, a.Cfg().Thanos.UseMutualTLS, a.Cfg().Thanos.Headers, a))).
+				Methods(methods[route.Url]...).
+				Name(route.Url)
+			continue
+		}
 		thanosRouter.HandleFunc(route.Url,
-			handler(route.MatchWord,
-				PromQLEnforcer(struct{}{}),
-				a.Cfg.Thanos.TenantLabel,
-				a.Cfg.Thanos.URL,
-				a.Cfg.Thanos.UseMutualTLS,
-				a.Cfg.Thanos.Headers,
-				a)).Name(route.Url)
+			headAsGet(handler(route.MatchWord,
+				enforcer,
+				a.Cfg().Thanos.TenantLabel,
+				a.Cfg().Thanos.URL,
+				a.Cfg().Thanos.UseMutualTLS,
+				a.Cfg().Thanos.Headers,
+				a))).Methods(methods[route.Url]...).Name(route.Url)
 
 	}
+	thanosURL, err := url.Parse(a.Cfg().Thanos.URL)
+	if err != nil {
+		log.Fatal().Err(err).Str("url", a.Cfg().Thanos.URL).Msg("Error parsing URL")
+	}
+	thanosRouter.HandleFunc("/api/v1/admin/tsdb/{action:delete_series|snapshot|clean_tombstones}", a.tsdbAdmin(thanosURL)).
+		Methods(http.MethodPost, http.MethodPut).
+		Name("/api/v1/admin/tsdb")
+	operator := a.operatorAPI(thanosURL)
+	thanosRouter.HandleFunc("/api/v1/{endpoint:stores|targets|targets/metadata|rules|alerts|alertmanagers}", operator).
+		Methods(http.MethodGet).
+		Name("/api/v1/operator")
+	thanosRouter.HandleFunc("/api/v1/status/{status:config|flags|tsdb|walreplay}", operator).
+		Methods(http.MethodGet).
+		Name("/api/v1/status/operator")
 	return a
 }
 
-// handler function orchestrates the request flow through the proxy, comprising
-// authentication, conditional enforcement, and forwarding to the upstream server.
-//
-// Initially, it retrieves the OAuth token and validates it.
-//
-// Subsequently, it validates labels retrieved from the token and determines whether
-// enforcement should be skipped based on them. If an error occurs during label
-// validation, it is logged and a forbidden status response is dispatched. If enforcement
-// is opted to be skipped, the request is streamed directly to the upstream server without
-// further checks.
-//
-// If the flow doesn’t skip enforcement, the function enforces the request based on the
-// provided labels and other relevant parameters. Should any enforcement error arise, it is
-// logged and a forbidden status is sent to the client.
-//
-// Finally, if all checks and possible enforcement pass successfully, the request is
-// streamed to the upstream server.
+// datasourceHandler serves an enforced route of a datasource. The settings that can only change with a
+// restart are read when the routes are built, all others from the config of the request.
+type datasourceHandler struct {
+	matchWord       string
+	enforcer        EnforceQL
+	language        string
+	tl              string
+	upstreamURL     *url.URL
+	tls             bool
+	headers         map[string]string
+	rewriteWarnings bool
+	router          *timeRouter
+	fan             *fanOut
+	a               *App
+}
+
+// handler returns the handler of an enforced datasource route. A request is authenticated, authorized
+// for the tenant labels of the user, enforced, limited by the tenant quota and forwarded to the upstream.
+// Users that skip the enforcement are forwarded after authorization, as are all authenticated requests in
+// dry-run mode, see dryRunEvaluate. Label lookups of Thanos are answered from the label index if it has
+// them, see labelIndex.
 func handler(matchWord string, enforcer EnforceQL, tl string, dsURL string, tls bool, headers map[string]string, a *App) func(http.ResponseWriter, *http.Request) {
 	upstreamURL, err := url.Parse(dsURL)
 	if err != nil {
 		log.Fatal().Err(err).Str("url", dsURL).Msg("Error parsing URL")
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		oauthToken, err := getToken(r, a)
-		if err != nil {
-			logAndWriteError(w, http.StatusForbidden, err, "")
+	h := &datasourceHandler{
+		matchWord:       matchWord,
+		enforcer:        enforcer,
+		language:        queryLanguage(enforcer),
+		tl:              tl,
+		upstreamURL:     upstreamURL,
+		tls:             tls,
+		headers:         headers,
+		rewriteWarnings: a.Cfg().Thanos.RewriteWarnings,
+		router:          newTimeRouter("promql", a.Cfg().Thanos.TimeRouting),
+		fan:             newFanOut("promql", a.Cfg().Thanos.FanOut),
+		a:               a,
+	}
+	if h.language == "logql" {
+		h.rewriteWarnings = a.Cfg().Loki.RewriteWarnings
+		h.router = newTimeRouter("logql", a.Cfg().Loki.TimeRouting)
+		h.fan = newFanOut("logql", a.Cfg().Loki.FanOut)
+	}
+	return h.serve
+}
+
+func (h *datasourceHandler) serve(w http.ResponseWriter, r *http.Request) {
+	// the settings of the handler come from one config, also if it is reloaded during the request
+	cfg := h.a.Cfg()
+	shedder := h.a.shedders[h.language]
+	if shedder != nil && shedder.shed(w, r) {
+		return
+	}
+	oauthToken, err := getToken(r, cfg, h.a)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	if cfg.Web.DryRun {
+		dryRunEvaluate(r, oauthToken, h.matchWord, h.enforcer, h.tl, cfg, h.a)
+		h.forward(w, r, cfg, shedder)
+		return
+	}
+
+	labels, skip, ok := h.authorize(w, r, cfg, oauthToken)
+	if !ok {
+		return
+	}
+	w, release, ok := h.prepareResponse(w, r, cfg, oauthToken, labels)
+	if !ok {
+		return
+	}
+	defer release()
+	setTenantHeaders(r, h.a.tenantHeaders[h.language], oauthToken, labels)
+	if skip {
+		if isAdmin(oauthToken, cfg) {
+			h.a.securityEvents.emit(r, securityAdminBypass, oauthToken, nil)
 		}
+		h.forward(w, r, cfg, shedder)
+		return
+	}
+	if h.language == "promql" && h.a.labelIndex.serve(w, r, labels, cfg.Quotas.forLabels(labels), cfg.LabelTransform) {
+		return
+	}
 
-		labels, skip, err := validateLabels(oauthToken, a)
-		if err != nil {
-			logAndWriteError(w, http.StatusForbidden, err, "")
-			return
+	original, ok := h.enforce(w, r, cfg, oauthToken, labels)
+	if !ok {
+		return
+	}
+	modifiers := h.applyQuotas(r, cfg, labels, original)
+	if invert := cfg.LabelTransform.invertResponse(r, h.tl); invert != nil {
+		modifiers = append(modifiers, invert)
+	}
+	if err := h.setActorHeader(r, oauthToken); err != nil {
+		logAndWriteError(w, http.StatusForbidden, err, "")
+		return
+	}
+	h.forward(w, r, cfg, shedder, modifiers...)
+}
+
+// authorize resolves the tenant labels of the user and reports whether the enforcement is skipped for them.
+// Requests of users without tenant labels are rejected with 403 and those of users of rate limited tenant
+// labels with 429 once the rate is exceeded, see TenantSuspension.
+func (h *datasourceHandler) authorize(w http.ResponseWriter, r *http.Request, cfg *Config, oauthToken OAuthToken) (map[string]bool, bool, bool) {
+	labels, skip, err := validateLabels(oauthToken, cfg, h.a)
+	if err != nil {
+		logAndWriteError(w, http.StatusForbidden, err, "")
+		return nil, false, false
+	}
+	logTenantLabels(r, labels)
+	if err := h.a.suspensions.allow(labels, cfg.Suspensions); err != nil {
+		writeSuspendedError(w, err)
+		return nil, false, false
+	}
+	return labels, skip, true
+}
+
+// prepareResponse wraps the response writer for the request and returns the function releasing what the
+// request holds. With response header policies configured, the headers of the matching policies are set
+// on the response, see ResponseHeaderPolicy. Live tail streams count against the per-user and global
+// stream limits while they are open, see streamLimiter, and are closed once idle for the idle timeout.
+func (h *datasourceHandler) prepareResponse(w http.ResponseWriter, r *http.Request, cfg *Config, oauthToken OAuthToken, labels map[string]bool) (http.ResponseWriter, func(), bool) {
+	if headers := policyResponseHeaders(cfg.ResponseHeaders, r, labels); len(headers) > 0 {
+		w = &headerPolicyWriter{ResponseWriter: w, headers: headers}
+	}
+	if h.a.streams == nil || !isTailRequest(r) {
+		return w, func() {}, true
+	}
+	release, err := h.a.streams.acquire(oauthToken.PreferredUsername)
+	if err != nil {
+		logAndWriteError(w, http.StatusTooManyRequests, err, "")
+		return w, nil, false
+	}
+	if timeout := cfg.Loki.Tail.IdleTimeout; timeout > 0 {
+		w = &idleTimeoutWriter{ResponseWriter: w, timeout: timeout}
+	}
+	return w, release, true
+}
+
+// enforce restricts the query of the request to the tenant labels, returns the original query and reports
+// whether the request may be forwarded. Tenant label values of the query are transformed as configured in
+// label_transform first, if the user took them from a response, see LabelTransformConfig.applyToQuery.
+// Rejected requests are counted per user with violation tracking enabled, see violationTracker, count as
+// authorization failures of the user and client address with the lockout enabled, see lockout, and are
+// exported with security events enabled, see securityEvents.
+func (h *datasourceHandler) enforce(w http.ResponseWriter, r *http.Request, cfg *Config, oauthToken OAuthToken, labels map[string]bool) (string, bool) {
+	original := requestParam(r, h.matchWord)
+	err := enforceRequest(r, cfg.LabelTransform.enforcer(h.enforcer, h.language), labels, h.tl, h.matchWord)
+	if err != nil {
+		status := enforceStatus(err)
+		if h.a.violations != nil && status == http.StatusForbidden {
+			h.a.violations.record(r, oauthToken.PreferredUsername, h.language, err)
 		}
-		if skip {
-			streamUp(w, r, upstreamURL, tls, headers, a)
-			return
+		if h.a.lockout != nil && status == http.StatusForbidden {
+			h.a.lockout.fail(r, oauthToken.PreferredUsername)
+		}
+		if status == http.StatusForbidden {
+			h.a.securityEvents.emit(r, securityEnforcementViolation, oauthToken, err)
 		}
+		requestLogger(r).Debug().Err(err).Int("status", status).Msg("Request rejected by the enforcement")
+		logAndWriteError(w, status, err, "")
+		return "", false
+	}
+	requestLogger(r).Debug().Str("original", original).Str("enforced", requestParam(r, h.matchWord)).Msg("Query enforced")
+	return original, true
+}
+
+// applyQuotas applies the limits of the tenant quota to the enforced request, see applyQuotaParams, and
+// returns the modifiers of the upstream response. With truncation enabled, oversized Thanos responses are
+// cut down to the quota, see truncateResponse. With rewrite warnings enabled, responses of queries that
+// differ from the original query carry a warning naming the tenant labels.
+func (h *datasourceHandler) applyQuotas(r *http.Request, cfg *Config, labels map[string]bool, original string) []func(*http.Response) error {
+	quota := cfg.Quotas.forLabels(labels)
+	applyQuotaParams(r, quota, h.language)
+	var modifiers []func(*http.Response) error
+	if cfg.Quotas.Truncate && h.language == "promql" {
+		modifiers = append(modifiers, truncateResponse(quota))
+	}
+	if h.rewriteWarnings && requestParam(r, h.matchWord) != original {
+		modifiers = append(modifiers, addWarningResponse(rewriteWarning(labels, h.tl)))
+	}
+	return modifiers
+}
+
+// setActorHeader sets the actor header of the datasource, if configured, to the identity of the user.
+func (h *datasourceHandler) setActorHeader(r *http.Request, oauthToken OAuthToken) error {
+	switch h.language {
+	case "logql":
+		return setActorHeaderLogQL(r, oauthToken, h.a)
+	case "promql":
+		return setActorHeaderPromQL(r, oauthToken, h.a)
+	}
+	return nil
+}
 
-		err = enforceRequest(r, enforcer, labels, tl, matchWord)
+// forward streams the request to the upstream and applies the modifiers to the response.
+// Streams requested as Server-Sent Events are relayed by sseTail and, with resume enabled, live tail
+// WebSockets by resumingTail. With time routing configured, requests that only read recent data are sent
+// to the hot upstream, see timeRouter, and with fan-out configured, queries are sent to all fan-out
+// upstreams as well and their results merged, see fanOut. With load shedding enabled, the latency and
+// status of the forwarded request are tracked by the shedder.
+func (h *datasourceHandler) forward(w http.ResponseWriter, r *http.Request, cfg *Config, shedder *loadShedder, modifiers ...func(*http.Response) error) {
+	if isSSETailRequest(r) {
+		sseTail(w, r, h.upstreamURL, h.tls, h.headers, cfg.Loki.Tail, h.a)
+		return
+	}
+	if cfg.Loki.Tail.Resume && isTailRequest(r) && isWebSocketRequest(r) {
+		resumingTail(w, r, h.upstreamURL, h.tls, h.headers, h.a)
+		return
+	}
+	target := h.router.route(r, h.matchWord, h.upstreamURL)
+	up := streamUp
+	if h.fan.handles(r) {
+		up = h.fan.serve
+	}
+	if shedder == nil {
+		up(w, r, target, h.tls, h.headers, h.a, modifiers...)
+		return
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	up(rec, r, target, h.tls, h.headers, h.a, modifiers...)
+	shedder.observe(time.Since(start), rec.status >= http.StatusInternalServerError)
+}
+
+// authenticatedHandler forwards requests of authenticated users without enforcement. It serves the
+// exempt routes, which do not return tenant data.
+func authenticatedHandler(dsURL string, tls bool, headers map[string]string, a *App) func(http.ResponseWriter, *http.Request) {
+	upstreamURL, err := url.Parse(dsURL)
+	if err != nil {
+		log.Fatal().Err(err).Str("url", dsURL).Msg("Error parsing URL")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		oauthToken, err := getToken(r, a.Cfg(), a)
 		if err != nil {
-			logAndWriteError(w, http.StatusForbidden, err, "")
+			writeTokenError(w, err)
 			return
 		}
-
-		if _, ok := enforcer.(LogQLEnforcer); ok {
-			err := setActorHeaderLogQL(r, oauthToken, a)
-			if err != nil {
-				logAndWriteError(w, http.StatusForbidden, err, "")
-				return
-			}
-		}
-		if _, ok := enforcer.(PromQLEnforcer); ok {
-			err := setActorHeaderPromQL(r, oauthToken, a)
-			if err != nil {
-				logAndWriteError(w, http.StatusForbidden, err, "")
-				return
-			}
-		}
-
+		requestLogger(r).Debug().Str("user", oauthToken.PreferredUsername).Str("path", r.URL.Path).Msg("Forwarding exempt route without enforcement")
 		streamUp(w, r, upstreamURL, tls, headers, a)
 	}
 }
 
 func setActorHeaderLogQL(r *http.Request, token OAuthToken, a *App) error {
-	if a.Cfg.Loki.ActorHeader != "" {
+	if a.Cfg().Loki.ActorHeader != "" {
 		data := fmt.Sprintf("%s%s", token.PreferredUsername, token.Email)
 		encoded := base64.StdEncoding.EncodeToString([]byte(data))
-		r.Header.Set(a.Cfg.Loki.ActorHeader, encoded)
+		r.Header.Set(a.Cfg().Loki.ActorHeader, encoded)
 	}
 	return nil
 }
 
 func setActorHeaderPromQL(r *http.Request, token OAuthToken, a *App) error {
-	if a.Cfg.Thanos.ActorHeader != "" {
+	if a.Cfg().Thanos.ActorHeader != "" {
 		data := fmt.Sprintf("%s%s", token.PreferredUsername, token.Email)
 		encoded := base64.StdEncoding.EncodeToString([]byte(data))
-		r.Header.Set(a.Cfg.Thanos.ActorHeader, encoded)
+		r.Header.Set(a.Cfg().Thanos.ActorHeader, encoded)
 	}
 	return nil
 }
 
 // streamUp forwards the provided HTTP request to the specified upstream URL using
 // a reverse proxy.It serves the upstream content back to the original client.
-func streamUp(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, tls bool, headers map[string]string, a *App) {
+// The modifiers are applied to the upstream response in order before it is served.
+// With compression enabled, the responses they rewrote are gzip encoded again for clients accepting it.
+// With conditional requests enabled, label and metadata lookups get an ETag and are answered with 304
+// if the client already has the response.
+func streamUp(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, tls bool, headers map[string]string, a *App, modifiers ...func(*http.Response) error) {
 	setHeaders(r, tls, headers, a.ServiceAccountToken)
 	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	proxy.Transport = a.upstreams.roundTripper(upstreamURL)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		requestLogger(r).Error().Err(err).Str("upstream", upstreamURL.Host).Msg("Upstream request failed")
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	if len(modifiers) > 0 && a.Cfg().Compression.Enabled {
+		modifiers = append(modifiers, compressResponse(a.Cfg().Compression, r.Header.Get("Accept-Encoding")))
+	}
+	if a.Cfg().Web.ConditionalRequests && r.Method == http.MethodGet && isConditionalEndpoint(r.URL.Path) {
+		modifiers = append(modifiers, conditionalResponse(r.Header.Get("If-None-Match")))
+	}
+	if len(modifiers) > 0 {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			for _, modify := range modifiers {
+				if err := modify(resp); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	requestLogger(r).Debug().Str("upstream", upstreamURL.Host).Str("query", r.URL.RawQuery).Msg("Forwarding request upstream")
 	proxy.ServeHTTP(w, r)
 }
 
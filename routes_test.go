@@ -11,13 +11,11 @@ import (
 )
 
 func TestSetActorHeaderLogQL(t *testing.T) {
-	app := &App{
-		Cfg: &Config{
-			Loki: LokiConfig{
-				ActorHeader: "X-Actor",
-			},
+	app := newApp(&Config{
+		Loki: LokiConfig{
+			ActorHeader: "X-Actor",
 		},
-	}
+	})
 	token := OAuthToken{
 		PreferredUsername: "user",
 		Email:             "user@example.com",
@@ -31,13 +29,11 @@ func TestSetActorHeaderLogQL(t *testing.T) {
 }
 
 func TestSetActorHeaderPromQL(t *testing.T) {
-	app := &App{
-		Cfg: &Config{
-			Thanos: ThanosConfig{
-				ActorHeader: "X-Actor",
-			},
+	app := newApp(&Config{
+		Thanos: ThanosConfig{
+			ActorHeader: "X-Actor",
 		},
-	}
+	})
 	token := OAuthToken{
 		PreferredUsername: "user",
 		Email:             "user@example.com",
@@ -50,13 +46,11 @@ func TestSetActorHeaderPromQL(t *testing.T) {
 }
 
 func TestWithHealthz(t *testing.T) {
-	app := &App{
-		Cfg: &Config{
-			Alert: AlertConfig{
-				Enabled: false,
-			},
+	app := newApp(&Config{
+		Alert: AlertConfig{
+			Enabled: false,
 		},
-	}
+	})
 
 	app = app.WithHealthz()
 
@@ -64,7 +58,7 @@ func TestWithHealthz(t *testing.T) {
 	defer ts.Close()
 
 	t.Run("Healthz OK", func(t *testing.T) {
-		app.healthy = true
+		app.healthy.Store(true)
 		resp, err := http.Get(ts.URL + "/healthz")
 		if err != nil {
 			t.Fatalf("Failed to send GET request: %v", err)
@@ -82,7 +76,7 @@ func TestWithHealthz(t *testing.T) {
 	})
 
 	t.Run("Healthz Not OK", func(t *testing.T) {
-		app.healthy = false
+		app.healthy.Store(false)
 		resp, err := http.Get(ts.URL + "/healthz")
 		if err != nil {
 			t.Fatalf("Failed to send GET request: %v", err)
@@ -116,3 +110,45 @@ func TestWithHealthz(t *testing.T) {
 		}
 	})
 }
+
+func TestExemptRoutes(t *testing.T) {
+	exempt, err := exemptRoutes("thanos", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"/api/v1/status/buildinfo": true, "/api/v1/status/runtimeinfo": true}, exempt)
+	exempt, err = exemptRoutes("loki", []string{"/ready"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"/ready": true}, exempt)
+	exempt, err = exemptRoutes("loki", []string{})
+	assert.NoError(t, err)
+	assert.Empty(t, exempt)
+
+	_, err = exemptRoutes("loki", []string{"/ready", "/api/v1/query_range"})
+	assert.ErrorContains(t, err, `route "/api/v1/query_range" is enforced`)
+	_, err = exemptRoutes("thanos", []string{"/ready"})
+	assert.Error(t, err, "/ready is not a Thanos route")
+}
+
+func TestCheckConfig_ExemptQueryRoute(t *testing.T) {
+	cfg := &Config{Thanos: ThanosConfig{ExemptRoutes: []string{"/api/v1/query"}}}
+	var messages []string
+	for _, p := range checkConfig(cfg) {
+		messages = append(messages, p.Error())
+	}
+	assert.Contains(t, messages, `thanos.exempt_routes: route "/api/v1/query" is enforced, only /api/v1/status/buildinfo, /api/v1/status/runtimeinfo can be exempt`)
+}
+
+func TestRouteMethods(t *testing.T) {
+	methods, err := routeMethods(lokiRoutes, map[string][]string{"/api/v1/tail": {"get"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{http.MethodGet}, methods["/api/v1/tail"])
+	assert.Equal(t, defaultRouteMethods, methods["/api/v1/query"])
+
+	for _, configured := range []map[string][]string{
+		{"/api/v1/unknown": {"GET"}},
+		{"/api/v1/query": {}},
+		{"/api/v1/query": {"GET", "PUT"}},
+	} {
+		_, err := routeMethods(thanosRoutes, configured)
+		assert.Error(t, err, configured)
+	}
+}
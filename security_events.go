@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// Kinds of security events.
+const (
+	securityAuthFailure          = "auth_failure"
+	securityEnforcementViolation = "enforcement_violation"
+	securityAdminBypass          = "admin_bypass"
+)
+
+var securityEventKinds = []string{securityAuthFailure, securityEnforcementViolation, securityAdminBypass}
+
+// syslogFacilities are the facilities security events can be sent with, see RFC 5424.
+var syslogFacilities = map[string]int{
+	"auth": 4, "authpriv": 10, "security": 13,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SecurityEventsConfig exports the authentication and enforcement decisions of the proxy to the sinks of a SIEM.
+// Events are queued per sink and sent in batches, failed batches are retried with an exponential backoff.
+type SecurityEventsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Kinds are the exported kinds of events, auth_failure, enforcement_violation and admin_bypass, empty exports all.
+	Kinds []string `mapstructure:"kinds"`
+	// BatchSize is the largest number of events sent at once, defaults to 100.
+	BatchSize int `mapstructure:"batch_size"`
+	// FlushInterval is the longest time an event waits for its batch to fill, defaults to 5s.
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// MaxRetries is the number of retries of a failed batch before it is dropped, defaults to 3.
+	MaxRetries int `mapstructure:"max_retries"`
+	// RetryBackoff is the wait before the first retry, it doubles with every further retry, defaults to 1s.
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+	// QueueSize is the number of events queued per sink, further events are dropped, defaults to 10000.
+	QueueSize int               `mapstructure:"queue_size"`
+	Syslog    SyslogSinkConfig  `mapstructure:"syslog"`
+	Kafka     KafkaSinkConfig   `mapstructure:"kafka"`
+	Webhook   WebhookSinkConfig `mapstructure:"webhook"`
+}
+
+// SyslogSinkConfig sends events as RFC 5424 messages with the JSON event as message.
+type SyslogSinkConfig struct {
+	// Address is the host:port of the syslog server, empty disables the sink.
+	Address string `mapstructure:"address"`
+	// Network is udp, tcp or tls, defaults to udp. Stream messages are framed by octet counting, see RFC 6587.
+	Network string `mapstructure:"network"`
+	// Facility is auth, authpriv, security or local0 to local7, defaults to authpriv.
+	Facility string `mapstructure:"facility"`
+	// AppName is the APP-NAME of the messages, defaults to multena-proxy.
+	AppName string `mapstructure:"app_name"`
+}
+
+// KafkaSinkConfig produces events as JSON records through the HTTP API of a Kafka REST proxy, e.g. the Confluent
+// REST proxy or the Strimzi Kafka bridge. The records are keyed by user.
+type KafkaSinkConfig struct {
+	// URL is the base URL of the REST proxy, empty disables the sink.
+	URL     string            `mapstructure:"url"`
+	Topic   string            `mapstructure:"topic"`
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+// WebhookSinkConfig posts batches of events as JSON array.
+type WebhookSinkConfig struct {
+	// URL receives the batches, empty disables the sink.
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+// validate returns the first problem found in the configuration.
+func (c SecurityEventsConfig) validate() error {
+	for _, kind := range c.Kinds {
+		if !ContainsIgnoreCase(securityEventKinds, kind) {
+			return fmt.Errorf("invalid kind %q, must be one of %s", kind, strings.Join(securityEventKinds, ", "))
+		}
+	}
+	if c.BatchSize < 0 || c.FlushInterval < 0 || c.MaxRetries < 0 || c.RetryBackoff < 0 || c.QueueSize < 0 {
+		return fmt.Errorf("sizes, intervals and retries must not be negative")
+	}
+	if c.Syslog.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Syslog.Address); err != nil {
+			return fmt.Errorf("invalid syslog address: %w", err)
+		}
+		if network := c.Syslog.Network; network != "" && network != "udp" && network != "tcp" && network != "tls" {
+			return fmt.Errorf("invalid syslog network %q, must be udp, tcp or tls", network)
+		}
+		if _, ok := syslogFacilities[c.Syslog.Facility]; c.Syslog.Facility != "" && !ok {
+			return fmt.Errorf("invalid syslog facility %q", c.Syslog.Facility)
+		}
+	}
+	if c.Kafka.URL != "" {
+		if err := checkURL(c.Kafka.URL); err != nil {
+			return fmt.Errorf("invalid kafka url: %w", err)
+		}
+		if c.Kafka.Topic == "" {
+			return fmt.Errorf("kafka topic must be set")
+		}
+	}
+	if c.Webhook.URL != "" {
+		if err := checkURL(c.Webhook.URL); err != nil {
+			return fmt.Errorf("invalid webhook url: %w", err)
+		}
+	}
+	if c.Syslog.Address == "" && c.Kafka.URL == "" && c.Webhook.URL == "" {
+		return fmt.Errorf("at least one of syslog, kafka and webhook must be configured")
+	}
+	return nil
+}
+
+var (
+	securityEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_security_events_total",
+		Help: "Number of exported security events, by kind.",
+	}, []string{"kind"})
+	securityEventBatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_security_event_batches_total",
+		Help: "Number of batches of security events sent to a sink, by sink and result.",
+	}, []string{"sink", "result"})
+	securityEventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_security_events_dropped_total",
+		Help: "Number of security events not delivered to a sink because its queue was full or its retries were exhausted.",
+	}, []string{"sink"})
+)
+
+// SecurityEvent is an authentication or enforcement decision of the proxy.
+type SecurityEvent struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	User      string    `json:"user,omitempty"`
+	Groups    []string  `json:"groups,omitempty"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	RequestID string    `json:"request_id,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// securitySink delivers batches of events to an external system.
+type securitySink interface {
+	name() string
+	send(ctx context.Context, events []SecurityEvent) error
+}
+
+// securityEvents queues the events for every sink, a slow or failing sink does not hold up the others.
+// A nil securityEvents exports nothing.
+type securityEvents struct {
+	cfg     SecurityEventsConfig
+	workers []*sinkWorker
+
+	// mu guards closed, emit holds it for reading while queueing
+	mu     sync.RWMutex
+	closed bool
+}
+
+// sinkWorker batches the events of one sink.
+type sinkWorker struct {
+	sink  securitySink
+	queue chan SecurityEvent
+	done  chan struct{}
+}
+
+// newSecurityEvents starts the workers of the configured sinks. The client is used by the HTTP sinks and the
+// TLS configuration by syslog over TLS.
+func newSecurityEvents(cfg SecurityEventsConfig, client *http.Client, tlsConfig *tls.Config) *securityEvents {
+	var sinks []securitySink
+	if cfg.Syslog.Address != "" {
+		sinks = append(sinks, newSyslogSink(cfg.Syslog, tlsConfig))
+	}
+	if cfg.Kafka.URL != "" {
+		sinks = append(sinks, &kafkaSink{cfg: cfg.Kafka, client: client})
+	}
+	if cfg.Webhook.URL != "" {
+		sinks = append(sinks, &webhookSink{cfg: cfg.Webhook, client: client})
+	}
+	return startSecurityEvents(cfg, sinks)
+}
+
+func startSecurityEvents(cfg SecurityEventsConfig, sinks []securitySink) *securityEvents {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 10000
+	}
+	s := &securityEvents{cfg: cfg}
+	for _, sink := range sinks {
+		w := &sinkWorker{sink: sink, queue: make(chan SecurityEvent, cfg.QueueSize), done: make(chan struct{})}
+		s.workers = append(s.workers, w)
+		go w.run(cfg)
+	}
+	return s
+}
+
+// emit queues an event of the kind for the request. The user is empty for failed authentications.
+func (s *securityEvents) emit(r *http.Request, kind string, token OAuthToken, reason error) {
+	if s == nil || (len(s.cfg.Kinds) > 0 && !ContainsIgnoreCase(s.cfg.Kinds, kind)) {
+		return
+	}
+	event := SecurityEvent{
+		Time:      time.Now().UTC(),
+		Kind:      kind,
+		User:      token.PreferredUsername,
+		Groups:    token.Groups,
+		Remote:    r.RemoteAddr,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		RequestID: r.Header.Get(requestIDHeader),
+	}
+	if reason != nil {
+		event.Reason = reason.Error()
+	}
+	securityEventsTotal.WithLabelValues(kind).Inc()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	for _, w := range s.workers {
+		select {
+		case w.queue <- event:
+		default:
+			securityEventsDropped.WithLabelValues(w.sink.name()).Inc()
+		}
+	}
+}
+
+// close sends the queued events and stops the workers.
+func (s *securityEvents) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for _, w := range s.workers {
+		close(w.queue)
+	}
+	s.mu.Unlock()
+	for _, w := range s.workers {
+		<-w.done
+	}
+}
+
+// run sends a batch when it is full or the flush interval passed, until the queue is closed.
+func (w *sinkWorker) run(cfg SecurityEventsConfig) {
+	defer close(w.done)
+	ticker := time.NewTicker(cfg.FlushInterval)
+	defer ticker.Stop()
+	var batch []SecurityEvent
+	for {
+		select {
+		case event, ok := <-w.queue:
+			if !ok {
+				w.deliver(cfg, batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= cfg.BatchSize {
+				w.deliver(cfg, batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			w.deliver(cfg, batch)
+			batch = nil
+		}
+	}
+}
+
+// deliver sends the batch, retrying failures with an exponential backoff. Batches that still fail are dropped.
+func (w *sinkWorker) deliver(cfg SecurityEventsConfig, batch []SecurityEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := w.sink.send(ctx, batch)
+		cancel()
+		if err == nil {
+			securityEventBatches.WithLabelValues(w.sink.name(), "sent").Inc()
+			return
+		}
+		securityEventBatches.WithLabelValues(w.sink.name(), "failed").Inc()
+		if attempt >= cfg.MaxRetries {
+			securityEventsDropped.WithLabelValues(w.sink.name()).Add(float64(len(batch)))
+			log.Error().Err(err).Str("sink", w.sink.name()).Int("events", len(batch)).Msg("Could not send security events")
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// webhookSink posts the batches as JSON array.
+type webhookSink struct {
+	cfg    WebhookSinkConfig
+	client *http.Client
+}
+
+func (s *webhookSink) name() string { return "webhook" }
+
+func (s *webhookSink) send(ctx context.Context, events []SecurityEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.client, s.cfg.URL, "application/json", s.cfg.Headers, body)
+}
+
+// kafkaSink produces the events through the REST proxy API, POST /topics/{topic}.
+type kafkaSink struct {
+	cfg    KafkaSinkConfig
+	client *http.Client
+}
+
+// kafkaRecord is a record of the REST proxy API with a JSON value.
+type kafkaRecord struct {
+	Key   string        `json:"key,omitempty"`
+	Value SecurityEvent `json:"value"`
+}
+
+func (s *kafkaSink) name() string { return "kafka" }
+
+func (s *kafkaSink) send(ctx context.Context, events []SecurityEvent) error {
+	records := make([]kafkaRecord, 0, len(events))
+	for _, event := range events {
+		records = append(records, kafkaRecord{Key: event.User, Value: event})
+	}
+	body, err := json.Marshal(map[string][]kafkaRecord{"records": records})
+	if err != nil {
+		return err
+	}
+	target := strings.TrimSuffix(s.cfg.URL, "/") + "/topics/" + s.cfg.Topic
+	return postJSON(ctx, s.client, target, "application/vnd.kafka.json.v2+json", s.cfg.Headers, body)
+}
+
+// postJSON posts the body and fails on non-2xx answers.
+func postJSON(ctx context.Context, client *http.Client, target string, contentType string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", redactedURL(target), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s: unexpected status %d", redactedURL(target), resp.StatusCode)
+	}
+	return nil
+}
+
+// syslogSink writes RFC 5424 messages. The connection is kept and dialed again after a failed write.
+type syslogSink struct {
+	cfg       SyslogSinkConfig
+	tlsConfig *tls.Config
+	facility  int
+	hostname  string
+	conn      net.Conn
+}
+
+func newSyslogSink(cfg SyslogSinkConfig, tlsConfig *tls.Config) *syslogSink {
+	if cfg.Network == "" {
+		cfg.Network = "udp"
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = "multena-proxy"
+	}
+	facility, ok := syslogFacilities[cfg.Facility]
+	if !ok {
+		facility = syslogFacilities["authpriv"]
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &syslogSink{cfg: cfg, tlsConfig: tlsConfig, facility: facility, hostname: hostname}
+}
+
+func (s *syslogSink) name() string { return "syslog" }
+
+func (s *syslogSink) send(ctx context.Context, events []SecurityEvent) error {
+	if s.conn == nil {
+		conn, err := s.dial(ctx)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetWriteDeadline(deadline)
+	}
+	// UDP takes one message per datagram, streams all messages at once
+	var stream bytes.Buffer
+	for _, event := range events {
+		message, err := s.format(event)
+		if err != nil {
+			return err
+		}
+		if s.cfg.Network == "udp" {
+			if _, err := s.conn.Write(message); err != nil {
+				s.reset()
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(&stream, "%d %s", len(message), message)
+	}
+	if stream.Len() > 0 {
+		if _, err := s.conn.Write(stream.Bytes()); err != nil {
+			s.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) dial(ctx context.Context) (net.Conn, error) {
+	if s.cfg.Network == "tls" {
+		dialer := &tls.Dialer{Config: s.tlsConfig}
+		return dialer.DialContext(ctx, "tcp", s.cfg.Address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, s.cfg.Network, s.cfg.Address)
+}
+
+func (s *syslogSink) reset() {
+	_ = s.conn.Close()
+	s.conn = nil
+}
+
+// format returns the RFC 5424 message of the event. Failed authentications and violations have the severity
+// warning, admin bypasses notice.
+func (s *syslogSink) format(event SecurityEvent) ([]byte, error) {
+	severity := 4
+	if event.Kind == securityAdminBypass {
+		severity = 5
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", s.facility*8+severity,
+		event.Time.Format(time.RFC3339Nano), s.hostname, s.cfg.AppName, os.Getpid(), event.Kind, body)), nil
+}
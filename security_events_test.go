@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSecuritySink records the batches it receives and fails the first failures sends.
+type fakeSecuritySink struct {
+	mu       sync.Mutex
+	failures int
+	batches  [][]SecurityEvent
+}
+
+func (f *fakeSecuritySink) name() string { return "fake" }
+
+func (f *fakeSecuritySink) send(_ context.Context, events []SecurityEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("sink down")
+	}
+	f.batches = append(f.batches, append([]SecurityEvent(nil), events...))
+	return nil
+}
+
+func TestSecurityEventsBatching(t *testing.T) {
+	sink := &fakeSecuritySink{failures: 1}
+	events := startSecurityEvents(SecurityEventsConfig{
+		Kinds:         []string{securityAuthFailure, securityEnforcementViolation},
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Millisecond,
+	}, []securitySink{sink})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	r.Header.Set(requestIDHeader, "abc")
+	events.emit(r, securityAuthFailure, OAuthToken{}, errors.New("token is expired"))
+	events.emit(r, securityAdminBypass, OAuthToken{PreferredUsername: "admin"}, nil)
+	events.emit(r, securityEnforcementViolation, OAuthToken{PreferredUsername: "jane", Groups: []string{"dev"}}, errors.New("unauthorized label a"))
+	events.emit(r, securityEnforcementViolation, OAuthToken{PreferredUsername: "joe"}, errors.New("unauthorized label b"))
+	events.close()
+	events.emit(r, securityAuthFailure, OAuthToken{}, nil)
+
+	if len(sink.batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(sink.batches))
+	}
+	assert.Len(t, sink.batches[0], 2, "the full batch is retried")
+	assert.Equal(t, securityAuthFailure, sink.batches[0][0].Kind)
+	assert.Equal(t, "token is expired", sink.batches[0][0].Reason)
+	assert.Equal(t, "abc", sink.batches[0][0].RequestID)
+	assert.Equal(t, "jane", sink.batches[0][1].User)
+	assert.Equal(t, []string{"dev"}, sink.batches[0][1].Groups)
+	assert.Len(t, sink.batches[1], 1, "the rest is sent on close")
+	assert.Equal(t, "joe", sink.batches[1][0].User)
+}
+
+func TestSecurityEventsValidate(t *testing.T) {
+	valid := SecurityEventsConfig{Webhook: WebhookSinkConfig{URL: "https://siem.example.com/events"}}
+	assert.NoError(t, valid.validate())
+	assert.Error(t, SecurityEventsConfig{}.validate())
+	assert.Error(t, SecurityEventsConfig{Kinds: []string{"login"}, Webhook: valid.Webhook}.validate())
+	assert.Error(t, SecurityEventsConfig{Kafka: KafkaSinkConfig{URL: "http://kafka-rest:8082"}}.validate())
+	assert.Error(t, SecurityEventsConfig{Syslog: SyslogSinkConfig{Address: "siem:514", Network: "sctp"}}.validate())
+	assert.Error(t, SecurityEventsConfig{Syslog: SyslogSinkConfig{Address: "siem:514", Facility: "kern"}}.validate())
+	assert.NoError(t, SecurityEventsConfig{Syslog: SyslogSinkConfig{Address: "siem:514", Network: "tcp", Facility: "local4"}}.validate())
+}
+
+func TestSyslogSink(t *testing.T) {
+	event := SecurityEvent{Time: time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC), Kind: securityAuthFailure, Reason: "no Authorization header found"}
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	sink := newSyslogSink(SyslogSinkConfig{Address: udp.LocalAddr().String()}, nil)
+	assert.NoError(t, sink.send(context.Background(), []SecurityEvent{event}))
+	buf := make([]byte, 4096)
+	_ = udp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := udp.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(buf[:n])
+	assert.True(t, strings.HasPrefix(message, "<84>1 2026-06-01T12:00:00Z "), message)
+	assert.Contains(t, message, " multena-proxy ")
+	assert.Contains(t, message, ` auth_failure - {"time":"2026-06-01T12:00:00Z","kind":"auth_failure"`)
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	sink = newSyslogSink(SyslogSinkConfig{Address: tcp.Addr().String(), Network: "tcp", Facility: "local0", AppName: "proxy"}, nil)
+	bypass := event
+	bypass.Kind = securityAdminBypass
+	assert.NoError(t, sink.send(context.Background(), []SecurityEvent{event, bypass}))
+	conn, err := tcp.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for _, prefix := range []string{"<132>1 ", "<133>1 "} {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		length, frame := readSyslogFrame(t, reader)
+		assert.Equal(t, length, len(frame), "frames are octet counted")
+		assert.True(t, strings.HasPrefix(frame, prefix), frame)
+	}
+}
+
+// readSyslogFrame reads an octet counted frame.
+func readSyslogFrame(t *testing.T, reader *bufio.Reader) (int, string) {
+	t.Helper()
+	header, err := reader.ReadString(' ')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var length int
+	if _, err := fmt.Sscan(strings.TrimSpace(header), &length); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		t.Fatal(err)
+	}
+	return length, string(frame)
+}
+
+func TestKafkaSink(t *testing.T) {
+	var path, contentType, auth string
+	var body map[string][]kafkaRecord
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType, auth = r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	sink := &kafkaSink{cfg: KafkaSinkConfig{URL: server.URL + "/", Topic: "security", Headers: map[string]string{"Authorization": "Basic c29j"}}, client: server.Client()}
+	assert.NoError(t, sink.send(context.Background(), []SecurityEvent{{Kind: securityEnforcementViolation, User: "jane"}}))
+	assert.Equal(t, "/topics/security", path)
+	assert.Equal(t, "application/vnd.kafka.json.v2+json", contentType)
+	assert.Equal(t, "Basic c29j", auth)
+	if len(body["records"]) != 1 {
+		t.Fatalf("expected 1 record, got %v", body)
+	}
+	assert.Equal(t, "jane", body["records"][0].Key)
+	assert.Equal(t, securityEnforcementViolation, body["records"][0].Value.Kind)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	sink.cfg.URL = failing.URL
+	assert.Error(t, sink.send(context.Background(), []SecurityEvent{{Kind: securityAuthFailure}}))
+}
+
+func TestE2E_SecurityEvents(t *testing.T) {
+	received := make(chan []SecurityEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []SecurityEvent
+		_ = json.NewDecoder(r.Body).Decode(&events)
+		received <- events
+	}))
+	defer webhook.Close()
+
+	env := newE2EEnv(t)
+	env.App.Cfg().Admin.Bypass = true
+	env.App.Cfg().SecurityEvents = SecurityEventsConfig{
+		Enabled:   true,
+		BatchSize: 3,
+		Webhook:   WebhookSinkConfig{URL: webhook.URL},
+	}
+	env.App.WithRoutes()
+	t.Cleanup(env.App.securityEvents.close)
+
+	env.do(http.MethodGet, "/api/v1/query?query=up", "", "")
+	env.do(http.MethodGet, `/api/v1/query?query=up{tenant_id="forbidden_tenant"}`, "groupTenant", "")
+	env.do(http.MethodGet, "/api/v1/query?query=up", "adminUserToken", "")
+
+	select {
+	case events := <-received:
+		if len(events) != 3 {
+			t.Fatalf("expected 3 events, got %v", events)
+		}
+		assert.Equal(t, securityAuthFailure, events[0].Kind)
+		assert.Equal(t, "no Authorization header found", events[0].Reason)
+		assert.Equal(t, securityEnforcementViolation, events[1].Kind)
+		assert.Contains(t, events[1].Reason, "forbidden_tenant")
+		assert.Equal(t, "/api/v1/query", events[1].Path)
+		assert.Equal(t, securityAdminBypass, events[2].Kind)
+		assert.Equal(t, "admin", events[2].User)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no security events were sent")
+	}
+}
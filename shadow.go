@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// builtinEnforcer is the name of the built-in enforcer for shadow_enforcer, to shadow an enforcer plugin with it.
+const builtinEnforcer = "builtin"
+
+var shadowComparisons = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_shadow_enforcement_total",
+	Help: "Queries enforced by both the serving and the shadow enforcer, partitioned by whether their outcomes matched.",
+}, []string{"language", "result"})
+
+// ShadowEnforcer serves the enforcement of Current and additionally runs Candidate on every query. Differing
+// outcomes are logged and counted, the outcome of Candidate is never used. This allows rolling out a new
+// enforcer, e.g. a plugin or a rewrite of a built-in one, against real traffic before it serves it.
+type ShadowEnforcer struct {
+	Current   EnforceQL
+	Candidate EnforceQL
+	Name      string
+}
+
+// shadowEnforcerFor wraps the serving enforcer in a ShadowEnforcer if a shadow enforcer is configured.
+// The name is an enforcer plugin or builtinEnforcer.
+func (a *App) shadowEnforcerFor(name string, current EnforceQL, builtin EnforceQL) EnforceQL {
+	if name == "" {
+		return current
+	}
+	candidate := builtin
+	if name != builtinEnforcer {
+		candidate = a.enforcerFor(name, builtin)
+	}
+	log.Info().Str("language", queryLanguage(current)).Str("shadow_enforcer", name).Msg("Shadowing enforcer")
+	return ShadowEnforcer{Current: current, Candidate: candidate, Name: name}
+}
+
+func (s ShadowEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
+	enforced, err := s.Current.Enforce(query, tenantLabels, labelMatch)
+	shadowed, shadowErr := s.Candidate.Enforce(query, tenantLabels, labelMatch)
+
+	language := queryLanguage(s.Current)
+	result := "match"
+	switch {
+	case err != nil && shadowErr != nil:
+	case err != nil:
+		result = "current_denied"
+	case shadowErr != nil:
+		result = "candidate_denied"
+	case canonicalQuery(enforced, labelMatch) != canonicalQuery(shadowed, labelMatch):
+		result = "mismatch"
+	}
+	shadowComparisons.WithLabelValues(language, result).Inc()
+	if result != "match" {
+		log.Warn().Str("language", language).Str("shadow_enforcer", s.Name).Str("result", result).
+			Str("query", query).Str("enforced", enforced).AnErr("error", err).
+			Str("shadow_enforced", shadowed).AnErr("shadow_error", shadowErr).
+			Msg("Shadow enforcer disagrees")
+	}
+	return enforced, err
+}
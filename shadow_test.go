@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadowEnforcer(t *testing.T) {
+	buf := captureLogs(t)
+	tenants := map[string]bool{"a": true, "b": true}
+	reordered := enforceFunc(func(string, map[string]bool, string) (string, error) {
+		return `up{namespace=~"b|a"}`, nil
+	})
+	dropping := enforceFunc(func(query string, _ map[string]bool, _ string) (string, error) {
+		return query, nil
+	})
+	denying := enforceFunc(func(string, map[string]bool, string) (string, error) {
+		return "", errors.New("unauthorized namespace")
+	})
+
+	// the order of the tenant alternatives is irrelevant
+	shadow := ShadowEnforcer{Current: PromQLEnforcer{}, Candidate: reordered, Name: "reordered"}
+	enforced, err := shadow.Enforce("up", tenants, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, `up{namespace=~"a|b"}`, enforced)
+	assert.Empty(t, buf.String())
+
+	shadow = ShadowEnforcer{Current: PromQLEnforcer{}, Candidate: dropping, Name: "dropping"}
+	enforced, err = shadow.Enforce("up", tenants, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, `up{namespace=~"a|b"}`, enforced)
+	assert.Contains(t, buf.String(), `"result":"mismatch"`)
+	assert.Contains(t, buf.String(), `"shadow_enforced":"up"`)
+
+	shadow = ShadowEnforcer{Current: PromQLEnforcer{}, Candidate: denying, Name: "denying"}
+	enforced, err = shadow.Enforce("up", tenants, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, `up{namespace=~"a|b"}`, enforced)
+	assert.Contains(t, buf.String(), `"result":"candidate_denied"`)
+
+	// the serving enforcer decides, also if it denies
+	shadow = ShadowEnforcer{Current: PromQLEnforcer{}, Candidate: dropping, Name: "dropping"}
+	_, err = shadow.Enforce(`up{namespace="c"}`, tenants, "namespace")
+	assert.Error(t, err)
+	assert.Contains(t, buf.String(), `"result":"current_denied"`)
+	assert.Equal(t, "promql", queryLanguage(shadow))
+
+	metrics := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, metrics.Body.String(), `multena_shadow_enforcement_total{language="promql",result="mismatch"}`)
+}
+
+func TestShadowEnforcerFor(t *testing.T) {
+	app := newApp(&Config{})
+	builtin := LogQLEnforcer{}
+	assert.Equal(t, builtin, app.shadowEnforcerFor("", builtin, builtin))
+
+	shadowed := app.shadowEnforcerFor(builtinEnforcer, builtin, builtin)
+	assert.Equal(t, ShadowEnforcer{Current: builtin, Candidate: builtin, Name: builtinEnforcer}, shadowed)
+	assert.Equal(t, "logql", queryLanguage(shadowed))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// isSSETailRequest reports whether the request opens a Loki live tail stream as Server-Sent Events.
+func isSSETailRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/api/v1/tail/sse")
+}
+
+// sseTail relays the upstream tail of the already enforced query as Server-Sent Events, for clients and
+// networks without WebSockets. Every event carries the timestamp of its newest entry as id, with which
+// reconnecting clients continue right after the last entry they received, see sseResumeStart. While no
+// entries arrive, heartbeat comments keep intermediaries from closing the connection. If the upstream
+// stream drops, the response ends and the client reconnects after the announced retry interval.
+func sseTail(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, tls bool, headers map[string]string, cfg TailConfig, a *App) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logAndWriteError(w, http.StatusInternalServerError, nil, "streaming responses are not supported")
+		return
+	}
+	setHeaders(r, tls, headers, a.ServiceAccountToken)
+	query := r.URL.Query()
+	if start := sseResumeStart(r, query); start > 0 {
+		query.Set("start", strconv.FormatInt(start, 10))
+	}
+	tail := r.Clone(r.Context())
+	tail.URL.Path = strings.TrimSuffix(r.URL.Path, "/sse")
+	upstream, err := dialTail(r.Context(), tail, upstreamURL, a.upstreams.transport(upstreamURL), query)
+	if err != nil {
+		requestLogger(r).Warn().Err(err).Str("path", tail.URL.Path).Msg("Could not connect upstream live tail stream")
+		logAndWriteError(w, http.StatusBadGateway, err, "")
+		return
+	}
+	defer func() { _ = upstream.Close() }()
+
+	messages := make(chan string)
+	go func() {
+		defer close(messages)
+		for {
+			var message string
+			if err := websocket.Message.Receive(upstream, &message); err != nil {
+				return
+			}
+			select {
+			case messages <- message:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	retry := cfg.ReconnectBackoff
+	if retry <= 0 {
+		retry = time.Second
+	}
+	heartbeat := cfg.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = 15 * time.Second
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keeps nginx based ingresses from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "retry: %d\n\n", retry.Milliseconds())
+	flusher.Flush()
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if cfg.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(cfg.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-idle:
+			idleStreams.Inc()
+			requestLogger(r).Debug().Str("path", r.URL.Path).Msg("Closing idle tail stream")
+			return
+		case <-ticker.C:
+			_, _ = io.WriteString(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case message, ok := <-messages:
+			if !ok {
+				requestLogger(r).Info().Str("path", r.URL.Path).Msg("Upstream live tail stream dropped, client reconnects")
+				return
+			}
+			writeSSEEvent(w, message)
+			flusher.Flush()
+			if idleTimer != nil {
+				idleTimer.Reset(cfg.IdleTimeout)
+			}
+		}
+	}
+}
+
+// sseResumeStart returns the start of a reconnecting stream, right after the entry of the last event id the
+// client received, or zero. Browsers send it in the Last-Event-ID header, clients that cannot set headers
+// in the last_event_id parameter, which is removed from the upstream query.
+func sseResumeStart(r *http.Request, query url.Values) int64 {
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = query.Get("last_event_id")
+	}
+	query.Del("last_event_id")
+	last, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || last <= 0 {
+		return 0
+	}
+	return last + 1
+}
+
+// writeSSEEvent writes a tail message as event, with the timestamp of its newest entry as id.
+// Messages without entries keep the id of the previous event.
+func writeSSEEvent(w io.Writer, message string) {
+	if ts := lastTimestamp(message); ts > 0 {
+		_, _ = fmt.Fprintf(w, "id: %d\n", ts)
+	}
+	for _, line := range strings.Split(message, "\n") {
+		_, _ = fmt.Fprintf(w, "data: %s\n", line)
+	}
+	_, _ = io.WriteString(w, "\n")
+}
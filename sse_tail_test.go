@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestE2E_SSETail(t *testing.T) {
+	requests := make(chan *http.Request, 2)
+	loki := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		requests <- ws.Request()
+		_ = websocket.Message.Send(ws, `{"streams":[{"stream":{"app":"a"},"values":[["100","first"],["150","second"]]}]}`)
+		_ = websocket.Message.Send(ws, `{"streams":[],"dropped_entries":null}`)
+		// the querier restarts
+	}))
+	t.Cleanup(loki.Close)
+
+	env := newE2EEnv(t)
+	env.App.Cfg().Loki.URL = loki.URL
+	env.App.Cfg().Loki.Tail = TailConfig{ReconnectBackoff: 2 * time.Second}
+	env.App.WithRoutes()
+	proxy := httptest.NewServer(env.App.e)
+	t.Cleanup(proxy.Close)
+
+	tail := func(lastEventID string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, proxy.URL+"/loki/api/v1/tail/sse?query="+url.QueryEscape(`{app="a"}`)+"&start=50", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+env.Tokens["userTenant"])
+		req.Header.Set("Accept", "text/event-stream")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := tail("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "retry: 2000\n\n"+
+		`id: 150`+"\n"+`data: {"streams":[{"stream":{"app":"a"},"values":[["100","first"],["150","second"]]}]}`+"\n\n"+
+		`data: {"streams":[],"dropped_entries":null}`+"\n\n", body, "the response ends with the upstream stream")
+	upstream := <-requests
+	assert.Equal(t, "/loki/api/v1/tail", upstream.URL.Path)
+	assert.Contains(t, upstream.URL.Query().Get("query"), "tenant_id")
+	assert.Equal(t, "50", upstream.URL.Query().Get("start"))
+
+	_, _ = tail("150")
+	upstream = <-requests
+	assert.Equal(t, "151", upstream.URL.Query().Get("start"), "the stream continues after the last event")
+}
+
+func TestE2E_SSETailQuota(t *testing.T) {
+	requests := make(chan *http.Request, 2)
+	loki := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		requests <- ws.Request()
+	}))
+	t.Cleanup(loki.Close)
+
+	env := newE2EEnv(t)
+	env.App.Cfg().Loki.URL = loki.URL
+	env.App.Cfg().Quotas = QuotasConfig{Default: QuotaConfig{MaxEntries: 1000, DefaultEntries: 100}}
+	env.App.WithRoutes()
+	proxy := httptest.NewServer(env.App.e)
+	t.Cleanup(proxy.Close)
+
+	for _, limit := range []string{"&limit=100000", ""} {
+		req, err := http.NewRequest(http.MethodGet, proxy.URL+"/loki/api/v1/tail/sse?query="+url.QueryEscape(`{app="a"}`)+limit, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+env.Tokens["userTenant"])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+	assert.Equal(t, "1000", (<-requests).URL.Query().Get("limit"), "the requested limit is clamped to max_entries")
+	assert.Equal(t, "100", (<-requests).URL.Query().Get("limit"), "tails without a limit get default_entries")
+}
+
+func TestE2E_SSETailHeartbeat(t *testing.T) {
+	loki := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var discard string
+		_ = websocket.Message.Receive(ws, &discard)
+	}))
+	t.Cleanup(loki.Close)
+
+	env := newE2EEnv(t)
+	env.App.Cfg().Loki.URL = loki.URL
+	env.App.Cfg().Loki.Tail = TailConfig{Heartbeat: 10 * time.Millisecond, IdleTimeout: 100 * time.Millisecond}
+	env.App.WithRoutes()
+	proxy := httptest.NewServer(env.App.e)
+	t.Cleanup(proxy.Close)
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL+"/loki/api/v1/tail/sse?query="+url.QueryEscape(`{app="a"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+env.Tokens["userTenant"])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), ": heartbeat\n\n")
+	assert.Greater(t, strings.Count(string(body), "heartbeat"), 2, "heartbeats do not keep the idle stream open")
+}
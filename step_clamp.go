@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/rs/zerolog/log"
+)
+
+// clampRangeParams raises the step of a range query to the minimum step of the quota and to the step
+// needed to stay below the maximum number of points per series. For Thanos the max_source_resolution
+// is raised to the quota's as well, also if it is auto, so that long ranges are answered from downsampled data.
+func clampRangeParams(values url.Values, quota QuotaConfig, language string) {
+	// a missing step is zero, Loki derives one from the range then
+	step, _ := parseStep(values.Get("step"))
+	wanted := step
+	if quota.MinStep > 0 && wanted < quota.MinStep {
+		wanted = quota.MinStep
+	}
+	if quota.MaxPoints > 0 {
+		start, okStart := parseTimeParam(values.Get("start"))
+		end, okEnd := parseTimeParam(values.Get("end"))
+		if okStart && okEnd && end.After(start) {
+			// round up to whole seconds, as the upstreams align steps to the second anyway
+			minStep := time.Duration(math.Ceil(end.Sub(start).Seconds()/float64(quota.MaxPoints))) * time.Second
+			if wanted < minStep {
+				wanted = minStep
+			}
+		}
+	}
+	if wanted != step {
+		log.Debug().Str("step", values.Get("step")).Dur("clamped", wanted).Msg("Clamping range query step")
+		values.Set("step", strconv.FormatFloat(wanted.Seconds(), 'f', -1, 64))
+	}
+
+	if language == "promql" && quota.MaxSourceResolution > 0 {
+		// auto picks the resolution from the step, which may be finer than the quota's
+		resolution, ok := parseStep(values.Get("max_source_resolution"))
+		if !ok || resolution < quota.MaxSourceResolution {
+			values.Set("max_source_resolution", model.Duration(quota.MaxSourceResolution).String())
+		}
+	}
+}
+
+// parseStep parses a duration parameter given either as a duration like 5m or as float seconds.
+func parseStep(raw string) (time.Duration, bool) {
+	if raw == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	d, err := model.ParseDuration(raw)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(d), true
+}
+
+// parseTimeParam parses a timestamp parameter given as RFC 3339 or as unix time in seconds.
+// Loki additionally accepts unix time in nanoseconds, which is detected by its magnitude.
+func parseTimeParam(raw string) (time.Time, bool) {
+	if raw == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t, true
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if f > 1e12 {
+		return time.Unix(0, int64(f)), true
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClampRangeParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   url.Values
+		quota    QuotaConfig
+		language string
+		want     url.Values
+	}{
+		{
+			name:   "step raised to minimum",
+			params: url.Values{"step": {"1"}},
+			quota:  QuotaConfig{MinStep: 30 * time.Second},
+			want:   url.Values{"step": {"30"}},
+		},
+		{
+			name:   "duration step kept",
+			params: url.Values{"step": {"1m"}},
+			quota:  QuotaConfig{MinStep: 30 * time.Second},
+			want:   url.Values{"step": {"1m"}},
+		},
+		{
+			name:   "step raised to max points",
+			params: url.Values{"step": {"1"}, "start": {"2026-07-16T00:00:00Z"}, "end": {"2026-10-14T00:00:00Z"}},
+			quota:  QuotaConfig{MaxPoints: 11000},
+			want:   url.Values{"step": {"707"}, "start": {"2026-07-16T00:00:00Z"}, "end": {"2026-10-14T00:00:00Z"}},
+		},
+		{
+			name:     "loki nanosecond timestamps",
+			params:   url.Values{"start": {"1760400000000000000"}, "end": {"1760403600000000000"}},
+			quota:    QuotaConfig{MaxPoints: 60},
+			language: "logql",
+			want:     url.Values{"step": {"60"}, "start": {"1760400000000000000"}, "end": {"1760403600000000000"}},
+		},
+		{
+			name:     "source resolution raised",
+			params:   url.Values{"step": {"60"}, "max_source_resolution": {"0s"}},
+			quota:    QuotaConfig{MaxSourceResolution: 5 * time.Minute},
+			language: "promql",
+			want:     url.Values{"step": {"60"}, "max_source_resolution": {"5m"}},
+		},
+		{
+			name:     "source resolution injected",
+			params:   url.Values{"step": {"60"}},
+			quota:    QuotaConfig{MaxSourceResolution: time.Hour},
+			language: "promql",
+			want:     url.Values{"step": {"60"}, "max_source_resolution": {"1h"}},
+		},
+		{
+			name:     "source resolution auto raised",
+			params:   url.Values{"step": {"60"}, "max_source_resolution": {"auto"}},
+			quota:    QuotaConfig{MaxSourceResolution: time.Hour},
+			language: "promql",
+			want:     url.Values{"step": {"60"}, "max_source_resolution": {"1h"}},
+		},
+		{
+			name:     "source resolution auto kept without quota",
+			params:   url.Values{"step": {"60"}, "max_source_resolution": {"auto"}},
+			quota:    QuotaConfig{MinStep: 30 * time.Second},
+			language: "promql",
+			want:     url.Values{"step": {"60"}, "max_source_resolution": {"auto"}},
+		},
+		{
+			name:     "source resolution ignored for loki",
+			params:   url.Values{"step": {"60"}},
+			quota:    QuotaConfig{MaxSourceResolution: time.Hour},
+			language: "logql",
+			want:     url.Values{"step": {"60"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clampRangeParams(tt.params, tt.quota, tt.language)
+			assert.Equal(t, tt.want, tt.params)
+		})
+	}
+}
+
+func TestE2E_RangeQueryStepIsClamped(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Quotas = QuotasConfig{Default: QuotaConfig{MinStep: time.Minute, MaxSourceResolution: 5 * time.Minute}}
+
+	form := url.Values{"query": {"up"}, "start": {"1760400000"}, "end": {"1760403600"}, "step": {"1"}}
+	rr := env.do(http.MethodPost, "/api/v1/query_range", "userTenant", form.Encode())
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ := env.Thanos.LastRequest()
+	assert.Equal(t, "60", req.Params.Get("step"))
+	assert.Equal(t, "5m", req.Params.Get("max_source_resolution"))
+	assert.Contains(t, req.Params.Get("query"), "tenant_id")
+}
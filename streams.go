@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// TailConfig limits the live tail streams, each of which pins a tailer in Loki. Zero means unlimited.
+type TailConfig struct {
+	// MaxPerUser is the number of simultaneous streams a user may open.
+	MaxPerUser int `mapstructure:"max_per_user"`
+	// MaxTotal is the number of simultaneous streams of all users.
+	MaxTotal int `mapstructure:"max_total"`
+	// IdleTimeout closes streams on which nothing was sent in either direction for this long.
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// Resume re-establishes dropped upstream WebSocket streams after the last delivered entry, see resumingTail.
+	Resume bool `mapstructure:"resume"`
+	// MaxReconnects is the number of consecutive failed reconnects after which the stream is closed, defaults to 5.
+	MaxReconnects int `mapstructure:"max_reconnects"`
+	// ReconnectBackoff is the wait before each reconnect, defaults to 1s. It is also the retry interval
+	// announced to Server-Sent Events clients.
+	ReconnectBackoff time.Duration `mapstructure:"reconnect_backoff"`
+	// Heartbeat is the interval of the comments sent on idle Server-Sent Events streams, defaults to 15s.
+	Heartbeat time.Duration `mapstructure:"heartbeat"`
+}
+
+var (
+	activeStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "multena_active_tail_streams",
+		Help: "Number of live tail streams currently proxied to Loki.",
+	})
+	rejectedStreams = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_rejected_tail_streams_total",
+		Help: "Number of live tail streams rejected, by the limit that was hit.",
+	}, []string{"limit"})
+	idleStreams = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "multena_idle_tail_streams_total",
+		Help: "Number of live tail streams closed because they were idle.",
+	})
+)
+
+// isTailRequest reports whether the request opens a Loki live tail stream, over a WebSocket or as Server-Sent Events.
+func isTailRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/api/v1/tail") || isSSETailRequest(r)
+}
+
+// streamLimiter counts the open streams per user and in total.
+type streamLimiter struct {
+	cfg    TailConfig
+	mu     sync.Mutex
+	total  int
+	byUser map[string]int
+}
+
+func newStreamLimiter(cfg TailConfig) *streamLimiter {
+	return &streamLimiter{cfg: cfg, byUser: map[string]int{}}
+}
+
+// acquire reserves a stream for the user. The returned function releases it and must be called once the stream is closed.
+func (l *streamLimiter) acquire(user string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.MaxTotal > 0 && l.total >= l.cfg.MaxTotal {
+		rejectedStreams.WithLabelValues("max_total").Inc()
+		return nil, fmt.Errorf("too many live tail streams, at most %d are allowed", l.cfg.MaxTotal)
+	}
+	if l.cfg.MaxPerUser > 0 && l.byUser[user] >= l.cfg.MaxPerUser {
+		rejectedStreams.WithLabelValues("max_per_user").Inc()
+		return nil, fmt.Errorf("too many live tail streams for user %s, at most %d are allowed", user, l.cfg.MaxPerUser)
+	}
+	l.total++
+	l.byUser[user]++
+	activeStreams.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.byUser[user]--; l.byUser[user] <= 0 {
+				delete(l.byUser, user)
+			}
+			activeStreams.Dec()
+		})
+	}, nil
+}
+
+// idleTimeoutWriter hands out hijacked connections that are closed once they are idle for the timeout.
+type idleTimeoutWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+}
+
+func (w *idleTimeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *idleTimeoutWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *idleTimeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	idle := &idleConn{Conn: conn, timeout: w.timeout}
+	_ = idle.extend()
+	return idle, rw, nil
+}
+
+// idleConn moves the deadline of the connection on every read and write, so that it only expires
+// when nothing was transferred in either direction for the timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) extend() error {
+	return c.Conn.SetDeadline(time.Now().Add(c.timeout))
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		_ = c.extend()
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		idleStreams.Inc()
+		log.Debug().Str("remote", c.RemoteAddr().String()).Msg("Closing idle tail stream")
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		_ = c.extend()
+	}
+	return n, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamLimiter(t *testing.T) {
+	l := newStreamLimiter(TailConfig{MaxPerUser: 1, MaxTotal: 2})
+
+	releaseA, err := l.acquire("a")
+	assert.NoError(t, err)
+	_, err = l.acquire("a")
+	assert.ErrorContains(t, err, "for user a")
+
+	releaseB, err := l.acquire("b")
+	assert.NoError(t, err)
+	_, err = l.acquire("c")
+	assert.ErrorContains(t, err, "at most 2 are allowed")
+
+	releaseA()
+	releaseA()
+	assert.Equal(t, 1, l.total, "releasing twice frees a single stream")
+	_, err = l.acquire("a")
+	assert.NoError(t, err)
+	releaseB()
+	assert.NotContains(t, l.byUser, "b")
+}
+
+func TestIdleConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &idleConn{Conn: server, timeout: 50 * time.Millisecond}
+	assert.NoError(t, conn.extend())
+
+	go func() {
+		_, _ = client.Write([]byte("ping"))
+	}()
+	buf := make([]byte, 4)
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+
+	_, err = conn.Read(buf)
+	var ne net.Error
+	assert.ErrorAs(t, err, &ne)
+	assert.True(t, ne.Timeout())
+}
+
+func TestE2E_TailStreamLimits(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Loki.Tail = TailConfig{MaxTotal: 1}
+	env.App.WithRoutes()
+
+	release, err := env.App.streams.acquire("someone")
+	assert.NoError(t, err)
+	rr := env.do(http.MethodGet, "/loki/api/v1/tail?query=%7Bapp%3D%22a%22%7D", "userTenant", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"errorType":"too_many_requests"`)
+	assert.Empty(t, env.Loki.Requests())
+
+	release()
+	rr = env.do(http.MethodGet, "/loki/api/v1/tail?query=%7Bapp%3D%22a%22%7D", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 0, env.App.streams.total, "the stream is released once it is closed")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	logqlv2 "github.com/observatorium/api/logql/v2"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// structuredMetadataRoutes are the Loki routes whose queries read log lines, so that their entries can be filtered
+// on structured metadata. The label, series and index APIs only accept stream selectors.
+var structuredMetadataRoutes = map[string]bool{
+	"/api/v1/query":       true,
+	"/api/v1/query_range": true,
+	"/api/v1/tail":        true,
+	"/api/v1/tail/sse":    true,
+}
+
+// structuredMetadataKeyPattern matches the keys of structured metadata in label filters, Loki stores OTLP
+// attributes with dots and dashes replaced by underscores, e.g. k8s.namespace.name as k8s_namespace_name.
+var structuredMetadataKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// checkStructuredMetadataKeys reports keys that cannot be used in label filters.
+func checkStructuredMetadataKeys(keys []string) error {
+	for _, key := range keys {
+		if !structuredMetadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid structured metadata key %q", key)
+		}
+	}
+	return nil
+}
+
+// StructuredMetadataEnforcer constrains the log entries of queries enforced by Enforcer on structured metadata.
+// Every log selector gets a label filter requiring each of the Keys to hold one of the tenant labels, placed
+// before the stages of the query, so that parsers cannot set the keys from the log line. Entries without a key
+// are filtered out. Grants only constrain the keys with their values of the tenant label, grants without
+// the tenant label allow any value, see Grant.
+type StructuredMetadataEnforcer struct {
+	Enforcer EnforceQL
+	Keys     []string
+}
+
+func (s StructuredMetadataEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
+	enforced, err := s.Enforcer.Enforce(query, tenantLabels, labelMatch)
+	if err != nil || enforced == "" {
+		return enforced, err
+	}
+	values, constrained, err := structuredMetadataValues(tenantLabels, labelMatch)
+	if err != nil || !constrained {
+		return enforced, err
+	}
+	expr, err := logqlv2.ParseExpr(enforced)
+	if err != nil {
+		return "", badQueryError{err}
+	}
+	matchType := labels.MatchEqual
+	if len(values) > 1 {
+		matchType = labels.MatchRegexp
+	}
+	// the label filter prints its values without quoting them
+	quoted := strconv.Quote(strings.Join(values, "|"))
+	value := quoted[1 : len(quoted)-1]
+	expr.Walk(func(expr interface{}) {
+		if selector, ok := expr.(*logqlv2.LogQueryExpr); ok {
+			matchers := make([]*labels.Matcher, 0, len(s.Keys))
+			for _, key := range s.Keys {
+				matchers = append(matchers, &labels.Matcher{Type: matchType, Name: key, Value: value})
+			}
+			selector.AppendPipelineMatchers(matchers, "and")
+		}
+	})
+	return expr.String(), nil
+}
+
+// structuredMetadataValues returns the sorted values of the tenant label the structured metadata keys are
+// constrained to. Without a constraint, because a grant allows every value of the tenant label, constrained is false.
+func structuredMetadataValues(tenantLabels map[string]bool, labelMatch string) (values []string, constrained bool, err error) {
+	grants, err := parseGrants(tenantLabels, labelMatch)
+	if err != nil {
+		return nil, false, err
+	}
+	unique := map[string]bool{}
+	for _, grant := range grants {
+		if len(grant[labelMatch]) == 0 {
+			return nil, false, nil
+		}
+		for value := range grant[labelMatch] {
+			unique[value] = true
+		}
+	}
+	values = MapKeysToArray(unique)
+	sort.Strings(values)
+	return values, len(values) > 0, nil
+}
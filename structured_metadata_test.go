@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStructuredMetadataEnforcer(t *testing.T) {
+	enforcer := StructuredMetadataEnforcer{
+		Enforcer: LogQLEnforcer{TenantSets: newTenantSetCache()},
+		Keys:     []string{"k8s_namespace_name"},
+	}
+	tests := []struct {
+		name         string
+		query        string
+		tenantLabels map[string]bool
+		expected     string
+	}{
+		{
+			name:         "single tenant label",
+			query:        `{app="a"}`,
+			tenantLabels: map[string]bool{"ns1": true},
+			expected:     `{app="a", namespace="ns1"} | k8s_namespace_name="ns1"`,
+		},
+		{
+			name:         "filter precedes the stages of the query",
+			query:        `{app="a"} | json | k8s_namespace_name="ns2"`,
+			tenantLabels: map[string]bool{"ns2": true, "ns1": true},
+			expected:     `{app="a", namespace=~"ns1|ns2"} | k8s_namespace_name=~"ns1|ns2" | json | k8s_namespace_name="ns2"`,
+		},
+		{
+			name:         "metric query",
+			query:        `sum(rate({app="a"} |= "error" [5m]))`,
+			tenantLabels: map[string]bool{"ns1": true},
+			expected:     `sum(rate(({app="a", namespace="ns1"} | k8s_namespace_name="ns1" |= "error") [5m]))`,
+		},
+		{
+			name:         "metric query without stages",
+			query:        `count_over_time({app="a"}[5m])`,
+			tenantLabels: map[string]bool{"ns1": true},
+			expected:     `count_over_time({app="a", namespace="ns1"}[5m] | k8s_namespace_name="ns1")`,
+		},
+		{
+			name:         "grants constrain with their tenant label",
+			query:        `{app="a"}`,
+			tenantLabels: map[string]bool{`cluster="c1",namespace="ns1"`: true},
+			expected:     `{app="a", cluster="c1", namespace="ns1"} | k8s_namespace_name="ns1"`,
+		},
+		{
+			name:         "grants without the tenant label allow any value",
+			query:        `{app="a"}`,
+			tenantLabels: map[string]bool{`cluster="c1"`: true},
+			expected:     `{app="a", cluster="c1"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enforced, err := enforcer.Enforce(tt.query, tt.tenantLabels, "namespace")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, enforced)
+		})
+	}
+
+	_, err := enforcer.Enforce(`{namespace="ns2"}`, map[string]bool{"ns1": true}, "namespace")
+	assert.Error(t, err, "the stream selector is still enforced")
+
+	assert.NoError(t, checkStructuredMetadataKeys([]string{"k8s_namespace_name", "tenant"}))
+	assert.Error(t, checkStructuredMetadataKeys([]string{"k8s.namespace.name"}))
+}
+
+func TestE2E_StructuredMetadataKeys(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Loki.StructuredMetadataKeys = []string{"service_namespace"}
+	env.App.WithRoutes()
+
+	rr := env.do(http.MethodGet, "/loki/api/v1/query_range?query="+url.QueryEscape(`{app="a"} |= "error"`), "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, ok := env.Loki.LastRequest()
+	if !ok {
+		t.Fatal("no request reached Loki")
+	}
+	assert.Contains(t, req.Params.Get("query"), `} | service_namespace=`)
+
+	rr = env.do(http.MethodGet, "/loki/api/v1/series?match[]="+url.QueryEscape(`{app="a"}`), "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ = env.Loki.LastRequest()
+	assert.NotContains(t, req.Params.Get("match[]"), "service_namespace", "the series API only accepts stream selectors")
+}
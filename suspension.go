@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// Suspension modes, block removes the tenant label from all requests, read_only only from the Loki deletion
+// API and rate_limit limits the requests of its users.
+const (
+	suspendBlock     = "block"
+	suspendReadOnly  = "read_only"
+	suspendRateLimit = "rate_limit"
+)
+
+var suspendedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_suspended_requests_total",
+	Help: "Number of requests rejected because of a tenant suspension, by suspension mode.",
+}, []string{"mode"})
+
+// TenantSuspension temporarily restricts a tenant label, e.g. during incident containment or billing disputes,
+// without changing the identity provider or the label store. Suspensions are configured per tenant label or
+// set through the suspension admin API, see suspensionAdmin.
+type TenantSuspension struct {
+	// Mode is block, read_only or rate_limit, defaults to block.
+	Mode string `mapstructure:"mode" json:"mode"`
+	// Rate is the number of requests per second of the users of the tenant label in rate_limit mode.
+	Rate float64 `mapstructure:"rate" json:"rate,omitempty"`
+	// Burst is the number of requests above the rate that are allowed at once, defaults to 1.
+	Burst int `mapstructure:"burst" json:"burst,omitempty"`
+	// Reason is shown to the users in the error message and logged.
+	Reason string `mapstructure:"reason" json:"reason,omitempty"`
+	// Expires lifts the suspension at the given RFC 3339 time, no expiry suspends until the suspension is removed.
+	Expires string `mapstructure:"expires" json:"expires,omitempty"`
+}
+
+func (s TenantSuspension) mode() string {
+	if s.Mode == "" {
+		return suspendBlock
+	}
+	return s.Mode
+}
+
+// validate returns the first problem found in the suspension.
+func (s TenantSuspension) validate() error {
+	switch s.mode() {
+	case suspendBlock, suspendReadOnly:
+	case suspendRateLimit:
+		if s.Rate <= 0 {
+			return fmt.Errorf("rate must be positive in rate_limit mode")
+		}
+	default:
+		return fmt.Errorf("invalid mode %q, must be block, read_only or rate_limit", s.Mode)
+	}
+	if s.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	if _, err := time.Parse(time.RFC3339, s.Expires); s.Expires != "" && err != nil {
+		return fmt.Errorf("invalid expiry %q, must be RFC 3339", s.Expires)
+	}
+	return nil
+}
+
+// active reports whether the suspension applies at the given time.
+func (s TenantSuspension) active(now time.Time) bool {
+	if s.Expires == "" {
+		return true
+	}
+	expires, err := time.Parse(time.RFC3339, s.Expires)
+	return err != nil || now.Before(expires)
+}
+
+// describe returns the message of the suspension for the tenant label.
+func (s TenantSuspension) describe(tenant string) string {
+	message := fmt.Sprintf("tenant %s is suspended", tenant)
+	switch s.mode() {
+	case suspendReadOnly:
+		message = fmt.Sprintf("tenant %s is read-only", tenant)
+	case suspendRateLimit:
+		message = fmt.Sprintf("tenant %s is rate limited to %g requests per second", tenant, s.Rate)
+	}
+	if s.Reason != "" {
+		message += ": " + s.Reason
+	}
+	return message
+}
+
+// suspendedError is returned for requests rejected by the rate limit of a suspension.
+type suspendedError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e suspendedError) Error() string {
+	return e.message
+}
+
+// suspensions holds the suspensions set through the admin API, which override the configured suspensions of
+// the same tenant label and are lost on restarts, and the rate limiters of the rate limited tenant labels.
+// A nil suspensions only applies the configured suspensions, without rate limits.
+type suspensions struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	runtime  map[string]TenantSuspension
+	limiters map[string]suspensionLimiter
+}
+
+// suspensionLimiter is the rate limiter of a tenant label, it is replaced when the rate or burst change.
+type suspensionLimiter struct {
+	rate    float64
+	burst   int
+	limiter *rate.Limiter
+}
+
+func newSuspensions() *suspensions {
+	return &suspensions{now: time.Now, runtime: map[string]TenantSuspension{}, limiters: map[string]suspensionLimiter{}}
+}
+
+// effective returns the active suspensions of the configured and the runtime suspensions.
+func (s *suspensions) effective(configured map[string]TenantSuspension) map[string]TenantSuspension {
+	now := time.Now()
+	all := map[string]TenantSuspension{}
+	for tenant, suspension := range configured {
+		all[tenant] = suspension
+	}
+	if s != nil {
+		now = s.now()
+		s.mu.Lock()
+		for tenant, suspension := range s.runtime {
+			all[tenant] = suspension
+		}
+		s.mu.Unlock()
+	}
+	for tenant, suspension := range all {
+		if !suspension.active(now) {
+			delete(all, tenant)
+			continue
+		}
+		suspension.Mode = suspension.mode()
+		all[tenant] = suspension
+	}
+	return all
+}
+
+// remove removes the tenant labels suspended in one of the modes. Every removal is logged.
+// It returns the remaining labels and the messages of the suspensions, sorted by tenant label.
+func (s *suspensions) remove(token OAuthToken, tenantLabels map[string]bool, configured map[string]TenantSuspension, modes ...string) (map[string]bool, []string) {
+	all := s.effective(configured)
+	if len(all) == 0 {
+		return tenantLabels, nil
+	}
+	var removed []string
+	for label := range tenantLabels {
+		if suspension, ok := all[label]; ok && ContainsIgnoreCase(modes, suspension.mode()) {
+			removed = append(removed, label)
+		}
+	}
+	if len(removed) == 0 {
+		return tenantLabels, nil
+	}
+	sort.Strings(removed)
+	remaining := make(map[string]bool, len(tenantLabels))
+	for label := range tenantLabels {
+		remaining[label] = true
+	}
+	messages := make([]string, 0, len(removed))
+	for _, label := range removed {
+		delete(remaining, label)
+		messages = append(messages, all[label].describe(label))
+	}
+	log.Info().
+		Str("audit", "suspension").
+		Str("user", token.PreferredUsername).
+		Strs("labels", removed).
+		Msg("Suspended tenant labels removed")
+	return remaining, messages
+}
+
+// allow takes a token from the rate limiter of every rate limited tenant label of the user. If one of them
+// is exhausted, the request is rejected with a suspendedError.
+func (s *suspensions) allow(tenantLabels map[string]bool, configured map[string]TenantSuspension) error {
+	if s == nil {
+		return nil
+	}
+	all := s.effective(configured)
+	labels := make([]string, 0, len(tenantLabels))
+	for label := range tenantLabels {
+		if suspension, ok := all[label]; ok && suspension.mode() == suspendRateLimit {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	reservations := make([]*rate.Reservation, 0, len(labels))
+	for _, label := range labels {
+		suspension := all[label]
+		burst := max(suspension.Burst, 1)
+		l, ok := s.limiters[label]
+		if !ok || l.rate != suspension.Rate || l.burst != burst {
+			l = suspensionLimiter{rate: suspension.Rate, burst: burst, limiter: rate.NewLimiter(rate.Limit(suspension.Rate), burst)}
+			s.limiters[label] = l
+		}
+		reservation := l.limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			// the request is not sent, so it does not count against the other tenant labels either
+			reservation.CancelAt(now)
+			for _, r := range reservations {
+				r.CancelAt(now)
+			}
+			suspendedRequests.WithLabelValues(suspendRateLimit).Inc()
+			return suspendedError{message: suspension.describe(label), retryAfter: delay}
+		}
+		reservations = append(reservations, reservation)
+	}
+	return nil
+}
+
+// set suspends the tenant label until the suspension is lifted, it overrides a configured suspension.
+func (s *suspensions) set(tenant string, suspension TenantSuspension) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runtime[tenant] = suspension
+}
+
+// lift removes the runtime suspension of the tenant label and reports whether there was one.
+func (s *suspensions) lift(tenant string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.runtime[tenant]
+	delete(s.runtime, tenant)
+	return ok
+}
+
+// writeSuspendedError writes the error of allow, 429 with Retry-After for a rate limited request.
+func writeSuspendedError(w http.ResponseWriter, err error) {
+	var suspended suspendedError
+	if errors.As(err, &suspended) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(suspended.retryAfter.Seconds()))))
+	}
+	logAndWriteError(w, http.StatusTooManyRequests, err, "")
+}
+
+// WithSuspensionAdmin registers GET /admin/suspensions, which lists the active suspensions, and PUT and DELETE
+// /admin/suspensions/{tenant}, which suspend a tenant label and lift the suspension.
+func (a *App) WithSuspensionAdmin() *App {
+	a.e.HandleFunc("/admin/suspensions", a.suspensionAdmin).Methods(http.MethodGet).Name("/admin/suspensions")
+	a.e.HandleFunc("/admin/suspensions/{tenant}", a.suspensionAdmin).Methods(http.MethodPut, http.MethodDelete).Name("/admin/suspensions/{tenant}")
+	return a
+}
+
+// suspensionAdmin lists, sets (PUT with a TenantSuspension as JSON body) or lifts (DELETE) suspensions.
+// Only members of the tenant admin groups may use it, every change is audited. Suspensions set through the API
+// override the configured suspension of the tenant label until they are lifted or the proxy restarts.
+func (a *App) suspensionAdmin(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	event := requestLogger(r).Info().
+		Str("audit", "suspension_admin").
+		Str("method", r.Method).
+		Str("tenant", tenant).
+		Str("remote", r.RemoteAddr)
+
+	oauthToken, err := getToken(r, a.Cfg(), a)
+	if err != nil {
+		event.Err(err).Bool("allowed", false).Msg("Suspension admin API call rejected")
+		writeTokenError(w, err)
+		return
+	}
+	event = event.Str("user", oauthToken.PreferredUsername).Strs("groups", oauthToken.Groups)
+
+	if !inAnyGroup(oauthToken, a.tenantAdminGroups()) {
+		event.Bool("allowed", false).Msg("Suspension admin API call rejected")
+		logAndWriteError(w, http.StatusForbidden, nil, "user is not allowed to suspend tenants")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(a.suspensions.effective(a.Cfg().Suspensions))
+	case http.MethodPut:
+		var suspension TenantSuspension
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&suspension); err != nil {
+			event.Err(err).Bool("allowed", false).Msg("Suspension admin API call rejected")
+			logAndWriteError(w, http.StatusBadRequest, err, "invalid request body")
+			return
+		}
+		if err := suspension.validate(); err != nil {
+			event.Err(err).Bool("allowed", false).Msg("Suspension admin API call rejected")
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		a.suspensions.set(tenant, suspension)
+		event.Bool("allowed", true).Str("mode", suspension.mode()).Str("reason", suspension.Reason).
+			Str("expires", suspension.Expires).Msg("Tenant suspended")
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !a.suspensions.lift(tenant) {
+			event.Bool("allowed", true).Msg("Tenant suspension to lift not found")
+			logAndWriteError(w, http.StatusNotFound, nil, fmt.Sprintf("tenant %s has no suspension set through the API", tenant))
+			return
+		}
+		event.Bool("allowed", true).Msg("Tenant suspension lifted")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantSuspensionValidate(t *testing.T) {
+	assert.NoError(t, TenantSuspension{}.validate())
+	assert.NoError(t, TenantSuspension{Mode: "read_only", Expires: "2026-12-31T00:00:00Z"}.validate())
+	assert.NoError(t, TenantSuspension{Mode: "rate_limit", Rate: 0.5, Burst: 2}.validate())
+	assert.Error(t, TenantSuspension{Mode: "rate_limit"}.validate())
+	assert.Error(t, TenantSuspension{Mode: "paused"}.validate())
+	assert.Error(t, TenantSuspension{Burst: -1}.validate())
+	assert.Error(t, TenantSuspension{Expires: "tomorrow"}.validate())
+}
+
+func TestSuspensionsRemove(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := newSuspensions()
+	s.now = func() time.Time { return now }
+	configured := map[string]TenantSuspension{
+		"a": {Reason: "incident 42"},
+		"b": {Mode: suspendReadOnly},
+		"c": {Expires: "2026-05-01T00:00:00Z"},
+	}
+	labels := map[string]bool{"a": true, "b": true, "c": true, "d": true}
+
+	remaining, messages := s.remove(OAuthToken{}, labels, configured, suspendBlock)
+	assert.Equal(t, map[string]bool{"b": true, "c": true, "d": true}, remaining)
+	assert.Equal(t, []string{"tenant a is suspended: incident 42"}, messages)
+	assert.Len(t, labels, 4, "the labels of the caller are not changed")
+
+	remaining, messages = s.remove(OAuthToken{}, labels, configured, suspendBlock, suspendReadOnly)
+	assert.Equal(t, map[string]bool{"c": true, "d": true}, remaining)
+	assert.Equal(t, []string{"tenant a is suspended: incident 42", "tenant b is read-only"}, messages)
+
+	s.set("a", TenantSuspension{Mode: suspendRateLimit, Rate: 1})
+	s.set("d", TenantSuspension{})
+	remaining, _ = s.remove(OAuthToken{}, labels, configured, suspendBlock)
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, remaining, "runtime suspensions override configured ones")
+	assert.True(t, s.lift("d"))
+	assert.False(t, s.lift("d"))
+
+	var none *suspensions
+	remaining, _ = none.remove(OAuthToken{}, labels, configured, suspendBlock)
+	assert.Len(t, remaining, 3)
+	assert.NoError(t, none.allow(labels, map[string]TenantSuspension{"a": {Mode: suspendRateLimit, Rate: 1}}))
+}
+
+func TestSuspensionsAllow(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := newSuspensions()
+	s.now = func() time.Time { return now }
+	configured := map[string]TenantSuspension{
+		"a": {Mode: suspendRateLimit, Rate: 0.5, Reason: "billing dispute"},
+		"b": {Mode: suspendRateLimit, Rate: 10, Burst: 5},
+	}
+
+	assert.NoError(t, s.allow(map[string]bool{"a": true, "b": true}, configured))
+	err := s.allow(map[string]bool{"a": true, "b": true}, configured)
+	assert.EqualError(t, err, "tenant a is rate limited to 0.5 requests per second: billing dispute")
+	assert.Equal(t, 2*time.Second, err.(suspendedError).retryAfter)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, s.allow(map[string]bool{"b": true}, configured), "rejected requests do not count against b")
+	}
+	assert.Error(t, s.allow(map[string]bool{"b": true}, configured))
+	assert.NoError(t, s.allow(map[string]bool{"c": true}, configured))
+
+	now = now.Add(2 * time.Second)
+	assert.NoError(t, s.allow(map[string]bool{"a": true}, configured))
+}
+
+func TestE2E_TenantSuspension(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Suspensions = map[string]TenantSuspension{"allowed_user": {Reason: "incident containment"}}
+	query := "/api/v1/query?query=" + url.QueryEscape("up")
+
+	rr := env.do(http.MethodGet, query, "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ := env.Thanos.LastRequest()
+	assert.NotContains(t, req.Params.Get("query"), `"allowed_user`)
+	rr = env.do(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(`up{tenant_id="allowed_user"}`), "userTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = env.do(http.MethodPut, "/admin/suspensions/also_allowed_user", "userTenant", `{"mode":"block"}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = env.do(http.MethodPut, "/admin/suspensions/also_allowed_user", "adminUserToken", `{"mode":"paused"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = env.do(http.MethodPut, "/admin/suspensions/also_allowed_user", "adminUserToken", `{"mode":"block","reason":"billing dispute"}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = env.do(http.MethodGet, query, "userTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "tenant allowed_user is suspended: incident containment; tenant also_allowed_user is suspended: billing dispute")
+
+	rr = env.do(http.MethodPut, "/admin/suspensions/also_allowed_user", "adminUserToken", `{"mode":"rate_limit","rate":0.1}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = env.do(http.MethodGet, "/admin/suspensions", "adminUserToken", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"allowed_user":{"mode":"block","reason":"incident containment"},"also_allowed_user":{"mode":"rate_limit","rate":0.1}}`, rr.Body.String())
+	rr = env.do(http.MethodGet, query, "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = env.do(http.MethodGet, query, "userTenant", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	rr = env.do(http.MethodDelete, "/admin/suspensions/also_allowed_user", "adminUserToken", "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = env.do(http.MethodDelete, "/admin/suspensions/also_allowed_user", "adminUserToken", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = env.do(http.MethodGet, query, "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestE2E_ReadOnlyTenant(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Suspensions = map[string]TenantSuspension{
+		"allowed_user":      {Mode: suspendReadOnly},
+		"also_allowed_user": {Mode: suspendReadOnly},
+	}
+
+	rr := env.do(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{app="a"}`), "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = env.do(http.MethodPost, "/loki/api/v1/delete?query="+url.QueryEscape(`{app="a"}`), "userTenant", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "tenant allowed_user is read-only")
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/websocket"
+)
+
+var tailReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_tail_reconnects_total",
+	Help: "Number of times a dropped upstream live tail stream was re-established, by result.",
+}, []string{"result"})
+
+// isWebSocketRequest reports whether the request asks for a WebSocket upgrade.
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// tailMessage is the part of a Loki tail response needed to resume it.
+type tailMessage struct {
+	Streams []struct {
+		Values [][]string `json:"values"`
+	} `json:"streams"`
+}
+
+// lastTimestamp returns the newest entry timestamp in nanoseconds of a tail message, or zero.
+func lastTimestamp(message string) int64 {
+	var tail tailMessage
+	if err := json.Unmarshal([]byte(message), &tail); err != nil {
+		return 0
+	}
+	var last int64
+	for _, stream := range tail.Streams {
+		for _, value := range stream.Values {
+			if len(value) == 0 {
+				continue
+			}
+			if ts, err := strconv.ParseInt(value[0], 10, 64); err == nil && ts > last {
+				last = ts
+			}
+		}
+	}
+	return last
+}
+
+// resumingTail terminates the client's WebSocket in the proxy and relays the messages of the upstream tail
+// with the already enforced query. If the upstream connection drops, it is re-established with a start
+// right after the last delivered entry, so that the client's stream continues.
+func resumingTail(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, tls bool, headers map[string]string, a *App) {
+	setHeaders(r, tls, headers, a.ServiceAccountToken)
+	server := websocket.Server{
+		// the token was already validated, browsers connecting from Grafana send its origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(client *websocket.Conn) {
+			relayTail(r.Context(), client, r, upstreamURL, a.upstreams.transport(upstreamURL), a.Cfg().Loki.Tail)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// relayTail relays upstream tail messages to the client until the client disconnects or the upstream
+// cannot be reconnected.
+func relayTail(ctx context.Context, client *websocket.Conn, r *http.Request, upstreamURL *url.URL, transport *http.Transport, cfg TailConfig) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		// clients do not send messages, reading detects their disconnect
+		var discard string
+		for websocket.Message.Receive(client, &discard) == nil {
+		}
+		cancel()
+	}()
+
+	maxReconnects := cfg.MaxReconnects
+	if maxReconnects == 0 {
+		maxReconnects = 5
+	}
+	backoff := cfg.ReconnectBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	query := r.URL.Query()
+	var last int64
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if attempt > maxReconnects {
+				tailReconnects.WithLabelValues("failed").Inc()
+				requestLogger(r).Warn().Str("path", r.URL.Path).Int("attempts", maxReconnects).Msg("Giving up reconnecting live tail stream")
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if last > 0 {
+				query.Set("start", strconv.FormatInt(last+1, 10))
+			}
+		}
+		upstream, err := dialTail(ctx, r, upstreamURL, transport, query)
+		if err != nil {
+			requestLogger(r).Warn().Err(err).Str("path", r.URL.Path).Msg("Could not connect upstream live tail stream")
+			continue
+		}
+		if attempt > 0 {
+			tailReconnects.WithLabelValues("success").Inc()
+			requestLogger(r).Info().Str("path", r.URL.Path).Int64("start", last+1).Msg("Resumed live tail stream")
+		}
+		go func() {
+			<-ctx.Done()
+			_ = upstream.Close()
+		}()
+		for {
+			var message string
+			if err := websocket.Message.Receive(upstream, &message); err != nil {
+				break
+			}
+			if err := websocket.Message.Send(client, message); err != nil {
+				_ = upstream.Close()
+				return
+			}
+			if ts := lastTimestamp(message); ts > last {
+				last = ts
+			}
+			attempt = 0
+		}
+		_ = upstream.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		requestLogger(r).Info().Str("path", r.URL.Path).Msg("Upstream live tail stream dropped, reconnecting")
+	}
+}
+
+// dialTail opens the upstream tail WebSocket with the request's headers and the given query.
+// The connection is dialed like all upstream requests, honoring endpoint discovery, but without an egress proxy.
+func dialTail(ctx context.Context, r *http.Request, upstreamURL *url.URL, transport *http.Transport, query url.Values) (*websocket.Conn, error) {
+	location := *upstreamURL
+	location.Path = strings.TrimSuffix(location.Path, "/") + r.URL.Path
+	location.RawQuery = query.Encode()
+	origin := *upstreamURL
+	switch upstreamURL.Scheme {
+	case "http":
+		location.Scheme = "ws"
+	case "https":
+		location.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", upstreamURL.Scheme)
+	}
+	config, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.Header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Origin":
+			continue
+		}
+		config.Header[k] = v
+	}
+
+	addr := upstreamURL.Host
+	if upstreamURL.Port() == "" {
+		addr = net.JoinHostPort(upstreamURL.Host, map[string]string{"ws": "80", "wss": "443"}[location.Scheme])
+	}
+	conn, err := transport.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if location.Scheme == "wss" {
+		tlsConfig := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig.Clone()
+		}
+		tlsConfig.ServerName = upstreamURL.Hostname()
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
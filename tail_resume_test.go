@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestLastTimestamp(t *testing.T) {
+	assert.Equal(t, int64(300), lastTimestamp(`{"streams":[{"stream":{"app":"a"},"values":[["100","x"],["300","y"]]},{"values":[["200","z"]]}]}`))
+	assert.Equal(t, int64(0), lastTimestamp(`{"streams":[]}`))
+	assert.Equal(t, int64(0), lastTimestamp(`not json`))
+}
+
+func TestE2E_TailResumesAfterUpstreamDrop(t *testing.T) {
+	var connections atomic.Int32
+	starts := make(chan string, 2)
+	loki := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		query := ws.Request().URL.Query()
+		assert.Contains(t, query.Get("query"), "tenant_id")
+		starts <- query.Get("start")
+		switch connections.Add(1) {
+		case 1:
+			_ = websocket.Message.Send(ws, `{"streams":[{"stream":{"app":"a"},"values":[["100","first"]]}]}`)
+			// the querier restarts
+		default:
+			_ = websocket.Message.Send(ws, `{"streams":[{"stream":{"app":"a"},"values":[["200","second"]]}]}`)
+			var discard string
+			_ = websocket.Message.Receive(ws, &discard)
+		}
+	}))
+	t.Cleanup(loki.Close)
+
+	env := newE2EEnv(t)
+	env.App.Cfg().Loki.URL = loki.URL
+	env.App.Cfg().Loki.Tail = TailConfig{Resume: true, ReconnectBackoff: 10 * time.Millisecond}
+	env.App.WithRoutes()
+	proxy := httptest.NewServer(env.App.e)
+	t.Cleanup(proxy.Close)
+
+	config, err := websocket.NewConfig(strings.Replace(proxy.URL, "http", "ws", 1)+"/loki/api/v1/tail?query=%7Bapp%3D%22a%22%7D&start=50", proxy.URL)
+	assert.NoError(t, err)
+	config.Header.Set("Authorization", "Bearer "+env.Tokens["userTenant"])
+	client, err := websocket.DialConfig(config)
+	assert.NoError(t, err)
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var message string
+	assert.NoError(t, websocket.Message.Receive(client, &message))
+	assert.Contains(t, message, "first")
+	assert.NoError(t, websocket.Message.Receive(client, &message))
+	assert.Contains(t, message, "second", "the stream continues over the new upstream connection")
+
+	assert.Equal(t, "50", <-starts)
+	assert.Equal(t, "101", <-starts, "the stream resumes after the last delivered entry")
+	assert.Equal(t, int32(2), connections.Load())
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// runTenant implements the tenant subcommand. tenant add onboards a group with its tenant labels in the
+// configured label store. It returns the process exit code like runValidate.
+func runTenant(args []string, stdout io.Writer) int {
+	if len(args) == 0 || args[0] != "add" {
+		_, _ = fmt.Fprintln(stdout, "usage: multena-proxy tenant add --group <name> --namespaces <label,...> [--apply]")
+		return 2
+	}
+	return runTenantAdd(args[1:], stdout)
+}
+
+// runTenantAdd prints the change of the label store that maps the tenant labels to the group, or applies it.
+// For labels.yaml, used by the configmap and git label stores, the change is the updated file, wrapped in a
+// ConfigMap for the configmap label store. For the mysql label store it is the insert query of every label.
+func runTenantAdd(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("tenant add", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	configDir := fs.String("config", "", "directory containing config.yaml and labels.yaml, defaults to the standard search paths")
+	labelsDir := fs.String("labels", "", "directory containing labels.yaml, defaults to the config directory")
+	group := fs.String("group", "", "group or user to onboard")
+	namespaces := fs.String("namespaces", "", "comma separated tenant labels of the group, e.g. namespaces")
+	configMap := fs.String("configmap", "multena-proxy-labels", "name of the labels ConfigMap that is printed for the configmap label store")
+	apply := fs.Bool("apply", false, "write labels.yaml or run the insert queries instead of printing the change")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	cPaths, lPaths := configPaths, labelsPaths
+	if *configDir != "" {
+		cPaths, lPaths = []string{*configDir}, []string{*configDir}
+	}
+	if *labelsDir != "" {
+		lPaths = []string{*labelsDir}
+	}
+	cfg, err := readConfig(cPaths)
+	if err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR config: %v\n", err)
+		return 1
+	}
+	var labels []string
+	for _, label := range strings.Split(*namespaces, ",") {
+		if label = strings.TrimSpace(label); label != "" && !ContainsIgnoreCase(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	if err := validateTenantMapping(*group, labels); err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR %v\n", err)
+		return 1
+	}
+
+	switch cfg.Web.LabelStoreKind {
+	case "configmap", "git":
+		return tenantAddLabelsFile(stdout, cfg.Web.LabelStoreKind, lPaths, *group, labels, *configMap, *apply)
+	case "mysql":
+		return tenantAddMySQL(stdout, cfg, *group, labels, *apply)
+	default:
+		_, _ = fmt.Fprintf(stdout, "ERROR web.label_store_kind: tenant add does not support the %q label store\n", cfg.Web.LabelStoreKind)
+		return 1
+	}
+}
+
+// tenantAddLabelsFile adds the labels of the group to labels.yaml. Labels the group already has are skipped,
+// labels that are already mapped to other identities and groups with cluster-wide access are reported.
+func tenantAddLabelsFile(stdout io.Writer, kind string, paths []string, group string, labels []string, configMap string, apply bool) int {
+	// keys of labels.yaml are lowercased when they are read, others would never match
+	for _, key := range append([]string{group}, labels...) {
+		if key != strings.ToLower(key) {
+			_, _ = fmt.Fprintf(stdout, "ERROR %q must be lowercase, the keys of labels.yaml are lowercased when they are read\n", key)
+			return 1
+		}
+	}
+	v := newViper("labels", paths)
+	if err := v.MergeInConfig(); err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR labels: %v\n", err)
+		return 1
+	}
+	path := v.ConfigFileUsed()
+	existing, problems := checkLabelsFile(paths)
+	for _, p := range problems {
+		_, _ = fmt.Fprintf(stdout, "ERROR %v\n", p)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+
+	if existing[group]["#cluster-wide"] {
+		_, _ = fmt.Fprintf(stdout, "WARN  %s has cluster-wide access, its tenant labels are not enforced\n", group)
+	}
+	var added []string
+	for _, label := range labels {
+		if existing[group][label] {
+			_, _ = fmt.Fprintf(stdout, "WARN  %s already has label %s\n", group, label)
+			continue
+		}
+		var owners []string
+		for identity, mapped := range existing {
+			if mapped[label] {
+				owners = append(owners, identity)
+			}
+		}
+		if len(owners) > 0 {
+			sort.Strings(owners)
+			_, _ = fmt.Fprintf(stdout, "WARN  label %s is already mapped to %s\n", label, strings.Join(owners, ", "))
+		}
+		added = append(added, label)
+	}
+	if len(added) == 0 {
+		_, _ = fmt.Fprintf(stdout, "Nothing to add, %s already has all labels\n", group)
+		return 0
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR labels: %v\n", err)
+		return 1
+	}
+	updated, err := addLabelsToFile(raw, group, added)
+	if err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR labels: %v\n", err)
+		return 1
+	}
+	if apply {
+		if err := os.WriteFile(path, updated, 0o644); err != nil {
+			_, _ = fmt.Fprintf(stdout, "ERROR labels: %v\n", err)
+			return 1
+		}
+		_, _ = fmt.Fprintf(stdout, "Added %s to %s in %s\n", strings.Join(added, ", "), group, path)
+		return 0
+	}
+	if kind == "configmap" {
+		_, _ = fmt.Fprintf(stdout, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %s\ndata:\n  labels.yaml: |\n", configMap)
+		for _, line := range strings.SplitAfter(string(updated), "\n") {
+			if line != "" {
+				_, _ = fmt.Fprint(stdout, "    "+line)
+			}
+		}
+		return 0
+	}
+	_, _ = stdout.Write(updated)
+	return 0
+}
+
+// addLabelsToFile adds the labels to the mapping of the group in the labels.yaml document, creating the group if
+// needed. The document is edited as a YAML node tree, which keeps its comments.
+func addLabelsToFile(raw []byte, group string, labels []string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("labels.yaml must be a mapping of identities to labels")
+	}
+	var mapping *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if strings.EqualFold(root.Content[i].Value, group) {
+			mapping = root.Content[i+1]
+		}
+	}
+	if mapping == nil {
+		mapping = &yaml.Node{Kind: yaml.MappingNode}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: group}, mapping)
+	}
+	for _, label := range labels {
+		mapping.Content = append(mapping.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: label},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: "true"})
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tenantAddMySQL prints the insert query of every label with the group and the label filled in, or runs them.
+// Existing labels can only be skipped when the database is accessible, so only if the queries are applied.
+func tenantAddMySQL(stdout io.Writer, cfg *Config, group string, labels []string, apply bool) int {
+	if cfg.Db.InsertQuery == "" {
+		_, _ = fmt.Fprintln(stdout, "ERROR db.insert_query: must be set to add tenants to the mysql label store")
+		return 1
+	}
+	if !apply {
+		for _, label := range labels {
+			_, _ = fmt.Fprintln(stdout, sqlStatement(cfg.Db.InsertQuery, group, label)+";")
+		}
+		return 0
+	}
+
+	store := &MySQLHandler{}
+	if err := store.Connect(newApp(cfg)); err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR db: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	existing := store.queryLabels(group)
+	var added []string
+	for _, label := range labels {
+		if existing[label] {
+			_, _ = fmt.Fprintf(stdout, "WARN  %s already has label %s\n", group, label)
+			continue
+		}
+		added = append(added, label)
+	}
+	if len(added) == 0 {
+		_, _ = fmt.Fprintf(stdout, "Nothing to add, %s already has all labels\n", group)
+		return 0
+	}
+	actor := "multena-proxy"
+	if u, err := user.Current(); err == nil {
+		actor = u.Username
+	}
+	if err := store.AddLabels(context.Background(), actor, group, added); err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR db: %v\n", err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(stdout, "Added %s to %s\n", strings.Join(added, ", "), group)
+	return 0
+}
+
+// sqlStatement fills the placeholders of the query with the values as quoted SQL strings.
+func sqlStatement(query string, values ...string) string {
+	var b strings.Builder
+	for _, part := range strings.SplitAfter(query, "?") {
+		if !strings.HasSuffix(part, "?") || len(values) == 0 {
+			b.WriteString(part)
+			continue
+		}
+		b.WriteString(strings.TrimSuffix(part, "?"))
+		b.WriteString("'" + strings.NewReplacer(`\`, `\\`, `'`, `''`).Replace(values[0]) + "'")
+		values = values[1:]
+	}
+	return b.String()
+}
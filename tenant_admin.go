@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// maxTenantLabelLength is the longest label accepted by the tenant admin API, the limit of Kubernetes namespace names.
+const maxTenantLabelLength = 253
+
+// tenantMappingStore is implemented by label stores whose mappings can be changed through the tenant admin API.
+type tenantMappingStore interface {
+	// Manageable reports whether the store is configured to change mappings.
+	Manageable() bool
+	AddLabels(ctx context.Context, actor string, identity string, labels []string) error
+	RemoveLabels(ctx context.Context, actor string, identity string, labels []string) error
+}
+
+// tenantLabelsRequest is the body of the tenant admin API.
+type tenantLabelsRequest struct {
+	Labels []string `json:"labels"`
+}
+
+// tenantAdminGroups returns the groups allowed to use the tenant admin API.
+// If none are configured, the admin group is used.
+func (a *App) tenantAdminGroups() []string {
+	if len(a.Cfg().Admin.TenantGroups) > 0 {
+		return a.Cfg().Admin.TenantGroups
+	}
+	return []string{a.Cfg().Admin.Group}
+}
+
+// WithTenantAdmin registers POST and DELETE /admin/tenants/{user}/labels, if the label store can change its mappings.
+func (a *App) WithTenantAdmin() *App {
+	store, ok := a.LabelStore.(tenantMappingStore)
+	if !ok || !store.Manageable() {
+		return a
+	}
+	a.e.HandleFunc("/admin/tenants/{user}/labels", a.tenantAdmin(store)).Methods(http.MethodPost, http.MethodDelete).Name("/admin/tenants/{user}/labels")
+	return a
+}
+
+// tenantAdmin adds (POST) or removes (DELETE) the labels in the JSON body for the identity in the path.
+// The identity is the value of the token property the label store is queried with, e.g. a username.
+// Only members of the tenant admin groups may change mappings, every call is audited.
+func (a *App) tenantAdmin(store tenantMappingStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity := mux.Vars(r)["user"]
+		event := requestLogger(r).Info().
+			Str("audit", "tenant_admin").
+			Str("method", r.Method).
+			Str("identity", identity).
+			Str("remote", r.RemoteAddr)
+
+		oauthToken, err := getToken(r, a.Cfg(), a)
+		if err != nil {
+			event.Err(err).Bool("allowed", false).Msg("Tenant admin API call rejected")
+			writeTokenError(w, err)
+			return
+		}
+		event = event.Str("user", oauthToken.PreferredUsername).Strs("groups", oauthToken.Groups)
+
+		if !inAnyGroup(oauthToken, a.tenantAdminGroups()) {
+			event.Bool("allowed", false).Msg("Tenant admin API call rejected")
+			logAndWriteError(w, http.StatusForbidden, nil, "user is not allowed to change tenant mappings")
+			return
+		}
+
+		var body tenantLabelsRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+			event.Err(err).Bool("allowed", false).Msg("Tenant admin API call rejected")
+			logAndWriteError(w, http.StatusBadRequest, err, "invalid request body")
+			return
+		}
+		if err := validateTenantMapping(identity, body.Labels); err != nil {
+			event.Err(err).Bool("allowed", false).Msg("Tenant admin API call rejected")
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		event = event.Strs("labels", body.Labels)
+
+		change := store.AddLabels
+		if r.Method == http.MethodDelete {
+			change = store.RemoveLabels
+		}
+		if err := change(r.Context(), oauthToken.PreferredUsername, identity, body.Labels); err != nil {
+			event.Err(err).Bool("allowed", true).Msg("Tenant mapping change failed")
+			logAndWriteError(w, http.StatusInternalServerError, err, "")
+			return
+		}
+		event.Bool("allowed", true).Msg("Tenant mapping changed")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// validateTenantMapping checks that the identity is set and the labels are usable as tenant label values.
+// Labels must not contain | or quotes, which would change the meaning of the enforced matchers.
+func validateTenantMapping(identity string, labels []string) error {
+	if strings.TrimSpace(identity) == "" {
+		return fmt.Errorf("identity must not be empty")
+	}
+	if len(labels) == 0 {
+		return fmt.Errorf("labels must not be empty")
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > maxTenantLabelLength {
+			return fmt.Errorf("label %q must have between 1 and %d characters", label, maxTenantLabelLength)
+		}
+		if strings.ContainsAny(label, "|\"'`\\") || strings.ContainsFunc(label, unicode.IsSpace) || strings.ContainsFunc(label, unicode.IsControl) {
+			return fmt.Errorf("label %q must not contain |, quotes, backslashes or whitespace", label)
+		}
+	}
+	return nil
+}
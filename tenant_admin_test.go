@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMappingStore records the changes of the tenant admin API on top of the test label store.
+type fakeMappingStore struct {
+	Labelstore
+	changes []string
+	err     error
+}
+
+func (f *fakeMappingStore) Manageable() bool { return true }
+
+func (f *fakeMappingStore) AddLabels(_ context.Context, actor string, identity string, labels []string) error {
+	f.changes = append(f.changes, actor+" add "+identity+" "+strings.Join(labels, ","))
+	return f.err
+}
+
+func (f *fakeMappingStore) RemoveLabels(_ context.Context, actor string, identity string, labels []string) error {
+	f.changes = append(f.changes, actor+" remove "+identity+" "+strings.Join(labels, ","))
+	return f.err
+}
+
+func TestTenantAdmin(t *testing.T) {
+	env := newE2EEnv(t)
+	store := &fakeMappingStore{Labelstore: env.App.LabelStore}
+	env.App.LabelStore = store
+	env.App.WithRoutes()
+
+	rr := env.do(http.MethodPost, "/admin/tenants/jane/labels", "adminUserToken", `{"labels":["team-a","team-b"]}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = env.do(http.MethodDelete, "/admin/tenants/jane/labels", "adminUserToken", `{"labels":["team-b"]}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, []string{"admin add jane team-a,team-b", "admin remove jane team-b"}, store.changes)
+
+	rr = env.do(http.MethodPost, "/admin/tenants/jane/labels", "userTenant", `{"labels":["team-a"]}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = env.do(http.MethodPost, "/admin/tenants/jane/labels", "", `{"labels":["team-a"]}`)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr = env.do(http.MethodPost, "/admin/tenants/jane/labels", "adminUserToken", `{"labels":["a|b"]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = env.do(http.MethodPost, "/admin/tenants/jane/labels", "adminUserToken", `labels`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Len(t, store.changes, 2)
+
+	store.err = errors.New("db down")
+	rr = env.do(http.MethodPost, "/admin/tenants/jane/labels", "adminUserToken", `{"labels":["team-c"]}`)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	env.App.Cfg().Admin.TenantGroups = []string{"platform"}
+	rr = env.do(http.MethodPost, "/admin/tenants/jane/labels", "adminUserToken", `{"labels":["team-a"]}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestTenantAdminNotRegistered(t *testing.T) {
+	env := newE2EEnv(t)
+
+	rr := env.do(http.MethodPost, "/admin/tenants/jane/labels", "adminUserToken", `{"labels":["team-a"]}`)
+	assert.NotEqual(t, http.StatusNoContent, rr.Code)
+}
+
+func TestValidateTenantMapping(t *testing.T) {
+	assert.NoError(t, validateTenantMapping("jane", []string{"team-a", "kube-system"}))
+	assert.ErrorContains(t, validateTenantMapping(" ", []string{"team-a"}), "identity")
+	assert.ErrorContains(t, validateTenantMapping("jane", nil), "labels must not be empty")
+	for _, label := range []string{"", "a|b", `a"b`, "a b", "a\nb", `a\b`, strings.Repeat("a", 254)} {
+		assert.Error(t, validateTenantMapping("jane", []string{label}), label)
+	}
+}
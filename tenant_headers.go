@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// tenantHeaderData is passed to the tenant header templates.
+type tenantHeaderData struct {
+	Username string
+	Email    string
+	Groups   []string
+	Labels   []string
+}
+
+var tenantHeaderFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// compileTenantHeaders parses the configured header value templates.
+func compileTenantHeaders(headers map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template, len(headers))
+	for name, value := range headers {
+		t, err := template.New(name).Funcs(tenantHeaderFuncs).Option("missingkey=zero").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for header %s: %w", name, err)
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+// setTenantHeaders renders the header templates for the identity and its resolved tenant labels
+// and sets them on the upstream request. Headers whose template fails to render are not set.
+func setTenantHeaders(r *http.Request, templates map[string]*template.Template, token OAuthToken, tenantLabels map[string]bool) {
+	if len(templates) == 0 {
+		return
+	}
+	data := tenantHeaderData{
+		Username: token.PreferredUsername,
+		Email:    token.Email,
+		Groups:   token.Groups,
+		Labels:   MapKeysToArray(tenantLabels),
+	}
+	sort.Strings(data.Labels)
+	for name, t := range templates {
+		var value bytes.Buffer
+		if err := t.Execute(&value, data); err != nil {
+			requestLogger(r).Error().Err(err).Str("header", name).Msg("Error while rendering tenant header")
+			continue
+		}
+		r.Header.Set(name, value.String())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetTenantHeaders(t *testing.T) {
+	templates, err := compileTenantHeaders(map[string]string{
+		"X-Team":     `{{ index .Groups 0 }}`,
+		"X-Tenants":  `{{ join .Labels "," }}`,
+		"X-User":     `{{ upper .Username }}`,
+		"X-Priority": `{{ if eq .Username "batch" }}low{{ else }}high{{ end }}`,
+	})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	setTenantHeaders(req, templates, OAuthToken{PreferredUsername: "user", Groups: []string{"team-a"}}, map[string]bool{"b": true, "a": true})
+	assert.Equal(t, "team-a", req.Header.Get("X-Team"))
+	assert.Equal(t, "a,b", req.Header.Get("X-Tenants"))
+	assert.Equal(t, "USER", req.Header.Get("X-User"))
+	assert.Equal(t, "high", req.Header.Get("X-Priority"))
+
+	// a failing template must not set the header
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	setTenantHeaders(req, templates, OAuthToken{PreferredUsername: "batch"}, nil)
+	assert.Empty(t, req.Header.Values("X-Team"))
+	assert.Equal(t, "low", req.Header.Get("X-Priority"))
+
+	_, err = compileTenantHeaders(map[string]string{"X-Broken": "{{ .Username"})
+	assert.Error(t, err)
+}
+
+func TestTenantHeadersAreForwarded(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Thanos.TenantHeaders = map[string]string{"x-team": `{{ join .Groups "," }}`}
+	env.App.WithRoutes()
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "groupsTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ := env.Thanos.LastRequest()
+	assert.Equal(t, "group1,group2", req.Header.Get("X-Team"))
+}
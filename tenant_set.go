@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+
+	enforcer "github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// maxTenantSets is the number of tenant sets kept in the cache before it is cleared.
+const maxTenantSets = 256
+
+// tenantPlaceholder stands in for the value of a tenant matcher while an enforced query is printed, see
+// tenantSet.print. It is random so that it cannot be part of a query.
+var tenantPlaceholder = fmt.Sprintf("multena-tenants-%016x", rand.Uint64())
+
+// tenantSet is the precompiled enforcement of a set of tenant labels. Users with thousands of tenant labels
+// would otherwise pay for sorting, joining and compiling the tenant matcher on every request.
+type tenantSet struct {
+	labelMatch string
+	// labels are sorted, so the enforced queries are the same for every request and cache well upstream.
+	labels   []string
+	matcher  *labels.Matcher
+	enforcer *enforcer.PromQLEnforcer
+	// selector selects all tenant labels of the set, it is the enforcement of an empty query.
+	selector string
+	// grants is set if the labels contain grants, which are enforced with their own matchers, see Grant.
+	// Sets of grants have no matcher, enforcer and selector.
+	grants bool
+	// placeholder replaces the matcher while printing, printed and quoted are the printed placeholder and matcher.
+	placeholder *labels.Matcher
+	printed     string
+	quoted      string
+}
+
+// newTenantSet compiles the matcher and enforcer of the tenant labels, keeping their order.
+func newTenantSet(tenantLabels []string, labelMatch string) (*tenantSet, error) {
+	for _, label := range tenantLabels {
+		if strings.Contains(label, "=") {
+			return &tenantSet{labelMatch: labelMatch, labels: tenantLabels, grants: true}, nil
+		}
+	}
+	matchType := labels.MatchEqual
+	if len(tenantLabels) > 1 {
+		matchType = labels.MatchRegexp
+	}
+	value := strings.Join(tenantLabels, "|")
+	matcher, err := labels.NewMatcher(matchType, labelMatch, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant labels: %w", err)
+	}
+	placeholder, err := labels.NewMatcher(matchType, labelMatch, tenantPlaceholder)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant labels: %w", err)
+	}
+	return &tenantSet{
+		labelMatch:  labelMatch,
+		labels:      tenantLabels,
+		matcher:     matcher,
+		enforcer:    enforcer.NewPromQLEnforcer(true, matcher),
+		selector:    fmt.Sprintf("{%s%s\"%s\"}", labelMatch, matchType, value),
+		placeholder: placeholder,
+		printed:     placeholder.String(),
+		quoted:      matcher.String(),
+	}, nil
+}
+
+// usePlaceholder replaces the matcher of the set in the matchers with its placeholder.
+func (s *tenantSet) usePlaceholder(matchers []*labels.Matcher) {
+	for i, matcher := range matchers {
+		if matcher == s.matcher {
+			matchers[i] = s.placeholder
+		}
+	}
+}
+
+// print returns the query of the enforced PromQL expression. Quoting the value of the matcher dominates printing
+// queries of users with thousands of tenant labels, so the matcher is printed as the placeholder, which is then
+// replaced by the matcher quoted once for the set.
+func (s *tenantSet) print(expr parser.Expr) string {
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vector, ok := node.(*parser.VectorSelector); ok {
+			s.usePlaceholder(vector.LabelMatchers)
+		}
+		return nil
+	})
+	return s.unquote(expr.String())
+}
+
+// unquote replaces the printed placeholder in the query with the quoted matcher.
+func (s *tenantSet) unquote(query string) string {
+	return strings.ReplaceAll(query, s.printed, s.quoted)
+}
+
+// equals reports whether the set holds exactly the tenant labels.
+func (s *tenantSet) equals(tenantLabels map[string]bool, labelMatch string) bool {
+	if s.labelMatch != labelMatch || len(s.labels) != len(tenantLabels) {
+		return false
+	}
+	for _, label := range s.labels {
+		if !tenantLabels[label] {
+			return false
+		}
+	}
+	return true
+}
+
+// tenantSetCache caches the tenant sets by a hash of their labels that does not depend on the map order,
+// so a set is found without sorting the labels of the request. Every App has its own cache, a nil cache
+// compiles the tenant sets without caching them.
+type tenantSetCache struct {
+	mu   sync.RWMutex
+	sets map[uint64][]*tenantSet
+	size int
+}
+
+func newTenantSetCache() *tenantSetCache {
+	return &tenantSetCache{sets: map[uint64][]*tenantSet{}}
+}
+
+var tenantSetSeed = maphash.MakeSeed()
+
+// tenantSetHash sums the hashes of the labels, which is cheaper than sorting them. Equal hashes are
+// verified with tenantSet.equals.
+func tenantSetHash(tenantLabels map[string]bool, labelMatch string) uint64 {
+	sum := maphash.String(tenantSetSeed, labelMatch) + uint64(len(tenantLabels))
+	for label := range tenantLabels {
+		sum += maphash.String(tenantSetSeed, label)
+	}
+	return sum
+}
+
+// get returns the tenant set of the tenant labels, compiling and caching it if it is not cached yet.
+func (c *tenantSetCache) get(tenantLabels map[string]bool, labelMatch string) (*tenantSet, error) {
+	if c == nil {
+		sorted := MapKeysToArray(tenantLabels)
+		slices.Sort(sorted)
+		return newTenantSet(sorted, labelMatch)
+	}
+	key := tenantSetHash(tenantLabels, labelMatch)
+	c.mu.RLock()
+	for _, set := range c.sets[key] {
+		if set.equals(tenantLabels, labelMatch) {
+			c.mu.RUnlock()
+			return set, nil
+		}
+	}
+	c.mu.RUnlock()
+
+	sorted := MapKeysToArray(tenantLabels)
+	slices.Sort(sorted)
+	set, err := newTenantSet(sorted, labelMatch)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size >= maxTenantSets {
+		c.sets, c.size = map[uint64][]*tenantSet{}, 0
+	}
+	c.sets[key] = append(c.sets[key], set)
+	c.size++
+	return set, nil
+}
+
+// dropEnforcedMatchers removes the matchers that are identical to the enforced matcher from all vector selectors.
+// The enforcer adds the matcher again, but would first check the identical matchers for conflicts, which
+// compiles the matcher's regular expression for every selector and fails for more than 256 tenant labels.
+func dropEnforcedMatchers(expr parser.Expr, matcher *labels.Matcher) {
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		if vector, ok := node.(*parser.VectorSelector); ok {
+			vector.LabelMatchers = slices.DeleteFunc(vector.LabelMatchers, func(m *labels.Matcher) bool {
+				return m.Name == matcher.Name && m.Type == matcher.Type && m.Value == matcher.Value
+			})
+		}
+		return nil
+	})
+}
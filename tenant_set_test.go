@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantSetCache(t *testing.T) {
+	cache := newTenantSetCache()
+
+	set, err := cache.get(map[string]bool{"c": true, "a": true, "b": true}, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, set.labels)
+	assert.Equal(t, `{namespace=~"a|b|c"}`, set.selector)
+	assert.True(t, set.matcher.Matches("b"))
+
+	again, err := cache.get(map[string]bool{"a": true, "b": true, "c": true}, "namespace")
+	assert.NoError(t, err)
+	assert.Same(t, set, again)
+
+	other, err := cache.get(map[string]bool{"a": true, "b": true}, "namespace")
+	assert.NoError(t, err)
+	assert.NotSame(t, set, other)
+	otherLabel, err := cache.get(map[string]bool{"a": true, "b": true, "c": true}, "tenant")
+	assert.NoError(t, err)
+	assert.Equal(t, `{tenant=~"a|b|c"}`, otherLabel.selector)
+
+	single, err := cache.get(map[string]bool{"a": true}, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, `{namespace="a"}`, single.selector)
+
+	for i := range maxTenantSets {
+		_, err := cache.get(map[string]bool{fmt.Sprint(i): true}, "namespace")
+		assert.NoError(t, err)
+	}
+	assert.LessOrEqual(t, cache.size, maxTenantSets)
+
+	var uncached *tenantSetCache
+	first, err := uncached.get(map[string]bool{"b": true, "a": true}, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, `{namespace=~"a|b"}`, first.selector)
+	second, err := uncached.get(map[string]bool{"a": true, "b": true}, "namespace")
+	assert.NoError(t, err)
+	assert.NotSame(t, first, second)
+}
+
+func TestTenantSetCachePerApp(t *testing.T) {
+	env := newE2EEnv(t)
+	other := newE2EEnv(t)
+	assert.NotSame(t, env.App.tenantSets, other.App.tenantSets)
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 1, env.App.tenantSets.size)
+	assert.Equal(t, 0, other.App.tenantSets.size)
+}
+
+func TestEnforceLargeTenantSets(t *testing.T) {
+	tenantLabels := largeTenantLabels(300)
+	sorted := make([]string, 0, len(tenantLabels))
+	for i := range len(tenantLabels) {
+		sorted = append(sorted, fmt.Sprintf("team-namespace-%05d", i))
+	}
+	all := strings.Join(sorted, "|")
+
+	// more values than the enforcer can enumerate from the regular expression
+	query := fmt.Sprintf(`up{namespace=~"%s"}`, all)
+	enforced, err := PromQLEnforcer{}.Enforce(query, tenantLabels, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, query, enforced)
+
+	enforced, err = PromQLEnforcer{}.Enforce("", tenantLabels, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`{namespace=~"%s"}`, all), enforced)
+
+	enforced, err = LogQLEnforcer{}.Enforce(`{app="api"}`, tenantLabels, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`{app="api", namespace=~"%s"}`, all), enforced)
+}
+
+func TestEnforceMixedTenantMatchers(t *testing.T) {
+	enforced, err := PromQLEnforcer{}.Enforce(`up{namespace="a"} + up{namespace=~"a|b"}`, map[string]bool{"a": true, "b": true}, "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, `up{namespace="a",namespace=~"a|b"} + up{namespace=~"a|b"}`, enforced)
+}
+
+func TestEnforcePrintsCachedTenantSets(t *testing.T) {
+	cache := newTenantSetCache()
+	tenantLabels := map[string]bool{`a"b`: true, `c\d`: true}
+	for range 2 {
+		enforced, err := PromQLEnforcer{TenantSets: cache}.Enforce(`sum(rate(up[5m])) / on() count(up)`, tenantLabels, "namespace")
+		assert.NoError(t, err)
+		assert.Equal(t, `sum(rate(up{namespace=~"a\"b|c\\d"}[5m])) / on () count(up{namespace=~"a\"b|c\\d"})`, enforced)
+		assert.NotContains(t, enforced, tenantPlaceholder)
+
+		enforced, err = LogQLEnforcer{TenantSets: cache}.Enforce(`sum(count_over_time({app="api"}[5m]))`, tenantLabels, "namespace")
+		assert.NoError(t, err)
+		assert.NotContains(t, enforced, tenantPlaceholder)
+		assert.Contains(t, enforced, `namespace=~"a\"b|c\\d"`)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const tenantLabels = `# managed by the platform team
+team-a:
+  ns-a: true # shared
+team-b:
+  '#cluster-wide': true
+`
+
+func TestRunTenantAdd_ConfigMap(t *testing.T) {
+	dir := writeConfigDir(t, "web:\n  label_store_kind: configmap\n", tenantLabels)
+
+	var out bytes.Buffer
+	code := runTenant([]string{"add", "--config", dir, "--group", "team-c", "--namespaces", "ns-a, ns-c"}, &out)
+	assert.Equal(t, 0, code, out.String())
+	assert.Equal(t, `WARN  label ns-a is already mapped to team-a
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: multena-proxy-labels
+data:
+  labels.yaml: |
+    # managed by the platform team
+    team-a:
+      ns-a: true # shared
+    team-b:
+      '#cluster-wide': true
+    team-c:
+      ns-a: true
+      ns-c: true
+`, out.String())
+	unchanged, _ := os.ReadFile(filepath.Join(dir, "labels.yaml"))
+	assert.Equal(t, tenantLabels, string(unchanged))
+
+	out.Reset()
+	code = runTenant([]string{"add", "--config", dir, "--group", "team-a", "--namespaces", "ns-a,ns-b", "--apply"}, &out)
+	assert.Equal(t, 0, code, out.String())
+	assert.Contains(t, out.String(), "WARN  team-a already has label ns-a")
+	assert.Contains(t, out.String(), "Added ns-b to team-a")
+	labels, problems := checkLabelsFile([]string{dir})
+	assert.Empty(t, problems)
+	assert.Equal(t, map[string]bool{"ns-a": true, "ns-b": true}, labels["team-a"])
+
+	out.Reset()
+	code = runTenant([]string{"add", "--config", dir, "--group", "team-b", "--namespaces", "ns-b"}, &out)
+	assert.Equal(t, 0, code, out.String())
+	assert.Contains(t, out.String(), "WARN  team-b has cluster-wide access")
+}
+
+func TestRunTenantAdd_Invalid(t *testing.T) {
+	dir := writeConfigDir(t, "web:\n  label_store_kind: configmap\n", tenantLabels)
+
+	for _, args := range [][]string{
+		{"add", "--config", dir, "--group", "team-c", "--namespaces", `ns"a`},
+		{"add", "--config", dir, "--group", "team-c", "--namespaces", ""},
+		{"add", "--config", dir, "--group", "Team-C", "--namespaces", "ns-c"},
+	} {
+		var out bytes.Buffer
+		assert.Equal(t, 1, runTenant(args, &out), args)
+		assert.Contains(t, out.String(), "ERROR", args)
+	}
+	var out bytes.Buffer
+	assert.Equal(t, 2, runTenant([]string{"remove"}, &out))
+}
+
+func TestRunTenantAdd_MySQL(t *testing.T) {
+	dir := writeConfigDir(t, "web:\n  label_store_kind: mysql\ndb:\n  insert_query: \"INSERT INTO users (username, label) VALUES (?, ?)\"\n", "")
+
+	var out bytes.Buffer
+	code := runTenant([]string{"add", "--config", dir, "--group", "o'brien", "--namespaces", "ns-a,ns-b"}, &out)
+	assert.Equal(t, 0, code, out.String())
+	assert.Equal(t, `INSERT INTO users (username, label) VALUES ('o''brien', 'ns-a');
+INSERT INTO users (username, label) VALUES ('o''brien', 'ns-b');
+`, out.String())
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// isRangeEndpoint reports whether the path is one of the APIs that select data between start and end.
+// Instant queries evaluate at a single time and are not included.
+func isRangeEndpoint(path string) bool {
+	return strings.HasSuffix(path, "/query_range") ||
+		strings.HasSuffix(path, "/index/stats") ||
+		strings.HasSuffix(path, "/query_exemplars") ||
+		isSeriesEndpoint(path)
+}
+
+// injectTimeRange sets start and end of a request that does not set them to the last rng before now.
+// A request with only an end gets a start rng before it, a request with a start is left to the upstream,
+// which uses the current time as end.
+func injectTimeRange(values url.Values, rng time.Duration, now time.Time) {
+	if rng <= 0 || values.Get("start") != "" {
+		return
+	}
+	end := now
+	if raw := values.Get("end"); raw != "" {
+		var ok bool
+		if end, ok = parseTimeParam(raw); !ok {
+			// leave invalid timestamps to the upstream to reject
+			return
+		}
+	} else {
+		values.Set("end", end.UTC().Format(time.RFC3339Nano))
+	}
+	values.Set("start", end.Add(-rng).UTC().Format(time.RFC3339Nano))
+	log.Debug().Str("start", values.Get("start")).Str("end", values.Get("end")).Msg("Injecting default time range")
+}
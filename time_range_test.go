@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInjectTimeRange(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		params url.Values
+		rng    time.Duration
+		want   url.Values
+	}{
+		{
+			name:   "start and end injected",
+			params: url.Values{"query": {"up"}},
+			rng:    time.Hour,
+			want:   url.Values{"query": {"up"}, "start": {"2026-10-14T11:00:00Z"}, "end": {"2026-10-14T12:00:00Z"}},
+		},
+		{
+			name:   "start injected before end",
+			params: url.Values{"end": {"1760400000"}},
+			rng:    time.Hour,
+			want:   url.Values{"end": {"1760400000"}, "start": {"2025-10-13T23:00:00Z"}},
+		},
+		{
+			name:   "start kept",
+			params: url.Values{"start": {"1760400000"}},
+			rng:    time.Hour,
+			want:   url.Values{"start": {"1760400000"}},
+		},
+		{
+			name:   "invalid end kept",
+			params: url.Values{"end": {"yesterday"}},
+			rng:    time.Hour,
+			want:   url.Values{"end": {"yesterday"}},
+		},
+		{
+			name:   "no default range",
+			params: url.Values{"query": {"up"}},
+			want:   url.Values{"query": {"up"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			injectTimeRange(tt.params, tt.rng, now)
+			assert.Equal(t, tt.want, tt.params)
+		})
+	}
+}
+
+func TestIsRangeEndpoint(t *testing.T) {
+	assert.True(t, isRangeEndpoint("/api/v1/query_range"))
+	assert.True(t, isRangeEndpoint("/loki/api/v1/series"))
+	assert.True(t, isRangeEndpoint("/api/v1/label/job/values"))
+	assert.True(t, isRangeEndpoint("/loki/api/v1/index/stats"))
+	assert.False(t, isRangeEndpoint("/api/v1/query"))
+	assert.False(t, isRangeEndpoint("/loki/api/v1/tail"))
+}
+
+func TestE2E_DefaultTimeRangeIsInjected(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Quotas = QuotasConfig{
+		Default: QuotaConfig{DefaultRange: time.Hour},
+		Tenants: map[string]QuotaConfig{"allowed_user": {DefaultRange: 24 * time.Hour}},
+	}
+
+	rr := env.do(http.MethodGet, "/api/v1/series?match[]=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ := env.Thanos.LastRequest()
+	start, ok := parseTimeParam(req.Params.Get("start"))
+	assert.True(t, ok)
+	end, ok := parseTimeParam(req.Params.Get("end"))
+	assert.True(t, ok)
+	assert.Equal(t, 24*time.Hour, end.Sub(start))
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req, _ = env.Thanos.LastRequest()
+	assert.Empty(t, req.Params.Get("start"))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/log"
+)
+
+// TimeRoutingConfig sends requests that only read recent data to a second upstream, e.g. Prometheus or a
+// short-term Loki in front of Thanos or a long-term Loki. All other requests go to the upstream's URL.
+type TimeRoutingConfig struct {
+	HotURL string `mapstructure:"hot_url"`
+	// MaxAge is the age of the oldest data the hot upstream is asked for.
+	MaxAge time.Duration `mapstructure:"max_age"`
+}
+
+// promqlLookbackDelta is how far Prometheus looks back for the samples of instant vector selectors.
+const promqlLookbackDelta = 5 * time.Minute
+
+var timeRoutedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "multena_time_routed_requests_total",
+	Help: "Number of requests routed by the time range they read, by query language and upstream.",
+}, []string{"language", "upstream"})
+
+// logqlRange matches the range vectors and offsets of a LogQL query, whose parser does not export them.
+var logqlRange = regexp.MustCompile(`\[\s*([0-9]+[a-z0-9]*)\s*\]|\boffset\s+([0-9]+[a-z0-9]*)`)
+
+// timeRouter chooses between the hot and the cold upstream of a datasource.
+type timeRouter struct {
+	language string
+	hot      *url.URL
+	maxAge   time.Duration
+	now      func() time.Time
+}
+
+// newTimeRouter returns the router of the config, or nil if time routing is not configured.
+func newTimeRouter(language string, cfg TimeRoutingConfig) *timeRouter {
+	if cfg.HotURL == "" || cfg.MaxAge <= 0 {
+		return nil
+	}
+	hot, err := url.Parse(cfg.HotURL)
+	if err != nil {
+		log.Fatal().Err(err).Str("url", cfg.HotURL).Msg("Error parsing hot upstream URL")
+	}
+	return &timeRouter{language: language, hot: hot, maxAge: cfg.MaxAge, now: time.Now}
+}
+
+// route returns the hot upstream if the request only reads data younger than the max age, otherwise cold.
+// It is called with the enforced request, which may also carry a default time range, see injectTimeRange.
+func (t *timeRouter) route(r *http.Request, matchWord string, cold *url.URL) *url.URL {
+	if t == nil || isTailRequest(r) {
+		return cold
+	}
+	oldest, ok := t.oldest(r, matchWord)
+	if !ok || t.now().Sub(oldest) > t.maxAge {
+		timeRoutedRequests.WithLabelValues(t.language, "cold").Inc()
+		return cold
+	}
+	timeRoutedRequests.WithLabelValues(t.language, "hot").Inc()
+	requestLogger(r).Trace().Str("path", r.URL.Path).Time("oldest", oldest).Msg("Routing request to the hot upstream")
+	return t.hot
+}
+
+// oldest returns the time of the oldest data the request reads, which is its start or, for instant queries,
+// its time, minus the lookback of its query. It is false if that is unknown, e.g. for series requests
+// without start, which read all data.
+func (t *timeRouter) oldest(r *http.Request, matchWord string) (time.Time, bool) {
+	var at time.Time
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/api/v1/query"):
+		at = t.now()
+		if raw := requestParam(r, "time"); raw != "" {
+			var ok bool
+			if at, ok = parseTimeParam(raw); !ok {
+				return time.Time{}, false
+			}
+		}
+	case isRangeEndpoint(r.URL.Path):
+		var ok bool
+		if at, ok = parseTimeParam(requestParam(r, "start")); !ok {
+			return time.Time{}, false
+		}
+	default:
+		return time.Time{}, false
+	}
+	query := requestParam(r, matchWord)
+	if query == "" || isSeriesEndpoint(r.URL.Path) {
+		return at, true
+	}
+	lookback, ok := t.lookback(query)
+	if !ok {
+		return time.Time{}, false
+	}
+	return at.Add(-lookback), true
+}
+
+// lookback returns how far before its evaluation time the query reads data.
+func (t *timeRouter) lookback(query string) (time.Duration, bool) {
+	if t.language == "logql" {
+		return logqlLookback(query)
+	}
+	return promqlLookback(query)
+}
+
+// promqlLookback returns the longest range and offset of the selectors of the query, including the ranges of
+// enclosing subqueries. Queries with @ modifiers read data at fixed times and have no known lookback.
+func promqlLookback(query string) (time.Duration, bool) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return 0, false
+	}
+	var lookback time.Duration
+	fixed := false
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		var window time.Duration
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			if n.Timestamp != nil || n.StartOrEnd != 0 {
+				fixed = true
+			}
+			window = promqlLookbackDelta + n.OriginalOffset
+			if len(path) > 0 {
+				if m, ok := path[len(path)-1].(*parser.MatrixSelector); ok {
+					window = m.Range + n.OriginalOffset
+				}
+			}
+		default:
+			return nil
+		}
+		for _, parent := range path {
+			if sq, ok := parent.(*parser.SubqueryExpr); ok {
+				if sq.Timestamp != nil || sq.StartOrEnd != 0 {
+					fixed = true
+				}
+				window += sq.Range + sq.OriginalOffset
+			}
+		}
+		lookback = max(lookback, window)
+		return nil
+	})
+	return lookback, !fixed
+}
+
+// logqlLookback returns the longest range plus the longest offset of the query.
+func logqlLookback(query string) (time.Duration, bool) {
+	var rng, offset time.Duration
+	for _, match := range logqlRange.FindAllStringSubmatch(query, -1) {
+		raw, isOffset := match[1], false
+		if raw == "" {
+			raw, isOffset = match[2], true
+		}
+		d, err := model.ParseDuration(raw)
+		if err != nil {
+			return 0, false
+		}
+		if isOffset {
+			offset = max(offset, time.Duration(d))
+		} else {
+			rng = max(rng, time.Duration(d))
+		}
+	}
+	return rng + offset, true
+}
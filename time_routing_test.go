@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gepaplexx/multena-proxy/internal/mockupstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromQLLookback(t *testing.T) {
+	cases := []struct {
+		query    string
+		lookback time.Duration
+		ok       bool
+	}{
+		{query: `up`, lookback: 5 * time.Minute, ok: true},
+		{query: `rate(http_requests_total[6h])`, lookback: 6 * time.Hour, ok: true},
+		{query: `up offset 1h`, lookback: time.Hour + 5*time.Minute, ok: true},
+		{query: `max_over_time(rate(x[5m])[1h:1m])`, lookback: time.Hour + 5*time.Minute, ok: true},
+		{query: `up @ 1700000000`, ok: false},
+		{query: `rate(x[`, ok: false},
+	}
+	for _, tc := range cases {
+		lookback, ok := promqlLookback(tc.query)
+		assert.Equal(t, tc.ok, ok, tc.query)
+		if tc.ok {
+			assert.Equal(t, tc.lookback, lookback, tc.query)
+		}
+	}
+}
+
+func TestLogQLLookback(t *testing.T) {
+	lookback, ok := logqlLookback(`sum(count_over_time({app="a"} |= "[x]" [3h] offset 30m))`)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Hour+30*time.Minute, lookback)
+	lookback, ok = logqlLookback(`{app="a"}`)
+	assert.True(t, ok)
+	assert.Zero(t, lookback)
+}
+
+func TestE2E_TimeRouting(t *testing.T) {
+	env := newE2EEnv(t)
+	hot := mockupstream.NewThanos()
+	t.Cleanup(hot.Close)
+	env.App.Cfg().Thanos.TimeRouting = TimeRoutingConfig{HotURL: hot.URL, MaxAge: 2 * time.Hour}
+	env.App.WithRoutes()
+
+	now := time.Now()
+	unix := func(d time.Duration) string { return strconv.FormatInt(now.Add(-d).Unix(), 10) }
+	cases := []struct {
+		target string
+		hot    bool
+	}{
+		{target: "/api/v1/query?query=up", hot: true},
+		{target: "/api/v1/query?query=" + url.QueryEscape("rate(up[6h])"), hot: false},
+		{target: "/api/v1/query_range?query=up&step=60&start=" + unix(time.Hour) + "&end=" + unix(0), hot: true},
+		{target: "/api/v1/query_range?query=up&step=60&start=" + unix(24*time.Hour) + "&end=" + unix(0), hot: false},
+		{target: "/api/v1/series?match[]=up", hot: false},
+	}
+	for _, tc := range cases {
+		before := len(hot.Requests())
+		rr := env.do(http.MethodGet, tc.target, "userTenant", "")
+		assert.Equal(t, http.StatusOK, rr.Code, tc.target)
+		assert.Equal(t, tc.hot, len(hot.Requests()) > before, tc.target)
+	}
+	req, _ := hot.LastRequest()
+	assert.Contains(t, req.Params.Get("query"), "allowed_user")
+}
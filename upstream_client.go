@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// UpstreamClientConfig tunes the connections to an upstream. Zero values keep the defaults of Go's http.Transport.
+type UpstreamClientConfig struct {
+	// DialTimeout limits establishing a connection, defaults to 30s.
+	DialTimeout time.Duration `mapstructure:"dial_timeout"`
+	// ResponseHeaderTimeout limits waiting for the response headers after the request was sent, unlimited by default.
+	ResponseHeaderTimeout time.Duration `mapstructure:"response_header_timeout"`
+	// IdleConnTimeout closes idle connections, defaults to 90s.
+	IdleConnTimeout     time.Duration `mapstructure:"idle_conn_timeout"`
+	MaxIdleConnsPerHost int           `mapstructure:"max_idle_conns_per_host"`
+	// HedgeDelay is the time after which a duplicate of a read request is sent if it was not answered yet,
+	// e.g. the p95 latency of the upstream, see hedgedRoundTrip. Zero disables hedging.
+	HedgeDelay time.Duration `mapstructure:"hedge_delay"`
+}
+
+var (
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_upstream_requests_total",
+		Help: "Requests sent to the upstream by status code and method.",
+	}, []string{"upstream", "code", "method"})
+	upstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "multena_upstream_request_duration_seconds",
+		Help:    "Duration of the requests to the upstream until the response headers were received.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"upstream"})
+)
+
+// upstreamClient is the dedicated transport of an upstream with its own TLS settings, egress proxy and discovery.
+type upstreamClient struct {
+	name         string
+	transport    *http.Transport
+	instrumented http.RoundTripper
+	hedgeDelay   time.Duration
+}
+
+func newUpstreamClient(name string, tlsConfig *tls.Config, cfg UpstreamClientConfig) *upstreamClient {
+	dialTimeout := cfg.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = 30 * time.Second
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSClientConfig = tlsConfig
+	transport.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	if cfg.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	labels := prometheus.Labels{"upstream": name}
+	return &upstreamClient{
+		name:       name,
+		transport:  transport,
+		hedgeDelay: cfg.HedgeDelay,
+		instrumented: promhttp.InstrumentRoundTripperCounter(upstreamRequests.MustCurryWith(labels),
+			promhttp.InstrumentRoundTripperDuration(upstreamRequestDuration.MustCurryWith(labels), transport)),
+	}
+}
+
+func (c *upstreamClient) RoundTrip(r *http.Request) (*http.Response, error) {
+	if c.hedgeDelay > 0 && isHedgeable(r) {
+		return hedgedRoundTrip(c.instrumented, r, c.name, c.hedgeDelay)
+	}
+	return c.instrumented.RoundTrip(r)
+}
+
+// upstreamClients finds the client of an upstream by the host of a request's URL. Hosts that are not
+// the host of an upstream, and every host if the clients were not set up, use Go's default transport.
+type upstreamClients struct {
+	byName map[string]*upstreamClient
+	byHost map[string]*upstreamClient
+}
+
+// add registers the client for the hosts of the URLs, e.g. the upstream's URL, hot URL and fan-out URLs.
+func (c *upstreamClients) add(client *upstreamClient, urls ...string) {
+	c.byName[client.name] = client
+	for _, raw := range urls {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			log.Fatal().Err(err).Str("url", raw).Msg("Error parsing URL")
+		}
+		c.byHost[u.Host] = client
+	}
+}
+
+func (c *upstreamClients) lookup(u *url.URL) *upstreamClient {
+	if c == nil {
+		return nil
+	}
+	return c.byHost[u.Host]
+}
+
+// roundTripper returns the transport requests to the URL are sent with.
+func (c *upstreamClients) roundTripper(u *url.URL) http.RoundTripper {
+	if client := c.lookup(u); client != nil {
+		return client
+	}
+	return http.DefaultTransport
+}
+
+// transport returns the uninstrumented transport of the URL, for connections that are not HTTP requests.
+func (c *upstreamClients) transport(u *url.URL) *http.Transport {
+	if client := c.lookup(u); client != nil {
+		return client.transport
+	}
+	return http.DefaultTransport.(*http.Transport)
+}
+
+// httpClient returns a client sending requests with the transport of the URL.
+func (c *upstreamClients) httpClient(u *url.URL) *http.Client {
+	return &http.Client{Transport: c.roundTripper(u)}
+}
+
+// WithUpstreamClients builds a dedicated transport for every upstream. The trusted CAs are shared, the client
+// certificate of an upstream is only presented to that upstream.
+func (a *App) WithUpstreamClients() *App {
+	a.upstreams = &upstreamClients{byName: map[string]*upstreamClient{}, byHost: map[string]*upstreamClient{}}
+	for _, upstream := range []struct {
+		name      string
+		cert, key string
+		client    UpstreamClientConfig
+		urls      []string
+	}{
+		{"thanos", a.Cfg().Thanos.Cert, a.Cfg().Thanos.Key, a.Cfg().Thanos.Client, append([]string{a.Cfg().Thanos.URL, a.Cfg().Thanos.TimeRouting.HotURL}, a.Cfg().Thanos.FanOut.URLs...)},
+		{"loki", a.Cfg().Loki.Cert, a.Cfg().Loki.Key, a.Cfg().Loki.Client, append([]string{a.Cfg().Loki.URL, a.Cfg().Loki.TimeRouting.HotURL}, a.Cfg().Loki.FanOut.URLs...)},
+	} {
+		tlsConfig := &tls.Config{}
+		if a.TlS != nil {
+			tlsConfig = a.TlS.Clone()
+		}
+		if upstream.cert != "" || upstream.key != "" {
+			cert, err := tls.LoadX509KeyPair(upstream.cert, upstream.key)
+			if err != nil {
+				log.Error().Err(err).Str("upstream", upstream.name).Msg("Error while loading the client certificate")
+			} else {
+				log.Debug().Str("upstream", upstream.name).Str("path", upstream.cert).Msg("Adding client certificate")
+				tlsConfig.Certificates = []tls.Certificate{cert}
+			}
+		}
+		a.upstreams.add(newUpstreamClient(upstream.name, tlsConfig, upstream.client), upstream.urls...)
+	}
+	return a
+}
+
+// httpClient returns the client for requests that are not sent to an upstream, like fetching the JWKS or
+// calling the identity provider and webhooks. It trusts the configured CAs but presents no client certificate.
+func (a *App) httpClient() *http.Client {
+	if a.client == nil {
+		return http.DefaultClient
+	}
+	return a.client
+}
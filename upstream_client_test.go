@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithUpstreamClients(t *testing.T) {
+	app := newApp(&Config{
+		Thanos: ThanosConfig{
+			URL:         "https://thanos.example.com:9091",
+			TimeRouting: TimeRoutingConfig{HotURL: "https://thanos-hot.example.com"},
+			FanOut:      FanOutConfig{URLs: []string{"https://thanos-eu.example.com"}},
+			Client:      UpstreamClientConfig{ResponseHeaderTimeout: time.Minute, MaxIdleConnsPerHost: 50},
+		},
+		Loki: LokiConfig{URL: "https://loki.example.com"},
+	})
+	app.WithUpstreamClients()
+
+	thanos := app.upstreams.byName["thanos"]
+	loki := app.upstreams.byName["loki"]
+	assert.NotSame(t, thanos.transport, loki.transport)
+	for _, raw := range []string{"https://thanos.example.com:9091", "https://thanos-hot.example.com/api", "https://thanos-eu.example.com"} {
+		u, _ := url.Parse(raw)
+		assert.Same(t, thanos, app.upstreams.roundTripper(u), raw)
+	}
+	u, _ := url.Parse("https://sso.example.com")
+	assert.Equal(t, http.DefaultTransport, app.upstreams.roundTripper(u))
+	assert.Equal(t, time.Minute, thanos.transport.ResponseHeaderTimeout)
+	assert.Equal(t, 50, thanos.transport.MaxIdleConnsPerHost)
+	assert.Zero(t, loki.transport.ResponseHeaderTimeout)
+	assert.NotSame(t, http.DefaultTransport.(*http.Transport).TLSClientConfig, thanos.transport.TLSClientConfig)
+
+	// without the clients every URL uses the default transport
+	var unset *upstreamClients
+	assert.Equal(t, http.DefaultTransport, unset.roundTripper(u))
+}
+
+func TestE2E_UpstreamClientMetrics(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.WithUpstreamClients()
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	metrics := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, metrics.Body.String(), `multena_upstream_requests_total{code="200",method="get",upstream="thanos"}`)
+	assert.Contains(t, metrics.Body.String(), `multena_upstream_request_duration_seconds_count{upstream="thanos"}`)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// runValidate implements the validate subcommand. It loads config.yaml and labels.yaml from the
+// given directory, reports every problem found and optionally resolves the labels of a sample user.
+// It returns the process exit code: 0 if the configuration is valid, 1 if it is not and 2 on usage errors.
+func runValidate(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	configDir := fs.String("config", "", "directory containing config.yaml and labels.yaml, defaults to the standard search paths")
+	user := fs.String("user", "", "optional username to resolve tenant labels for")
+	groups := fs.String("groups", "", "comma separated groups of the sample user")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	cPaths, lPaths := configPaths, labelsPaths
+	if *configDir != "" {
+		cPaths, lPaths = []string{*configDir}, []string{*configDir}
+	}
+
+	v := newViper("config", cPaths)
+	if err := v.MergeInConfig(); err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR config: %v\n", err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(stdout, "Validating %s\n", v.ConfigFileUsed())
+	if err := v.UnmarshalExact(&Config{}); err != nil {
+		_, _ = fmt.Fprintf(stdout, "WARN  config: %s\n", strings.Join(strings.Fields(err.Error()), " "))
+	}
+	cfg := &Config{}
+	if err := v.Unmarshal(cfg); err != nil {
+		_, _ = fmt.Fprintf(stdout, "ERROR config: %v\n", err)
+		return 1
+	}
+	problems := checkConfig(cfg)
+
+	var labels map[string]map[string]bool
+	if cfg.Web.LabelStoreKind == "configmap" {
+		var labelProblems []error
+		labels, labelProblems = checkLabelsFile(lPaths)
+		problems = append(problems, labelProblems...)
+	}
+
+	for _, p := range problems {
+		_, _ = fmt.Fprintf(stdout, "ERROR %v\n", p)
+	}
+	if len(problems) > 0 {
+		_, _ = fmt.Fprintf(stdout, "%d problems found\n", len(problems))
+		return 1
+	}
+
+	if *user != "" {
+		if labels == nil {
+			_, _ = fmt.Fprintf(stdout, "Resolving sample users is only supported for the configmap label store\n")
+		} else {
+			token := OAuthToken{PreferredUsername: *user}
+			if *groups != "" {
+				token.Groups = strings.Split(*groups, ",")
+			}
+			resolved, skip := (&ConfigMapHandler{labels: labels}).GetLabels(token)
+			keys := MapKeysToArray(resolved)
+			sort.Strings(keys)
+			switch {
+			case skip:
+				_, _ = fmt.Fprintf(stdout, "User %s: cluster-wide access, enforcement is skipped\n", *user)
+			case len(keys) == 0:
+				_, _ = fmt.Fprintf(stdout, "User %s: no tenant labels, all requests are denied\n", *user)
+			default:
+				_, _ = fmt.Fprintf(stdout, "User %s: %s\n", *user, strings.Join(keys, ", "))
+			}
+		}
+	}
+	_, _ = fmt.Fprintln(stdout, "Configuration is valid")
+	return 0
+}
+
+// checkConfig returns every problem found in the configuration, each prefixed with the offending key.
+func checkConfig(cfg *Config) []error {
+	var problems []error
+	add := func(key string, format string, args ...any) {
+		problems = append(problems, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if cfg.Log.Level < -1 || cfg.Log.Level > 5 {
+		add("log.level", "must be between -1 and 5, got %d", cfg.Log.Level)
+	}
+	if len(cfg.Web.Listeners) == 0 {
+		for key, port := range map[string]int{"web.proxy_port": cfg.Web.ProxyPort, "web.metrics_port": cfg.Web.MetricsPort} {
+			if port < 1 || port > 65535 {
+				add(key, "must be between 1 and 65535, got %d", port)
+			}
+		}
+		if cfg.Web.ProxyPort == cfg.Web.MetricsPort {
+			add("web.metrics_port", "must differ from web.proxy_port")
+		}
+	}
+	proxyListener := len(cfg.Web.Listeners) == 0
+	for i, l := range cfg.Web.Listeners {
+		if err := l.validate(); err != nil {
+			add(fmt.Sprintf("web.listeners[%d]", i), "%v", err)
+		} else if _, err := l.tlsConfig(); err != nil {
+			add(fmt.Sprintf("web.listeners[%d].client_ca", i), "%v", err)
+		}
+		proxyListener = proxyListener || l.Router == routerProxy
+	}
+	if !proxyListener {
+		add("web.listeners", "at least one listener must serve the proxy router")
+	}
+	switch cfg.Web.LabelStoreKind {
+	case "configmap":
+	case "mysql":
+		problems = append(problems, checkDbConfig(cfg.Db)...)
+	case "git":
+		if cfg.Git.URL == "" {
+			add("git.url", "must be set for the git label store")
+		}
+		if cfg.Git.Interval < 0 {
+			add("git.interval", "must not be negative")
+		}
+		if filepath.IsAbs(cfg.Git.Path) || strings.HasPrefix(filepath.Clean(cfg.Git.Path), "..") {
+			add("git.path", "must be a directory inside the repository, got %q", cfg.Git.Path)
+		}
+	case "namespaces":
+		if cfg.Namespaces.RetryInterval < 0 {
+			add("namespaces.retry_interval", "must not be negative")
+		}
+		for _, key := range cfg.Namespaces.OwnerKeys {
+			if strings.TrimSpace(key) == "" {
+				add("namespaces.owner_keys", "must not contain empty keys")
+			}
+		}
+	case "":
+		add("web.label_store_kind", "must be set")
+	default:
+		if cfg.Plugins.Dir == "" {
+			add("web.label_store_kind", "unknown kind %q and no plugin directory configured", cfg.Web.LabelStoreKind)
+		}
+	}
+	if !cfg.Dev.Enabled && (cfg.Web.JwksCertURL != "" || !cfg.ForwardAuth.Enabled) {
+		if err := checkURL(cfg.Web.JwksCertURL); err != nil {
+			add("web.jwks_cert_url", "%v", err)
+		}
+	}
+	if cfg.Web.OAuthGroupName == "" {
+		add("web.oauth_group_name", "must be set")
+	}
+	if cfg.Admin.Bypass && cfg.Admin.Group == "" {
+		add("admin.group", "must be set when admin.bypass is enabled")
+	}
+	if cfg.Alert.Enabled {
+		if cfg.Alert.TokenHeader == "" {
+			add("alert.token_header", "must be set when alerting is enabled")
+		}
+		if cfg.Alert.CertURL != "" {
+			if err := checkURL(cfg.Alert.CertURL); err != nil {
+				add("alert.alert_cert_url", "%v", err)
+			}
+		}
+		if cfg.Alert.Cert != "" && !json.Valid([]byte(cfg.Alert.Cert)) {
+			add("alert.alert_cert", "is not valid JSON")
+		}
+	}
+
+	if cfg.Thanos.URL == "" && cfg.Loki.URL == "" {
+		add("thanos.url", "at least one of thanos.url and loki.url must be set")
+	}
+	checkDatasource := func(name string, dsURL string, tenantLabel string, mTLS bool, cert string, key string) {
+		if dsURL == "" {
+			return
+		}
+		if err := checkURL(dsURL); err != nil {
+			add(name+".url", "%v", err)
+		}
+		if tenantLabel == "" {
+			add(name+".tenant_label", "must be set")
+		}
+		if mTLS {
+			if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+				add(name+".cert", "could not load mutual TLS certificate: %v", err)
+			}
+		}
+	}
+	for i, p := range cfg.ResponseHeaders {
+		if err := p.validate(); err != nil {
+			add(fmt.Sprintf("response_headers[%d]", i), "%v", err)
+		}
+	}
+	for tenant, s := range cfg.Suspensions {
+		if err := s.validate(); err != nil {
+			add("suspensions."+tenant, "%v", err)
+		}
+	}
+	for i, w := range cfg.AccessWindows {
+		if err := w.validate(); err != nil {
+			add(fmt.Sprintf("access_windows[%d]", i), "%v", err)
+		}
+	}
+	if cfg.Preflight.Interval < 0 || cfg.Preflight.Timeout < 0 {
+		add("preflight", "interval and timeout must not be negative")
+	}
+	if cfg.LoadShedding.Enabled {
+		if cfg.LoadShedding.ShedFraction < 0 || cfg.LoadShedding.ShedFraction > 1 {
+			add("load_shedding.shed_fraction", "must be between 0 and 1, got %v", cfg.LoadShedding.ShedFraction)
+		}
+		if cfg.LoadShedding.ErrorThreshold < 0 || cfg.LoadShedding.ErrorThreshold > 1 {
+			add("load_shedding.error_threshold", "must be between 0 and 1, got %v", cfg.LoadShedding.ErrorThreshold)
+		}
+		if _, err := newLoadShedder("", cfg.LoadShedding); err != nil {
+			add("load_shedding.low_priority_headers", "%v", err)
+		}
+	}
+	for name, proxy := range map[string]EgressProxyConfig{"thanos.proxy": cfg.Thanos.Proxy, "loki.proxy": cfg.Loki.Proxy} {
+		if _, err := proxy.proxyFunc(); err != nil {
+			add(name, "%v", err)
+		}
+	}
+	for name, rewrite := range map[string]PathRewriteConfig{"thanos.path_rewrite": cfg.Thanos.PathRewrite, "loki.path_rewrite": cfg.Loki.PathRewrite} {
+		if _, err := newPathRewriter(rewrite); err != nil {
+			add(name, "%v", err)
+		}
+	}
+	if err := cfg.LabelTransform.validate(); err != nil {
+		add("label_transform.map", "%v", err)
+	}
+	if _, err := exemptRoutes("thanos", cfg.Thanos.ExemptRoutes); err != nil {
+		add("thanos.exempt_routes", "%v", err)
+	}
+	if _, err := exemptRoutes("loki", cfg.Loki.ExemptRoutes); err != nil {
+		add("loki.exempt_routes", "%v", err)
+	}
+	if _, err := routeMethods(thanosRoutes, cfg.Thanos.RouteMethods); err != nil {
+		add("thanos.route_methods", "%v", err)
+	}
+	if _, err := routeMethods(lokiRoutes, cfg.Loki.RouteMethods); err != nil {
+		add("loki.route_methods", "%v", err)
+	}
+	if err := checkStructuredMetadataKeys(cfg.Loki.StructuredMetadataKeys); err != nil {
+		add("loki.structured_metadata_keys", "%v", err)
+	}
+	for name, client := range map[string]UpstreamClientConfig{"thanos.client": cfg.Thanos.Client, "loki.client": cfg.Loki.Client} {
+		if client.HedgeDelay < 0 {
+			add(name+".hedge_delay", "must not be negative")
+		}
+	}
+	for name, discovery := range map[string]DiscoveryConfig{"thanos.discovery": cfg.Thanos.Discovery, "loki.discovery": cfg.Loki.Discovery} {
+		if discovery.Mode != "" && discovery.Mode != discoveryDNS && discovery.Mode != discoverySRV {
+			add(name+".mode", "must be dns or srv, got %q", discovery.Mode)
+		}
+		if discovery.Interval < 0 {
+			add(name+".interval", "must not be negative")
+		}
+	}
+	if cfg.Loki.Tail.MaxPerUser < 0 || cfg.Loki.Tail.MaxTotal < 0 || cfg.Loki.Tail.IdleTimeout < 0 ||
+		cfg.Loki.Tail.MaxReconnects < 0 || cfg.Loki.Tail.ReconnectBackoff < 0 || cfg.Loki.Tail.Heartbeat < 0 {
+		add("loki.tail", "limits, timeouts and reconnects must not be negative")
+	}
+	if index := cfg.Thanos.LabelIndex; index.Interval < 0 || index.Lookback < 0 || index.IdleTimeout < 0 || index.MaxTenants < 0 || index.Timeout < 0 {
+		add("thanos.label_index", "intervals, timeouts and max_tenants must not be negative")
+	}
+	if cfg.Compression.MinSize < 0 {
+		add("compression.min_size", "must not be negative")
+	}
+	checkQuota := func(key string, q QuotaConfig) {
+		if q.MaxSeries < 0 || q.MaxSamples < 0 || q.MaxEntries < 0 || q.DefaultEntries < 0 || q.MaxPoints < 0 || q.MinStep < 0 || q.MaxSourceResolution < 0 || q.DefaultRange < 0 {
+			add(key, "limits must not be negative")
+		}
+		if q.MaxEntries > 0 && q.DefaultEntries > q.MaxEntries {
+			add(key+".default_entries", "must not be larger than max_entries")
+		}
+		// the upstreams take no per-request sample limit, only the truncation enforces it
+		if q.MaxSamples > 0 && !cfg.Quotas.Truncate {
+			add(key+".max_samples", "has no effect without quotas.truncate")
+		}
+	}
+	checkQuota("quotas.default", cfg.Quotas.Default)
+	for tenant, q := range cfg.Quotas.Tenants {
+		checkQuota("quotas.tenants."+tenant, q)
+	}
+	if cfg.SecurityEvents.Enabled {
+		if err := cfg.SecurityEvents.validate(); err != nil {
+			add("security_events", "%v", err)
+		}
+	}
+	if cfg.Violations.Enabled {
+		if cfg.Violations.Window < 0 || cfg.Violations.Threshold < 0 {
+			add("violations", "window and threshold must not be negative")
+		}
+		if cfg.Violations.WebhookURL != "" {
+			if err := checkURL(cfg.Violations.WebhookURL); err != nil {
+				add("violations.webhook_url", "%v", err)
+			}
+		}
+	}
+	if cfg.Lockout.Enabled {
+		if cfg.Lockout.Window < 0 || cfg.Lockout.MaxFailures < 0 || cfg.Lockout.Cooldown < 0 {
+			add("lockout", "window, max_failures and cooldown must not be negative")
+		}
+		for _, cidr := range cfg.Lockout.AllowNetworks {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				add("lockout.allow_networks", "%v", err)
+			}
+		}
+	}
+	if cfg.Web.Lifecycle.EnableQuit && cfg.Web.Lifecycle.QuitTokenPath == "" {
+		add("web.lifecycle.quit_token_path", "must be set when /-/quit is enabled")
+	}
+	if cfg.ForwardAuth.Enabled {
+		if cfg.ForwardAuth.SecretPath == "" && len(cfg.ForwardAuth.TrustedNetworks) == 0 {
+			add("forward_auth", "secret_path or trusted_networks must be set, otherwise anyone can send identity headers")
+		}
+		for _, cidr := range cfg.ForwardAuth.TrustedNetworks {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				add("forward_auth.trusted_networks", "%v", err)
+			}
+		}
+	}
+	if cfg.OIDC.Enabled {
+		if err := checkURL(cfg.OIDC.IssuerURL); err != nil {
+			add("oidc.issuer_url", "%v", err)
+		}
+		if err := checkURL(cfg.OIDC.RedirectURL); err != nil {
+			add("oidc.redirect_url", "%v", err)
+		}
+		if cfg.OIDC.ClientID == "" {
+			add("oidc.client_id", "must be set when the OIDC login is enabled")
+		}
+		if cfg.OIDC.CookieKeyPath == "" {
+			add("oidc.cookie_key_path", "must be set when the OIDC login is enabled")
+		}
+		if cfg.OIDC.SessionTTL < 0 {
+			add("oidc.session_ttl", "must not be negative")
+		}
+	}
+	switch cfg.Thanos.CrossTenantPolicy {
+	case "", crossTenantAllow, crossTenantWarn, crossTenantDeny:
+	default:
+		add("thanos.cross_tenant_policy", "must be one of allow, warn or deny, got %q", cfg.Thanos.CrossTenantPolicy)
+	}
+	checkDatasource("thanos", cfg.Thanos.URL, cfg.Thanos.TenantLabel, cfg.Thanos.UseMutualTLS, cfg.Thanos.Cert, cfg.Thanos.Key)
+	checkDatasource("loki", cfg.Loki.URL, cfg.Loki.TenantLabel, cfg.Loki.UseMutualTLS, cfg.Loki.Cert, cfg.Loki.Key)
+	for name, fan := range map[string]FanOutConfig{"thanos": cfg.Thanos.FanOut, "loki": cfg.Loki.FanOut} {
+		for _, raw := range fan.URLs {
+			if err := checkURL(raw); err != nil {
+				add(name+".fan_out.urls", "%v", err)
+			}
+		}
+		if fan.Timeout < 0 {
+			add(name+".fan_out.timeout", "must not be negative")
+		}
+	}
+	for name, routing := range map[string]TimeRoutingConfig{"thanos": cfg.Thanos.TimeRouting, "loki": cfg.Loki.TimeRouting} {
+		if routing.HotURL == "" {
+			continue
+		}
+		if err := checkURL(routing.HotURL); err != nil {
+			add(name+".time_routing.hot_url", "%v", err)
+		}
+		if routing.MaxAge <= 0 {
+			add(name+".time_routing.max_age", "must be positive when a hot upstream is set")
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+	return problems
+}
+
+func checkDbConfig(db DbConfig) []error {
+	var problems []error
+	if db.Host == "" {
+		problems = append(problems, fmt.Errorf("db.host: must be set for the mysql label store"))
+	}
+	if db.Port < 1 || db.Port > 65535 {
+		problems = append(problems, fmt.Errorf("db.port: must be between 1 and 65535, got %d", db.Port))
+	}
+	if db.User == "" {
+		problems = append(problems, fmt.Errorf("db.user: must be set for the mysql label store"))
+	}
+	if !strings.Contains(db.Query, "?") {
+		problems = append(problems, fmt.Errorf("db.query: must contain at least one ? placeholder"))
+	}
+	switch db.TokenKey {
+	case "email", "username", "groups":
+	default:
+		problems = append(problems, fmt.Errorf("db.token_key: must be one of email, username or groups, got %q", db.TokenKey))
+	}
+	if (db.InsertQuery == "") != (db.DeleteQuery == "") {
+		problems = append(problems, fmt.Errorf("db.insert_query: must be set together with db.delete_query"))
+	}
+	for key, query := range map[string]string{"db.insert_query": db.InsertQuery, "db.delete_query": db.DeleteQuery} {
+		if query != "" && strings.Count(query, "?") != 2 {
+			problems = append(problems, fmt.Errorf("%s: must contain two ? placeholders, for the identity and the label", key))
+		}
+	}
+	if db.AuditQuery != "" && strings.Count(db.AuditQuery, "?") != 4 {
+		problems = append(problems, fmt.Errorf("db.audit_query: must contain four ? placeholders, for the actor, action, identity and label"))
+	}
+	if db.CacheTTL < 0 {
+		problems = append(problems, fmt.Errorf("db.cache_ttl: must not be negative"))
+	}
+	return problems
+}
+
+func checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q must be an http or https URL", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
+
+// checkLabelsFile reads labels.yaml and returns the parsed labels and every problem found in it.
+func checkLabelsFile(paths []string) (map[string]map[string]bool, []error) {
+	v := newViper("labels", paths)
+	if err := v.MergeInConfig(); err != nil {
+		return nil, []error{fmt.Errorf("labels: %w", err)}
+	}
+	var raw map[string]any
+	if err := v.Unmarshal(&raw); err != nil {
+		return nil, []error{fmt.Errorf("labels: %w", err)}
+	}
+
+	var problems []error
+	labels := make(map[string]map[string]bool, len(raw))
+	for identity, entry := range raw {
+		values, ok := entry.(map[string]any)
+		if !ok {
+			problems = append(problems, fmt.Errorf("labels.%s: must be a mapping of label to true", identity))
+			continue
+		}
+		if len(values) == 0 {
+			problems = append(problems, fmt.Errorf("labels.%s: has no labels", identity))
+		}
+		labels[identity] = map[string]bool{}
+		for label, value := range values {
+			b, ok := value.(bool)
+			if !ok || !b {
+				problems = append(problems, fmt.Errorf("labels.%s.%s: value must be true, got %v", identity, label, value))
+				continue
+			}
+			if _, err := parseGrant(label, "tenant"); err != nil {
+				problems = append(problems, fmt.Errorf("labels.%s.%s: %v", identity, label, err))
+				continue
+			}
+			labels[identity][label] = true
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+	return labels, problems
+}
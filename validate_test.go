@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigDir(t *testing.T, config string, labels string) string {
+	t.Helper()
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(config), 0o600))
+	if labels != "" {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "labels.yaml"), []byte(labels), 0o600))
+	}
+	return dir
+}
+
+func TestRunValidate_ShippedConfig(t *testing.T) {
+	var out bytes.Buffer
+	code := runValidate([]string{"--config", "./configs", "--user", "user3"}, &out)
+
+	assert.Equal(t, 0, code, out.String())
+	assert.Contains(t, out.String(), "User user3: grafana, opernshift-logging, opernshift-monitoring")
+	assert.Contains(t, out.String(), "Configuration is valid")
+}
+
+func TestRunValidate_Problems(t *testing.T) {
+	dir := writeConfigDir(t, `
+web:
+  proxy_port: 8080
+  metrics_port: 8080
+  label_store_kind: configmap
+  jwks_cert_url: "sso.example.com/certs"
+  oauth_group_name: groups
+thanos:
+  url: https://thanos:9091
+loki:
+  url: ftp://loki
+  tenant_label: namespace
+`, `
+team-a:
+  ns-a: true
+  ns-b: false
+  'cluster!="x"': true
+team-b: [ns-c]
+`)
+	var out bytes.Buffer
+	code := runValidate([]string{"--config", dir}, &out)
+
+	assert.Equal(t, 1, code)
+	for _, expected := range []string{
+		"web.metrics_port: must differ from web.proxy_port",
+		`web.jwks_cert_url: "sso.example.com/certs" must be an http or https URL`,
+		"thanos.tenant_label: must be set",
+		`loki.url: "ftp://loki" must be an http or https URL`,
+		"labels.team-a.ns-b: value must be true, got false",
+		"labels.team-b: must be a mapping of label to true",
+		`labels.team-a.cluster!="x": invalid grant cluster!="x": only = and =~ matchers are allowed`,
+		"7 problems found",
+	} {
+		assert.Contains(t, out.String(), expected)
+	}
+}
+
+func TestRunValidate_MissingConfig(t *testing.T) {
+	var out bytes.Buffer
+	code := runValidate([]string{"--config", t.TempDir()}, &out)
+
+	assert.Equal(t, 1, code)
+	assert.Contains(t, out.String(), "Not Found")
+}
+
+func TestCheckDbConfig(t *testing.T) {
+	problems := checkDbConfig(DbConfig{Host: "db", Port: 3306, User: "u", Query: "SELECT ns FROM t", TokenKey: "name"})
+	assert.Len(t, problems, 2)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersion(t *testing.T) {
+	Version, Commit, BuildDate = "v1.2.3", "abc123", "2024-01-01T00:00:00Z"
+	t.Cleanup(func() { Version, Commit, BuildDate = "", "", "" })
+	app := newApp(&Config{})
+	app.WithHealthz()
+
+	rr := httptest.NewRecorder()
+	app.i.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var info BuildInfo
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	assert.Equal(t, BuildInfo{Version: "v1.2.3", Commit: "abc123", BuildDate: "2024-01-01T00:00:00Z", GoVersion: runtime.Version()}, info)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// ViolationsConfig enables tracking of enforcement rejections per user, e.g. queries for tenants the user
+// does not own. A user exceeding the threshold within the window is reported by log, metric and webhook.
+type ViolationsConfig struct {
+	Enabled   bool          `mapstructure:"enabled"`
+	Window    time.Duration `mapstructure:"window"`
+	Threshold int           `mapstructure:"threshold"`
+	// WebhookURL receives a JSON POST for every user exceeding the threshold, at most once per window.
+	WebhookURL     string            `mapstructure:"webhook_url"`
+	WebhookHeaders map[string]string `mapstructure:"webhook_headers"`
+}
+
+var (
+	enforcementViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_enforcement_violations_total",
+		Help: "Number of requests rejected by the enforcement, by query language.",
+	}, []string{"language"})
+	violationAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_violation_alerts_total",
+		Help: "Number of times a user exceeded the violation threshold, by webhook delivery result.",
+	}, []string{"webhook"})
+)
+
+// violationAlert is the body posted to the webhook.
+type violationAlert struct {
+	User       string    `json:"user"`
+	Violations int       `json:"violations"`
+	Window     string    `json:"window"`
+	LastError  string    `json:"last_error"`
+	Path       string    `json:"path"`
+	Time       time.Time `json:"time"`
+}
+
+// violationTracker counts the violations of each user in a sliding window.
+type violationTracker struct {
+	cfg    ViolationsConfig
+	client *http.Client
+	now    func() time.Time
+	notify func(violationAlert)
+
+	mu      sync.Mutex
+	users   map[string][]time.Time
+	alerted map[string]time.Time
+}
+
+func newViolationTracker(cfg ViolationsConfig, client *http.Client) *violationTracker {
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Minute
+	}
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 10
+	}
+	t := &violationTracker{cfg: cfg, client: client, now: time.Now, users: map[string][]time.Time{}, alerted: map[string]time.Time{}}
+	t.notify = t.postWebhook
+	return t
+}
+
+// record counts a violation of the user. When the user's violations in the window reach the threshold
+// the alert is sent, after that the user is not reported again until the window has passed.
+func (t *violationTracker) record(r *http.Request, user string, language string, cause error) {
+	enforcementViolations.WithLabelValues(language).Inc()
+	now := t.now()
+
+	t.mu.Lock()
+	var recent []time.Time
+	for _, at := range t.users[user] {
+		if now.Sub(at) < t.cfg.Window {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, now)
+	t.users[user] = recent
+	last, alerted := t.alerted[user]
+	report := len(recent) >= t.cfg.Threshold && (!alerted || now.Sub(last) >= t.cfg.Window)
+	if report {
+		t.alerted[user] = now
+	}
+	t.prune(now)
+	t.mu.Unlock()
+
+	if !report {
+		return
+	}
+	log.Warn().Str("audit", "violations").Str("user", user).Int("violations", len(recent)).
+		Dur("window", t.cfg.Window).Str("path", r.URL.Path).Err(cause).Msg("User exceeded the enforcement violation threshold")
+	alert := violationAlert{
+		User:       user,
+		Violations: len(recent),
+		Window:     t.cfg.Window.String(),
+		LastError:  cause.Error(),
+		Path:       r.URL.Path,
+		Time:       now.UTC(),
+	}
+	if t.cfg.WebhookURL == "" {
+		violationAlerts.WithLabelValues("disabled").Inc()
+		return
+	}
+	go t.notify(alert)
+}
+
+// prune drops users without violations in the window, so the tracker does not grow with every user ever seen.
+// It must be called with the lock held.
+func (t *violationTracker) prune(now time.Time) {
+	for user, times := range t.users {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= t.cfg.Window {
+			delete(t.users, user)
+		}
+	}
+	for user, at := range t.alerted {
+		if now.Sub(at) >= t.cfg.Window {
+			delete(t.alerted, user)
+		}
+	}
+}
+
+// postWebhook sends the alert to the configured webhook.
+func (t *violationTracker) postWebhook(alert violationAlert) {
+	err := t.sendWebhook(alert)
+	if err != nil {
+		violationAlerts.WithLabelValues("failed").Inc()
+		log.Error().Err(err).Str("user", alert.User).Str("url", redactedURL(t.cfg.WebhookURL)).Msg("Could not send violation alert")
+		return
+	}
+	violationAlerts.WithLabelValues("sent").Inc()
+}
+
+func (t *violationTracker) sendWebhook(alert violationAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.cfg.WebhookHeaders {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViolationTracker(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tracker := newViolationTracker(ViolationsConfig{Window: time.Minute, Threshold: 3, WebhookURL: "http://alerts.example.com"}, http.DefaultClient)
+	tracker.now = func() time.Time { return now }
+	alerts := make(chan violationAlert, 10)
+	tracker.notify = func(alert violationAlert) { alerts <- alert }
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	cause := errors.New("unauthorized label other-team")
+
+	tracker.record(r, "jane", "promql", cause)
+	tracker.record(r, "jane", "promql", cause)
+	tracker.record(r, "john", "promql", cause)
+	tracker.record(r, "jane", "promql", cause)
+	select {
+	case alert := <-alerts:
+		assert.Equal(t, violationAlert{User: "jane", Violations: 3, Window: "1m0s", LastError: cause.Error(), Path: "/api/v1/query", Time: now}, alert)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no violation alert sent")
+	}
+
+	// reported once per window
+	tracker.record(r, "jane", "promql", cause)
+
+	// violations outside the window are forgotten
+	now = now.Add(2 * time.Minute)
+	tracker.record(r, "john", "promql", cause)
+	tracker.record(r, "john", "promql", cause)
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, alerts)
+	assert.NotContains(t, tracker.users, "jane")
+}
+
+func TestE2E_ViolationsAreReported(t *testing.T) {
+	received := make(chan violationAlert, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		var alert violationAlert
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		received <- alert
+	}))
+	defer webhook.Close()
+
+	env := newE2EEnv(t)
+	env.App.Cfg().Violations = ViolationsConfig{Enabled: true, Window: time.Minute, Threshold: 2, WebhookURL: webhook.URL, WebhookHeaders: map[string]string{"Authorization": "Bearer secret"}}
+	env.App.WithRoutes()
+
+	query := "/api/v1/query?query=" + url.QueryEscape(`up{tenant_id="forbidden_tenant"}`)
+	for range 2 {
+		rr := env.do(http.MethodGet, query, "userTenant", "")
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	}
+
+	select {
+	case alert := <-received:
+		assert.Equal(t, 2, alert.Violations)
+		assert.Equal(t, "/api/v1/query", alert.Path)
+		assert.NotEmpty(t, alert.User)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no violation alert received")
+	}
+}
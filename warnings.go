@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxWarningLabels is the number of tenant labels listed in a rewrite warning, further labels are counted.
+const maxWarningLabels = 10
+
+// requestParam returns the named query or form parameter of the request.
+func requestParam(r *http.Request, name string) string {
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err == nil {
+			return r.PostForm.Get(name)
+		}
+	}
+	return r.URL.Query().Get(name)
+}
+
+// rewriteWarning describes the tenant labels a rewritten query was restricted to.
+func rewriteWarning(tenantLabels map[string]bool, labelMatch string) string {
+	labels := MapKeysToArray(tenantLabels)
+	sort.Strings(labels)
+	listed := labels
+	if len(listed) > maxWarningLabels {
+		listed = listed[:maxWarningLabels]
+	}
+	warning := fmt.Sprintf("query restricted by multena to %s %s", labelMatch, strings.Join(listed, ", "))
+	if more := len(labels) - len(listed); more > 0 {
+		warning += fmt.Sprintf(" and %d more", more)
+	}
+	return warning
+}
+
+// addWarningResponse returns a response modifier that appends the warning to the warnings of successful JSON responses.
+func addWarningResponse(warning string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+			return nil
+		}
+		body, err := readResponseBody(resp)
+		if err != nil {
+			return err
+		}
+		var envelope map[string]json.RawMessage
+		if err := json.Unmarshal(body, &envelope); err != nil || envelope["status"] == nil {
+			log.Debug().Err(err).Msg("No warning added, response is not a Prometheus or Loki API response")
+			setResponseBody(resp, body)
+			return nil
+		}
+		appendWarning(envelope, warning)
+		if warned, err := json.Marshal(envelope); err == nil {
+			body = warned
+		}
+		setResponseBody(resp, body)
+		return nil
+	}
+}
+
+// appendWarning appends the warning to the warnings of the API response envelope.
+func appendWarning(envelope map[string]json.RawMessage, warning string) {
+	var warnings []string
+	_ = json.Unmarshal(envelope["warnings"], &warnings)
+	warnings = append(warnings, warning)
+	envelope["warnings"], _ = json.Marshal(warnings)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteWarning(t *testing.T) {
+	assert.Equal(t, "query restricted by multena to namespace a, b", rewriteWarning(map[string]bool{"b": true, "a": true}, "namespace"))
+
+	labels := map[string]bool{}
+	for i := 0; i < 12; i++ {
+		labels[fmt.Sprintf("ns%02d", i)] = true
+	}
+	assert.Equal(t, "query restricted by multena to namespace ns00, ns01, ns02, ns03, ns04, ns05, ns06, ns07, ns08, ns09 and 2 more",
+		rewriteWarning(labels, "namespace"))
+}
+
+func TestE2E_RewriteWarnings(t *testing.T) {
+	env := newE2EEnv(t)
+	env.App.Cfg().Thanos.RewriteWarnings = true
+	env.App.WithRoutes()
+	env.Thanos.SetResponse("/api/v1/query", http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[]},"warnings":["upstream warning"]}`)
+
+	rr := env.do(http.MethodGet, "/api/v1/query?query=up", "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"success","data":{"resultType":"vector","result":[]},"warnings":["upstream warning","query restricted by multena to tenant_id allowed_user, also_allowed_user"]}`, rr.Body.String())
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(`up{tenant_id="allowed_user"}`), "userTenant", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "restricted by multena", "queries that are not rewritten get no warning")
+
+	rr = env.do(http.MethodGet, "/api/v1/query?query=up", "adminUserToken", "")
+	assert.NotContains(t, rr.Body.String(), "restricted by multena")
+}